@@ -0,0 +1,135 @@
+package webtransport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An AccessLogEntry describes a session that was accepted by the Server.
+// It is written to the Server's AccessLog once the session ends.
+type AccessLogEntry struct {
+	// Session is the session's identifier (see Conn.String).
+	Session    string
+	RemoteAddr string
+	Path       string
+	// Origin is the value of the Origin header of the CONNECT request.
+	Origin string
+	// Start is the time when the session was established.
+	Start    time.Time
+	Duration time.Duration
+	Stats    SessionStats
+	// CloseReason describes why the session ended, e.g. "closed" if the application closed it,
+	// or "connection closed" if the QUIC connection was closed.
+	CloseReason string
+}
+
+// An AccessLogFormat formats an access log entry.
+// The returned line must include the trailing newline.
+type AccessLogFormat func(*AccessLogEntry) []byte
+
+// AccessLogCommon formats entries similar to the Common Log Format used by HTTP servers,
+// with the WebTransport-specific fields appended:
+//
+//	remote - - [time] "CONNECT path webtransport" 200 bytes_sent bytes_received "origin" duration streams "close reason"
+func AccessLogCommon(e *AccessLogEntry) []byte {
+	return []byte(fmt.Sprintf("%s - - [%s] \"CONNECT %s webtransport\" 200 %d %d %q %s %d %q\n",
+		e.RemoteAddr,
+		e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Path,
+		e.Stats.BytesSent,
+		e.Stats.BytesReceived,
+		e.Origin,
+		e.Duration,
+		e.Stats.StreamsOpened+e.Stats.StreamsAccepted,
+		e.CloseReason,
+	))
+}
+
+type jsonAccessLogEntry struct {
+	Time              string  `json:"time"`
+	Session           string  `json:"session"`
+	RemoteAddr        string  `json:"remote_addr"`
+	Path              string  `json:"path"`
+	Origin            string  `json:"origin,omitempty"`
+	Duration          float64 `json:"duration"` // in seconds
+	BytesSent         uint64  `json:"bytes_sent"`
+	BytesReceived     uint64  `json:"bytes_received"`
+	StreamsOpened     uint64  `json:"streams_opened"`
+	StreamsAccepted   uint64  `json:"streams_accepted"`
+	DatagramsSent     uint64  `json:"datagrams_sent"`
+	DatagramsReceived uint64  `json:"datagrams_received"`
+	CloseReason       string  `json:"close_reason"`
+}
+
+// AccessLogJSON formats entries as JSON objects, one per line.
+func AccessLogJSON(e *AccessLogEntry) []byte {
+	b, _ := json.Marshal(&jsonAccessLogEntry{
+		Time:              e.Start.Format(time.RFC3339Nano),
+		Session:           e.Session,
+		RemoteAddr:        e.RemoteAddr,
+		Path:              e.Path,
+		Origin:            e.Origin,
+		Duration:          e.Duration.Seconds(),
+		BytesSent:         e.Stats.BytesSent,
+		BytesReceived:     e.Stats.BytesReceived,
+		StreamsOpened:     e.Stats.StreamsOpened,
+		StreamsAccepted:   e.Stats.StreamsAccepted,
+		DatagramsSent:     e.Stats.DatagramsSent,
+		DatagramsReceived: e.Stats.DatagramsReceived,
+		CloseReason:       e.CloseReason,
+	})
+	return append(b, '\n')
+}
+
+// accessLogger writes access log entries.
+// Entries are written with a single Write call, so that entries of concurrent sessions don't interleave.
+type accessLogger struct {
+	format AccessLogFormat
+
+	mx sync.Mutex
+	w  io.Writer
+}
+
+func newAccessLogger(w io.Writer, format AccessLogFormat) *accessLogger {
+	if format == nil {
+		format = AccessLogCommon
+	}
+	return &accessLogger{w: w, format: format}
+}
+
+func (l *accessLogger) Log(e *AccessLogEntry) {
+	line := l.format(e)
+	l.mx.Lock()
+	l.w.Write(line)
+	l.mx.Unlock()
+}
+
+// newAccessLogEntry creates the access log entry for a session that was just established.
+func newAccessLogEntry(c *Conn, r *http.Request) *AccessLogEntry {
+	return &AccessLogEntry{
+		Session:    c.String(),
+		RemoteAddr: c.RemoteAddr().String(),
+		Path:       r.URL.Path,
+		Origin:     r.Header.Get("Origin"),
+		Start:      time.Now(),
+	}
+}
+
+// finish completes the access log entry when the session ends.
+// serverClosed says if the session ended because the server was closed.
+func (e *AccessLogEntry) finish(c *Conn, serverClosed bool) {
+	e.Duration = time.Since(e.Start)
+	e.Stats = c.Stats()
+	switch {
+	case c.ctx.Err() != nil:
+		e.CloseReason = c.closeReason
+	case serverClosed:
+		e.CloseReason = "server closed"
+	default:
+		e.CloseReason = "connection closed"
+	}
+}
@@ -0,0 +1,114 @@
+package webtransport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+// chanWriter sends every call to Write on a channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	accessLog := make(chanWriter, 1)
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:              http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		AccessLog:       accessLog,
+		AccessLogFormat: webtransport.AccessLogJSON,
+	}
+	defer s.Close()
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := c.ReceiveMessage(ctx); err != nil {
+			return
+		}
+		str, err := c.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		io.Copy(str, str)
+		str.Close()
+		c.Close()
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.SendMessage([]byte("foo")))
+	sendDataAndCheckEcho(t, conn)
+
+	var line []byte
+	select {
+	case line = <-accessLog:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the access log entry")
+	}
+	require.Equal(t, byte('\n'), line[len(line)-1])
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(line, &entry))
+	require.Equal(t, "/webtransport", entry["path"])
+	remoteAddr := entry["remote_addr"].(string)
+	_, port, err := net.SplitHostPort(remoteAddr)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port), port)
+	require.Contains(t, entry["session"], remoteAddr)
+	require.EqualValues(t, 5*1024, entry["bytes_sent"])
+	require.EqualValues(t, 5*1024+3, entry["bytes_received"])
+	require.EqualValues(t, 0, entry["streams_opened"])
+	require.EqualValues(t, 1, entry["streams_accepted"])
+	require.EqualValues(t, 1, entry["datagrams_received"])
+	require.Equal(t, "closed", entry["close_reason"])
+
+	stats := conn.Stats()
+	require.Equal(t, uint64(5*1024+3), stats.BytesSent)
+	require.Equal(t, uint64(5*1024), stats.BytesReceived)
+	require.Equal(t, uint64(1), stats.StreamsOpened)
+	require.Equal(t, uint64(1), stats.DatagramsSent)
+}
+
+func TestAccessLogCommonFormat(t *testing.T) {
+	start := time.Date(2022, 5, 3, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	line := webtransport.AccessLogCommon(&webtransport.AccessLogEntry{
+		RemoteAddr: "192.0.2.1:1234",
+		Path:       "/webtransport",
+		Origin:     "https://example.com",
+		Start:      start,
+		Duration:   1500 * time.Millisecond,
+		Stats: webtransport.SessionStats{
+			BytesSent:       1000,
+			BytesReceived:   42,
+			StreamsOpened:   2,
+			StreamsAccepted: 3,
+		},
+		CloseReason: "connection closed",
+	})
+	require.Equal(t,
+		`192.0.2.1:1234 - - [03/May/2022:13:55:36 -0700] "CONNECT /webtransport webtransport" 200 1000 42 "https://example.com" 1.5s 5 "connection closed"`+"\n",
+		string(line),
+	)
+}
@@ -0,0 +1,41 @@
+package webtransport
+
+import (
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// These are the same values that quic-go uses for its default token validation.
+const (
+	tokenValidity      = 24 * time.Hour
+	retryTokenValidity = 10 * time.Second
+)
+
+// newAcceptToken creates a quic.Config.AcceptToken callback.
+// For client addresses that don't require address validation, every token (including no token) is accepted.
+// For all other addresses, the token is validated the same way as quic-go does by default:
+// it must have been issued for the client's IP address, and must not have expired.
+func newAcceptToken(requireAddressValidation func(net.Addr) bool) func(net.Addr, *quic.Token) bool {
+	return func(addr net.Addr, token *quic.Token) bool {
+		if !requireAddressValidation(addr) {
+			return true
+		}
+		if token == nil {
+			return false
+		}
+		validity := tokenValidity
+		if token.IsRetryToken {
+			validity = retryTokenValidity
+		}
+		if time.Now().After(token.SentTime.Add(validity)) {
+			return false
+		}
+		sourceAddr := addr.String()
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			sourceAddr = udpAddr.IP.String()
+		}
+		return sourceAddr == token.RemoteAddr
+	}
+}
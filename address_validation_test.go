@@ -0,0 +1,36 @@
+package webtransport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptToken(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+	otherAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1337}
+
+	t.Run("no address validation", func(t *testing.T) {
+		accept := newAcceptToken(func(net.Addr) bool { return false })
+		require.True(t, accept(addr, nil))
+	})
+
+	t.Run("address validation", func(t *testing.T) {
+		var validated net.Addr
+		accept := newAcceptToken(func(a net.Addr) bool {
+			validated = a
+			return true
+		})
+		require.False(t, accept(addr, nil))
+		require.Equal(t, addr, validated)
+		require.True(t, accept(addr, &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}))
+		require.False(t, accept(otherAddr, &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}))
+		// retry tokens expire quickly
+		require.False(t, accept(addr, &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now().Add(-time.Minute)}))
+		require.True(t, accept(addr, &quic.Token{RemoteAddr: "192.168.0.1", SentTime: time.Now().Add(-time.Minute)}))
+		require.False(t, accept(addr, &quic.Token{RemoteAddr: "192.168.0.1", SentTime: time.Now().Add(-25 * time.Hour)}))
+	})
+}
@@ -0,0 +1,77 @@
+package webtransport
+
+import (
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultRoutingTokenHeader is the default name of the response header carrying the routing token.
+const DefaultRoutingTokenHeader = "Webtransport-Routing-Token"
+
+// A ConnectionID is a QUIC connection ID.
+type ConnectionID []byte
+
+func (id ConnectionID) String() string {
+	return hex.EncodeToString(id)
+}
+
+// QUICConnectionIDs are the active connection IDs of a QUIC connection, ordered by sequence number.
+type QUICConnectionIDs struct {
+	// Local are the connection IDs issued by this endpoint.
+	// The peer uses them as the destination connection ID of the packets it sends,
+	// so these are the IDs a QUIC-aware load balancer in front of a server routes on.
+	Local []ConnectionID
+	// Remote are the connection IDs issued by the peer.
+	Remote []ConnectionID
+}
+
+// QUICConnectionIDs returns the connection IDs of the underlying QUIC connection.
+// They are shared by all sessions established on the same QUIC connection,
+// and change over the lifetime of the connection, as endpoints issue new connection IDs and retire old ones.
+// quic-go doesn't expose the connection IDs, so they are obtained by tracing the QUIC connection.
+// Unlike the identifier used in log messages and profiler labels (see String), these are the connection IDs
+// used on the wire, i.e. the ones a QUIC-aware load balancer sees.
+// It returns false if the connection IDs are not available.
+func (c *Conn) QUICConnectionIDs() (QUICConnectionIDs, bool) {
+	if c.metrics == nil {
+		return QUICConnectionIDs{}, false
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return QUICConnectionIDs{}, false
+	}
+	return m.ConnectionIDs(), true
+}
+
+// SetRoutingToken sets the session's routing token.
+// Routing tokens are chosen by the application, and identify the backend a session is established with,
+// so that clients can be routed to the same backend when reconnecting.
+// On the server side, the token is sent to the client if it's set by the Server's RoutingToken callback.
+func (c *Conn) SetRoutingToken(token string) {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	c.routingToken = token
+}
+
+// RoutingToken returns the routing token set using SetRoutingToken.
+func (c *Conn) RoutingToken() string {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	return c.routingToken
+}
+
+// setRoutingToken sets the session's routing token, and adds it to the response headers.
+func (s *Server) setRoutingToken(w http.ResponseWriter, c *Conn, r *http.Request) {
+	token := s.RoutingToken(c, r)
+	if token == "" {
+		return
+	}
+	c.SetRoutingToken(token)
+	hdr := s.RoutingTokenHeader
+	if hdr == "" {
+		hdr = DefaultRoutingTokenHeader
+	}
+	w.Header().Set(hdr, token)
+}
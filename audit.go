@@ -0,0 +1,322 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An AuditEvent is the type of event recorded by an AuditLog.
+type AuditEvent string
+
+const (
+	// AuditEventSessionRejected is recorded when a CONNECT request is rejected by Upgrade,
+	// e.g. by CheckOrigin or OnSessionRequest.
+	AuditEventSessionRejected AuditEvent = "session_rejected"
+	// AuditEventSessionOpened is recorded when a session is accepted by Upgrade.
+	AuditEventSessionOpened AuditEvent = "session_opened"
+	// AuditEventSessionClosed is recorded when a session ends.
+	AuditEventSessionClosed AuditEvent = "session_closed"
+	// AuditEventSessionAdminClosed is recorded instead of AuditEventSessionClosed when a session
+	// is closed by the server, i.e. using Server.CloseSession, or when the server is closed.
+	AuditEventSessionAdminClosed AuditEvent = "session_admin_closed"
+)
+
+// An AuditRecord is a record in the audit log.
+// Records form a hash chain: every record contains the hash of the previous record,
+// so that removing, reordering or modifying records can be detected using VerifyAuditRecords.
+type AuditRecord struct {
+	// Seq is the sequence number of the record, starting at 1.
+	Seq        uint64     `json:"seq"`
+	Time       time.Time  `json:"time"`
+	Event      AuditEvent `json:"event"`
+	Session    string     `json:"session,omitempty"`
+	RemoteAddr string     `json:"remote_addr"`
+	Path       string     `json:"path,omitempty"`
+	Origin     string     `json:"origin,omitempty"`
+	// Status is the status code sent when a session was rejected, if known.
+	Status int `json:"status,omitempty"`
+	// Reason describes why a session was rejected or closed.
+	Reason string `json:"reason,omitempty"`
+	// Duration, BytesSent and BytesReceived are only set when a session is closed.
+	Duration      float64 `json:"duration,omitempty"` // in seconds
+	BytesSent     uint64  `json:"bytes_sent,omitempty"`
+	BytesReceived uint64  `json:"bytes_received,omitempty"`
+
+	// PrevHash is the Hash of the previous record. It is empty for the first record.
+	PrevHash string `json:"prev_hash"`
+	// Hash is the SHA-256 hash (or HMAC-SHA256, if the AuditLog has a Key) of the record's
+	// JSON encoding, with the Hash field omitted.
+	Hash string `json:"hash,omitempty"`
+}
+
+// An AuditSink receives the records of an AuditLog.
+// WriteAuditRecord is called for one record at a time, in the order of the records.
+// It must not block, and must not modify or retain the record.
+type AuditSink interface {
+	WriteAuditRecord(*AuditRecord) error
+}
+
+// An AuditLog records the lifecycle events of the sessions of a Server, for deployments with
+// compliance requirements. The records are written to all Sinks.
+// Since the hash chain is kept in memory, a new chain is started when the process is restarted.
+type AuditLog struct {
+	Sinks []AuditSink
+	// Key, if set, is used to compute the records' hashes using HMAC-SHA256,
+	// which prevents an attacker without the key from recomputing the hash chain.
+	Key []byte
+	// OnError is called when a sink fails to write a record.
+	// If unset, the error is ignored.
+	OnError func(AuditSink, *AuditRecord, error)
+
+	mx       sync.Mutex
+	seq      uint64
+	prevHash string
+}
+
+func (l *AuditLog) record(r *AuditRecord) {
+	if l == nil {
+		return
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.seq++
+	r.Seq = l.seq
+	r.Time = time.Now().UTC()
+	r.PrevHash = l.prevHash
+	h, err := hashAuditRecord(r, l.Key)
+	if err != nil { // should never happen
+		return
+	}
+	r.Hash = h
+	l.prevHash = h
+	for _, s := range l.Sinks {
+		if err := s.WriteAuditRecord(r); err != nil && l.OnError != nil {
+			l.OnError(s, r, err)
+		}
+	}
+}
+
+func (l *AuditLog) sessionRejected(r *http.Request, err error) {
+	if l == nil {
+		return
+	}
+	rec := &AuditRecord{
+		Event:      AuditEventSessionRejected,
+		RemoteAddr: r.RemoteAddr,
+		Path:       r.URL.Path,
+		Origin:     r.Header.Get("Origin"),
+		Reason:     err.Error(),
+	}
+	var rejectedErr *SessionRejectedError
+	if errors.As(err, &rejectedErr) {
+		rec.Status = rejectedErr.StatusCode
+	}
+	l.record(rec)
+}
+
+func (l *AuditLog) sessionOpened(c *Conn, r *http.Request) {
+	l.record(&AuditRecord{
+		Event:      AuditEventSessionOpened,
+		Session:    c.String(),
+		RemoteAddr: c.RemoteAddr().String(),
+		Path:       r.URL.Path,
+		Origin:     r.Header.Get("Origin"),
+	})
+}
+
+func (l *AuditLog) sessionClosed(c *Conn, start time.Time, event AuditEvent, reason string) {
+	stats := c.Stats()
+	l.record(&AuditRecord{
+		Event:         event,
+		Session:       c.String(),
+		RemoteAddr:    c.RemoteAddr().String(),
+		Reason:        reason,
+		Duration:      time.Since(start).Seconds(),
+		BytesSent:     stats.BytesSent,
+		BytesReceived: stats.BytesReceived,
+	})
+}
+
+func hashAuditRecord(r *AuditRecord, key []byte) (string, error) {
+	rec := *r
+	rec.Hash = ""
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyAuditRecords verifies the hash chain of a sequence of audit records,
+// as written by an AuditLog. The sequence may start at any record of the chain.
+// key must be the AuditLog's Key.
+func VerifyAuditRecords(records []*AuditRecord, key []byte) error {
+	for i, r := range records {
+		h, err := hashAuditRecord(r, key)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(h), []byte(r.Hash)) {
+			return fmt.Errorf("webtransport: audit record %d: invalid hash", r.Seq)
+		}
+		if i == 0 {
+			if r.Seq == 1 && r.PrevHash != "" {
+				return fmt.Errorf("webtransport: audit record %d: first record has a previous hash", r.Seq)
+			}
+			continue
+		}
+		prev := records[i-1]
+		if r.Seq != prev.Seq+1 {
+			return fmt.Errorf("webtransport: audit record %d: expected sequence number %d", r.Seq, prev.Seq+1)
+		}
+		if r.PrevHash != prev.Hash {
+			return fmt.Errorf("webtransport: audit record %d: hash chain broken", r.Seq)
+		}
+	}
+	return nil
+}
+
+// ReadAuditRecords reads audit records written by an AuditWriterSink.
+func ReadAuditRecords(r io.Reader) ([]*AuditRecord, error) {
+	var records []*AuditRecord
+	dec := json.NewDecoder(r)
+	for {
+		rec := &AuditRecord{}
+		if err := dec.Decode(rec); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// AuditWriterSink writes audit records to an io.Writer (e.g. a file), as JSON objects, one per line.
+type AuditWriterSink struct {
+	w io.Writer
+}
+
+var _ AuditSink = &AuditWriterSink{}
+
+func NewAuditWriterSink(w io.Writer) *AuditWriterSink {
+	return &AuditWriterSink{w: w}
+}
+
+func (s *AuditWriterSink) WriteAuditRecord(r *AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// AuditWebhookSink posts audit records to a URL, as JSON objects.
+// Records are queued and posted asynchronously, one at a time, in order.
+// If the queue is full, WriteAuditRecord returns an error, and the record is not posted.
+type AuditWebhookSink struct {
+	// URL is the URL the records are posted to.
+	URL string
+	// Client is the HTTP client used to post the records.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+	// QueueSize is the maximum number of records waiting to be posted.
+	// Defaults to 1024.
+	QueueSize int
+	// OnError is called when posting a record fails, or if the response status is not 2xx.
+	// If unset, the error is ignored.
+	OnError func(*AuditRecord, error)
+
+	initOnce sync.Once
+	queue    chan *AuditRecord
+	done     chan struct{}
+
+	closeOnce sync.Once
+}
+
+var _ AuditSink = &AuditWebhookSink{}
+
+func (s *AuditWebhookSink) init() {
+	size := s.QueueSize
+	if size == 0 {
+		size = 1024
+	}
+	s.queue = make(chan *AuditRecord, size)
+	s.done = make(chan struct{})
+	go s.run()
+}
+
+func (s *AuditWebhookSink) WriteAuditRecord(r *AuditRecord) error {
+	s.initOnce.Do(s.init)
+	rec := *r
+	select {
+	case s.queue <- &rec:
+		return nil
+	default:
+		return errors.New("webtransport: audit webhook queue full")
+	}
+}
+
+func (s *AuditWebhookSink) run() {
+	defer close(s.done)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for r := range s.queue {
+		if err := s.post(client, r); err != nil && s.OnError != nil {
+			s.OnError(r, err)
+		}
+	}
+}
+
+func (s *AuditWebhookSink) post(client *http.Client, r *AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webtransport: audit webhook returned status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// Close waits until all queued records have been posted.
+// No records must be written after Close was called.
+func (s *AuditWebhookSink) Close() error {
+	s.initOnce.Do(s.init)
+	s.closeOnce.Do(func() { close(s.queue) })
+	<-s.done
+	return nil
+}
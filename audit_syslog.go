@@ -0,0 +1,35 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package webtransport
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// AuditSyslogSink writes audit records to syslog, as JSON objects.
+// Rejections and administrative closes are logged with severity NOTICE, all other events with severity INFO.
+type AuditSyslogSink struct {
+	w *syslog.Writer
+}
+
+var _ AuditSink = &AuditSyslogSink{}
+
+// NewAuditSyslogSink creates a sink that writes to the syslog writer, e.g. one created by syslog.New.
+func NewAuditSyslogSink(w *syslog.Writer) *AuditSyslogSink {
+	return &AuditSyslogSink{w: w}
+}
+
+func (s *AuditSyslogSink) WriteAuditRecord(r *AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	switch r.Event {
+	case AuditEventSessionRejected, AuditEventSessionAdminClosed:
+		return s.w.Notice(string(b))
+	default:
+		return s.w.Info(string(b))
+	}
+}
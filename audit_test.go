@@ -0,0 +1,206 @@
+package webtransport_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	lines := make(chanWriter, 10)
+	key := []byte("secret")
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		OnSessionRequest: func(r *http.Request) (int, http.Header, error) {
+			if r.Header.Get("Token") == "" {
+				return http.StatusUnauthorized, nil, nil
+			}
+			return 0, nil, nil
+		},
+		Audit: &webtransport.AuditLog{
+			Sinks: []webtransport.AuditSink{webtransport.NewAuditWriterSink(lines)},
+			Key:   key,
+		},
+	}
+	defer s.Close()
+	serverConns := make(chan *webtransport.Conn, 10)
+	addHandler(t, &s, func(c *webtransport.Conn) { serverConns <- c })
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	var records []*webtransport.AuditRecord
+	expectRecord := func(t *testing.T, event webtransport.AuditEvent) *webtransport.AuditRecord {
+		t.Helper()
+		select {
+		case line := <-lines:
+			var r webtransport.AuditRecord
+			require.NoError(t, json.Unmarshal(line, &r))
+			require.Equal(t, event, r.Event)
+			records = append(records, &r)
+			return &r
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s record", event)
+		}
+		return nil
+	}
+
+	// rejected
+	_, _, err := d.Dial(context.Background(), url, nil)
+	require.Error(t, err)
+	r := expectRecord(t, webtransport.AuditEventSessionRejected)
+	require.Equal(t, http.StatusUnauthorized, r.Status)
+	require.Equal(t, "/webtransport", r.Path)
+
+	// opened and closed by the application
+	hdr := func() http.Header { return http.Header{"Token": []string{"foo"}} }
+	_, conn, err := d.Dial(context.Background(), url, hdr())
+	require.NoError(t, err)
+	defer conn.Close()
+	sconn := <-serverConns
+	r = expectRecord(t, webtransport.AuditEventSessionOpened)
+	require.Equal(t, sconn.String(), r.Session)
+	require.NoError(t, sconn.Close())
+	r = expectRecord(t, webtransport.AuditEventSessionClosed)
+	require.Equal(t, "closed", r.Reason)
+
+	// closed by the operator
+	_, conn, err = d.Dial(context.Background(), url, hdr())
+	require.NoError(t, err)
+	defer conn.Close()
+	sconn = <-serverConns
+	expectRecord(t, webtransport.AuditEventSessionOpened)
+	require.NoError(t, s.CloseSession(sconn, "kicked"))
+	r = expectRecord(t, webtransport.AuditEventSessionAdminClosed)
+	require.Equal(t, "kicked", r.Reason)
+
+	// closed by closing the server
+	_, conn, err = d.Dial(context.Background(), url, hdr())
+	require.NoError(t, err)
+	defer conn.Close()
+	<-serverConns
+	expectRecord(t, webtransport.AuditEventSessionOpened)
+	require.NoError(t, s.Close())
+	r = expectRecord(t, webtransport.AuditEventSessionAdminClosed)
+	require.Equal(t, "server closed", r.Reason)
+
+	require.Len(t, records, 7)
+	require.NoError(t, webtransport.VerifyAuditRecords(records, key))
+	require.Error(t, webtransport.VerifyAuditRecords(records, []byte("wrong key")))
+	// a suffix of the chain can be verified as well
+	require.NoError(t, webtransport.VerifyAuditRecords(records[3:], key))
+
+	t.Run("modified record", func(t *testing.T) {
+		modified := append([]*webtransport.AuditRecord{}, records...)
+		rec := *modified[2]
+		rec.Reason = "foobar"
+		modified[2] = &rec
+		require.EqualError(t, webtransport.VerifyAuditRecords(modified, key), "webtransport: audit record 3: invalid hash")
+	})
+
+	t.Run("removed record", func(t *testing.T) {
+		removed := append(append([]*webtransport.AuditRecord{}, records[:2]...), records[3:]...)
+		require.EqualError(t, webtransport.VerifyAuditRecords(removed, key), "webtransport: audit record 4: expected sequence number 3")
+	})
+}
+
+func TestAuditWriterSink(t *testing.T) {
+	lines := make(chanWriter, 2)
+	l := &webtransport.AuditLog{Sinks: []webtransport.AuditSink{webtransport.NewAuditWriterSink(lines)}}
+	s := webtransport.Server{Audit: l}
+	defer s.Close()
+	_, _, closeFn := dialRawSession(t, &s)
+	closeFn()
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			buf.Write(line)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	records, err := webtransport.ReadAuditRecords(&buf)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, webtransport.AuditEventSessionOpened, records[0].Event)
+	require.Equal(t, webtransport.AuditEventSessionClosed, records[1].Event)
+	require.Contains(t, records[1].Reason, "connection closed")
+	require.NoError(t, webtransport.VerifyAuditRecords(records, nil))
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	var mx sync.Mutex
+	var received []*webtransport.AuditRecord
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var rec webtransport.AuditRecord
+		require.NoError(t, json.Unmarshal(b, &rec))
+
+		mx.Lock()
+		defer mx.Unlock()
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, &rec)
+	}))
+	defer srv.Close()
+
+	errChan := make(chan error, 1)
+	sink := &webtransport.AuditWebhookSink{
+		URL:     srv.URL,
+		OnError: func(_ *webtransport.AuditRecord, err error) { errChan <- err },
+	}
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, sink.WriteAuditRecord(&webtransport.AuditRecord{Seq: uint64(i)}))
+	}
+	require.NoError(t, sink.Close())
+	require.EqualError(t, <-errChan, "webtransport: audit webhook returned status 500")
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, received, 2)
+	require.Equal(t, uint64(2), received[0].Seq)
+	require.Equal(t, uint64(3), received[1].Seq)
+}
+
+func TestAuditWebhookSinkQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-block }))
+	defer srv.Close()
+
+	sink := &webtransport.AuditWebhookSink{URL: srv.URL, QueueSize: 1}
+	require.NoError(t, sink.WriteAuditRecord(&webtransport.AuditRecord{Seq: 1}))
+	// wait for the first record to be dequeued
+	require.Eventually(t, func() bool {
+		return sink.WriteAuditRecord(&webtransport.AuditRecord{Seq: 2}) == nil
+	}, time.Second, 5*time.Millisecond)
+	require.EqualError(t, sink.WriteAuditRecord(&webtransport.AuditRecord{Seq: 3}), "webtransport: audit webhook queue full")
+	close(block)
+	require.NoError(t, sink.Close())
+}
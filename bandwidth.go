@@ -0,0 +1,179 @@
+package webtransport
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// shapingQuantum is the maximum number of bytes sent at once when the bandwidth is shaped.
+// Larger writes are split, such that a session writing a lot of data doesn't hold up the other sessions.
+const shapingQuantum = 16 << 10
+
+// tokenBucket limits the rate at which bytes are sent.
+type tokenBucket struct {
+	mx     sync.Mutex
+	rate   float64 // in bytes per second, 0 means no limit
+	tokens float64
+	last   time.Time
+}
+
+// burst is the number of bytes that can be sent at once after the bucket was idle.
+func (b *tokenBucket) burst() float64 {
+	if burst := b.rate / 20; burst > shapingQuantum {
+		return burst
+	}
+	return shapingQuantum
+}
+
+func (b *tokenBucket) setRate(bytesPerSecond int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if bytesPerSecond <= 0 {
+		b.rate = 0
+		return
+	}
+	b.rate = float64(bytesPerSecond)
+	b.tokens = b.burst()
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) limited() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.rate > 0
+}
+
+// reserve takes n bytes from the bucket, and returns how long to wait before sending them.
+// The bucket can go into debt, such that writes larger than the burst size are possible.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shapingIdleTimeout is the time after which a session that didn't send any data
+// doesn't count towards the sessions sharing the bandwidth of the QUIC connection any more.
+const shapingIdleTimeout = 100 * time.Millisecond
+
+// connShaper limits the bandwidth used by the sessions on a QUIC connection (see Server.BandwidthLimit).
+// Every session that recently sent data gets a share of the bandwidth in proportion to its scheduling weight.
+type connShaper struct {
+	mx   sync.Mutex
+	rate float64 // in bytes per second
+	// the time at which every session is allowed to send next
+	next map[*Conn]time.Time
+}
+
+func newConnShaper(bytesPerSecond int) *connShaper {
+	return &connShaper{
+		rate: float64(bytesPerSecond),
+		next: make(map[*Conn]time.Time),
+	}
+}
+
+// reserve reserves the bandwidth to send n bytes on the session,
+// and returns how long to wait before sending them.
+func (s *connShaper) reserve(c *Conn, n int) time.Duration {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	total := c.schedulingWeight()
+	for other, next := range s.next {
+		if other == c {
+			continue
+		}
+		if now.Sub(next) > shapingIdleTimeout {
+			delete(s.next, other)
+			continue
+		}
+		total += other.schedulingWeight()
+	}
+	start := s.next[c]
+	if start.Before(now) {
+		start = now
+	}
+	share := s.rate * float64(c.schedulingWeight()) / float64(total)
+	s.next[c] = start.Add(time.Duration(float64(n) / share * float64(time.Second)))
+	return start.Sub(now)
+}
+
+// SetBandwidthLimit limits the rate (in bytes per second) at which the session sends data,
+// on streams and in datagrams. A value of 0 removes the limit.
+// Writes on streams and sending of datagrams block until they are within the limit.
+// Combined with the Server's (or the Dialer's) BandwidthLimit and scheduling weights, this allows
+// capping bulk transfers, such that other sessions on the same QUIC connection are guaranteed
+// a share of the bandwidth.
+func (c *Conn) SetBandwidthLimit(bytesPerSecond int) {
+	c.limiter.setRate(bytesPerSecond)
+}
+
+// shape delays sending n bytes according to the session's bandwidth limit,
+// and the bandwidth limit of the QUIC connection.
+func (c *Conn) shape(ctx context.Context, n int) error {
+	if err := sleepContext(ctx, c.limiter.reserve(n)); err != nil {
+		return err
+	}
+	if c.shaper == nil {
+		return nil
+	}
+	return sleepContext(ctx, c.shaper.reserve(c, n))
+}
+
+// shapeStream delays a write of n bytes on a stream, according to the bandwidth limits,
+// and while capsules are being sent on CONNECT streams (see Server.DisableConnectStreamPriority).
+// It returns os.ErrDeadlineExceeded if the stream's write deadline expires first,
+// and a SessionError if the session is closed.
+func (c *Conn) shapeStream(deadline time.Time, n int) error {
+	if c.shaper == nil && !c.limiter.limited() && !c.priority.busy() {
+		return nil
+	}
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	err := c.priority.wait(ctx)
+	if err == nil {
+		err = c.shape(ctx, n)
+	}
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return os.ErrDeadlineExceeded
+		}
+		return c.sessionError()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package webtransport
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	require.Zero(t, b.reserve(1<<20)) // no limit
+
+	b.setRate(100 << 10) // 100 KB/s
+	require.Zero(t, b.reserve(shapingQuantum))
+	d := b.reserve(10 << 10)
+	require.InDelta(t, 100*time.Millisecond, d, float64(10*time.Millisecond))
+	// the bucket is in debt, the next write waits for both reservations
+	require.Greater(t, b.reserve(10<<10), d)
+
+	b.setRate(0)
+	require.Zero(t, b.reserve(1<<20))
+}
+
+func TestSessionBandwidthLimit(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+
+	server.SetBandwidthLimit(200 << 10) // 200 KB/s
+	str, err := server.OpenStream()
+	require.NoError(t, err)
+	start := time.Now()
+	// the first 16 KB are sent immediately, the next 40 KB take 200ms
+	n, err := str.Write(make([]byte, 56<<10))
+	require.NoError(t, err)
+	require.Equal(t, 56<<10, n)
+	require.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+
+	// writes are bounded by the write deadline
+	require.NoError(t, str.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = str.Write(make([]byte, 64<<10))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// datagrams are limited as well
+	server.SetBandwidthLimit(10 << 10) // 10 KB/s
+	require.NoError(t, server.SendMessage(make([]byte, 16<<10)))
+	start = time.Now()
+	require.NoError(t, server.SendMessage(make([]byte, 1000)))
+	require.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+
+	server.SetBandwidthLimit(0)
+	start = time.Now()
+	_, err = str.Write(make([]byte, 1<<20))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded) // the deadline is still set
+	require.NoError(t, str.SetWriteDeadline(time.Time{}))
+	_, err = str.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestConnBandwidthSharing(t *testing.T) {
+	shaper := newConnShaper(1600 << 10) // 100 turns per second
+	a, b := &Conn{shaper: shaper}, &Conn{shaper: shaper}
+	a.SetSchedulingWeight(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	count := func(c *Conn, n *int) {
+		defer wg.Done()
+		for c.shape(ctx, shapingQuantum) == nil {
+			*n++
+		}
+	}
+	var numA, numB int
+	wg.Add(2)
+	go count(a, &numA)
+	go count(b, &numB)
+	wg.Wait()
+	require.NotZero(t, numB)
+	require.GreaterOrEqual(t, numA, 2*numB)
+}
@@ -0,0 +1,119 @@
+package webtransport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// establishBenchmarkSession establishes a session with an echo server, running on the loopback interface.
+// The server echoes streams as well as datagrams.
+func establishBenchmarkSession(b *testing.B) *webtransport.Conn {
+	b.Helper()
+	tlsConf, certPool := getTLSConf(b)
+	s := &webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	b.Cleanup(func() { s.Close() })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		go conn.HandleMessages(context.Background(), func(b []byte) { conn.SendMessage(b) })
+		go conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			io.Copy(str, str)
+			str.Close()
+		})
+	})
+	s.H3.Handler = mux
+
+	laddr, err := net.ResolveUDPAddr("udp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go s.Serve(udpConn)
+
+	d := &webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	b.Cleanup(func() { d.Close() })
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+func BenchmarkStreamEcho(b *testing.B) {
+	for _, size := range []int{100, 10 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%d bytes", size), func(b *testing.B) {
+			conn := establishBenchmarkSession(b)
+			data := make([]byte, size)
+			buf := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				str, err := conn.OpenStreamSync(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Read concurrently, since large messages would otherwise exceed the flow control window.
+				errChan := make(chan error, 1)
+				go func() {
+					_, err := io.ReadFull(str, buf)
+					errChan <- err
+				}()
+				if _, err := str.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := str.Close(); err != nil {
+					b.Fatal(err)
+				}
+				if err := <-errChan; err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDatagramEcho(b *testing.B) {
+	for _, size := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("%d bytes", size), func(b *testing.B) {
+			conn := establishBenchmarkSession(b)
+			data := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			var lost int
+			for i := 0; i < b.N; i++ {
+				if err := conn.SendMessage(data); err != nil {
+					b.Fatal(err)
+				}
+				// Datagrams can be lost (even on the loopback interface), so we can't wait forever.
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				_, err := conn.ReceiveMessage(ctx)
+				cancel()
+				if err != nil {
+					lost++
+				}
+			}
+			b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+		})
+	}
+}
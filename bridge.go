@@ -0,0 +1,195 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// A BridgeMessageType says how a message forwarded by a Bridge is delivered to a session.
+type BridgeMessageType uint8
+
+const (
+	// BridgeDatagram messages are sent as a datagram.
+	BridgeDatagram BridgeMessageType = iota
+	// BridgeStream messages are sent on a new unidirectional stream.
+	BridgeStream
+)
+
+func (t BridgeMessageType) String() string {
+	switch t {
+	case BridgeDatagram:
+		return "datagram"
+	case BridgeStream:
+		return "stream"
+	default:
+		return fmt.Sprintf("unknown message type %d", uint8(t))
+	}
+}
+
+// ErrNoSessions is returned by Bridge.Send if no session is registered for the message.
+var ErrNoSessions = errors.New("webtransport: no sessions registered with the key")
+
+// A BridgeMessage is a message addressed to the sessions registered with a key in a SessionDirectory.
+type BridgeMessage struct {
+	Type BridgeMessageType
+	// Key is the key the sessions are registered with (see SessionEntry.Key).
+	Key string
+	// Session, if set, restricts delivery to a single session (see SessionEntry.Session).
+	Session string
+	Payload []byte
+}
+
+// MarshalBinary encodes the message, for transports that exchange messages as bytes.
+func (m *BridgeMessage) MarshalBinary() ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteByte(byte(m.Type))
+	quicvarint.Write(b, uint64(len(m.Key)))
+	b.WriteString(m.Key)
+	quicvarint.Write(b, uint64(len(m.Session)))
+	b.WriteString(m.Session)
+	b.Write(m.Payload)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary.
+func (m *BridgeMessage) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	t, err := r.ReadByte()
+	if err != nil {
+		return errors.New("webtransport: bridge message too short")
+	}
+	key, err := readBridgeString(r)
+	if err != nil {
+		return err
+	}
+	session, err := readBridgeString(r)
+	if err != nil {
+		return err
+	}
+	m.Type = BridgeMessageType(t)
+	m.Key = key
+	m.Session = session
+	m.Payload = data[len(data)-r.Len():]
+	return nil
+}
+
+func readBridgeString(r *bytes.Reader) (string, error) {
+	l, err := quicvarint.Read(r)
+	if err != nil {
+		return "", errors.New("webtransport: bridge message too short")
+	}
+	if l > uint64(r.Len()) {
+		return "", errors.New("webtransport: bridge message too short")
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// A BridgeTransport carries messages between the nodes of a cluster, e.g. using a message queue or RPC.
+// It is provided by the application.
+type BridgeTransport interface {
+	// Forward sends the message to the node.
+	// The receiving node passes the message to its Bridge's Deliver method.
+	Forward(ctx context.Context, node string, msg *BridgeMessage) error
+}
+
+// BridgeError is returned by Bridge.Send if delivering the message failed on at least one node.
+type BridgeError struct {
+	// Errors contains the error for every node that delivery failed on.
+	// Errors on this node are BroadcastErrors.
+	Errors map[string]error
+}
+
+func (e *BridgeError) Error() string {
+	return fmt.Sprintf("webtransport: bridging message failed on %d nodes", len(e.Errors))
+}
+
+// A Bridge delivers messages to sessions, regardless of the node of a cluster they're established with.
+// It uses the Server's SessionDirectory to locate the sessions: messages for sessions established with
+// this server are sent directly, messages for sessions established with other nodes are forwarded
+// using the Transport, once per node.
+type Bridge struct {
+	Server    *Server
+	Transport BridgeTransport
+}
+
+// Send delivers the message to all sessions registered with msg.Key.
+// It returns ErrNoSessions if no session is registered.
+func (b *Bridge) Send(ctx context.Context, msg *BridgeMessage) error {
+	entries, err := b.Server.LookupSessions(ctx, msg.Key)
+	if err != nil {
+		return err
+	}
+	var local bool
+	var nodes []string
+	seen := make(map[string]struct{})
+	for _, e := range entries {
+		if msg.Session != "" && e.Session != msg.Session {
+			continue
+		}
+		if _, ok := seen[e.Node]; ok {
+			continue
+		}
+		seen[e.Node] = struct{}{}
+		if e.Node == b.Server.nodeID {
+			local = true
+		} else {
+			nodes = append(nodes, e.Node)
+		}
+	}
+	if !local && len(nodes) == 0 {
+		return ErrNoSessions
+	}
+
+	var mx sync.Mutex
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			defer wg.Done()
+			if err := b.Transport.Forward(ctx, node, msg); err != nil {
+				mx.Lock()
+				errs[node] = err
+				mx.Unlock()
+			}
+		}(node)
+	}
+	if local {
+		if err := b.Deliver(ctx, msg); err != nil {
+			mx.Lock()
+			errs[b.Server.nodeID] = err
+			mx.Unlock()
+		}
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BridgeError{Errors: errs}
+	}
+	return nil
+}
+
+// Deliver sends the message to the matching sessions established with this server.
+// Transports call it for messages forwarded by other nodes.
+func (b *Bridge) Deliver(ctx context.Context, msg *BridgeMessage) error {
+	filter := func(sess Session) bool {
+		return sess.Label() == msg.Key && (msg.Session == "" || sess.String() == msg.Session)
+	}
+	switch msg.Type {
+	case BridgeDatagram:
+		return b.Server.Broadcast(msg.Payload, filter)
+	case BridgeStream:
+		return b.Server.BroadcastStream(ctx, msg.Payload, filter)
+	default:
+		return fmt.Errorf("webtransport: invalid bridge message type: %s", msg.Type)
+	}
+}
@@ -0,0 +1,156 @@
+package webtransport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+// localBridgeTransport forwards messages to Bridges in the same process.
+// It encodes the messages, like a transport using the network would.
+type localBridgeTransport map[string]*webtransport.Bridge
+
+func (t localBridgeTransport) Forward(ctx context.Context, node string, msg *webtransport.BridgeMessage) error {
+	b, ok := t[node]
+	if !ok {
+		return errors.New("unknown node")
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var m webtransport.BridgeMessage
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return b.Deliver(ctx, &m)
+}
+
+func TestBridgeMessageEncoding(t *testing.T) {
+	msg := &webtransport.BridgeMessage{
+		Type:    webtransport.BridgeStream,
+		Key:     "alice",
+		Session: "session",
+		Payload: []byte("foobar"),
+	}
+	data, err := msg.MarshalBinary()
+	require.NoError(t, err)
+	var m webtransport.BridgeMessage
+	require.NoError(t, m.UnmarshalBinary(data))
+	require.Equal(t, msg, &m)
+
+	for i := 0; i < len(data)-len(msg.Payload); i++ {
+		require.Error(t, m.UnmarshalBinary(data[:i]))
+	}
+}
+
+func TestBridge(t *testing.T) {
+	var dir webtransport.MemorySessionDirectory
+	tlsConf, certPool := getTLSConf(t)
+	transport := make(localBridgeTransport)
+	newServer := func(node string) (*webtransport.Server, string) {
+		s := &webtransport.Server{
+			H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+			SessionDirectory: &dir,
+			NodeID:           node,
+			OnSessionEstablished: func(c *webtransport.Conn, r *http.Request) {
+				c.SetLabel(r.Header.Get("User"))
+			},
+		}
+		transport[node] = &webtransport.Bridge{Server: s, Transport: transport}
+		addHandler(t, s, func(c *webtransport.Conn) {})
+		udpConn := getConn(t)
+		go s.Serve(udpConn)
+		return s, fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	s1, url1 := newServer("node1")
+	defer s1.Close()
+	s2, url2 := newServer("node2")
+	defer s2.Close()
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	_, conn1, err := d.Dial(context.Background(), url1, http.Header{"User": []string{"alice"}})
+	require.NoError(t, err)
+	defer conn1.Close()
+	_, conn2, err := d.Dial(context.Background(), url2, http.Header{"User": []string{"alice"}})
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, conn3, err := d.Dial(context.Background(), url2, http.Header{"User": []string{"bob"}})
+	require.NoError(t, err)
+	defer conn3.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	t.Run("datagrams", func(t *testing.T) {
+		// sent from node1, to sessions on node1 and node2
+		require.NoError(t, transport["node1"].Send(ctx, &webtransport.BridgeMessage{Key: "alice", Payload: []byte("foo")}))
+		for _, conn := range []*webtransport.Conn{conn1, conn2} {
+			data, err := conn.ReceiveMessage(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []byte("foo"), data)
+		}
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		// sent from node1, to a session on node2
+		require.NoError(t, transport["node1"].Send(ctx, &webtransport.BridgeMessage{
+			Type:    webtransport.BridgeStream,
+			Key:     "bob",
+			Payload: []byte("bar"),
+		}))
+		str, err := conn3.AcceptUniStream(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(str)
+		require.NoError(t, err)
+		require.Equal(t, []byte("bar"), data)
+	})
+
+	t.Run("single session", func(t *testing.T) {
+		entries, err := s1.LookupSessions(ctx, "alice")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, "node2", entries[1].Node)
+		require.NoError(t, transport["node1"].Send(ctx, &webtransport.BridgeMessage{
+			Type:    webtransport.BridgeStream,
+			Key:     "alice",
+			Session: entries[1].Session,
+			Payload: []byte("baz"),
+		}))
+		// only sent to the session on node2
+		str, err := conn2.AcceptUniStream(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(str)
+		require.NoError(t, err)
+		require.Equal(t, []byte("baz"), data)
+		shortCtx, cancel := context.WithTimeout(ctx, scaleDuration(50*time.Millisecond))
+		defer cancel()
+		_, err = conn1.AcceptUniStream(shortCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("no sessions", func(t *testing.T) {
+		require.ErrorIs(t, transport["node1"].Send(ctx, &webtransport.BridgeMessage{Key: "carol"}), webtransport.ErrNoSessions)
+	})
+
+	t.Run("forwarding fails", func(t *testing.T) {
+		b := &webtransport.Bridge{Server: s1, Transport: localBridgeTransport{}}
+		err := b.Send(ctx, &webtransport.BridgeMessage{Key: "bob"})
+		var bridgeErr *webtransport.BridgeError
+		require.ErrorAs(t, err, &bridgeErr)
+		require.Len(t, bridgeErr.Errors, 1)
+		require.EqualError(t, bridgeErr.Errors["node2"], "unknown node")
+	})
+}
@@ -0,0 +1,78 @@
+package webtransport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const defaultBroadcastConcurrency = 16
+
+// BroadcastError is returned by Broadcast and BroadcastStream
+// if sending failed for at least one session.
+type BroadcastError struct {
+	// Errors contains the error for every session that sending failed for.
+	Errors map[*Conn]error
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("webtransport: broadcast failed for %d sessions", len(e.Errors))
+}
+
+// Broadcast sends the payload as a datagram to all active sessions.
+// If filter is non-nil, the payload is only sent to sessions for which filter returns true.
+func (s *Server) Broadcast(payload []byte, filter func(Session) bool) error {
+	return s.broadcast(filter, func(c *Conn) error {
+		return c.SendMessage(payload)
+	})
+}
+
+// BroadcastStream opens a new unidirectional stream to all active sessions, and sends the payload on it.
+// If filter is non-nil, the payload is only sent to sessions for which filter returns true.
+func (s *Server) BroadcastStream(ctx context.Context, payload []byte, filter func(Session) bool) error {
+	return s.broadcast(filter, func(c *Conn) error {
+		str, err := c.OpenUniStreamSync(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := str.Write(payload); err != nil {
+			return err
+		}
+		return str.Close()
+	})
+}
+
+func (s *Server) broadcast(filter func(Session) bool, send func(*Conn) error) error {
+	if filter == nil {
+		filter = func(Session) bool { return true }
+	}
+	concurrency := s.BroadcastConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBroadcastConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var mx sync.Mutex
+	errs := make(map[*Conn]error)
+	var wg sync.WaitGroup
+	for _, c := range s.filterSessions(func(c *Conn) bool { return filter(c) }) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *Conn) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := send(c); err != nil {
+				mx.Lock()
+				errs[c] = err
+				mx.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BroadcastError{Errors: errs}
+	}
+	return nil
+}
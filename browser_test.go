@@ -0,0 +1,185 @@
+//go:build browser
+// +build browser
+
+// The browser tests run a WebTransport client in a headless Chromium, in order to catch
+// interoperability issues that tests between two Go endpoints don't catch.
+// They are run using:
+//
+//	go test -tags browser -run Browser
+//
+// The Chromium binary is taken from the CHROMIUM environment variable.
+// If it is not set, chromium, chromium-browser and google-chrome are looked up in the PATH.
+package webtransport_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+// browserTestPage is the page loaded by Chromium.
+// Once all tests have run, it replaces the document's body with the (JSON-encoded) results.
+const browserTestPage = `<!DOCTYPE html>
+<html><body><script>
+const enc = new TextEncoder();
+const dec = new TextDecoder();
+
+async function readAll(readable) {
+	const reader = readable.getReader();
+	let s = "";
+	for (;;) {
+		const {value, done} = await reader.read();
+		if (done) return s;
+		s += dec.decode(value);
+	}
+}
+
+async function run() {
+	const results = {};
+	try {
+		const wt = new WebTransport("https://localhost:%[1]d/webtransport");
+		await wt.ready;
+
+		const bidi = await wt.createBidirectionalStream();
+		const writer = bidi.writable.getWriter();
+		await writer.write(enc.encode("bidirectional stream"));
+		await writer.close();
+		results.bidi = await readAll(bidi.readable);
+
+		const {value: uni} = await wt.incomingUnidirectionalStreams.getReader().read();
+		results.uni = await readAll(uni);
+
+		await wt.datagrams.writable.getWriter().write(enc.encode("datagram"));
+		const {value: datagram} = await wt.datagrams.readable.getReader().read();
+		results.datagram = dec.decode(datagram);
+		wt.close();
+
+		const wt2 = new WebTransport("https://localhost:%[1]d/close");
+		await wt2.ready;
+		await wt2.closed;
+		results.closed = true;
+	} catch (e) {
+		results.error = String(e);
+	}
+	document.body.textContent = JSON.stringify(results);
+}
+run();
+</script></body></html>`
+
+func findChromium(t *testing.T) string {
+	if path := os.Getenv("CHROMIUM"); path != "" {
+		return path
+	}
+	for _, name := range []string{"chromium", "chromium-browser", "google-chrome"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	t.Skip("Chromium not found")
+	return ""
+}
+
+func TestBrowser(t *testing.T) {
+	chromium := findChromium(t)
+
+	tlsConf, _ := getTLSConf(t)
+	tlsConf.NextProtos = nil
+	leaf, err := x509.ParseCertificate(tlsConf.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	spkiHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	s := webtransport.Server{
+		H3:          http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	defer s.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		go conn.HandleMessages(context.Background(), func(b []byte) { conn.SendMessage(b) })
+		go func() {
+			str, err := conn.OpenUniStreamSync(context.Background())
+			if err != nil {
+				return
+			}
+			str.Write([]byte("unidirectional stream"))
+			str.Close()
+		}()
+		go conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			io.Copy(str, str)
+			str.Close()
+		})
+	})
+	mux.HandleFunc("/close", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn.Close()
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	// serve the test page via HTTP/1.1
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, browserTestPage, port)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, chromium,
+		"--headless",
+		"--no-sandbox",
+		"--disable-gpu",
+		"--virtual-time-budget=20000",
+		fmt.Sprintf("--origin-to-force-quic-on=localhost:%d", port),
+		"--ignore-certificate-errors-spki-list="+base64.StdEncoding.EncodeToString(spkiHash[:]),
+		"--dump-dom",
+		fmt.Sprintf("http://%s/", ln.Addr()),
+	).Output()
+	require.NoError(t, err)
+
+	m := regexp.MustCompile(`<body>(.*)</body>`).FindSubmatch(out)
+	require.NotNil(t, m, "unexpected output: %s", out)
+	var results struct {
+		Bidi     string
+		Uni      string
+		Datagram string
+		Closed   bool
+		Error    string
+	}
+	require.NoError(t, json.Unmarshal([]byte(html.UnescapeString(string(m[1]))), &results))
+	require.Empty(t, results.Error)
+	require.Equal(t, "bidirectional stream", results.Bidi)
+	require.Equal(t, "unidirectional stream", results.Uni)
+	require.Equal(t, "datagram", results.Datagram)
+	require.True(t, results.Closed)
+}
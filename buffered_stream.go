@@ -0,0 +1,60 @@
+package webtransport
+
+import (
+	"github.com/lucas-clemente/quic-go"
+)
+
+// BufferedStreamConfig configures the handling of streams for sessions that are not established
+// within the StreamReorderingTimeout.
+// By default, these streams are reset using WebTransportBufferedStreamRejectedErrorCode.
+type BufferedStreamConfig struct {
+	// ErrorCode is the HTTP/3 error code used to reset the stream.
+	// If zero, WebTransportBufferedStreamRejectedErrorCode is used.
+	ErrorCode quic.StreamErrorCode
+	// Pause keeps the stream open instead of resetting it. The stream's data is not read,
+	// so the peer is blocked by flow control once it has sent the data the receive window allows.
+	// If the session is established later, the stream is delivered to the session.
+	// Otherwise, it stays paused until the QUIC connection is closed.
+	// This is meant for debugging slow control planes, as paused streams count towards the stream limit.
+	Pause bool
+	// OnRejected is called when the reordering timeout fires for a stream, i.e. when the stream is reset
+	// or, if Pause is set, paused. It must not block.
+	OnRejected func(qconn quic.Connection, sessionID uint64, id quic.StreamID)
+}
+
+func (c *BufferedStreamConfig) errorCode() quic.StreamErrorCode {
+	if c == nil || c.ErrorCode == 0 {
+		return WebTransportBufferedStreamRejectedErrorCode
+	}
+	return c.ErrorCode
+}
+
+// exceedsBufferedStreamLimit says if buffering another stream would exceed the limit on the number of streams
+// waiting for their session to be established. The limit applies across all sessions, including paused streams.
+func (m *sessionManager) exceedsBufferedStreamLimit() bool {
+	return m.maxBufferedStreams > 0 && m.numBufferedStreams >= m.maxBufferedStreams
+}
+
+func (m *sessionManager) pauseBufferedStreams() bool {
+	return m.bufferedStreams != nil && m.bufferedStreams.Pause
+}
+
+// rejectBufferedStream handles a stream for a session that was not established within the timeout.
+// It returns true if the stream was paused, i.e. if it is kept until the session is established.
+func (m *sessionManager) rejectBufferedStream(str incomingStream, key sessionKey) (paused bool) {
+	paused = m.pauseBufferedStreams()
+	m.mx.Lock()
+	m.rejectedStreams++
+	m.mx.Unlock()
+	if !paused {
+		code := m.bufferedStreams.errorCode()
+		str.reject(code)
+	}
+	if m.tracer != nil {
+		m.tracer.BufferedStreamTimeout(key.qconn, uint64(key.id), str.StreamID())
+	}
+	if m.bufferedStreams != nil && m.bufferedStreams.OnRejected != nil {
+		m.bufferedStreams.OnRejected(key.qconn, uint64(key.id), str.StreamID())
+	}
+	return paused
+}
@@ -0,0 +1,186 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"unicode/utf8"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// drainSessionCapsuleType is the type of the DRAIN_WEBTRANSPORT_SESSION capsule.
+// It tells the peer that the session will be closed soon, and that it should
+// establish a new session (e.g. with another server) and wrap up its work on this one.
+const drainSessionCapsuleType = 0x78ae
+
+// closeSessionCapsuleType is the type of the CLOSE_WEBTRANSPORT_SESSION capsule.
+// It carries an application error code (32 bits) and an error message.
+const closeSessionCapsuleType = 0x2843
+
+// maxCloseMessageLen is the maximum length of the error message of a CLOSE_WEBTRANSPORT_SESSION capsule.
+const maxCloseMessageLen = 1024
+
+// dataFrameType is the type of the HTTP/3 DATA frame.
+const dataFrameType = 0x0
+
+// Capsules are sent on the CONNECT stream, after the response headers.
+// In HTTP/3, they are carried in DATA frames (RFC 9297, section 3.2).
+// The http3 client unframes the response body, so capsules can be read from it directly.
+
+// sendDrainCapsule sends a DRAIN_WEBTRANSPORT_SESSION capsule, if this is a server-side session.
+// quic-go's http3.Server closes the CONNECT stream once the handler returns, so this only
+// succeeds if the handler that called Upgrade is still running.
+func (c *Conn) sendDrainCapsule() {
+	if err := c.sendCapsule(drainSessionCapsuleType, nil); err != nil {
+		c.logf(LogLevelDebug, "sending drain capsule failed: %s", err)
+	}
+}
+
+// sendCloseCapsule sends a CLOSE_WEBTRANSPORT_SESSION capsule, if this is a server-side session.
+// The same restrictions as for sendDrainCapsule apply.
+// Messages longer than maxCloseMessageLen are truncated, since the peer drops the capsule otherwise.
+func (c *Conn) sendCloseCapsule(code SessionErrorCode, msg string) {
+	msg = truncateCloseMessage(msg)
+	payload := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(payload, uint32(code))
+	payload = append(payload, msg...)
+	if err := c.sendCapsule(closeSessionCapsuleType, payload); err != nil {
+		c.logf(LogLevelDebug, "sending close capsule failed: %s", err)
+	}
+}
+
+// sendCapsule sends a capsule on the CONNECT stream, if this is a server-side session.
+func (c *Conn) sendCapsule(typ uint64, payload []byte) error {
+	c.connectStrMx.Lock()
+	defer c.connectStrMx.Unlock()
+
+	if c.connectStr == nil {
+		return nil
+	}
+	capsule := &bytes.Buffer{}
+	quicvarint.Write(capsule, typ)
+	quicvarint.Write(capsule, uint64(len(payload)))
+	capsule.Write(payload)
+	b := &bytes.Buffer{}
+	quicvarint.Write(b, dataFrameType)
+	quicvarint.Write(b, uint64(capsule.Len()))
+	b.Write(capsule.Bytes())
+
+	c.priority.enter()
+	defer c.priority.leave()
+	_, err := c.connectStr.Write(b.Bytes())
+	return err
+}
+
+func (c *Conn) setConnectStream(str quic.Stream) {
+	c.connectStrMx.Lock()
+	c.connectStr = str
+	c.connectStrMx.Unlock()
+}
+
+// responseBody is the body of the response to the CONNECT request, on the client side.
+// http3's response body must not be closed while it's being read, so closing is left to readCapsules:
+// Close cancels the context of the request, which makes http3 cancel the CONNECT stream,
+// and waits for readCapsules to close the body.
+type responseBody struct {
+	io.ReadCloser
+	cancelRequest context.CancelFunc
+	done          chan struct{} // closed when readCapsules returned
+}
+
+func newResponseBody(body io.ReadCloser, cancelRequest context.CancelFunc) *responseBody {
+	return &responseBody{ReadCloser: body, cancelRequest: cancelRequest, done: make(chan struct{})}
+}
+
+func (b *responseBody) Close() error {
+	b.cancelRequest()
+	<-b.done
+	return nil
+}
+
+// truncateCloseMessage truncates msg to maxCloseMessageLen bytes.
+// It doesn't split a UTF-8 encoded character.
+func truncateCloseMessage(msg string) string {
+	if len(msg) <= maxCloseMessageLen {
+		return msg
+	}
+	n := maxCloseMessageLen
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n]
+}
+
+// readCapsules reads the capsules the server sends on the CONNECT stream.
+// It returns once the CONNECT stream is closed, once the body is closed, or once the server
+// closed the session by sending a CLOSE_WEBTRANSPORT_SESSION capsule. In that case, the session is closed
+// with a SessionError carrying the server's error code and message.
+// Unknown capsule types are skipped.
+func (c *Conn) readCapsules(body *responseBody) {
+	var sessErr *SessionError
+	defer func() {
+		// Closing the session closes the body, which waits for done to be closed.
+		if sessErr != nil {
+			c.closeWithReason(sessErr, "closed by peer")
+		}
+	}()
+	defer close(body.done)
+	defer body.cancelRequest()
+	defer body.ReadCloser.Close()
+
+	r := quicvarint.NewReader(body.ReadCloser)
+	for {
+		typ, err := quicvarint.Read(r)
+		if err != nil {
+			return
+		}
+		l, err := quicvarint.Read(r)
+		if err != nil {
+			return
+		}
+		if typ == closeSessionCapsuleType {
+			if l < 4 || l > 4+maxCloseMessageLen {
+				return
+			}
+			payload := make([]byte, l)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			sessErr = &SessionError{
+				Remote:    true,
+				ErrorCode: SessionErrorCode(binary.BigEndian.Uint32(payload)),
+				Message:   string(payload[4:]),
+			}
+			return
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(l)); err != nil {
+			return
+		}
+		if typ == drainSessionCapsuleType {
+			c.setPeerDraining()
+		}
+	}
+}
+
+// setPeerDraining records that the peer announced that the session will be closed soon.
+func (c *Conn) setPeerDraining() {
+	c.peerDrainOnce.Do(func() {
+		close(c.peerDraining)
+		if c.onPeerDraining != nil {
+			c.onPeerDraining(c)
+		}
+	})
+}
+
+// PeerDraining returns a channel that is closed when the peer announced that the session
+// will be closed soon, by sending a DRAIN_WEBTRANSPORT_SESSION capsule.
+// Servers send it when a session is drained (see Drain), e.g. when the server is shut down.
+// On the client side, it is also closed when the server sends an HTTP/3 GOAWAY frame on the QUIC connection.
+// Clients should establish a new session, and wrap up their work on this session.
+// Only sessions dialed by a Dialer receive the announcement.
+func (c *Conn) PeerDraining() <-chan struct{} {
+	return c.peerDraining
+}
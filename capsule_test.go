@@ -0,0 +1,73 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateCloseMessage(t *testing.T) {
+	require.Equal(t, "foobar", truncateCloseMessage("foobar"))
+	msg := strings.Repeat("a", maxCloseMessageLen)
+	require.Equal(t, msg, truncateCloseMessage(msg))
+	require.Equal(t, msg, truncateCloseMessage(msg+"b"))
+	// the 1024th byte is in the middle of a 2 byte character
+	msg = "a" + strings.Repeat("ä", maxCloseMessageLen)
+	truncated := truncateCloseMessage(msg)
+	require.Len(t, truncated, maxCloseMessageLen-1)
+	require.True(t, utf8.ValidString(truncated))
+	require.True(t, strings.HasPrefix(msg, truncated))
+}
+
+func TestCloseCapsuleLongMessage(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	connectStr, remote := openTestStream(t, client, server)
+	c.setConnectStream(remote)
+
+	msg := "a" + strings.Repeat("ä", maxCloseMessageLen)
+	require.NoError(t, c.CloseWithError(42, msg))
+
+	// the CLOSE_WEBTRANSPORT_SESSION capsule, in a DATA frame
+	r := quicvarint.NewReader(connectStr)
+	typ, err := quicvarint.Read(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(dataFrameType), typ)
+	l, err := quicvarint.Read(r)
+	require.NoError(t, err)
+	frame := make([]byte, l)
+	_, err = io.ReadFull(r, frame)
+	require.NoError(t, err)
+
+	// the capsule is accepted by the peer
+	peer := newConn(0, client, io.NopCloser(strings.NewReader("")))
+	peer.readCapsules(newResponseBody(io.NopCloser(bytes.NewReader(frame)), func() {}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = peer.AcceptStream(ctx)
+	var sessErr *SessionError
+	require.True(t, errors.As(err, &sessErr), "expected a SessionError, got %#v", err)
+	require.True(t, sessErr.Remote)
+	require.Equal(t, SessionErrorCode(42), sessErr.ErrorCode)
+	require.Equal(t, msg[:maxCloseMessageLen-1], sessErr.Message)
+
+	// the payload is the error code followed by the truncated message
+	fr := quicvarint.NewReader(bytes.NewReader(frame))
+	_, err = quicvarint.Read(fr)
+	require.NoError(t, err)
+	pl, err := quicvarint.Read(fr)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4+maxCloseMessageLen-1), pl)
+	require.Equal(t, uint32(42), binary.BigEndian.Uint32(frame[len(frame)-int(pl):]))
+}
@@ -3,15 +3,19 @@ package webtransport
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
-	"github.com/lucas-clemente/quic-go/quicvarint"
 )
 
 type Dialer struct {
@@ -23,53 +27,365 @@ type Dialer struct {
 	// If DialFunc is nil, quic.DialAddrEarlyContext will be used.
 	DialFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
 
-	// StreamReorderingTime is the time an incoming WebTransport stream that cannot be associated
-	// with a session is buffered.
+	// HandshakeTimeout limits the time it takes to establish a session, i.e. the QUIC handshake
+	// (if a new QUIC connection is established), the exchange of the HTTP/3 SETTINGS,
+	// and waiting for the response to the CONNECT request.
+	// If the timeout expires, Dial returns a DialError wrapping context.DeadlineExceeded.
+	// If zero, establishing a session is only limited by the context passed to Dial.
+	HandshakeTimeout time.Duration
+
+	// StreamReorderingTime is the time an incoming WebTransport stream (bidirectional or unidirectional)
+	// that cannot be associated with a session is buffered.
 	// This can happen if the response to a CONNECT request (that creates a new session) is reordered,
 	// and arrives after the first WebTransport stream(s) for that session.
+	// Buffered streams are accepted in order once the session is established, the same way as on the server side.
 	// Defaults to 5 seconds.
 	StreamReorderingTimeout time.Duration
+	// BufferedStreams configures what happens to streams once the StreamReorderingTimeout fires.
+	// If unset, they are reset using WebTransportBufferedStreamRejectedErrorCode.
+	BufferedStreams *BufferedStreamConfig
+	// MaxBufferedStreams limits the number of streams waiting for their session to be established,
+	// across all sessions. See Server.MaxBufferedStreams for details.
+	MaxBufferedStreams int
+	// SessionMemoryLimit limits the memory (in bytes) a session may hold in buffers for data the application
+	// didn't consume yet. See Server.SessionMemoryLimit for details.
+	SessionMemoryLimit int
+	// SlowConsumers configures the detection of sessions whose application doesn't consume
+	// the streams and datagrams received (see Server.SlowConsumers).
+	SlowConsumers *SlowConsumerConfig
+	// Heartbeat configures a watchdog that closes sessions whose server doesn't answer liveness probes.
+	// If unset, no probes are sent. Probes sent by the server are always answered.
+	Heartbeat *HeartbeatConfig
+	// FairScheduling schedules the datagrams sent and the streams opened by the sessions on the same
+	// QUIC connection, which is useful when multiplexing several sessions (see Server.FairScheduling).
+	FairScheduling bool
+	// BandwidthLimit limits the rate (in bytes per second) at which the sessions on a QUIC connection
+	// send data (see Server.BandwidthLimit). A value of 0 means no limit.
+	BandwidthLimit int
+
+	// PanicHandler is called when a handler passed to Conn.HandleStreams or Conn.HandleMessages panics.
+	// If unset, the panic is logged.
+	PanicHandler PanicHandler
+
+	// MaxConcurrentStreamHandlers limits the number of handlers passed to Conn.HandleStreams
+	// that run concurrently, across all sessions.
+	// Once the limit is reached, no new streams are accepted until one of the handlers returns.
+	// Sessions blocked in HandleStreams waiting for a stream don't count towards the limit.
+	// If zero, there's no limit.
+	MaxConcurrentStreamHandlers int
+
+	// DSCP is the Differentiated Services Code Point (RFC 2474) that all packets are marked with.
+	// It has to fit in 6 bits. If zero, packets are not marked.
+	// It is ignored if DialFunc is set.
+	DSCP uint8
+
+	// UDPBufferSizes are the sizes of the receive and send buffers of the UDP sockets.
+	// Zero values leave the respective buffer size at the OS default.
+	// It is ignored if DialFunc is set.
+	UDPBufferSizes UDPBufferSizes
+	// UDPBufferSizesCallback, if set, is called with the actual buffer sizes for every UDP socket
+	// created, after setting UDPBufferSizes.
+	// The OS might not honor the requested sizes, e.g. on Linux, they are capped by the
+	// net.core.rmem_max and net.core.wmem_max sysctls, and the kernel reports double the requested size.
+	// It is not called on platforms that don't allow inspecting the buffer sizes.
+	UDPBufferSizesCallback func(requested, actual UDPBufferSizes)
+
+	// KeyLogWriter optionally specifies a destination for TLS master secrets
+	// in NSS key log format, which can be used to decrypt the QUIC packets, e.g. with Wireshark.
+	// Use of KeyLogWriter compromises security and should only be used for debugging.
+	KeyLogWriter io.Writer
+
+	// ConnectionIDLength is the length of the connection IDs the client chooses, in bytes.
+	// It can be 0, or any value between 4 and 18. If zero, quic-go's default is used.
+	ConnectionIDLength int
+
+	// Strict enables validation of the server's behavior, to aid debugging of interoperability issues.
+	// If the server violates the protocol, the QUIC connection is closed with the respective HTTP/3 error code,
+	// and the violation is reported to ProtocolViolationHandler.
+	// The following violations are detected:
+	//  * streams with a session ID that is not a client-initiated bidirectional stream ID
+	//  * streams for sessions that are not established within StreamReorderingTimeout
+	//  * sessions that are established twice on the same stream
+	//  * malformed datagrams, and datagrams for unknown sessions
+	// Note that a server that sends datagrams right after accepting a session might trigger the
+	// last check, if the datagram arrives before the response.
+	Strict bool
+	// ProtocolViolationHandler is called when a protocol violation is detected in strict mode.
+	// If unset, the violation is logged.
+	ProtocolViolationHandler func(quic.Connection, *ProtocolViolationError)
+
+	// DisableDatagrams disables support for datagrams: neither QUIC datagrams nor HTTP/3 datagrams
+	// (H3_DATAGRAM) are advertised to the server. Sending and receiving datagrams then fails
+	// with ErrDatagramsDisabled. Datagrams are also disabled for sessions with servers that don't support them.
+	DisableDatagrams bool
+
+	// DatagramStatsInterval is the interval at which datagram statistics are reported to the server
+	// (see Conn.PeerDatagramStats). If zero, no statistics are reported.
+	// The statistics are sent on a separate stream, using a non-standard HTTP/3 frame type.
+	// This should only be enabled if the server is known to support this extension (e.g. if it uses webtransport-go).
+	DatagramStatsInterval time.Duration
+
+	// Logging configures logging.
+	// If unset, errors are logged using log.Printf.
+	Logging *LogConfig
+
+	// Tracer is notified of events on all sessions, and of datagrams and streams that
+	// can't be associated with a session.
+	Tracer Tracer
+
+	// RoundTripper optionally specifies the HTTP/3 round tripper used to establish sessions.
+	// This allows sharing QUIC connections with other HTTP/3 requests made by the application.
+	// The Dialer enables datagrams and WebTransport on the round tripper, and sets its StreamHijacker,
+	// which therefore must not be set. The round tripper must not have been used before dialing
+	// the first session, since the settings only apply to QUIC connections established afterwards.
+	// If set, TLSClientConf, DialFunc, DSCP, UDPBufferSizes and KeyLogWriter are ignored,
+	// and the round tripper's configuration is used instead.
+	RoundTripper *http3.RoundTripper
+
+	// OnDraining is called when the server announces that a session will be closed soon,
+	// e.g. because the server is shutting down (see Conn.PeerDraining).
+	// Clients should establish a new session, and wrap up their work on the draining session.
+	// When the server sends a GOAWAY frame, it is called for all sessions on the QUIC connection,
+	// and Dial establishes new sessions on a new QUIC connection (unless RoundTripper is set).
+	OnDraining func(*Conn)
+
+	// ResumptionTokenHeader is the name of the header that carries the resumption token (see Resume).
+	// It must match the server's configuration. Defaults to DefaultResumptionTokenHeader.
+	ResumptionTokenHeader string
 
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
-	initOnce     sync.Once
+	initOnce sync.Once
+	initErr  error
+
+	rtMx sync.Mutex
+	// The round tripper used by Dial. It is replaced when the server sends a GOAWAY frame.
 	roundTripper *http3.RoundTripper
+	// the number of dials in progress and established sessions, per round tripper
+	rtUsers map[*http3.RoundTripper]int
+	// round trippers that were replaced, they are closed once the last session using them is closed
+	retiredRTs map[*http3.RoundTripper]struct{}
 
 	conns sessionManager
+
+	streamHandlerSem chan struct{}
+	metrics          *metricsTracer
+	logger           *logger
 }
 
-func (d *Dialer) init() {
+func (d *Dialer) init() error {
+	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
+	if err := validateConnectionIDLength(d.ConnectionIDLength); err != nil {
+		return err
+	}
 	timeout := d.StreamReorderingTimeout
 	if timeout == 0 {
 		timeout = 5 * time.Second
 	}
 	d.conns = *newSessionManager(timeout)
-	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
-	d.roundTripper = &http3.RoundTripper{
-		TLSClientConfig:    d.TLSClientConf,
-		QuicConfig:         &quic.Config{MaxIncomingStreams: 100, MaxIncomingUniStreams: 100},
-		Dial:               d.DialFunc,
-		EnableDatagrams:    true,
-		AdditionalSettings: map[uint64]uint64{settingsEnableWebtransport: 1},
-		StreamHijacker: func(ft http3.FrameType, conn quic.Connection, str quic.Stream) (hijacked bool, err error) {
-			if ft != webTransportFrameType {
-				return false, nil
-			}
-			id, err := quicvarint.Read(quicvarint.NewReader(str))
-			if err != nil {
-				return false, err
-			}
-			d.conns.AddStream(conn, str, sessionID(id))
+	d.conns.strict = d.Strict
+	d.conns.onViolation = d.ProtocolViolationHandler
+	d.logger = newLogger(d.Logging)
+	d.conns.logger = d.logger
+	d.conns.tracer = d.Tracer
+	d.conns.bufferedStreams = d.BufferedStreams
+	d.conns.memoryLimit = d.SessionMemoryLimit
+	d.conns.maxBufferedStreams = d.MaxBufferedStreams
+	d.conns.fairScheduling = d.FairScheduling
+	d.conns.bandwidthLimit = d.BandwidthLimit
+	if d.MaxConcurrentStreamHandlers > 0 {
+		d.streamHandlerSem = make(chan struct{}, d.MaxConcurrentStreamHandlers)
+	}
+	d.metrics = newMetricsTracer()
+	d.rtUsers = make(map[*http3.RoundTripper]int)
+	d.retiredRTs = make(map[*http3.RoundTripper]struct{})
+	if d.RoundTripper != nil {
+		if err := d.configureRoundTripper(d.RoundTripper); err != nil {
+			return err
+		}
+		d.roundTripper = d.RoundTripper
+		return nil
+	}
+	rt, err := d.newRoundTripper(nil)
+	if err != nil {
+		return err
+	}
+	d.roundTripper = rt
+	return nil
+}
+
+// newRoundTripper creates a round tripper using the Dialer's configuration.
+// If opts is not nil, the options override the respective parts of the configuration.
+func (d *Dialer) newRoundTripper(opts *DialOptions) (*http3.RoundTripper, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	dialFunc := d.DialFunc
+	sockOpts := &socketOptions{
+		dscp:          d.DSCP,
+		bufferSizes:   d.UDPBufferSizes,
+		onBufferSizes: d.UDPBufferSizesCallback,
+		ctx:           d.ctx,
+		refCount:      d.conns.refCount,
+	}
+	if dialFunc == nil && !sockOpts.isDefault() {
+		dialFunc = sockOpts.dial
+	}
+	tlsConf := d.TLSClientConf
+	if opts.TLSClientConf != nil {
+		tlsConf = opts.TLSClientConf
+	}
+	if d.KeyLogWriter != nil {
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		} else {
+			tlsConf = tlsConf.Clone()
+		}
+		tlsConf.KeyLogWriter = d.KeyLogWriter
+	}
+	quicConf := &quic.Config{
+		MaxIncomingStreams:    100,
+		MaxIncomingUniStreams: 100,
+	}
+	if opts.QuicConfig != nil {
+		quicConf = opts.QuicConfig.Clone()
+	}
+	if opts.HandshakeTimeout != 0 {
+		quicConf.HandshakeIdleTimeout = opts.HandshakeTimeout
+	}
+	rt := &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig:      quicConf,
+		Dial:            dialFunc,
+	}
+	if len(opts.AdditionalSettings) > 0 {
+		rt.AdditionalSettings = make(map[uint64]uint64, len(opts.AdditionalSettings)+1)
+		for k, v := range opts.AdditionalSettings {
+			rt.AdditionalSettings[k] = v
+		}
+	}
+	if err := d.configureRoundTripper(rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// configureRoundTripper enables WebTransport on the round tripper.
+func (d *Dialer) configureRoundTripper(rt *http3.RoundTripper) error {
+	if rt.StreamHijacker != nil {
+		return errors.New("StreamHijacker already set")
+	}
+	rt.QuicConfig = d.metrics.addToConfig(rt.QuicConfig)
+	if d.ConnectionIDLength != 0 {
+		rt.QuicConfig.ConnectionIDLength = d.ConnectionIDLength
+	}
+	if rt.AdditionalSettings == nil {
+		rt.AdditionalSettings = make(map[uint64]uint64)
+	}
+	rt.AdditionalSettings[settingsEnableWebtransport] = 1
+	rt.EnableDatagrams = !d.DisableDatagrams
+	rt.Dial = d.wrapDial(rt, trackDialProgress(rt.Dial))
+	rt.StreamHijacker = func(ft http3.FrameType, conn quic.Connection, str quic.Stream) (hijacked bool, err error) {
+		if ft == datagramStatsFrameType {
+			d.conns.AddDatagramStatsStream(conn, str)
+			return true, nil
+		}
+		if ft == heartbeatFrameType {
+			d.conns.AddHeartbeatStream(conn, str)
 			return true, nil
-		},
+		}
+		if ft != webTransportFrameType {
+			return false, nil
+		}
+		id, err := readSessionID(str)
+		if err != nil {
+			return false, err
+		}
+		d.conns.AddStream(conn, str, id)
+		return true, nil
 	}
+	return nil
+}
+
+// DialOptions are options for a single session, see Dialer.DialWithOptions.
+// Unset fields default to the Dialer's configuration.
+type DialOptions struct {
+	// TLSClientConf specifies the TLS configuration to use.
+	// If nil, the Dialer's TLSClientConf is used.
+	TLSClientConf *tls.Config
+	// QuicConfig specifies the QUIC configuration to use.
+	// If nil, a default configuration is used.
+	QuicConfig *quic.Config
+	// HandshakeTimeout is the idle timeout of the QUIC handshake (see quic.Config.HandshakeIdleTimeout).
+	// If zero, the value from the QuicConfig is used.
+	HandshakeTimeout time.Duration
+	// AdditionalSettings are HTTP/3 settings sent in addition to the settings required for WebTransport.
+	AdditionalSettings map[uint64]uint64
 }
 
 func (d *Dialer) Dial(ctx context.Context, urlStr string, reqHdr http.Header) (*http.Response, *Conn, error) {
-	d.initOnce.Do(func() { d.init() })
+	d.initOnce.Do(func() { d.initErr = d.init() })
+	if d.initErr != nil {
+		return nil, nil, d.initErr
+	}
+	return d.dialShared(ctx, urlStr, reqHdr)
+}
 
-	u, err := url.Parse(urlStr)
+// DialWithOptions is like Dial, but allows overriding the Dialer's configuration for this session.
+// Since QUIC connections with different configurations can't be shared, the session is established
+// on a dedicated QUIC connection, which is closed when the session is closed.
+// It can't be used if the Dialer's RoundTripper is set.
+func (d *Dialer) DialWithOptions(ctx context.Context, urlStr string, reqHdr http.Header, opts *DialOptions) (*http.Response, *Conn, error) {
+	d.initOnce.Do(func() { d.initErr = d.init() })
+	if d.initErr != nil {
+		return nil, nil, d.initErr
+	}
+	if opts == nil {
+		return d.dialShared(ctx, urlStr, reqHdr)
+	}
+	if d.RoundTripper != nil {
+		return nil, nil, errors.New("webtransport: DialOptions can't be used with a custom RoundTripper")
+	}
+	rt, err := d.newRoundTripper(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsp, conn, err := d.dial(ctx, urlStr, reqHdr, rt)
+	if err != nil {
+		rt.Close()
+		return rsp, nil, err
+	}
+	go func() {
+		select {
+		case <-conn.Context().Done():
+		case <-conn.qconn.Context().Done():
+		}
+		rt.Close()
+	}()
+	return rsp, conn, nil
+}
+
+// dialShared establishes a session using the round tripper shared by the Dialer's sessions.
+func (d *Dialer) dialShared(ctx context.Context, urlStr string, reqHdr http.Header) (*http.Response, *Conn, error) {
+	rt := d.acquireRoundTripper()
+	rsp, conn, err := d.dial(ctx, urlStr, reqHdr, rt)
+	if err != nil {
+		d.releaseRoundTripper(rt)
+		return rsp, nil, err
+	}
+	go func() {
+		select {
+		case <-conn.Context().Done():
+		case <-conn.qconn.Context().Done():
+		}
+		d.releaseRoundTripper(rt)
+	}()
+	return rsp, conn, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, urlStr string, reqHdr http.Header, rt *http3.RoundTripper) (*http.Response, *Conn, error) {
+	u, err := parseURL(urlStr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -84,23 +400,144 @@ func (d *Dialer) Dial(ctx context.Context, urlStr string, reqHdr http.Header) (*
 		Host:   u.Host,
 		URL:    u,
 	}
+	ctx, progress := withDialProgress(ctx)
+	// The context of the request must not be cancelled once the session is established,
+	// since that would cancel the CONNECT stream. We therefore can't use context.WithTimeout.
+	// Once the session is established, the context is cancelled when the session is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	releaseCtx := cancel
+	var stopTimer func() bool
+	if d.HandshakeTimeout > 0 {
+		stopTimer = time.AfterFunc(d.HandshakeTimeout, releaseCtx).Stop
+	}
 	req = req.WithContext(ctx)
 
-	rsp, err := d.roundTripper.RoundTripOpt(req, http3.RoundTripOpt{})
+	rsp, err := rt.RoundTripOpt(req, http3.RoundTripOpt{})
+	if stopTimer != nil && !stopTimer() { // the handshake timeout expired
+		if err == nil {
+			rsp.Body.Close()
+		}
+		err = context.DeadlineExceeded
+	}
 	if err != nil {
+		releaseCtx()
+		err = &DialError{Phase: dialErrorPhase(err, progress), Err: err}
+		d.logger.Logf(LogComponentClient, LogLevelDebug, "dialing %s failed: %s", urlStr, err)
 		return nil, nil, err
 	}
 	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
-		return rsp, nil, fmt.Errorf("received status %d", rsp.StatusCode)
+		// The context is not released, since the application might still read the response body.
+		d.logger.Logf(LogComponentClient, LogLevelInfo, "session to %s rejected with status %d", urlStr, rsp.StatusCode)
+		return rsp, nil, &DialError{Phase: DialPhaseConnect, StatusCode: rsp.StatusCode}
+	}
+	qconn, ok := rsp.Body.(http3.Hijacker).StreamCreator().(quic.Connection)
+	if !ok { // should never happen, unless quic-go changed the API
+		releaseCtx()
+		return nil, nil, errors.New("failed to get QUIC connection")
 	}
-	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
 	id := sessionID(rsp.Body.(streamIDGetter).StreamID())
-	conn := newConn(id, qconn, rsp.Body)
-	d.conns.AddSession(qconn, id, conn)
+	body := newResponseBody(rsp.Body, releaseCtx)
+	conn := newConn(id, qconn, body)
+	conn.response = rsp
+	conn.panicHandler = d.PanicHandler
+	conn.handlerSem = d.streamHandlerSem
+	conn.metrics = d.metrics
+	conn.logger = d.logger
+	conn.tracer = d.Tracer
+	conn.onPeerDraining = d.OnDraining
+	conn.datagramsDisabled = d.DisableDatagrams || !qconn.ConnectionState().SupportsDatagrams
+	conn.memoryLimit = d.SessionMemoryLimit
+	d.setResumption(conn, rsp)
+	conn.setProfilerLabels(u.Path)
+	if err := d.conns.AddSession(qconn, id, conn); err != nil {
+		releaseCtx()
+		return nil, nil, err
+	}
+	if ga, ok := qconn.(*goAwayConn); ok && ga.hasGoneAway() {
+		conn.setPeerDraining()
+	}
+	conn.goLabeled(func() { conn.readCapsules(body) })
+	if conn.tracer != nil {
+		conn.startTracing()
+	}
+	if d.DatagramStatsInterval > 0 && !conn.datagramsDisabled {
+		conn.goLabeled(func() { conn.reportDatagramStats(d.DatagramStatsInterval) })
+	}
+	if d.SlowConsumers != nil && d.SlowConsumers.Timeout > 0 {
+		conn.goLabeled(func() { conn.watchConsumer(d.SlowConsumers) })
+	}
+	if d.Heartbeat != nil && d.Heartbeat.Interval > 0 {
+		conn.goLabeled(func() { conn.watchHeartbeat(d.Heartbeat) })
+	}
+	if d.logger.Enabled(LogComponentClient, LogLevelDebug) {
+		d.logger.Logf(LogComponentClient, LogLevelDebug, "[%s] established session to %s", conn, urlStr)
+	}
 	return rsp, conn, nil
 }
 
+// parseURL parses and validates the URL of a WebTransport server.
+// Both https:// and webtransport:// URLs are accepted, the returned URL always uses the https scheme.
+// If the URL doesn't contain a port, the default port 443 is used.
+func parseURL(urlStr string) (*url.URL, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("webtransport: invalid URL: %w", err)
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("webtransport: invalid URL %q: %s", urlStr, fmt.Sprintf(format, args...))
+	}
+	switch u.Scheme {
+	case "https", "webtransport":
+	case "":
+		return nil, invalid("missing scheme")
+	default:
+		return nil, invalid("unsupported scheme %q", u.Scheme)
+	}
+	if u.Opaque != "" {
+		return nil, invalid("missing host")
+	}
+	if u.User != nil {
+		return nil, invalid("user info is not allowed")
+	}
+	if u.Fragment != "" || strings.HasSuffix(urlStr, "#") {
+		return nil, invalid("fragment is not allowed")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, invalid("missing host")
+	}
+	port := u.Port()
+	if port == "" && !strings.HasSuffix(u.Host, ":") { // url.Parse accepts an empty port after the colon
+		port = "443"
+	} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return nil, invalid("invalid port %q", port)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return nil, invalid("path must start with a slash")
+	}
+	return &url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(host, port),
+		Path:     u.Path,
+		RawPath:  u.RawPath,
+		RawQuery: u.RawQuery,
+	}, nil
+}
+
+// DroppedDatagrams returns the number of datagrams that were dropped because they were malformed,
+// or because they didn't belong to a known session.
+func (d *Dialer) DroppedDatagrams() uint64 {
+	return d.conns.DroppedDatagrams()
+}
+
 func (d *Dialer) Close() error {
 	d.ctxCancel()
+	// Stop buffering streams for sessions that are not established yet.
+	// The session manager's go routines receiving datagrams return once the QUIC connections are closed.
+	if d.conns.ctxCancel != nil { // nil if initialization failed
+		d.conns.ctxCancel()
+	}
 	return nil
 }
@@ -0,0 +1,344 @@
+package webtransport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseGracefullyWaitsForStreams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	cstr, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = cstr.Write([]byte("foo"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	closed := make(chan error, 1)
+	go func() { closed <- server.CloseGracefully(context.Background()) }()
+
+	// New streams are rejected, but the existing stream can still be used.
+	require.Eventually(t, server.Draining, time.Second, time.Millisecond)
+	_, err = server.OpenStream()
+	require.Error(t, err)
+	select {
+	case <-closed:
+		t.Fatal("CloseGracefully returned while a stream was still open")
+	case <-time.After(scaleDuration(50 * time.Millisecond)):
+	}
+
+	require.NoError(t, cstr.Close())
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), data)
+	select {
+	case <-closed:
+		t.Fatal("CloseGracefully returned while a stream was still open")
+	case <-time.After(scaleDuration(50 * time.Millisecond)):
+	}
+	_, err = sstr.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, sstr.Close())
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for CloseGracefully to return")
+	}
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the session to be closed")
+	}
+}
+
+func TestCloseGracefullyTimeout(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	cstr, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, cstr.Flush())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	start := time.Now()
+	timeout := scaleDuration(50 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	require.NoError(t, server.CloseGracefully(ctx))
+	require.GreaterOrEqual(t, time.Since(start), timeout)
+	select {
+	case <-server.Context().Done():
+	default:
+		t.Fatal("session context not cancelled")
+	}
+	_, err = cstr.Read([]byte{0})
+	require.Error(t, err)
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer server.Close()
+
+	const num = 10
+	errChan := make(chan error, 2*num)
+	for i := 0; i < num; i++ {
+		go func() { errChan <- client.Close() }()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(10*time.Millisecond))
+			defer cancel()
+			errChan <- client.CloseGracefully(ctx)
+		}()
+	}
+	first := <-errChan
+	for i := 1; i < 2*num; i++ {
+		require.Equal(t, first, <-errChan)
+	}
+	require.Equal(t, first, client.Close())
+
+	_, err := client.OpenStream()
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	_, err = client.OpenStreamSync(context.Background())
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	_, err = client.OpenUniStream()
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	_, err = client.AcceptStream(context.Background())
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	require.ErrorIs(t, client.SendMessage([]byte("foo")), webtransport.ErrSessionClosed)
+	require.ErrorIs(t, client.SendMessageContext(context.Background(), []byte("foo")), webtransport.ErrSessionClosed)
+	require.ErrorIs(t, client.SendMessageWithPriority([]byte("foo"), webtransport.MessagePriorityHigh), webtransport.ErrSessionClosed)
+	_, err = client.ReceiveMessage(context.Background())
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+}
+
+func TestCloseRacingWithStreams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer server.Close()
+	go server.HandleStreams(context.Background(), func(str webtransport.Stream) {
+		io.Copy(str, str) // fails when the session is closed
+		str.Close()
+	})
+
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				str, err := client.OpenStreamSync(context.Background())
+				if err != nil {
+					require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+					return
+				}
+				str.Write([]byte("foobar"))
+				str.Close()
+				io.ReadAll(str)
+			}
+		}()
+	}
+	time.Sleep(scaleDuration(10 * time.Millisecond))
+	require.NoError(t, client.Close())
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+}
+
+func TestStreamCloseIdempotent(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	go newEchoHandler(t)(server)
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	errChan := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() { errChan <- str.Close() }()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errChan)
+	}
+	data, err := io.ReadAll(str)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+
+	// Closing a canceled stream is a no-op.
+	str, err = client.OpenStream()
+	require.NoError(t, err)
+	str.CancelWrite(1)
+	str.CancelWrite(2)
+	require.NoError(t, str.Close())
+	str.CancelRead(1)
+	str.CancelRead(1)
+}
+
+// sessionOp is an operation that blocks until the session (or the stream) is closed.
+type sessionOp struct {
+	name string
+	run  func(*webtransport.Conn, webtransport.Stream) error
+}
+
+var sessionOps = []sessionOp{
+	{
+		name: "read",
+		run: func(_ *webtransport.Conn, str webtransport.Stream) error {
+			_, err := str.Read([]byte{0})
+			return err
+		},
+	},
+	{
+		name: "write",
+		run: func(_ *webtransport.Conn, str webtransport.Stream) error {
+			b := make([]byte, 1<<10)
+			for {
+				if _, err := str.Write(b); err != nil {
+					return err
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		},
+	},
+	{
+		name: "accept",
+		run: func(conn *webtransport.Conn, _ webtransport.Stream) error {
+			_, err := conn.AcceptStream(context.Background())
+			return err
+		},
+	},
+}
+
+func requireSessionError(t *testing.T, err error, remote bool, code webtransport.SessionErrorCode, msg string) {
+	t.Helper()
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	var sessErr *webtransport.SessionError
+	require.True(t, errors.As(err, &sessErr), "expected a SessionError, got %#v", err)
+	require.Equal(t, remote, sessErr.Remote)
+	require.Equal(t, code, sessErr.ErrorCode)
+	require.Equal(t, msg, sessErr.Message)
+}
+
+func TestSessionErrorLocalClose(t *testing.T) {
+	for _, op := range sessionOps {
+		op := op
+		t.Run(op.name, func(t *testing.T) {
+			client, server := webtransport.Pipe()
+			defer client.Close()
+
+			cstr, err := client.OpenStream()
+			require.NoError(t, err)
+			_, err = cstr.Write([]byte("foo"))
+			require.NoError(t, err)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			sstr, err := server.AcceptStream(ctx)
+			require.NoError(t, err)
+			_, err = io.ReadFull(sstr, make([]byte, 3))
+			require.NoError(t, err)
+
+			errChan := make(chan error, 1)
+			go func() { errChan <- op.run(server, sstr) }()
+			time.Sleep(scaleDuration(10 * time.Millisecond))
+			require.NoError(t, server.CloseWithError(42, "bye"))
+			select {
+			case err := <-errChan:
+				requireSessionError(t, err, false, 42, "bye")
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+			// subsequent calls return the same error
+			requireSessionError(t, op.run(server, sstr), false, 42, "bye")
+		})
+	}
+}
+
+func TestSessionErrorPeerClose(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	mux := http.NewServeMux()
+	// The CLOSE_WEBTRANSPORT_SESSION capsule is sent on the CONNECT stream, which is closed when the handler returns.
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		connChan <- conn
+		<-conn.Context().Done()
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	for _, op := range sessionOps {
+		op := op
+		t.Run(op.name, func(t *testing.T) {
+			_, conn, err := d.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			sconn := <-connChan
+
+			str, err := conn.OpenStream()
+			require.NoError(t, err)
+			_, err = str.Write([]byte("foo"))
+			require.NoError(t, err)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = sconn.AcceptStream(ctx)
+			require.NoError(t, err)
+
+			errChan := make(chan error, 1)
+			go func() { errChan <- op.run(conn, str) }()
+			time.Sleep(scaleDuration(10 * time.Millisecond))
+			require.NoError(t, sconn.CloseWithError(42, "bye"))
+			select {
+			case err := <-errChan:
+				// Streams might be reset before the close capsule is received,
+				// in which case the error doesn't carry the error code and message yet.
+				require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+				var sessErr *webtransport.SessionError
+				require.True(t, errors.As(err, &sessErr), "expected a SessionError, got %#v", err)
+				require.True(t, sessErr.Remote)
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+			select {
+			case <-conn.Context().Done():
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for the session to be closed")
+			}
+			requireSessionError(t, op.run(conn, str), true, 42, "bye")
+			_, err = conn.OpenStream()
+			requireSessionError(t, err, true, 42, "bye")
+		})
+	}
+}
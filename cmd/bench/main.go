@@ -0,0 +1,190 @@
+// Command bench measures the throughput, allocations and latency of stream echo and datagram echo
+// over the loopback interface.
+// The results are printed in the Go benchmark format, so they can be compared using benchstat.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+func main() {
+	streamSizes := flag.String("stream-sizes", "100,10240,1048576", "comma-separated list of message sizes for stream echo")
+	datagramSizes := flag.String("datagram-sizes", "100,1000", "comma-separated list of message sizes for datagram echo")
+	flag.Parse()
+
+	conn, closeFn, err := setup()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeFn()
+
+	for _, size := range parseSizes(*streamSizes) {
+		res := testing.Benchmark(func(b *testing.B) { benchmarkStreamEcho(b, conn, size) })
+		printResult(fmt.Sprintf("StreamEcho/%d", size), res)
+	}
+	for _, size := range parseSizes(*datagramSizes) {
+		res := testing.Benchmark(func(b *testing.B) { benchmarkDatagramEcho(b, conn, size) })
+		printResult(fmt.Sprintf("DatagramEcho/%d", size), res)
+	}
+}
+
+func parseSizes(s string) []int {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		size, err := strconv.Atoi(f)
+		if err != nil {
+			log.Fatalf("invalid size: %s", f)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+func printResult(name string, res testing.BenchmarkResult) {
+	fmt.Printf("Benchmark%s\t%s\t%s\n", name, res.String(), res.MemString())
+}
+
+// setup starts an echo server on the loopback interface, and establishes a session with it.
+func setup() (*webtransport.Conn, func(), error) {
+	tlsConf, certPool, err := generateTLSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bench", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		go conn.HandleMessages(context.Background(), func(b []byte) { conn.SendMessage(b) })
+		go conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			io.Copy(str, str)
+			str.Close()
+		})
+	})
+	s.H3.Handler = mux
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, nil, err
+	}
+	go s.Serve(udpConn)
+
+	d := &webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	url := fmt.Sprintf("https://localhost:%d/bench", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return conn, func() {
+		conn.Close()
+		d.Close()
+		s.Close()
+		udpConn.Close()
+	}, nil
+}
+
+func benchmarkStreamEcho(b *testing.B, conn *webtransport.Conn, size int) {
+	data := make([]byte, size)
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		str, err := conn.OpenStreamSync(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Read concurrently, since large messages would otherwise exceed the flow control window.
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(str, buf)
+			errChan <- err
+		}()
+		if _, err := str.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := str.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if err := <-errChan; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDatagramEcho(b *testing.B, conn *webtransport.Conn, size int) {
+	data := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	var lost int
+	for i := 0; i < b.N; i++ {
+		if err := conn.SendMessage(data); err != nil {
+			b.Fatal(err)
+		}
+		// Datagrams can be lost (even on the loopback interface), so we can't wait forever.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := conn.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			lost++
+		}
+	}
+	b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+}
+
+// generateTLSConfig generates a self-signed certificate for localhost.
+func generateTLSConfig() (*tls.Config, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+	}, pool, nil
+}
@@ -0,0 +1,129 @@
+// Command chat is a chat room, demonstrating the use of WebTransport with browsers.
+//
+// The server serves a web page (over HTTP/1.1, HTTP/2 and HTTP/3), which establishes a WebTransport
+// session with the same server. Chat messages are sent as datagrams, and the server broadcasts
+// every message it receives to all participants.
+//
+// Since browsers require a valid certificate for WebTransport, a certificate that is trusted by
+// the browser has to be used, e.g. one created using mkcert.
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// maxMessageLen is the maximum length of a chat message, in bytes.
+// Longer messages are dropped.
+const maxMessageLen = 1000
+
+type message struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+func main() {
+	addr := flag.String("addr", ":4433", "address to listen on (both TCP and UDP)")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS key file")
+	origins := flag.String("origins", "", "comma-separated list of allowed origins (e.g. https://example.com:4433). If empty, only same-origin requests are allowed")
+	flag.Parse()
+	if *certFile == "" || *keyFile == "" {
+		log.Fatal("-cert and -key are required")
+	}
+
+	mux := http.NewServeMux()
+	s := &webtransport.Server{
+		H3: http3.Server{Server: &http.Server{Addr: *addr, Handler: mux}},
+	}
+	if *origins != "" {
+		allowed := make(map[string]bool)
+		for _, o := range strings.Split(*origins, ",") {
+			allowed[strings.TrimSpace(o)] = true
+		}
+		s.CheckOrigin = func(r *http.Request) bool { return allowed[r.Header.Get("Origin")] }
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	mux.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			log.Printf("upgrading failed: %s", err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		log.Printf("%s joined", conn.RemoteAddr())
+		go handleSession(s, conn)
+	})
+
+	// Browsers first load the page via HTTP/1.1 or HTTP/2, and discover HTTP/3 using the Alt-Svc header.
+	tcpServer := &http.Server{
+		Addr: *addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.H3.SetQuicHeaders(w.Header())
+			mux.ServeHTTP(w, r)
+		}),
+	}
+	go func() {
+		if err := tcpServer.ListenAndServeTLS(*certFile, *keyFile); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		// Close all sessions, so that browsers are notified that the chat is going away.
+		log.Print("shutting down")
+		for _, conn := range s.Sessions() {
+			conn.Drain()
+			conn.Close()
+		}
+		tcpServer.Close()
+		s.Close()
+	}()
+
+	log.Printf("listening on %s", *addr)
+	if err := s.ListenAndServeTLS(*certFile, *keyFile); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+// handleSession receives chat messages, and broadcasts them to all participants.
+func handleSession(s *webtransport.Server, conn *webtransport.Conn) {
+	err := conn.HandleMessages(context.Background(), func(b []byte) {
+		var msg message
+		if len(b) > maxMessageLen || !utf8.Valid(b) || json.Unmarshal(b, &msg) != nil {
+			return
+		}
+		b, err := json.Marshal(&msg) // don't forward unknown fields
+		if err != nil {
+			return
+		}
+		if err := s.Broadcast(b, nil); err != nil {
+			log.Printf("broadcast failed: %s", err)
+		}
+	})
+	log.Printf("%s left: %s", conn.RemoteAddr(), err)
+}
@@ -0,0 +1,161 @@
+// Command client is a command line WebTransport client, useful for manual testing of WebTransport servers.
+//
+// It dials the WebTransport URL, and sends everything read from stdin to the server,
+// either on a bidirectional stream (the default), or as datagrams (with -datagrams),
+// one datagram per line. Data received from the server is written to stdout.
+//
+// Usage:
+//
+//	client [flags] https://example.com/webtransport
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+)
+
+type headerFlag http.Header
+
+func (h headerFlag) String() string { return "" }
+
+func (h headerFlag) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid header: %q", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+func main() {
+	hdr := http.Header{}
+	flag.Var(headerFlag(hdr), "H", "request header, in the form `Name: value` (can be repeated)")
+	insecure := flag.Bool("insecure", false, "skip verification of the server's certificate")
+	datagrams := flag.Bool("datagrams", false, "send stdin as datagrams (one per line) instead of on a stream")
+	dialTimeout := flag.Duration("timeout", 10*time.Second, "timeout for establishing the session")
+	linger := flag.Duration("linger", 2*time.Second, "once stdin is exhausted, keep receiving until nothing was received for this long")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *dialTimeout)
+	_, conn, err := d.Dial(ctx, flag.Arg(0), hdr)
+	cancel()
+	if err != nil {
+		log.Fatalf("dialing failed: %s", err)
+	}
+	defer conn.Close()
+
+	activity := make(chan struct{}, 1)
+	out := &activityWriter{w: os.Stdout, activity: activity}
+	go receiveDatagrams(conn, out)
+	go receiveStreams(conn, out)
+
+	if *datagrams {
+		err = sendDatagrams(conn, os.Stdin)
+	} else {
+		err = sendStream(conn, os.Stdin, out)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Keep printing what the server sends, until it goes quiet.
+	for {
+		select {
+		case <-activity:
+		case <-time.After(*linger):
+			return
+		}
+	}
+}
+
+// activityWriter signals every write, so that the linger timer can be reset.
+type activityWriter struct {
+	w        io.Writer
+	activity chan<- struct{}
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	select {
+	case w.activity <- struct{}{}:
+	default:
+	}
+	return w.w.Write(b)
+}
+
+// sendStream sends everything read from r on a new bidirectional stream,
+// and copies everything the server sends on that stream to out.
+func sendStream(conn *webtransport.Conn, r io.Reader, out io.Writer) error {
+	str, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return fmt.Errorf("opening stream failed: %w", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, str)
+		errChan <- err
+	}()
+	if _, err := io.Copy(str, r); err != nil {
+		return fmt.Errorf("sending failed: %w", err)
+	}
+	if err := str.Close(); err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+func sendDatagrams(conn *webtransport.Conn, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := conn.SendMessage(scanner.Bytes()); err != nil {
+			return fmt.Errorf("sending datagram failed: %w", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func receiveDatagrams(conn *webtransport.Conn, out io.Writer) {
+	for {
+		b, err := conn.ReceiveMessage(context.Background())
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(out, "%s\n", b)
+	}
+}
+
+// receiveStreams prints everything received on streams opened by the server.
+func receiveStreams(conn *webtransport.Conn, out io.Writer) {
+	for {
+		str, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			if _, err := io.Copy(out, str); err != nil {
+				log.Printf("receiving on stream failed: %s", err)
+			}
+		}()
+	}
+}
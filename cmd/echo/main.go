@@ -0,0 +1,179 @@
+// Command echo is a WebTransport echo server.
+// It echoes all bidirectional streams and datagrams it receives.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+type logLevel int
+
+const (
+	logLevelError logLevel = iota
+	logLevelInfo
+	logLevelDebug
+)
+
+var level = logLevelInfo
+
+func logf(l logLevel, format string, args ...interface{}) {
+	if l <= level {
+		log.Printf(format, args...)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "[::1]:4433", "address to listen on")
+	path := flag.String("path", "/webtransport", "path of the WebTransport endpoint")
+	origins := flag.String("origins", "", "comma-separated list of allowed origins, or * to allow all origins. If empty, only same-origin requests are allowed")
+	logLevelStr := flag.String("log-level", "info", "log level: error, info or debug")
+	maxSessions := flag.Int("max-sessions", 0, "maximum number of concurrent sessions (0 means no limit)")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS key file")
+	generateCert := flag.String("generate-cert", "", "generate a self-signed certificate for the given (comma-separated) host names, instead of using -cert and -key")
+	keyLogFile := flag.String("keylog", "", "file to write TLS secrets to, for decrypting the traffic with Wireshark")
+	flag.Parse()
+
+	switch *logLevelStr {
+	case "error":
+		level = logLevelError
+	case "info":
+		level = logLevelInfo
+	case "debug":
+		level = logLevelDebug
+	default:
+		log.Fatalf("invalid log level: %s", *logLevelStr)
+	}
+
+	tlsConf, err := getTLSConfig(*certFile, *keyFile, *generateCert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s := &webtransport.Server{
+		H3: http3.Server{Server: &http.Server{Addr: *addr, Handler: mux, TLSConfig: tlsConf}},
+	}
+	if *keyLogFile != "" {
+		f, err := os.OpenFile(*keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		s.KeyLogWriter = f
+	}
+	switch *origins {
+	case "":
+	case "*":
+		s.CheckOrigin = func(*http.Request) bool { return true }
+	default:
+		allowed := make(map[string]bool)
+		for _, o := range strings.Split(*origins, ",") {
+			allowed[strings.TrimSpace(o)] = true
+		}
+		s.CheckOrigin = func(r *http.Request) bool { return allowed[r.Header.Get("Origin")] }
+	}
+
+	mux.HandleFunc(*path, func(w http.ResponseWriter, r *http.Request) {
+		if *maxSessions > 0 && len(s.Sessions()) >= *maxSessions {
+			logf(logLevelInfo, "rejecting session from %s: too many sessions", r.RemoteAddr)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			logf(logLevelError, "upgrading failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logf(logLevelInfo, "new session from %s", conn.RemoteAddr())
+		go handleSession(conn)
+	})
+
+	logf(logLevelInfo, "listening on %s%s", *addr, *path)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func handleSession(conn *webtransport.Conn) {
+	go conn.HandleMessages(context.Background(), func(b []byte) {
+		logf(logLevelDebug, "%s: echoing datagram (%d bytes)", conn.RemoteAddr(), len(b))
+		if err := conn.SendMessage(b); err != nil {
+			logf(logLevelError, "%s: echoing datagram failed: %s", conn.RemoteAddr(), err)
+		}
+	})
+	err := conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+		n, err := io.Copy(str, str)
+		if err != nil {
+			logf(logLevelError, "%s: echoing stream failed: %s", conn.RemoteAddr(), err)
+			return
+		}
+		logf(logLevelDebug, "%s: echoed stream (%d bytes)", conn.RemoteAddr(), n)
+		str.Close()
+	})
+	logf(logLevelInfo, "session from %s closed: %s", conn.RemoteAddr(), err)
+}
+
+func getTLSConfig(certFile, keyFile, hosts string) (*tls.Config, error) {
+	if hosts == "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("either -cert and -key, or -generate-cert is required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	cert, err := generateSelfSignedCert(strings.Split(hosts, ","))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// generateSelfSignedCert generates a self-signed certificate.
+// The certificate uses ECDSA and is valid for less than 14 days, so that browsers accept it
+// when its hash is passed to the WebTransport constructor in serverCertificateHashes.
+func generateSelfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hash := sha256.Sum256(certDER)
+	logf(logLevelInfo, "generated self-signed certificate, SHA-256 hash: %s", hex.EncodeToString(hash[:]))
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}, nil
+}
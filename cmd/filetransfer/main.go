@@ -0,0 +1,281 @@
+// Command filetransfer transfers files over WebTransport.
+//
+// The server serves the files in a directory:
+//
+//	filetransfer server -cert cert.pem -key key.pem -dir /path/to/files
+//
+// The client downloads a file. If the output file already exists (e.g. because a previous
+// transfer was interrupted), the transfer is resumed:
+//
+//	filetransfer client -url https://localhost:4433/files -name file.bin -out file.bin
+//
+// Every file is transferred on a separate bidirectional stream. The client sends a request,
+// consisting of the file name and the offset to start at. The server responds with the size
+// and the SHA-256 hash of the file, followed by the file contents (starting at the offset).
+// Once the transfer is complete, the client verifies the hash of the whole file.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+const chunkSize = 64 << 10
+
+// errorCodeNotFound is used to reset the stream if the requested file can't be served.
+const errorCodeNotFound webtransport.ErrorCode = 1
+
+type request struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+}
+
+type response struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s server|client [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "server":
+		err = runServer(os.Args[2:])
+	case "client":
+		err = runClient(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mode: %s\n", os.Args[1])
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := fs.String("addr", ":4433", "address to listen on")
+	certFile := fs.String("cert", "", "TLS certificate file")
+	keyFile := fs.String("key", "", "TLS key file")
+	dir := fs.String("dir", ".", "directory to serve files from")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for sending a single chunk")
+	fs.Parse(args)
+	if *certFile == "" || *keyFile == "" {
+		return errors.New("-cert and -key are required")
+	}
+
+	mux := http.NewServeMux()
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{Addr: *addr, Handler: mux}},
+	}
+	mux.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			log.Printf("upgrading failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		go conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			if err := serveFile(str, *dir, *timeout); err != nil {
+				log.Printf("serving file failed: %s", err)
+			}
+		})
+	})
+	log.Printf("serving %s on %s", *dir, *addr)
+	return s.ListenAndServeTLS(*certFile, *keyFile)
+}
+
+func serveFile(str webtransport.Stream, dir string, timeout time.Duration) error {
+	str.SetReadDeadline(time.Now().Add(timeout))
+	var req request
+	if err := json.NewDecoder(bufio.NewReader(str)).Decode(&req); err != nil {
+		str.CancelWrite(errorCodeNotFound)
+		return err
+	}
+	// don't allow escaping from the directory
+	f, err := os.Open(filepath.Join(dir, filepath.Base(req.Name)))
+	if err != nil {
+		str.CancelWrite(errorCodeNotFound)
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		str.CancelWrite(errorCodeNotFound)
+		return err
+	}
+	if req.Offset < 0 || req.Offset > size {
+		str.CancelWrite(errorCodeNotFound)
+		return fmt.Errorf("invalid offset %d for file of size %d", req.Offset, size)
+	}
+	str.SetWriteDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(str).Encode(&response{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}); err != nil {
+		return err
+	}
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		str.CancelWrite(errorCodeNotFound)
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			// The deadline applies to every chunk, such that large files can be transferred,
+			// but a stalled transfer is aborted.
+			str.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := str.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return str.Close()
+		}
+		if err != nil {
+			str.CancelWrite(errorCodeNotFound)
+			return err
+		}
+	}
+}
+
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	url := fs.String("url", "https://localhost:4433/files", "URL of the file server")
+	name := fs.String("name", "", "name of the file to download")
+	out := fs.String("out", "", "output file (defaults to the name of the file)")
+	insecure := fs.Bool("insecure", false, "skip verification of the server's certificate")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for receiving a single chunk")
+	fs.Parse(args)
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	if *out == "" {
+		*out = filepath.Base(*name)
+	}
+
+	// cancel the transfer on Ctrl-C
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{InsecureSkipVerify: *insecure}}
+	defer d.Close()
+	dialCtx, dialCancel := context.WithTimeout(ctx, *timeout)
+	_, conn, err := d.Dial(dialCtx, *url, nil)
+	dialCancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return download(ctx, conn, *name, *out, *timeout)
+}
+
+func download(ctx context.Context, conn *webtransport.Conn, name, out string, timeout time.Duration) error {
+	f, err := os.OpenFile(out, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		log.Printf("resuming download at %d bytes", offset)
+	}
+
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	// abort the transfer when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			str.CancelRead(0)
+			str.CancelWrite(0)
+		case <-done:
+		}
+	}()
+
+	str.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(str).Encode(&request{Name: name, Offset: offset}); err != nil {
+		return err
+	}
+	if err := str.Close(); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(str, chunkSize)
+	var rsp response
+	// The response is a single line of JSON, followed by the file contents.
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("reading response failed: %w", err)
+	}
+	if err := json.Unmarshal(line, &rsp); err != nil {
+		return err
+	}
+	if offset > rsp.Size {
+		return fmt.Errorf("local file (%d bytes) is larger than remote file (%d bytes)", offset, rsp.Size)
+	}
+
+	start := time.Now()
+	buf := make([]byte, chunkSize)
+	received := offset
+	for received < rsp.Size {
+		str.SetReadDeadline(time.Now().Add(timeout))
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			received += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("transfer interrupted at %d bytes: %w", received, err)
+		}
+	}
+	if received != rsp.Size {
+		return fmt.Errorf("transfer incomplete: received %d of %d bytes", received, rsp.Size)
+	}
+	elapsed := time.Since(start)
+	log.Printf("received %d bytes in %s (%.2f MB/s)", received-offset, elapsed.Round(time.Millisecond), float64(received-offset)/1e6/elapsed.Seconds())
+
+	// verify the integrity of the whole file, including the parts received in previous transfers
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != rsp.SHA256 {
+		return fmt.Errorf("hash mismatch: expected %s, got %s", rsp.SHA256, sum)
+	}
+	log.Printf("hash verified: %s", rsp.SHA256)
+	return nil
+}
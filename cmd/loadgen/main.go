@@ -0,0 +1,221 @@
+// Command loadgen generates load on a WebTransport echo server (e.g. cmd/wpt-server's echo.py handler).
+//
+// It opens a number of concurrent sessions, each of which sends messages at a configurable rate,
+// either on streams (one stream per message) or as datagrams, and waits for them to be echoed.
+// Once the test is completed, it reports latency percentiles, throughput and error rates.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+)
+
+type config struct {
+	url      string
+	sessions int
+	duration time.Duration
+	rate     float64 // messages per second, per session
+	size     int
+	mode     string
+}
+
+// results are the results collected by all sessions.
+type results struct {
+	mx        sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	sent      int
+	errors    map[string]int
+}
+
+func (r *results) addLatency(d time.Duration, n int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.latencies = append(r.latencies, d)
+	r.bytes += int64(n)
+}
+
+func (r *results) addSent() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.sent++
+}
+
+func (r *results) addError(err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.errors[err.Error()]++
+}
+
+func main() {
+	var conf config
+	flag.StringVar(&conf.url, "url", "https://localhost:4433/webtransport/handlers/echo.py", "URL of the echo server")
+	flag.IntVar(&conf.sessions, "sessions", 10, "number of concurrent sessions")
+	flag.DurationVar(&conf.duration, "duration", 10*time.Second, "duration of the test")
+	flag.Float64Var(&conf.rate, "rate", 100, "messages per second, per session")
+	flag.IntVar(&conf.size, "size", 1000, "message size, in bytes")
+	flag.StringVar(&conf.mode, "mode", "stream", "traffic pattern: stream, datagram or mixed")
+	insecure := flag.Bool("insecure", false, "skip verification of the server's certificate")
+	flag.Parse()
+
+	switch conf.mode {
+	case "stream", "datagram", "mixed":
+	default:
+		log.Fatalf("invalid mode: %s", conf.mode)
+	}
+	if conf.size < 16 {
+		log.Fatal("message size must be at least 16 bytes")
+	}
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{InsecureSkipVerify: *insecure}}
+	defer d.Close()
+
+	res := &results{errors: make(map[string]int)}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < conf.sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSession(ctx, &d, &conf, res)
+		}()
+	}
+	wg.Wait()
+	report(res, time.Since(start))
+}
+
+func runSession(ctx context.Context, d *webtransport.Dialer, conf *config, res *results) {
+	_, conn, err := d.Dial(ctx, conf.url, nil)
+	if err != nil {
+		res.addError(fmt.Errorf("dial: %w", err))
+		return
+	}
+	defer conn.Close()
+
+	go receiveDatagrams(ctx, conn, res)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / conf.rate))
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for seq := uint64(0); ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		useStream := conf.mode == "stream" || (conf.mode == "mixed" && seq%2 == 0)
+		if !useStream {
+			res.addSent()
+			if err := conn.SendMessage(newMessage(conf.size)); err != nil {
+				res.addError(fmt.Errorf("datagram: %w", err))
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.addSent()
+			if err := echoStream(ctx, conn, conf.size, res); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				res.addError(fmt.Errorf("stream: %w", err))
+			}
+		}()
+	}
+}
+
+// newMessage creates a new message of the given size.
+// The first 8 bytes contain the send timestamp, which is used to calculate the latency of datagrams.
+func newMessage(size int) []byte {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	rand.Read(b[8:])
+	return b
+}
+
+func echoStream(ctx context.Context, conn *webtransport.Conn, size int, res *results) error {
+	start := time.Now()
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+	if _, err := str.Write(newMessage(size)); err != nil {
+		return err
+	}
+	if err := str.Close(); err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, str)
+	if err != nil {
+		return err
+	}
+	if int(n) != size {
+		return fmt.Errorf("expected %d bytes, received %d", size, n)
+	}
+	res.addLatency(time.Since(start), size)
+	return nil
+}
+
+func receiveDatagrams(ctx context.Context, conn *webtransport.Conn, res *results) {
+	for {
+		b, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return
+		}
+		if len(b) < 8 {
+			continue
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+		res.addLatency(time.Since(sent), len(b))
+	}
+}
+
+func report(res *results, duration time.Duration) {
+	res.mx.Lock()
+	defer res.mx.Unlock()
+
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(res.latencies) == 0 {
+			return 0
+		}
+		return res.latencies[int(float64(len(res.latencies)-1)*p)]
+	}
+	received := len(res.latencies)
+	fmt.Printf("duration:   %s\n", duration.Round(time.Millisecond))
+	fmt.Printf("messages:   %d sent, %d echoed (%.2f%% lost or failed)\n", res.sent, received, lossRate(res.sent, received))
+	fmt.Printf("throughput: %.2f Mbit/s, %.0f messages/s\n", float64(res.bytes)*8/1e6/duration.Seconds(), float64(received)/duration.Seconds())
+	fmt.Printf("latency:    p50 %s, p90 %s, p99 %s, max %s\n", percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	if len(res.errors) > 0 {
+		fmt.Println("errors:")
+		for err, n := range res.errors {
+			fmt.Printf("  %6d %s\n", n, err)
+		}
+	}
+}
+
+func lossRate(sent, received int) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return 100 * float64(sent-received) / float64(sent)
+}
@@ -0,0 +1,195 @@
+// Command media-demo streams (simulated) media frames over WebTransport datagrams.
+//
+// The server sends frames of a configurable size at a configurable frame rate to every session.
+// Frames that are larger than a datagram are split into fragments. The client reassembles the
+// frames, and reports packet loss, frame loss and jitter (calculated as described in RFC 3550).
+//
+//	media-demo server -cert cert.pem -key key.pem -fps 30 -frame-size 20000
+//	media-demo client -url https://localhost:4433/media -insecure
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// maxFragmentSize is the maximum size of a fragment (including the header).
+// quic-go doesn't expose the maximum datagram size, so we use a conservative value
+// that fits into the smallest packet size that QUIC allows.
+const maxFragmentSize = 1100
+
+// header is the header of every fragment.
+type header struct {
+	Seq        uint32 // sequence number of the fragment, used to detect packet loss
+	Frame      uint32 // frame number
+	Index      uint16 // index of this fragment within the frame
+	Count      uint16 // number of fragments of this frame
+	SentTimeNs int64  // send time of the frame, in nanoseconds
+}
+
+const headerLen = 4 + 4 + 2 + 2 + 8
+
+func (h *header) append(b []byte) []byte {
+	var hdr [headerLen]byte
+	binary.BigEndian.PutUint32(hdr[0:4], h.Seq)
+	binary.BigEndian.PutUint32(hdr[4:8], h.Frame)
+	binary.BigEndian.PutUint16(hdr[8:10], h.Index)
+	binary.BigEndian.PutUint16(hdr[10:12], h.Count)
+	binary.BigEndian.PutUint64(hdr[12:20], uint64(h.SentTimeNs))
+	return append(b, hdr[:]...)
+}
+
+func parseHeader(b []byte) (*header, error) {
+	if len(b) < headerLen {
+		return nil, errors.New("datagram too short")
+	}
+	return &header{
+		Seq:        binary.BigEndian.Uint32(b[0:4]),
+		Frame:      binary.BigEndian.Uint32(b[4:8]),
+		Index:      binary.BigEndian.Uint16(b[8:10]),
+		Count:      binary.BigEndian.Uint16(b[10:12]),
+		SentTimeNs: int64(binary.BigEndian.Uint64(b[12:20])),
+	}, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s server|client [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "server":
+		err = runServer(os.Args[2:])
+	case "client":
+		err = runClient(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mode: %s\n", os.Args[1])
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := fs.String("addr", ":4433", "address to listen on")
+	certFile := fs.String("cert", "", "TLS certificate file")
+	keyFile := fs.String("key", "", "TLS key file")
+	fps := fs.Int("fps", 30, "frames per second")
+	frameSize := fs.Int("frame-size", 10000, "frame size, in bytes")
+	fs.Parse(args)
+	if *certFile == "" || *keyFile == "" {
+		return errors.New("-cert and -key are required")
+	}
+
+	mux := http.NewServeMux()
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{Addr: *addr, Handler: mux}},
+	}
+	mux.HandleFunc("/media", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			log.Printf("upgrading failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("streaming to %s", conn.RemoteAddr())
+		go func() {
+			err := sendFrames(conn, *fps, *frameSize)
+			log.Printf("stopped streaming to %s: %s", conn.RemoteAddr(), err)
+		}()
+	})
+	log.Printf("listening on %s", *addr)
+	return s.ListenAndServeTLS(*certFile, *keyFile)
+}
+
+func sendFrames(conn *webtransport.Conn, fps, frameSize int) error {
+	const payloadSize = maxFragmentSize - headerLen
+	count := (frameSize + payloadSize - 1) / payloadSize
+	frame := make([]byte, frameSize)
+	buf := make([]byte, 0, maxFragmentSize)
+
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+	var seq uint32
+	for frameNum := uint32(0); ; frameNum++ {
+		select {
+		case <-conn.Context().Done():
+			return conn.Context().Err()
+		case <-ticker.C:
+		}
+		now := time.Now().UnixNano()
+		for i := 0; i < count; i++ {
+			end := (i + 1) * payloadSize
+			if end > frameSize {
+				end = frameSize
+			}
+			hdr := header{Seq: seq, Frame: frameNum, Index: uint16(i), Count: uint16(count), SentTimeNs: now}
+			seq++
+			b := append(hdr.append(buf[:0]), frame[i*payloadSize:end]...)
+			if err := conn.SendMessage(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	url := fs.String("url", "https://localhost:4433/media", "URL of the media server")
+	insecure := fs.Bool("insecure", false, "skip verification of the server's certificate")
+	interval := fs.Duration("interval", time.Second, "reporting interval")
+	duration := fs.Duration("duration", 0, "stop after this duration (0 means run until interrupted)")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{InsecureSkipVerify: *insecure}}
+	defer d.Close()
+	_, conn, err := d.Dial(ctx, *url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	st := &receiverStats{frames: make(map[uint32]uint16)}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	go func() {
+		for range ticker.C {
+			st.report()
+		}
+	}()
+	for {
+		b, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			st.report()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		hdr, err := parseHeader(b)
+		if err != nil {
+			continue
+		}
+		st.add(hdr, time.Now())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// receiverStats collects the statistics of received frames.
+// All values are reset after every report.
+type receiverStats struct {
+	mx sync.Mutex
+
+	highestSeq  uint32
+	receivedAny bool
+	received    int // number of fragments received
+	expected    int // number of fragments expected, derived from the sequence numbers
+
+	frames         map[uint32]uint16 // number of fragments received per frame
+	completeFrames int
+	highestFrame   uint32
+
+	// jitter is the interarrival jitter, as defined in RFC 3550, section 6.4.1
+	jitter         float64
+	lastTransit    time.Duration
+	hasLastTransit bool
+}
+
+func (s *receiverStats) add(hdr *header, now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.received++
+	if !s.receivedAny || hdr.Seq > s.highestSeq {
+		if s.receivedAny {
+			s.expected += int(hdr.Seq - s.highestSeq)
+		} else {
+			s.expected++
+		}
+		s.highestSeq = hdr.Seq
+		s.receivedAny = true
+	}
+
+	s.frames[hdr.Frame]++
+	if s.frames[hdr.Frame] == hdr.Count {
+		s.completeFrames++
+		delete(s.frames, hdr.Frame)
+	}
+	if hdr.Frame > s.highestFrame {
+		s.highestFrame = hdr.Frame
+	}
+
+	// Only the first fragment of every frame is used for the jitter calculation,
+	// since all fragments share the frame's timestamp.
+	if hdr.Index != 0 {
+		return
+	}
+	transit := now.Sub(time.Unix(0, hdr.SentTimeNs))
+	if s.hasLastTransit {
+		d := transit - s.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+	s.lastTransit = transit
+	s.hasLastTransit = true
+}
+
+func (s *receiverStats) report() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var loss float64
+	if s.expected > 0 {
+		loss = 100 * float64(s.expected-s.received) / float64(s.expected)
+	}
+	// Frames that are missing fragments, and that are older than the most recent frame, are considered lost.
+	var lostFrames int
+	for frame := range s.frames {
+		if frame < s.highestFrame {
+			lostFrames++
+			delete(s.frames, frame)
+		}
+	}
+	log.Printf("frames: %d complete, %d incomplete; fragments: %d received, %.2f%% lost; jitter: %s",
+		s.completeFrames, lostFrames, s.received, loss, time.Duration(s.jitter).Round(time.Microsecond))
+	s.received = 0
+	s.expected = 0
+	s.completeFrames = 0
+}
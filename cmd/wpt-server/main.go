@@ -0,0 +1,185 @@
+// Command wpt-server is a WebTransport server implementing the handlers used by the
+// WebTransport web-platform-tests (https://github.com/web-platform-tests/wpt/tree/master/webtransport).
+// It allows running the web-platform-tests against this package, in order to verify
+// interoperability with browsers.
+//
+// The following handlers are implemented:
+//
+//	/webtransport/handlers/echo.py                  echoes bidirectional streams and datagrams
+//	/webtransport/handlers/echo-request-headers.py  sends the request headers (as JSON) on a unidirectional stream
+//	/webtransport/handlers/server-close.py          closes the session right after it was established
+//	/webtransport/handlers/client-close.py?token=   echoes like echo.py, and records statistics under token
+//	/webtransport/handlers/query.py?token=          sends the statistics recorded under token (as JSON) on a unidirectional stream
+//	/webtransport/handlers/datagram-limits.py?max=  echoes datagrams up to max bytes, and drops larger datagrams
+//
+// This package implements draft-02 of WebTransport over HTTP/3, which doesn't define error codes
+// for closing a session. The code and reason parameters of server-close.py are therefore ignored.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// stats are the statistics recorded for a session by client-close.py
+type stats struct {
+	mx        sync.Mutex
+	Streams   int
+	Datagrams int
+}
+
+type server struct {
+	wt *webtransport.Server
+
+	statsMx sync.Mutex
+	stats   map[string]*stats
+}
+
+func main() {
+	addr := flag.String("addr", ":4433", "address to listen on")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS key file")
+	flag.Parse()
+	if *certFile == "" || *keyFile == "" {
+		log.Fatal("-cert and -key are required")
+	}
+
+	s := &server{stats: make(map[string]*stats)}
+	mux := http.NewServeMux()
+	s.wt = &webtransport.Server{
+		H3: http3.Server{Server: &http.Server{Addr: *addr, Handler: mux}},
+		// The tests are served from a different origin than the WebTransport server.
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	mux.HandleFunc("/webtransport/handlers/echo.py", s.upgrade(s.handleEcho))
+	mux.HandleFunc("/webtransport/handlers/echo-request-headers.py", s.upgrade(s.handleEchoRequestHeaders))
+	mux.HandleFunc("/webtransport/handlers/server-close.py", s.upgrade(s.handleServerClose))
+	mux.HandleFunc("/webtransport/handlers/client-close.py", s.upgrade(s.handleClientClose))
+	mux.HandleFunc("/webtransport/handlers/query.py", s.upgrade(s.handleQuery))
+	mux.HandleFunc("/webtransport/handlers/datagram-limits.py", s.upgrade(s.handleDatagramLimits))
+
+	log.Printf("listening on %s", *addr)
+	if err := s.wt.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *server) upgrade(handler func(*webtransport.Conn, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.wt.Upgrade(w, r)
+		if err != nil {
+			log.Printf("upgrading failed: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		go handler(conn, r)
+	}
+}
+
+// echo echoes all streams and datagrams received on the session.
+// For every stream and datagram, onStream and onDatagram are called (if set).
+// Datagrams for which accept returns false are dropped.
+func echo(conn *webtransport.Conn, onStream func(), accept func([]byte) bool) {
+	go conn.HandleMessages(context.Background(), func(b []byte) {
+		if accept != nil && !accept(b) {
+			return
+		}
+		if err := conn.SendMessage(b); err != nil {
+			log.Printf("failed to echo datagram: %s", err)
+		}
+	})
+	conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+		if onStream != nil {
+			onStream()
+		}
+		if _, err := io.Copy(str, str); err != nil {
+			log.Printf("failed to echo stream: %s", err)
+			return
+		}
+		str.Close()
+	})
+}
+
+func (s *server) handleEcho(conn *webtransport.Conn, _ *http.Request) {
+	echo(conn, nil, nil)
+}
+
+func (s *server) handleEchoRequestHeaders(conn *webtransport.Conn, r *http.Request) {
+	headers := make(map[string]string, len(r.Header))
+	for k := range r.Header {
+		headers[k] = r.Header.Get(k)
+	}
+	sendJSON(conn, headers)
+}
+
+func (s *server) handleServerClose(conn *webtransport.Conn, _ *http.Request) {
+	conn.Close()
+}
+
+func (s *server) handleClientClose(conn *webtransport.Conn, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	st := &stats{}
+	s.statsMx.Lock()
+	s.stats[token] = st
+	s.statsMx.Unlock()
+
+	echo(conn, func() {
+		st.mx.Lock()
+		st.Streams++
+		st.mx.Unlock()
+	}, func([]byte) bool {
+		st.mx.Lock()
+		st.Datagrams++
+		st.mx.Unlock()
+		return true
+	})
+}
+
+func (s *server) handleQuery(conn *webtransport.Conn, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	s.statsMx.Lock()
+	st, ok := s.stats[token]
+	s.statsMx.Unlock()
+	if !ok {
+		sendJSON(conn, nil)
+		return
+	}
+	st.mx.Lock()
+	v := map[string]int{"streams": st.Streams, "datagrams": st.Datagrams}
+	st.mx.Unlock()
+	sendJSON(conn, v)
+}
+
+func (s *server) handleDatagramLimits(conn *webtransport.Conn, r *http.Request) {
+	max, err := strconv.Atoi(r.URL.Query().Get("max"))
+	if err != nil {
+		log.Printf("invalid max parameter: %s", err)
+		conn.Close()
+		return
+	}
+	echo(conn, nil, func(b []byte) bool { return len(b) <= max })
+}
+
+// sendJSON sends v, encoded as JSON, on a new unidirectional stream.
+func sendJSON(conn *webtransport.Conn, v interface{}) {
+	str, err := conn.OpenUniStreamSync(context.Background())
+	if err != nil {
+		log.Printf("failed to open stream: %s", err)
+		return
+	}
+	if err := json.NewEncoder(str).Encode(v); err != nil {
+		log.Printf("failed to send JSON: %s", err)
+		str.CancelWrite(0)
+		return
+	}
+	str.Close()
+}
@@ -3,108 +3,879 @@ package webtransport
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/lucas-clemente/quic-go/quicvarint"
 )
 
 // sessionID is the WebTransport Session ID
 type sessionID uint64
 
+var (
+	// ErrSessionClosed matches the SessionError returned by all operations on a session after it was closed,
+	// including operations on its streams.
+	ErrSessionClosed   = errors.New("webtransport: session closed")
+	errSessionDraining = errors.New("webtransport: session draining")
+	// ErrStreamLimitReached is returned by OpenStream and OpenUniStream if the peer's stream limit
+	// doesn't allow opening a new stream (see StreamBudget).
+	// It is a temporary net.Error: OpenStreamSync and OpenUniStreamSync wait until the peer allows
+	// opening a new stream instead.
+	ErrStreamLimitReached net.Error = streamLimitError{}
+	// ErrDatagramsDisabled is returned when sending or receiving datagrams on a session that doesn't
+	// support datagrams, either because they were disabled (see Server.DisableDatagrams and
+	// Dialer.DisableDatagrams), or because the peer doesn't support them.
+	ErrDatagramsDisabled = errors.New("webtransport: datagrams disabled")
+)
+
+type streamLimitError struct{}
+
+func (streamLimitError) Error() string   { return "webtransport: stream limit reached" }
+func (streamLimitError) Temporary() bool { return true }
+func (streamLimitError) Timeout() bool   { return false }
+
+// Session is the core functionality of a WebTransport session: opening and accepting streams,
+// sending and receiving datagrams, and closing the session.
+// It is implemented by Conn, and used by the callbacks and helpers of this package.
+// Applications can use this interface to mock sessions in tests.
+// It is kept deliberately small; everything else (e.g. statistics, draining, deadlines
+// and datagram priorities) is only available on Conn.
+type Session interface {
+	AcceptStream(context.Context) (Stream, error)
+	AcceptUniStream(context.Context) (ReceiveStream, error)
+	OpenStream() (Stream, error)
+	OpenStreamSync(context.Context) (Stream, error)
+	OpenUniStream() (SendStream, error)
+	OpenUniStreamSync(context.Context) (SendStream, error)
+	HandleStreams(context.Context, func(Stream)) error
+
+	SendMessage([]byte) error
+	ReceiveMessage(context.Context) ([]byte, error)
+	HandleMessages(context.Context, func([]byte)) error
+
+	Label() string
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Context() context.Context
+	String() string
+
+	Close() error
+	CloseWithError(SessionErrorCode, string) error
+}
+
 type Conn struct {
+	// contain 64-bit values that are accessed atomically, must be the first fields
+	counters       sessionCounters
+	heartbeatAcked uint64 // the highest sequence number of the heartbeat probes answered by the peer
+	datagramStats  datagramCounters
+
 	sessionID  sessionID
-	qconn      http3.StreamCreator
-	requestStr io.Reader // TODO: this needs to be an io.ReadWriteCloser so we can close the stream
+	qconn      quic.Connection
+	requestStr io.ReadCloser
+	response   *http.Response // the response to the CONNECT request, only set for sessions dialed by a Dialer
+	// the CONNECT stream, used to send capsules
+	// only set for sessions accepted by a Server
+	connectStr   quic.Stream
+	connectStrMx sync.Mutex
+
+	peerDrainOnce  sync.Once
+	peerDraining   chan struct{} // closed when the peer sends a DRAIN_WEBTRANSPORT_SESSION capsule
+	onPeerDraining func(*Conn)
+
+	responseAcked <-chan struct{} // closed when the client acknowledged the response, only set for sessions accepted by a Server
+
+	ctx       context.Context // is closed when Close is called
+	ctxCancel context.CancelFunc
+
+	deadline *connDeadline // set using SetDeadline
+
+	closeOnce   sync.Once
+	closeErr    error
+	closeReason string        // set before ctx is cancelled by Close or CloseGracefully
+	sessionErr  *SessionError // set before ctx is cancelled by Close, CloseWithError or CloseGracefully
+
+	panicHandler PanicHandler
+	metrics      *metricsTracer
+	logger       *logger // nil if no LogConfig was set
+	tracer       Tracer  // may be nil
 
-	acceptMx   sync.Mutex
-	acceptChan chan struct{}
-	// Contains all the streams waiting to be accepted.
-	// There's no explicit limit to the length of the queue, but it is implicitly
+	// tracks the go routines started for this session
+	// nil if the session wasn't accepted by a Server
+	refCount *refCounter
+
+	// profiler labels for the go routines started for this session, see setProfilerLabels
+	profLabels   pprof.LabelSet
+	profLabelCtx context.Context
+	// limits the number of concurrently running stream handlers, shared between all sessions
+	// nil if there's no limit
+	handlerSem chan struct{}
+
+	drainMx  sync.Mutex
+	draining bool
+
+	// the streams opened and accepted on this session
+	streams *streamTracker
+
+	acceptMx      sync.Mutex
+	acceptChan    chan struct{}
+	acceptUniChan chan struct{}
+	// Contain all the bidirectional and unidirectional streams waiting to be accepted.
+	// There's no explicit limit to the length of the queues, but they are implicitly
 	// limited by the stream flow control provided by QUIC.
-	acceptQueue []quic.Stream
+	acceptQueue    streamQueue
+	acceptUniQueue streamQueue
+
+	senderOnce sync.Once
+	sender     *datagramSender // used by SendMessageWithPriority, created lazily
+
+	// set if datagrams were disabled locally, or if the peer doesn't support them
+	datagramsDisabled bool
+	// the maximum number of bytes held in the accept queue and the datagram queue, 0 means no limit
+	memoryLimit int
+
+	// schedules datagrams and stream opens among the sessions on the QUIC connection
+	// nil if fair scheduling is disabled
+	scheduler *connScheduler
+	weight    int32 // accessed atomically, see SetSchedulingWeight
+
+	limiter tokenBucket // see SetBandwidthLimit
+	// limits the bandwidth used by the sessions on the QUIC connection, nil if there's no limit
+	shaper *connShaper
+	// prioritizes writes on the CONNECT streams of the sessions on the QUIC connection,
+	// nil if CONNECT streams are not prioritized
+	priority *priorityGate
+
+	datagramMx   sync.Mutex
+	datagramChan chan struct{}
+	// Contains all the datagrams waiting to be received.
+	// Datagrams are dropped when the queue is full.
+	datagramQueue datagramQueue
+
+	// the stream headers are the same for all streams of this session
+	streamHdr    []byte
+	uniStreamHdr []byte
+
+	valuesMx sync.Mutex
+	values   map[interface{}]interface{}
+	label    string
+	// routingToken is an application-defined token, used to route reconnections to the same backend
+	routingToken string
+	// the token to resume this session, and the session this session resumes
+	resumptionToken string
+	resumedSession  string
+	resumed         bool
+
+	stringOnce sync.Once
+	str        string // returned by String
 }
 
-func newConn(sessionID sessionID, qconn http3.StreamCreator, requestStr io.Reader) *Conn {
+var _ Session = &Conn{}
+
+func newConn(sessionID sessionID, qconn quic.Connection, requestStr io.ReadCloser) *Conn {
 	c := &Conn{
-		sessionID:  sessionID,
-		qconn:      qconn,
-		requestStr: requestStr,
-		acceptChan: make(chan struct{}, 1),
+		sessionID:     sessionID,
+		qconn:         qconn,
+		requestStr:    requestStr,
+		acceptChan:    make(chan struct{}, 1),
+		acceptUniChan: make(chan struct{}, 1),
+		datagramChan:  make(chan struct{}, 1),
+		peerDraining:  make(chan struct{}),
+		streams:       newStreamTracker(),
+		deadline:      newConnDeadline(),
+		profLabelCtx:  context.Background(),
 	}
+	c.streamHdr = streamHeader(sessionID, webTransportFrameType)
+	c.uniStreamHdr = streamHeader(sessionID, webTransportUniStreamType)
+	c.ctx, c.ctxCancel = context.WithCancel(context.Background())
 	return c
 }
 
 func (c *Conn) addStream(str quic.Stream) {
+	if c.addIncomingStream(incomingStream{ReceiveStream: str, bidi: true}) {
+		c.streamDelivered(str.StreamID(), 0)
+	}
+}
+
+// addIncomingStream adds a stream to the accept queue for its direction, and reports whether it was added.
+// The session manager calls it with its lock held, so it doesn't call the tracer: that's up to the caller,
+// using streamDelivered, once the lock was released.
+func (c *Conn) addIncomingStream(str incomingStream) bool {
+	if c.isDraining() {
+		str.reject(requestRejectedErrorCode)
+		c.logf(LogLevelDebug, "rejected stream %d, session is draining", str.StreamID())
+		return false
+	}
+
 	c.acceptMx.Lock()
 	defer c.acceptMx.Unlock()
 
-	c.acceptQueue = append(c.acceptQueue, str)
+	// The accept queues are emptied when the session is closed (see resetStreams).
+	if c.ctx.Err() != nil {
+		str.reject(WebTransportSessionGoneErrorCode)
+		return false
+	}
+	if !c.reserveMemory(streamMemoryCost) {
+		atomic.AddUint64(&c.counters.memoryRejectedStreams, 1)
+		str.reject(WebTransportBufferedStreamRejectedErrorCode)
+		c.logf(LogLevelDebug, "rejected stream %d, memory limit exceeded", str.StreamID())
+		return false
+	}
+	queue, notify := &c.acceptQueue, c.acceptChan
+	if !str.bidi {
+		queue, notify = &c.acceptUniQueue, c.acceptUniChan
+	}
+	queue.Push(str.ReceiveStream)
 	select {
-	case c.acceptChan <- struct{}{}:
+	case notify <- struct{}{}:
 	default:
 	}
+	return true
+}
+
+// streamDelivered notifies the tracer that a stream was added to the accept queue.
+// buffered is the time the stream waited for the session to be established.
+func (c *Conn) streamDelivered(id quic.StreamID, buffered time.Duration) {
+	if c.tracer != nil {
+		c.tracer.StreamDelivered(c, id, buffered)
+	}
+}
+
+func (c *Conn) addDatagram(b []byte, info MessageInfo) {
+	c.datagramMx.Lock()
+	// The receive queue is emptied when the session is closed (see resetStreams).
+	if c.ctx.Err() != nil {
+		c.datagramMx.Unlock()
+		return
+	}
+	if !c.reserveMemory(len(b)) {
+		c.datagramMx.Unlock()
+		atomic.AddUint64(&c.counters.memoryDroppedDatagrams, 1)
+		c.logger.Sampledf(LogComponentConn, LogLevelDebug, "datagram memory limit", "[%s] dropped datagram, memory limit exceeded", c)
+		if c.tracer != nil {
+			c.tracer.DatagramDropped(c.qconn, DatagramDropMemoryLimit)
+		}
+		return
+	}
+	ok := c.datagramQueue.Push(receivedDatagram{data: b, info: info})
+	if !ok {
+		c.releaseMemory(len(b))
+	}
+	c.datagramMx.Unlock()
+
+	if !ok {
+		c.logger.Sampledf(LogComponentConn, LogLevelDebug, "datagram queue full", "[%s] dropped datagram, receive queue full", c)
+		if c.tracer != nil {
+			c.tracer.DatagramDropped(c.qconn, DatagramDropQueueFull)
+		}
+		return
+	}
+	atomic.AddUint64(&c.datagramStats.received, 1)
+	countBytes(&c.counters.bytesReceived, len(b))
+	if c.tracer != nil {
+		c.tracer.DatagramReceived(c, len(b))
+	}
+	select {
+	case c.datagramChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetValue associates val with key on this connection.
+// This allows middleware (e.g. for authentication or tracing) to attach data to a session,
+// which can then be retrieved using Value by the code handling the session's streams.
+// Setting a nil value removes the key.
+func (c *Conn) SetValue(key, val interface{}) {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	if val == nil {
+		delete(c.values, key)
+		return
+	}
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = val
+}
+
+// Value returns the value associated with key, or nil if no value is associated with key.
+func (c *Conn) Value(key interface{}) interface{} {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	return c.values[key]
+}
+
+// SetLabel assigns a label to this connection.
+// Labels are chosen by the application (e.g. a user or tenant ID),
+// and can be used to look up sessions using Server.SessionsByLabel.
+func (c *Conn) SetLabel(label string) {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	c.label = label
+}
+
+// Label returns the label assigned using SetLabel.
+func (c *Conn) Label() string {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	return c.label
+}
+
+// Drain puts the session into draining state.
+// A draining session doesn't accept any new streams: streams opened by the peer are reset
+// with the H3_REQUEST_REJECTED error code, telling the peer that it can retry them on a new session.
+// OpenStream / OpenStreamSync return an error.
+// Streams that were already opened or accepted are not affected.
+// On the server side, a DRAIN_WEBTRANSPORT_SESSION capsule is sent to the client (see PeerDraining).
+// Since quic-go's http3.Server closes the CONNECT stream once the handler returns, the capsule
+// is only sent if the handler that called Upgrade is still running.
+// It is the application's responsibility to Close the session once it's done.
+func (c *Conn) Drain() {
+	c.drainMx.Lock()
+	wasDraining := c.draining
+	c.draining = true
+	c.drainMx.Unlock()
+
+	if !wasDraining && c.ctx.Err() == nil {
+		c.sendDrainCapsule()
+	}
+}
+
+// Draining says if the session is in draining state.
+func (c *Conn) Draining() bool {
+	return c.isDraining()
+}
+
+// canOpenStream returns an error if no new streams can be opened,
+// because the session was closed or is draining.
+func (c *Conn) canOpenStream() error {
+	if c.ctx.Err() != nil {
+		return c.sessionError()
+	}
+	if c.isDraining() {
+		return errSessionDraining
+	}
+	return nil
+}
+
+// openStreamError returns a SessionError if opening a stream failed because the session was closed,
+// os.ErrDeadlineExceeded if the deadline set using SetDeadline expired,
+// and ErrStreamLimitReached if it failed because of the peer's stream limit.
+func (c *Conn) openStreamError(err error) error {
+	if c.ctx.Err() != nil {
+		return c.sessionError()
+	}
+	if err := c.deadlineError(); err != nil {
+		return err
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+		return ErrStreamLimitReached
+	}
+	return err
+}
+
+// withSessionContext returns a context that is cancelled when either ctx or the session's context is done,
+// or when the deadline set using SetDeadline expires.
+func (c *Conn) withSessionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	deadline := c.deadline.wait()
+	c.goLabeled(func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-deadline:
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+	return ctx, cancel
+}
+
+func (c *Conn) isDraining() bool {
+	c.drainMx.Lock()
+	defer c.drainMx.Unlock()
+
+	return c.draining
+}
+
+// isClosed says if the session or the underlying QUIC connection was closed.
+func (c *Conn) isClosed() bool {
+	return c.ctx.Err() != nil || c.qconn.Context().Err() != nil
+}
+
+// sessionError returns the error returned by operations on the closed session.
+// If the session itself wasn't closed, the QUIC connection was.
+func (c *Conn) sessionError() error {
+	if c.ctx.Err() != nil {
+		if c.sessionErr != nil {
+			return c.sessionErr
+		}
+		return &SessionError{}
+	}
+	return connClosedError(c.qconn)
+}
+
+// connClosedError returns the SessionError for a session whose QUIC connection was closed.
+func connClosedError(qconn quic.Connection) *SessionError {
+	sessErr := &SessionError{Message: "QUIC connection closed"}
+	if err := connCloseError(qconn); err != nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) {
+			sessErr.Remote = appErr.Remote
+		}
+		sessErr.Message += ": " + err.Error()
+	}
+	return sessErr
+}
+
+// closedError returns the error returned by stream operations: a SessionError if the session
+// or the QUIC connection was closed, and nil otherwise.
+func (c *Conn) closedError() error {
+	if !c.isClosed() {
+		return nil
+	}
+	return c.sessionError()
 }
 
 // Context returns a context that is closed when the connection is closed.
+// Sessions accepted by a Server are also closed when the underlying QUIC connection is closed,
+// and when the client cancels the CONNECT request.
 func (c *Conn) Context() context.Context {
-	return context.Background() // TODO: fix
+	return c.ctx
 }
 
+// AcceptStream accepts the next bidirectional stream opened by the peer.
+// Streams are returned in the order their stream headers were processed. This also applies to streams
+// that were received before the session was established, and were buffered until then
+// (see StreamReorderingTimeout). Stream.StreamID can be used to verify the order the peer opened them in.
 func (c *Conn) AcceptStream(ctx context.Context) (Stream, error) {
-	var str quic.Stream
-	c.acceptMx.Lock()
-	if len(c.acceptQueue) > 0 {
-		str = c.acceptQueue[0]
-		c.acceptQueue = c.acceptQueue[1:]
+	if c.ctx.Err() != nil {
+		return nil, c.sessionError()
 	}
+	c.acceptMx.Lock()
+	s := c.acceptQueue.Pop()
 	c.acceptMx.Unlock()
-	if str != nil {
-		return &stream{str}, nil
+	if s != nil {
+		c.consumed(streamMemoryCost)
+		str := s.(quic.Stream)
+		return c.trackStream(newStream(str, nil), str, true), nil
+	}
+	deadline := c.deadline.wait()
+	if isClosedChan(deadline) {
+		return nil, os.ErrDeadlineExceeded
 	}
 
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.sessionError()
+	case <-deadline:
+		return nil, os.ErrDeadlineExceeded
 	case <-c.acceptChan:
 		return c.AcceptStream(ctx)
 	}
 }
 
+// AcceptUniStream accepts a unidirectional stream opened by the peer.
+func (c *Conn) AcceptUniStream(ctx context.Context) (ReceiveStream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.sessionError()
+	}
+	c.acceptMx.Lock()
+	str := c.acceptUniQueue.Pop()
+	c.acceptMx.Unlock()
+	if str != nil {
+		c.consumed(streamMemoryCost)
+		return c.trackReceiveStream(&receiveStream{str: str}, str), nil
+	}
+	deadline := c.deadline.wait()
+	if isClosedChan(deadline) {
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.sessionError()
+	case <-deadline:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.acceptUniChan:
+		return c.AcceptUniStream(ctx)
+	}
+}
+
+// OpenStream opens a new bidirectional stream.
+// If the peer's stream limit doesn't allow opening a new stream, it returns ErrStreamLimitReached.
 func (c *Conn) OpenStream() (Stream, error) {
+	if err := c.canOpenStream(); err != nil {
+		return nil, err
+	}
 	str, err := c.qconn.OpenStream()
 	if err != nil {
+		return nil, c.openStreamError(err)
+	}
+	c.trackOpenedStream(str.StreamID())
+	return c.trackStream(newStream(str, c.streamHdr), str, false), nil
+}
+
+// OpenStreamSync opens a new bidirectional stream.
+// It blocks until the peer's stream limit allows opening a new stream.
+func (c *Conn) OpenStreamSync(ctx context.Context) (Stream, error) {
+	if err := c.canOpenStream(); err != nil {
 		return nil, err
 	}
-	if err := c.writeStreamHeader(str); err != nil {
+	if err := c.deadlineError(); err != nil {
 		return nil, err
 	}
-	return &stream{str: str}, nil
+	ctx, cancel := c.withSessionContext(ctx)
+	defer cancel()
+	if c.scheduler != nil {
+		if err := c.scheduler.bidiOpens.acquire(ctx, c); err != nil {
+			return nil, c.openStreamError(err)
+		}
+		defer c.scheduler.bidiOpens.release()
+	}
+	str, err := c.qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, c.openStreamError(err)
+	}
+	c.trackOpenedStream(str.StreamID())
+	return c.trackStream(newStream(str, c.streamHdr), str, false), nil
 }
 
-func (c *Conn) OpenStreamSync(ctx context.Context) (Stream, error) {
-	str, err := c.qconn.OpenStreamSync(ctx)
+// OpenUniStream opens a new unidirectional stream.
+// If the peer's stream limit doesn't allow opening a new stream, it returns ErrStreamLimitReached.
+func (c *Conn) OpenUniStream() (SendStream, error) {
+	if err := c.canOpenStream(); err != nil {
+		return nil, err
+	}
+	str, err := c.qconn.OpenUniStream()
 	if err != nil {
+		return nil, c.openStreamError(err)
+	}
+	c.trackOpenedStream(str.StreamID())
+	return c.trackSendStream(newSendStream(str, c.uniStreamHdr), str), nil
+}
+
+// OpenUniStreamSync opens a new unidirectional stream.
+// It blocks until the peer's stream limit allows opening a new stream.
+func (c *Conn) OpenUniStreamSync(ctx context.Context) (SendStream, error) {
+	if err := c.canOpenStream(); err != nil {
 		return nil, err
 	}
-	// TODO: this should probably respect the context
-	if err := c.writeStreamHeader(str); err != nil {
+	if err := c.deadlineError(); err != nil {
 		return nil, err
 	}
-	return &stream{str: str}, nil
+	ctx, cancel := c.withSessionContext(ctx)
+	defer cancel()
+	if c.scheduler != nil {
+		if err := c.scheduler.uniOpens.acquire(ctx, c); err != nil {
+			return nil, c.openStreamError(err)
+		}
+		defer c.scheduler.uniOpens.release()
+	}
+	str, err := c.qconn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, c.openStreamError(err)
+	}
+	c.trackOpenedStream(str.StreamID())
+	return c.trackSendStream(newSendStream(str, c.uniStreamHdr), str), nil
+}
+
+// streamHeader returns the stream header.
+// For bidirectional streams, that's the WEBTRANSPORT_STREAM frame type,
+// for unidirectional streams the WebTransport stream type, followed by the session ID.
+func streamHeader(id sessionID, typ uint64) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 10)) // 2 bytes for the frame / stream type, up to 8 bytes for the session ID
+	quicvarint.Write(buf, typ)
+	quicvarint.Write(buf, uint64(id))
+	return buf.Bytes()
+}
+
+// datagramBufPool holds the buffers used to serialize outgoing datagrams.
+// quic-go copies the datagram when it is sent, so the buffer can be reused right away.
+var datagramBufPool = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
 }
 
-func (c *Conn) writeStreamHeader(str quic.Stream) error {
-	buf := bytes.NewBuffer(make([]byte, 0, 9)) // 1 byte for the frame type, up to 8 bytes for the session ID
-	quicvarint.Write(buf, webTransportFrameType)
-	quicvarint.Write(buf, uint64(c.sessionID))
-	_, err := str.Write(buf.Bytes())
+// SendMessage sends a datagram on this session.
+// It blocks until the datagram has been queued for sending.
+func (c *Conn) SendMessage(b []byte) error {
+	if c.ctx.Err() != nil {
+		return c.sessionError()
+	}
+	if c.datagramsDisabled {
+		return ErrDatagramsDisabled
+	}
+	if err := c.deadlineError(); err != nil {
+		return err
+	}
+	buf := c.packDatagram(b)
+	err := c.sendDatagram(buf.Bytes())
+	datagramBufPool.Put(buf)
 	return err
 }
 
+// SendMessageSync is an alias for SendMessageContext.
+//
+// Deprecated: Use SendMessageContext instead.
+func (c *Conn) SendMessageSync(ctx context.Context, b []byte) error {
+	return c.SendMessageContext(ctx, b)
+}
+
+// SendMessageContext sends a datagram on this session, like SendMessage.
+// quic-go only holds a single datagram in its send queue, so it blocks until the previous datagram
+// has been dequeued for sending. This allows the application to pace itself to the rate at which
+// datagrams can actually be sent.
+// SendMessageContext stops waiting when ctx is canceled, returning ctx.Err(), or when the session or
+// the QUIC connection is closed, returning a SessionError. Note that quic-go doesn't allow taking back
+// a datagram, so once it has been handed to QUIC, it might still be sent after SendMessageContext returned.
+func (c *Conn) SendMessageContext(ctx context.Context, b []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.isClosed() {
+		return c.sessionError()
+	}
+	if c.datagramsDisabled {
+		return ErrDatagramsDisabled
+	}
+	deadline := c.deadline.wait()
+	if isClosedChan(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	buf := c.packDatagram(b)
+	done := make(chan error, 1)
+	c.goLabeled(func() {
+		err := c.sendDatagram(buf.Bytes())
+		datagramBufPool.Put(buf)
+		done <- err
+	})
+	select {
+	case err := <-done:
+		if err != nil && c.isClosed() {
+			return c.sessionError()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return c.sessionError()
+	case <-c.qconn.Context().Done():
+		return c.sessionError()
+	case <-deadline:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// SendMessageWithPriority queues a datagram for sending on this session, and returns immediately.
+// Queued datagrams are handed to QUIC highest priority first. When the connection is congested,
+// high-priority datagrams therefore preempt low-priority datagrams that are still queued.
+// Datagrams sent using SendMessage or SendMessageContext bypass this queue.
+// If too many datagrams of the same priority are queued, the oldest one is dropped.
+// Since sending happens asynchronously, errors (e.g. datagrams that are too large) are not reported.
+func (c *Conn) SendMessageWithPriority(b []byte, prio MessagePriority) error {
+	return c.queueMessage(b, prio, time.Time{})
+}
+
+// SendMessageWithTTL queues a datagram for sending on this session, and returns immediately.
+// If the datagram can't be handed to QUIC within maxAge, e.g. because the connection is congested,
+// it is dropped, since stale real-time data is often worse than no data.
+// Once handed to QUIC, the datagram is sent, no matter how old it is.
+// A non-positive maxAge means that the datagram doesn't expire.
+// The datagram is queued with MessagePriorityNormal, see SendMessageWithPriority.
+func (c *Conn) SendMessageWithTTL(b []byte, maxAge time.Duration) error {
+	var deadline time.Time
+	if maxAge > 0 {
+		deadline = time.Now().Add(maxAge)
+	}
+	return c.queueMessage(b, MessagePriorityNormal, deadline)
+}
+
+func (c *Conn) queueMessage(b []byte, prio MessagePriority, deadline time.Time) error {
+	if c.ctx.Err() != nil {
+		return c.sessionError()
+	}
+	if c.datagramsDisabled {
+		return ErrDatagramsDisabled
+	}
+	c.datagramSender().Queue(c.packDatagram(b), prio, deadline)
+	return nil
+}
+
+func (c *Conn) datagramSender() *datagramSender {
+	c.senderOnce.Do(func() {
+		c.sender = newDatagramSender(pprof.WithLabels(c.ctx, c.profLabels), c.sendDatagram)
+	})
+	return c.sender
+}
+
+// DatagramSendQueueLen returns the number of datagrams queued using SendMessageWithPriority and
+// SendMessageWithTTL (across all priorities) that have not been handed to QUIC yet.
+// Senders can use it to pace themselves, instead of filling up the queue and having datagrams dropped.
+func (c *Conn) DatagramSendQueueLen() int {
+	return c.datagramSender().Len()
+}
+
+// DatagramSendQueueCap returns the number of datagrams that can be queued per priority.
+// Once the queue for a priority is full, queueing another datagram drops the oldest one.
+func (c *Conn) DatagramSendQueueCap() int {
+	return maxSendQueueLen
+}
+
+// DatagramSendQueueDrained returns a channel that is closed once no more than threshold datagrams
+// are queued (see DatagramSendQueueLen). If that's already the case, the channel is closed immediately.
+// When the session is closed, the queue is cleared, and the channel is closed as well.
+func (c *Conn) DatagramSendQueueDrained(threshold int) <-chan struct{} {
+	return c.datagramSender().NotifyDrained(threshold)
+}
+
+// sendDatagram sends a serialized datagram, and counts it if successful.
+func (c *Conn) sendDatagram(b []byte) error {
+	return c.sendTrackedDatagram(b, nil)
+}
+
+// sendTrackedDatagram sends a serialized datagram, and counts it if successful.
+// If result is not nil, it receives the delivery status of the datagram.
+func (c *Conn) sendTrackedDatagram(b []byte, result chan<- DatagramResult) error {
+	if err := c.shape(c.ctx, len(b)); err != nil {
+		return c.sessionError()
+	}
+	if c.scheduler != nil {
+		if err := c.scheduler.datagrams.acquire(c.ctx, c); err != nil {
+			return c.sessionError()
+		}
+		defer c.scheduler.datagrams.release()
+	}
+	if err := c.sendMessage(b, result); err != nil {
+		return err
+	}
+	size := len(b) - int(quicvarint.Len(uint64(c.sessionID)/4))
+	atomic.AddUint64(&c.datagramStats.sent, 1)
+	countBytes(&c.counters.bytesSent, size)
+	if c.tracer != nil {
+		c.tracer.DatagramSent(c, size)
+	}
+	return nil
+}
+
+// packDatagram serializes a datagram into a buffer from the datagramBufPool.
+func (c *Conn) packDatagram(b []byte) *bytes.Buffer {
+	qsid := uint64(c.sessionID) / 4 // the Quarter Stream ID
+	buf := datagramBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	quicvarint.Write(buf, qsid)
+	buf.Write(b)
+	return buf
+}
+
+// ReceiveMessage returns the next datagram received on this session.
+func (c *Conn) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	b, _, err := c.ReceiveMessageWithInfo(ctx)
+	return b, err
+}
+
+// MessageInfo contains information about a received datagram.
+type MessageInfo struct {
+	// ReceiveTime is the time when the datagram was received from the QUIC connection.
+	// quic-go doesn't expose when the packet carrying the datagram was read from the socket,
+	// so this doesn't include the time the packet spent in quic-go's receive path.
+	// Kernel receive timestamps are not available.
+	ReceiveTime time.Time
+}
+
+// ReceiveMessageWithInfo returns the next datagram received on this session,
+// together with information about its reception.
+func (c *Conn) ReceiveMessageWithInfo(ctx context.Context) ([]byte, MessageInfo, error) {
+	if c.ctx.Err() != nil {
+		return nil, MessageInfo{}, c.sessionError()
+	}
+	if c.datagramsDisabled {
+		return nil, MessageInfo{}, ErrDatagramsDisabled
+	}
+	c.datagramMx.Lock()
+	if c.datagramQueue.Len() > 0 {
+		d := c.datagramQueue.Pop()
+		c.datagramMx.Unlock()
+		c.consumed(len(d.data))
+		return d.data, d.info, nil
+	}
+	c.datagramMx.Unlock()
+	deadline := c.deadline.wait()
+	if isClosedChan(deadline) {
+		return nil, MessageInfo{}, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, MessageInfo{}, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, MessageInfo{}, c.sessionError()
+	case <-deadline:
+		return nil, MessageInfo{}, os.ErrDeadlineExceeded
+	case <-c.datagramChan:
+		return c.ReceiveMessageWithInfo(ctx)
+	}
+}
+
+// PathInfo describes a network path used by a session.
+type PathInfo struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// BandwidthEstimate returns the current bandwidth estimate of the underlying QUIC connection.
+// It returns false if no estimate is available (yet).
+func (c *Conn) BandwidthEstimate() (BandwidthEstimate, bool) {
+	if c.metrics == nil {
+		return BandwidthEstimate{}, false
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return BandwidthEstimate{}, false
+	}
+	return m.BandwidthEstimate()
+}
+
+// ECNCounts returns the ECN counts most recently reported by the peer.
+// It returns false if the peer hasn't reported any ECN feedback, which is the case
+// if the network path (or the sender) doesn't support ECN.
+// Note that quic-go currently doesn't mark outgoing packets as ECN-capable,
+// so ECN feedback is only expected from peers that do.
+func (c *Conn) ECNCounts() (ECNCounts, bool) {
+	if c.metrics == nil {
+		return ECNCounts{}, false
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return ECNCounts{}, false
+	}
+	return m.ECNCounts()
+}
+
+// Paths returns the network paths used by the underlying QUIC connection.
+// quic-go doesn't support multipath QUIC (yet), so this currently always returns a single path,
+// which is the same as the path described by LocalAddr and RemoteAddr.
+// Applications that want to be prepared for multipath support should use this method
+// instead of assuming a single path.
+func (c *Conn) Paths() []PathInfo {
+	return []PathInfo{{LocalAddr: c.LocalAddr(), RemoteAddr: c.RemoteAddr()}}
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.qconn.LocalAddr()
 }
@@ -113,6 +884,194 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.qconn.RemoteAddr()
 }
 
+// String returns a human-readable identifier for this session, for use in logs.
+// It contains the peer's address, the session ID and a short identifier of the QUIC connection,
+// which is shared by all sessions established on the same QUIC connection.
+// The identifier doesn't change over the lifetime of the session.
+// It is assigned by this process, and is not a QUIC connection ID: the peer and load balancers
+// don't know about it. Use QUICConnectionIDs to get the connection IDs used on the wire.
+func (c *Conn) String() string {
+	c.stringOnce.Do(func() {
+		if c.qconn == nil {
+			c.str = fmt.Sprintf("session %d", c.sessionID)
+			return
+		}
+		c.str = sessionString(c.qconn, c.sessionID)
+	})
+	return c.str
+}
+
+// Response returns the response to the extended CONNECT request that established this session.
+// It allows clients to read headers set by the server, e.g. session tokens.
+// It returns nil for sessions accepted by a Server.
+//
+// HTTP trailers are not supported: the HTTP/3 implementation neither sends nor parses trailers,
+// so Trailer is always empty.
+func (c *Conn) Response() *http.Response {
+	return c.response
+}
+
+// connCloseError returns the error that the QUIC connection was closed with, or nil if it isn't closed.
+// quic-go doesn't expose this error directly. It records it before cancelling the connection's context,
+// and returns it from all stream operations from then on. Accepting a stream with a cancelled context
+// returns it right away, without opening or accepting a stream.
+func connCloseError(qconn quic.Connection) error {
+	select {
+	case <-qconn.Context().Done():
+	default:
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := qconn.AcceptUniStream(ctx)
+	return err
+}
+
+// logf logs a message about this session, prefixed with the session identifier.
+func (c *Conn) logf(lvl LogLevel, format string, args ...interface{}) {
+	if !c.logger.Enabled(LogComponentConn, lvl) {
+		return
+	}
+	c.logger.Logf(LogComponentConn, lvl, "[%s] "+format, append([]interface{}{c}, args...)...)
+}
+
+// Close closes the WebTransport session.
+// The session's context is cancelled, and the request stream is closed.
+// Streams that are still open, including streams that were not accepted yet, are reset with
+// WebTransportSessionGoneErrorCode, and datagrams that were not received yet are dropped.
+// It is safe to call Close (and CloseGracefully) multiple times, and from multiple go routines:
+// Only the first call closes the session, all calls return the same result.
+// Once the session is closed, opening, accepting, sending and receiving return a SessionError
+// (which matches ErrSessionClosed), on the session as well as on its streams.
 func (c *Conn) Close() error {
-	return nil
+	return c.CloseWithError(0, "")
+}
+
+// CloseWithError closes the session like Close, with an application error code and message.
+// Sessions accepted by a Server send them to the client in a CLOSE_WEBTRANSPORT_SESSION capsule,
+// while the handler that called Upgrade is still running (quic-go closes the CONNECT stream once the handler returns).
+// The client then returns a SessionError with Remote set, carrying the code and the message.
+func (c *Conn) CloseWithError(code SessionErrorCode, msg string) error {
+	return c.closeWithReason(&SessionError{ErrorCode: code, Message: msg}, "closed")
+}
+
+// closeWithReason closes the session with the given error, recording the reason for the access and audit logs.
+// Unless the session was closed by the peer, the error is sent to the peer in a CLOSE_WEBTRANSPORT_SESSION capsule.
+func (c *Conn) closeWithReason(sessErr *SessionError, reason string) error {
+	c.closeOnce.Do(func() {
+		if !sessErr.Remote {
+			c.sendCloseCapsule(sessErr.ErrorCode, sessErr.Message)
+		}
+		c.closeReason = reason
+		c.sessionErr = sessErr
+		c.ctxCancel()
+		c.closeErr = c.requestStr.Close()
+	})
+	c.resetStreams()
+	return c.closeErr
+}
+
+// CloseGracefully closes the WebTransport session, after giving streams the chance to finish.
+// It puts the session into draining state (see Drain), and waits until all streams that were
+// opened or accepted are done (i.e. closed or reset in both directions), or until ctx is done.
+// Then the session is closed the same way as by Close: the session's context is cancelled,
+// the request stream is closed, which signals the peer that the session was closed,
+// and streams that are still open are reset.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	c.Drain()
+	for c.streams.Len() > 0 {
+		select {
+		case <-ctx.Done():
+		case <-c.ctx.Done():
+		case <-c.streams.doneChan:
+			continue
+		}
+		break
+	}
+	return c.closeWithReason(&SessionError{}, "closed gracefully")
+}
+
+// resetStreams resets the streams that are still associated with the closed session, such that they
+// don't hold on to the QUIC connection's flow control windows, and drops the received datagrams.
+// It must only be called after the session's context was cancelled.
+func (c *Conn) resetStreams() {
+	c.acceptMx.Lock()
+	var pending []incomingStream
+	for c.acceptQueue.Len() > 0 {
+		pending = append(pending, incomingStream{ReceiveStream: c.acceptQueue.Pop(), bidi: true})
+	}
+	for c.acceptUniQueue.Len() > 0 {
+		pending = append(pending, incomingStream{ReceiveStream: c.acceptUniQueue.Pop()})
+	}
+	c.acceptMx.Unlock()
+	for _, str := range pending {
+		c.releaseMemory(streamMemoryCost)
+		str.reject(WebTransportSessionGoneErrorCode)
+	}
+	c.streams.ResetAll(WebTransportSessionGoneErrorCode)
+
+	c.datagramMx.Lock()
+	for c.datagramQueue.Len() > 0 {
+		c.releaseMemory(len(c.datagramQueue.Pop().data))
+	}
+	c.datagramQueue = datagramQueue{}
+	c.datagramMx.Unlock()
+}
+
+// trackStream sets up counting, tracing and tracking (for CloseGracefully) of a bidirectional stream.
+func (c *Conn) trackStream(s *stream, str quic.Stream, accepted bool) *stream {
+	if accepted {
+		atomic.AddUint64(&c.counters.streamsAccepted, 1)
+	} else {
+		atomic.AddUint64(&c.counters.streamsOpened, 1)
+	}
+	s.sendStream.bytesSent = &c.counters.bytesSent
+	s.receiveStream.bytesReceived = &c.counters.bytesReceived
+	s.sendStream.sessionErr = c.closedError
+	s.sendStream.shape = c.shapeStream
+	s.receiveStream.sessionErr = c.closedError
+	if c.tracer != nil {
+		id := str.StreamID()
+		if accepted {
+			c.tracer.StreamAccepted(c, id)
+		} else {
+			c.tracer.StreamOpened(c, id, true)
+		}
+		onReset := func(code ErrorCode, remote bool) { c.tracer.StreamReset(c, id, code, remote) }
+		s.sendStream.onReset = onReset
+		s.receiveStream.onReset = onReset
+	}
+	c.streams.TrackStream(s, str)
+	c.trackStalls(&s.sendStream, str.StreamID())
+	return s
+}
+
+// trackSendStream sets up counting, tracing and tracking (for CloseGracefully) of a unidirectional stream.
+func (c *Conn) trackSendStream(s *sendStream, str quic.SendStream) *sendStream {
+	atomic.AddUint64(&c.counters.streamsOpened, 1)
+	s.bytesSent = &c.counters.bytesSent
+	s.sessionErr = c.closedError
+	s.shape = c.shapeStream
+	if c.tracer != nil {
+		id := str.StreamID()
+		c.tracer.StreamOpened(c, id, false)
+		s.onReset = func(code ErrorCode, remote bool) { c.tracer.StreamReset(c, id, code, remote) }
+	}
+	c.streams.TrackSendStream(s, str)
+	c.trackStalls(s, str.StreamID())
+	return s
+}
+
+// trackReceiveStream sets up counting, tracing and tracking (for CloseGracefully) of an accepted unidirectional stream.
+func (c *Conn) trackReceiveStream(s *receiveStream, str quic.ReceiveStream) *receiveStream {
+	atomic.AddUint64(&c.counters.streamsAccepted, 1)
+	s.bytesReceived = &c.counters.bytesReceived
+	s.sessionErr = c.closedError
+	if c.tracer != nil {
+		id := str.StreamID()
+		c.tracer.StreamAccepted(c, id)
+		s.onReset = func(code ErrorCode, remote bool) { c.tracer.StreamReset(c, id, code, remote) }
+	}
+	c.streams.TrackReceiveStream(s, str)
+	return s
 }
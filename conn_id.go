@@ -0,0 +1,60 @@
+package webtransport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// quic-go doesn't expose the QUIC connection ID.
+// Instead, we assign a short random identifier to every QUIC connection the first time it is needed.
+// All sessions established on the same QUIC connection share this identifier, which makes it possible
+// to correlate them in logs. It is local to this process: it is not the connection ID used on the wire,
+// and the peer doesn't know about it.
+var connIDs = struct {
+	mx sync.Mutex
+	m  map[quic.Connection]string
+	// swept is the number of identifiers that were left after the last sweep (see sweepConnectionIDs)
+	swept int
+}{m: make(map[quic.Connection]string)}
+
+// connectionID returns the local identifier assigned to a QUIC connection.
+// The identifier is forgotten once the QUIC connection is closed: the session manager forgets the identifiers
+// of the connections it handles (see forgetConnectionID), and identifiers of other connections are swept
+// once the number of identifiers doubled.
+func connectionID(qconn quic.Connection) string {
+	connIDs.mx.Lock()
+	defer connIDs.mx.Unlock()
+
+	if id, ok := connIDs.m[qconn]; ok {
+		return id
+	}
+	var b [4]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	connIDs.m[qconn] = id
+	if len(connIDs.m) >= 2*connIDs.swept {
+		sweepConnectionIDs()
+	}
+	return id
+}
+
+// sweepConnectionIDs forgets the identifiers of closed QUIC connections.
+// connIDs.mx must be held.
+func sweepConnectionIDs() {
+	for qconn := range connIDs.m {
+		if qconn.Context().Err() != nil {
+			delete(connIDs.m, qconn)
+		}
+	}
+	connIDs.swept = len(connIDs.m)
+}
+
+// forgetConnectionID forgets the identifier of a closed QUIC connection.
+func forgetConnectionID(qconn quic.Connection) {
+	connIDs.mx.Lock()
+	delete(connIDs.m, qconn)
+	connIDs.mx.Unlock()
+}
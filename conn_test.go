@@ -0,0 +1,241 @@
+package webtransport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnValues(t *testing.T) {
+	type key struct{}
+	c := newConn(0, nil, nil)
+	require.Nil(t, c.Value(key{}))
+	c.SetValue(key{}, "foo")
+	c.SetValue("bar", 42)
+	require.Equal(t, "foo", c.Value(key{}))
+	require.Equal(t, 42, c.Value("bar"))
+	c.SetValue(key{}, nil)
+	require.Nil(t, c.Value(key{}))
+	require.Equal(t, 42, c.Value("bar"))
+}
+
+func TestConnString(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	qconn := newPipeConn(ctx, cancel, false)
+	qconn.peer = newPipeConn(ctx, cancel, true)
+	c1 := newConn(0, qconn, nil)
+	c2 := newConn(4, qconn, nil)
+	connID := connectionID(qconn)
+	require.Len(t, connID, 8)
+	require.Equal(t, fmt.Sprintf("%s (session 0, conn %s)", qconn.RemoteAddr(), connID), c1.String())
+	require.Equal(t, fmt.Sprintf("%s (session 4, conn %s)", qconn.RemoteAddr(), connID), c2.String())
+
+	// the identifier is different for every QUIC connection
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	require.NotEqual(t, connID, connectionID(newPipeConn(ctx2, cancel2, false)))
+
+	// the identifier is forgotten once the QUIC connection is closed, but the session keeps its identifier
+	cancel()
+	connIDs.mx.Lock()
+	sweepConnectionIDs()
+	_, ok := connIDs.m[qconn]
+	connIDs.mx.Unlock()
+	require.False(t, ok)
+	require.Contains(t, c1.String(), connID)
+}
+
+func TestConnectionIDSweep(t *testing.T) {
+	connIDs.mx.Lock()
+	m, swept := connIDs.m, connIDs.swept
+	connIDs.m, connIDs.swept = make(map[quic.Connection]string), 0
+	connIDs.mx.Unlock()
+	defer func() {
+		connIDs.mx.Lock()
+		connIDs.m, connIDs.swept = m, swept
+		connIDs.mx.Unlock()
+	}()
+
+	newQUICConn := func() quic.Connection {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return newPipeConn(ctx, cancel, false)
+	}
+	var closed []quic.Connection
+	for i := 0; i < 10; i++ {
+		qconn := newQUICConn()
+		connectionID(qconn)
+		closed = append(closed, qconn)
+	}
+	for _, qconn := range closed {
+		qconn.CloseWithError(0, "")
+	}
+	// The last sweep left 8 identifiers. The next one happens once there are 16 identifiers.
+	for i := 0; i < 5; i++ {
+		connectionID(newQUICConn())
+	}
+	connIDs.mx.Lock()
+	require.Len(t, connIDs.m, 15)
+	connIDs.mx.Unlock()
+	connectionID(newQUICConn())
+	connIDs.mx.Lock()
+	defer connIDs.mx.Unlock()
+	require.Len(t, connIDs.m, 6)
+	for _, qconn := range closed {
+		require.NotContains(t, connIDs.m, qconn)
+	}
+}
+
+func TestConnPaths(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, nil)
+
+	paths := c.Paths()
+	require.Len(t, paths, 1)
+	require.Equal(t, c.LocalAddr(), paths[0].LocalAddr)
+	require.Equal(t, c.RemoteAddr(), paths[0].RemoteAddr)
+	require.Equal(t, pipeAddr("server"), paths[0].LocalAddr)
+	require.Equal(t, pipeAddr("client"), paths[0].RemoteAddr)
+}
+
+func TestConnCloseResetsStreams(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, io.NopCloser(strings.NewReader("")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	local1, remote := openTestStream(t, client, server)
+	c.addStream(remote)
+	str, err := c.AcceptStream(ctx)
+	require.NoError(t, err)
+	// not accepted by the application
+	local2, remote := openTestStream(t, client, server)
+	c.addStream(remote)
+	c.addDatagram([]byte("foobar"), MessageInfo{})
+
+	require.NoError(t, c.Close())
+	requireStreamReset(t, local1, WebTransportSessionGoneErrorCode)
+	requireStreamReset(t, local2, WebTransportSessionGoneErrorCode)
+	_, err = str.Read([]byte{0})
+	require.ErrorIs(t, err, ErrSessionClosed)
+	c.datagramMx.Lock()
+	require.Zero(t, c.datagramQueue.Len())
+	c.datagramMx.Unlock()
+
+	// streams and datagrams received after the session was closed
+	local3, remote := openTestStream(t, client, server)
+	c.addStream(remote)
+	requireStreamReset(t, local3, WebTransportSessionGoneErrorCode)
+	c.addDatagram([]byte("foobar"), MessageInfo{})
+	c.datagramMx.Lock()
+	require.Zero(t, c.datagramQueue.Len())
+	c.datagramMx.Unlock()
+}
+
+func TestConnCloseError(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	local, remote := openTestStream(t, client, server)
+	// doesn't open a stream while the connection is open
+	require.NoError(t, connCloseError(server))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.AcceptUniStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, server.CloseWithError(42, "foobar"))
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, connCloseError(server), &appErr)
+	require.Equal(t, quic.ApplicationErrorCode(42), appErr.ErrorCode)
+	sessErr := connClosedError(server)
+	require.False(t, sessErr.Remote)
+	require.Equal(t, "QUIC connection closed: "+appErr.Error(), sessErr.Message)
+	require.True(t, connClosedError(client).Remote)
+	// streams return the error as well
+	_, err = remote.Write([]byte("foo"))
+	require.ErrorAs(t, err, &appErr)
+	require.False(t, appErr.Remote)
+	_, err = local.Read([]byte{0})
+	require.ErrorAs(t, err, &appErr)
+	require.True(t, appErr.Remote)
+	require.Equal(t, "foobar", appErr.ErrorMessage)
+}
+
+// blockingSendConn is a QUIC connection that blocks sending datagrams until the connection is closed,
+// as if the datagram queue was full.
+type blockingSendConn struct {
+	*pipeConn
+}
+
+func (c *blockingSendConn) SendMessage([]byte) error {
+	<-c.ctx.Done()
+	return errPipeClosed
+}
+
+func TestConnSendMessageContext(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, &blockingSendConn{server}, io.NopCloser(strings.NewReader("")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.SendMessageContext(ctx, []byte("foobar")), context.DeadlineExceeded)
+
+	// closing the QUIC connection while waiting
+	errChan := make(chan error, 1)
+	go func() { errChan <- c.SendMessageContext(context.Background(), []byte("foobar")) }()
+	time.Sleep(10 * time.Millisecond)
+	server.CloseWithError(0, "")
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, ErrSessionClosed)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func BenchmarkAcceptStream(b *testing.B) {
+	c := newConn(0, nil, nil)
+	str := &mockStream{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.addStream(str)
+		c.addStream(str)
+		if _, err := c.AcceptStream(ctx); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.AcceptStream(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReceiveMessage(b *testing.B) {
+	c := newConn(0, nil, nil)
+	data := []byte("foobar")
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.addDatagram(data, MessageInfo{})
+		c.addDatagram(data, MessageInfo{})
+		if _, err := c.ReceiveMessage(ctx); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.ReceiveMessage(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
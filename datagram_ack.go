@@ -0,0 +1,177 @@
+package webtransport
+
+import (
+	"errors"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// ErrDatagramTrackingUnavailable is returned by SendMessageNotify if the delivery status of datagrams
+// can't be tracked, e.g. for sessions created using Pipe.
+var ErrDatagramTrackingUnavailable = errors.New("webtransport: datagram delivery tracking unavailable")
+
+// DatagramResult is the delivery status of a datagram sent using SendMessageNotify.
+type DatagramResult uint8
+
+const (
+	// DatagramAcked means that the packet carrying the datagram was acknowledged by the peer.
+	// Note that the peer might still drop the datagram, e.g. if its receive queue is full.
+	DatagramAcked DatagramResult = iota + 1
+	// DatagramLost means that the packet carrying the datagram was declared lost.
+	// Lost datagrams are not retransmitted by QUIC.
+	DatagramLost
+	// DatagramDropped means that the datagram was not sent, or that its fate is unknown,
+	// because the QUIC connection was closed first.
+	DatagramDropped
+)
+
+func (r DatagramResult) String() string {
+	switch r {
+	case DatagramAcked:
+		return "acked"
+	case DatagramLost:
+		return "lost"
+	case DatagramDropped:
+		return "dropped"
+	default:
+		return "unknown"
+	}
+}
+
+// pendingDatagram is a datagram handed to QUIC, that hasn't been sent in a packet yet.
+type pendingDatagram struct {
+	length logging.ByteCount
+	result chan<- DatagramResult // nil if the delivery status is not tracked
+}
+
+// sendDatagram hands a datagram to QUIC, tracking its delivery status.
+// quic-go queues a single datagram at a time, and sends every datagram in a packet of its own,
+// so datagrams are sent in the order they were handed to QUIC. All datagrams sent on the QUIC connection
+// therefore need to be registered, even if their delivery status is not tracked (result is nil).
+func (m *connMetrics) sendDatagram(qconn quic.Connection, b []byte, result chan<- DatagramResult) error {
+	m.datagramSendMx.Lock()
+	defer m.datagramSendMx.Unlock()
+
+	d := &pendingDatagram{length: logging.ByteCount(len(b)), result: result}
+	m.mx.Lock()
+	if m.datagramsClosed {
+		m.mx.Unlock()
+		return qconn.SendMessage(b)
+	}
+	m.pendingDatagrams = append(m.pendingDatagrams, d)
+	m.mx.Unlock()
+
+	err := qconn.SendMessage(b)
+	if err != nil {
+		m.mx.Lock()
+		for i, p := range m.pendingDatagrams {
+			if p == d {
+				m.pendingDatagrams = append(m.pendingDatagrams[:i], m.pendingDatagrams[i+1:]...)
+				break
+			}
+		}
+		m.mx.Unlock()
+	}
+	return err
+}
+
+// sentDatagram is called when a packet carrying a datagram is sent.
+func (m *connMetrics) sentDatagram(pn logging.PacketNumber, length logging.ByteCount) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if len(m.pendingDatagrams) == 0 || m.pendingDatagrams[0].length != length {
+		return // not sent by this package
+	}
+	d := m.pendingDatagrams[0]
+	m.pendingDatagrams = m.pendingDatagrams[1:]
+	if d.result == nil {
+		return
+	}
+	if m.sentDatagrams == nil {
+		m.sentDatagrams = make(map[logging.PacketNumber]chan<- DatagramResult)
+	}
+	m.sentDatagrams[pn] = d.result
+}
+
+// ackedDatagram is called when a packet is acknowledged (acked is true) or declared lost.
+func (m *connMetrics) ackedDatagram(pn logging.PacketNumber, acked bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	result, ok := m.sentDatagrams[pn]
+	if !ok {
+		return
+	}
+	delete(m.sentDatagrams, pn)
+	if acked {
+		result <- DatagramAcked
+	} else {
+		result <- DatagramLost
+	}
+}
+
+// closeDatagrams reports all datagrams whose delivery status is not known yet as dropped.
+// It is called when the QUIC connection is closed.
+func (m *connMetrics) closeDatagrams() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.datagramsClosed = true
+	for _, d := range m.pendingDatagrams {
+		if d.result != nil {
+			d.result <- DatagramDropped
+		}
+	}
+	m.pendingDatagrams = nil
+	for pn, result := range m.sentDatagrams {
+		result <- DatagramDropped
+		delete(m.sentDatagrams, pn)
+	}
+}
+
+// sendMessage hands a datagram to QUIC.
+// If metrics are available, the datagram is registered for tracking of its delivery status.
+func (c *Conn) sendMessage(b []byte, result chan<- DatagramResult) error {
+	if m := c.connMetrics(); m != nil {
+		return m.sendDatagram(c.qconn, b, result)
+	}
+	return c.qconn.SendMessage(b)
+}
+
+func (c *Conn) connMetrics() *connMetrics {
+	if c.metrics == nil {
+		return nil
+	}
+	return c.metrics.Get(c.qconn)
+}
+
+// SendMessageNotify sends a datagram on this session, like SendMessage.
+// The returned channel receives the delivery status of the datagram, once it is known:
+// DatagramAcked once the packet carrying the datagram was acknowledged, DatagramLost if it was
+// declared lost, and DatagramDropped if the QUIC connection was closed first.
+// This allows applications to retransmit only the datagrams that were actually lost.
+// It returns ErrDatagramTrackingUnavailable if the delivery status can't be tracked.
+func (c *Conn) SendMessageNotify(b []byte) (<-chan DatagramResult, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.sessionError()
+	}
+	if c.datagramsDisabled {
+		return nil, ErrDatagramsDisabled
+	}
+	if c.connMetrics() == nil {
+		return nil, ErrDatagramTrackingUnavailable
+	}
+	if err := c.deadlineError(); err != nil {
+		return nil, err
+	}
+	result := make(chan DatagramResult, 1)
+	buf := c.packDatagram(b)
+	err := c.sendTrackedDatagram(buf.Bytes(), result)
+	datagramBufPool.Put(buf)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package webtransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	"github.com/stretchr/testify/require"
+)
+
+func expectDatagramResult(t *testing.T, ch <-chan DatagramResult, expected DatagramResult) {
+	t.Helper()
+	select {
+	case r := <-ch:
+		require.Equal(t, expected, r)
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for %s", expected)
+	}
+}
+
+func TestDatagramDeliveryTracking(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	m := &connMetrics{}
+	tr := &connMetricsTracer{metrics: m, onClose: func() {}}
+	shortHdr := func(pn logging.PacketNumber) *logging.ExtendedHeader {
+		return &logging.ExtendedHeader{PacketNumber: pn}
+	}
+
+	r1 := make(chan DatagramResult, 1)
+	require.NoError(t, m.sendDatagram(client, []byte("foo"), r1))
+	require.NoError(t, m.sendDatagram(client, []byte("foobar"), nil)) // not tracked
+	r2 := make(chan DatagramResult, 1)
+	require.NoError(t, m.sendDatagram(client, []byte("lorem ipsum"), r2))
+	r3 := make(chan DatagramResult, 1)
+	require.NoError(t, m.sendDatagram(client, []byte("dolor"), r3))
+	for i := 0; i < 4; i++ {
+		_, err := server.ReceiveMessage()
+		require.NoError(t, err)
+	}
+
+	tr.SentPacket(shortHdr(1), 1000, nil, []logging.Frame{&logging.DatagramFrame{Length: 3}})
+	// a datagram that wasn't sent by this package
+	tr.SentPacket(shortHdr(2), 1000, nil, []logging.Frame{&logging.DatagramFrame{Length: 42}})
+	tr.SentPacket(shortHdr(3), 1000, nil, []logging.Frame{&logging.DatagramFrame{Length: 6}})
+	tr.SentPacket(shortHdr(4), 1000, nil, []logging.Frame{&logging.DatagramFrame{Length: 11}})
+	tr.AcknowledgedPacket(logging.Encryption1RTT, 3)
+	tr.LostPacket(logging.Encryption1RTT, 4, logging.PacketLossReorderingThreshold)
+	expectDatagramResult(t, r2, DatagramLost)
+	// packet numbers of other packet number spaces don't acknowledge datagrams
+	tr.AcknowledgedPacket(logging.EncryptionHandshake, 1)
+	require.Empty(t, r1)
+	tr.AcknowledgedPacket(logging.Encryption1RTT, 1)
+	expectDatagramResult(t, r1, DatagramAcked)
+
+	// the last datagram is still queued when the connection is closed
+	tr.Close()
+	expectDatagramResult(t, r3, DatagramDropped)
+	require.Empty(t, m.pendingDatagrams)
+	require.Empty(t, m.sentDatagrams)
+}
+
+func TestDatagramDeliveryTrackingUnavailable(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+	_, err := server.SendMessageNotify([]byte("foobar"))
+	require.ErrorIs(t, err, ErrDatagramTrackingUnavailable)
+	// the datagram wasn't sent
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ReceiveMessage(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
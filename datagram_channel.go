@@ -0,0 +1,127 @@
+package webtransport
+
+import (
+	"context"
+	"sync"
+)
+
+// A Codec encodes and decodes the messages exchanged on a DatagramChannel.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte) (interface{}, error)
+}
+
+// A DatagramChannel sends and receives messages as datagrams on a session, encoded using a Codec.
+// Messages written to Send are encoded and sent using SendMessage. Received datagrams are
+// decoded and delivered on Receive.
+// The channel stops on the first error: when a message can't be encoded or decoded,
+// when sending fails, or when the session is closed. Receive is then closed, and Err returns the error.
+// After that, messages written to Send are discarded, until the session is closed: from then on,
+// Send is not read from anymore. The application closes Send once it's done sending.
+type DatagramChannel struct {
+	Send    chan<- interface{}
+	Receive <-chan interface{}
+
+	conn   *Conn
+	codec  Codec
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx  sync.Mutex
+	err error
+}
+
+// NewDatagramChannel creates a DatagramChannel on the session.
+// Up to bufSize messages are buffered in each direction.
+// The session's datagrams must not be received by anything else (e.g. using ReceiveMessage or HandleMessages).
+// Since this package supports Go versions without type parameters, messages are passed as interface{} values.
+func NewDatagramChannel(c *Conn, codec Codec, bufSize int) *DatagramChannel {
+	send := make(chan interface{}, bufSize)
+	receive := make(chan interface{}, bufSize)
+	ctx, cancel := context.WithCancel(c.Context())
+	ch := &DatagramChannel{
+		Send:    send,
+		Receive: receive,
+		conn:    c,
+		codec:   codec,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	c.goLabeled(func() { ch.runSend(send) })
+	c.goLabeled(func() { ch.runReceive(receive) })
+	return ch
+}
+
+func (ch *DatagramChannel) runSend(send <-chan interface{}) {
+	for {
+		var v interface{}
+		select {
+		case <-ch.conn.Context().Done():
+			return
+		case m, ok := <-send:
+			if !ok {
+				return
+			}
+			v = m
+		}
+		if ch.ctx.Err() != nil {
+			continue // discard
+		}
+		b, err := ch.codec.Marshal(v)
+		if err != nil {
+			ch.fail(err)
+			continue
+		}
+		if err := ch.conn.SendMessage(b); err != nil {
+			ch.fail(err)
+		}
+	}
+}
+
+func (ch *DatagramChannel) runReceive(receive chan<- interface{}) {
+	defer close(receive)
+
+	for {
+		b, err := ch.conn.ReceiveMessage(ch.ctx)
+		if err != nil {
+			if ch.conn.isClosed() {
+				err = ch.conn.sessionError()
+			}
+			ch.fail(err)
+			return
+		}
+		v, err := ch.codec.Unmarshal(b)
+		if err != nil {
+			ch.fail(err)
+			return
+		}
+		select {
+		case receive <- v:
+		case <-ch.ctx.Done():
+			ch.fail(ch.conn.sessionError())
+			return
+		}
+	}
+}
+
+// fail stops the channel. Only the first error is recorded.
+func (ch *DatagramChannel) fail(err error) {
+	ch.mx.Lock()
+	if ch.err == nil {
+		ch.err = err
+	}
+	ch.mx.Unlock()
+	ch.cancel()
+}
+
+// Done returns a channel that is closed once the DatagramChannel stopped.
+func (ch *DatagramChannel) Done() <-chan struct{} {
+	return ch.ctx.Done()
+}
+
+// Err returns the error that stopped the DatagramChannel, or nil if it's still running.
+func (ch *DatagramChannel) Err() error {
+	ch.mx.Lock()
+	defer ch.mx.Unlock()
+	return ch.err
+}
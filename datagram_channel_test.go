@@ -0,0 +1,97 @@
+package webtransport
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// intCodec encodes ints as decimal strings.
+type intCodec struct{}
+
+func (intCodec) Marshal(v interface{}) ([]byte, error) {
+	i, ok := v.(int)
+	if !ok {
+		return nil, errors.New("not an int")
+	}
+	return []byte(strconv.Itoa(i)), nil
+}
+
+func (intCodec) Unmarshal(b []byte) (interface{}, error) {
+	return strconv.Atoi(string(b))
+}
+
+func receiveFromChannel(t *testing.T, ch *DatagramChannel) interface{} {
+	t.Helper()
+	select {
+	case v := <-ch.Receive:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestDatagramChannel(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+
+	cch := NewDatagramChannel(client, intCodec{}, 4)
+	defer close(cch.Send)
+	sch := NewDatagramChannel(server, intCodec{}, 4)
+	defer close(sch.Send)
+
+	cch.Send <- 42
+	require.Equal(t, 42, receiveFromChannel(t, sch))
+	sch.Send <- 1337
+	require.Equal(t, 1337, receiveFromChannel(t, cch))
+	require.NoError(t, cch.Err())
+
+	// the peer sends a datagram that can't be decoded
+	require.NoError(t, client.SendMessage([]byte("foobar")))
+	select {
+	case _, ok := <-sch.Receive:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Error(t, sch.Err())
+	var numErr *strconv.NumError
+	require.ErrorAs(t, sch.Err(), &numErr)
+}
+
+func TestDatagramChannelEncodingError(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+
+	ch := NewDatagramChannel(server, intCodec{}, 1)
+	defer close(ch.Send)
+	ch.Send <- "foobar"
+	select {
+	case <-ch.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.EqualError(t, ch.Err(), "not an int")
+	// messages are discarded after the channel stopped
+	ch.Send <- 42
+	ch.Send <- 43
+}
+
+func TestDatagramChannelSessionClose(t *testing.T) {
+	client, server := Pipe()
+	ch := NewDatagramChannel(server, intCodec{}, 1)
+	defer close(ch.Send)
+
+	require.NoError(t, client.Close())
+	select {
+	case _, ok := <-ch.Receive:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.ErrorIs(t, ch.Err(), ErrSessionClosed)
+}
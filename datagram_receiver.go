@@ -0,0 +1,99 @@
+package webtransport
+
+import (
+	"context"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// datagramReceiver calls ReceiveMessage on a QUIC connection for the datagram dispatcher.
+// quic-go's ReceiveMessage can't be interrupted, so it is called on a separate go routine,
+// which allows the dispatcher to return once the last session on the QUIC connection is closed.
+// There's at most one call to ReceiveMessage outstanding for a QUIC connection. It returns once
+// the next datagram is received, or once the QUIC connection is closed. The datagram is then
+// handed to the dispatcher of a session established in the meantime, or dropped.
+type datagramReceiver struct {
+	reading  bool // set while a call to ReceiveMessage is outstanding
+	received chan receiveResult
+}
+
+type receiveResult struct {
+	data []byte
+	err  error
+}
+
+// receiveDatagram receives the next datagram on a QUIC connection.
+// It returns ctx.Err() when ctx is canceled.
+func (m *sessionManager) receiveDatagram(ctx context.Context, qconn quic.Connection) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mx.Lock()
+	r, ok := m.datagramReceivers[qconn]
+	if !ok {
+		r = &datagramReceiver{received: make(chan receiveResult)}
+		m.datagramReceivers[qconn] = r
+	}
+	if !r.reading {
+		r.reading = true
+		go m.receiveMessage(qconn, r)
+	}
+	m.mx.Unlock()
+
+	select {
+	case res := <-r.received:
+		m.mx.Lock()
+		r.reading = false
+		if ctx.Err() != nil {
+			// The dispatcher was stopped while the datagram was handed over.
+			// It still dispatches this datagram, but the next one is received for the next dispatcher.
+			if d, ok := m.datagramConns[qconn]; ok && d.receiving() {
+				r.reading = true
+				go m.receiveMessage(qconn, r)
+			} else {
+				m.stopReceivingDatagrams(qconn)
+			}
+		}
+		m.mx.Unlock()
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// receiveMessage calls ReceiveMessage, and hands the result to the dispatcher.
+// If the dispatcher is stopped in the meantime, it is handed to the next dispatcher,
+// or dropped if there's no session on the QUIC connection anymore.
+func (m *sessionManager) receiveMessage(qconn quic.Connection, r *datagramReceiver) {
+	b, err := qconn.ReceiveMessage()
+	for {
+		m.mx.Lock()
+		d, ok := m.datagramConns[qconn]
+		if !ok || !d.receiving() {
+			r.reading = false
+			m.stopReceivingDatagrams(qconn)
+			m.mx.Unlock()
+			return
+		}
+		ctx := d.ctx
+		m.mx.Unlock()
+
+		select {
+		case r.received <- receiveResult{data: b, err: err}:
+			return
+		case <-ctx.Done():
+		}
+	}
+}
+
+// stopReceivingDatagrams removes the receiver of a QUIC connection once datagrams are not received anymore,
+// unless a call to ReceiveMessage is still outstanding.
+// It must be called with the mutex held.
+func (m *sessionManager) stopReceivingDatagrams(qconn quic.Connection) {
+	if d, ok := m.datagramConns[qconn]; ok && d.receiving() {
+		return
+	}
+	if r, ok := m.datagramReceivers[qconn]; ok && !r.reading {
+		delete(m.datagramReceivers, qconn)
+	}
+}
@@ -0,0 +1,190 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// MessagePriority is the priority of a datagram sent using SendMessageWithPriority.
+type MessagePriority uint8
+
+const (
+	// MessagePriorityLow is intended for bulk data that can tolerate delays.
+	MessagePriorityLow MessagePriority = iota
+	// MessagePriorityNormal is the priority used by default, e.g. for media.
+	MessagePriorityNormal
+	// MessagePriorityHigh is intended for control messages.
+	MessagePriorityHigh
+
+	numMessagePriorities
+)
+
+// maxSendQueueLen is the maximum number of datagrams queued per priority, waiting to be sent.
+const maxSendQueueLen = 128
+
+type queuedDatagram struct {
+	buf *bytes.Buffer
+	// the datagram is dropped if it can't be handed to QUIC before the deadline
+	// zero if the datagram doesn't expire
+	deadline time.Time
+}
+
+// datagramSender queues datagrams, and hands them to QUIC one by one, highest priority first.
+// quic-go only dequeues a datagram when it has space in a packet, so when the connection
+// is congested, datagrams queue up here, where high-priority datagrams can overtake
+// low-priority ones.
+type datagramSender struct {
+	send func([]byte) error
+
+	mx      sync.Mutex
+	queues  [numMessagePriorities]sendQueue
+	waiters []drainWaiter
+
+	queuedChan chan struct{}
+}
+
+// drainWaiter is notified once no more than threshold datagrams are queued, see NotifyDrained.
+type drainWaiter struct {
+	threshold int
+	ch        chan struct{}
+}
+
+func newDatagramSender(ctx context.Context, send func([]byte) error) *datagramSender {
+	s := &datagramSender{
+		send:       send,
+		queuedChan: make(chan struct{}, 1),
+	}
+	// ctx might carry profiler labels
+	goLabeled(ctx, func() { s.run(ctx) })
+	return s
+}
+
+// Queue queues a datagram for sending.
+// If the queue for the datagram's priority is full, the oldest datagram in that queue is dropped.
+// If deadline is not zero, the datagram is dropped if it's still queued at the deadline.
+func (s *datagramSender) Queue(buf *bytes.Buffer, prio MessagePriority, deadline time.Time) {
+	if prio >= numMessagePriorities {
+		prio = numMessagePriorities - 1
+	}
+	s.mx.Lock()
+	q := &s.queues[prio]
+	if q.Len() >= maxSendQueueLen {
+		datagramBufPool.Put(q.Pop().buf)
+	}
+	q.Push(queuedDatagram{buf: buf, deadline: deadline})
+	s.mx.Unlock()
+
+	select {
+	case s.queuedChan <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next datagram to send. Expired datagrams are dropped.
+// It returns nil if no datagram is queued.
+func (s *datagramSender) next() *bytes.Buffer {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	defer s.notifyWaiters()
+
+	var now time.Time
+	for prio := numMessagePriorities - 1; ; prio-- {
+		for s.queues[prio].Len() > 0 {
+			d := s.queues[prio].Pop()
+			if !d.deadline.IsZero() {
+				if now.IsZero() {
+					now = time.Now()
+				}
+				if now.After(d.deadline) {
+					datagramBufPool.Put(d.buf)
+					continue
+				}
+			}
+			return d.buf
+		}
+		if prio == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *datagramSender) run(ctx context.Context) {
+	defer s.clear()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.queuedChan:
+		}
+		for buf := s.next(); buf != nil; buf = s.next() {
+			s.send(buf.Bytes())
+			datagramBufPool.Put(buf)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *datagramSender) clear() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for i := range s.queues {
+		for s.queues[i].Len() > 0 {
+			datagramBufPool.Put(s.queues[i].Pop().buf)
+		}
+	}
+	s.notifyWaiters()
+}
+
+// Len returns the number of datagrams queued, across all priorities.
+func (s *datagramSender) Len() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.len()
+}
+
+// len must be called with the mutex held.
+func (s *datagramSender) len() int {
+	var n int
+	for i := range s.queues {
+		n += s.queues[i].Len()
+	}
+	return n
+}
+
+// NotifyDrained returns a channel that is closed once no more than threshold datagrams are queued.
+func (s *datagramSender) NotifyDrained(threshold int) <-chan struct{} {
+	ch := make(chan struct{})
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.len() <= threshold {
+		close(ch)
+		return ch
+	}
+	s.waiters = append(s.waiters, drainWaiter{threshold: threshold, ch: ch})
+	return ch
+}
+
+// notifyWaiters notifies the waiters whose threshold was reached.
+// It must be called with the mutex held.
+func (s *datagramSender) notifyWaiters() {
+	if len(s.waiters) == 0 {
+		return
+	}
+	n := s.len()
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if n <= w.threshold {
+			close(w.ch)
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	s.waiters = waiters
+}
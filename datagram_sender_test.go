@@ -0,0 +1,165 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingSender hands every datagram to the test, and blocks until the test unblocks it.
+type blockingSender struct {
+	sent    chan []byte
+	unblock chan struct{}
+}
+
+func newBlockingSender() *blockingSender {
+	return &blockingSender{sent: make(chan []byte), unblock: make(chan struct{})}
+}
+
+func (s *blockingSender) send(b []byte) error {
+	s.sent <- append([]byte(nil), b...)
+	<-s.unblock
+	return nil
+}
+
+func (s *blockingSender) expectSent(t *testing.T, expected string) {
+	t.Helper()
+	select {
+	case b := <-s.sent:
+		require.Equal(t, expected, string(b))
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for %s to be sent", expected)
+	}
+}
+
+func TestDatagramSenderPriorities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := newBlockingSender()
+	defer close(bs.unblock)
+	s := newDatagramSender(ctx, bs.send)
+
+	s.Queue(bytes.NewBufferString("low 1"), MessagePriorityLow, time.Time{})
+	bs.expectSent(t, "low 1")
+	// The sender is now blocked. Queue datagrams with different priorities.
+	s.Queue(bytes.NewBufferString("low 2"), MessagePriorityLow, time.Time{})
+	s.Queue(bytes.NewBufferString("normal"), MessagePriorityNormal, time.Time{})
+	s.Queue(bytes.NewBufferString("low 3"), MessagePriorityLow, time.Time{})
+	s.Queue(bytes.NewBufferString("high"), MessagePriorityHigh, time.Time{})
+
+	for _, expected := range []string{"high", "normal", "low 2", "low 3"} {
+		bs.unblock <- struct{}{}
+		bs.expectSent(t, expected)
+	}
+}
+
+func TestDatagramSenderQueueFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := newBlockingSender()
+	defer close(bs.unblock)
+	s := newDatagramSender(ctx, bs.send)
+
+	s.Queue(bytes.NewBufferString("first"), MessagePriorityNormal, time.Time{})
+	bs.expectSent(t, "first")
+	for i := 0; i < maxSendQueueLen+2; i++ {
+		s.Queue(bytes.NewBufferString(string(rune('a'+i%26))), MessagePriorityNormal, time.Time{})
+	}
+	// the two oldest datagrams were dropped
+	bs.unblock <- struct{}{}
+	bs.expectSent(t, "c")
+}
+
+func TestDatagramSenderClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bs := newBlockingSender()
+	s := newDatagramSender(ctx, bs.send)
+	s.Queue(bytes.NewBufferString("foo"), MessagePriorityNormal, time.Time{})
+	bs.expectSent(t, "foo")
+	s.Queue(bytes.NewBufferString("bar"), MessagePriorityNormal, time.Time{})
+	cancel()
+	close(bs.unblock)
+
+	require.Eventually(t, func() bool {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return s.queues[MessagePriorityNormal].Len() == 0
+	}, time.Second, 5*time.Millisecond)
+	select {
+	case b := <-bs.sent:
+		t.Fatalf("didn't expect %s to be sent", b)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDatagramSenderExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := newBlockingSender()
+	defer close(bs.unblock)
+	s := newDatagramSender(ctx, bs.send)
+
+	s.Queue(bytes.NewBufferString("first"), MessagePriorityNormal, time.Time{})
+	bs.expectSent(t, "first")
+	s.Queue(bytes.NewBufferString("expired"), MessagePriorityHigh, time.Now().Add(-time.Millisecond))
+	s.Queue(bytes.NewBufferString("expiring"), MessagePriorityNormal, time.Now().Add(10*time.Millisecond))
+	s.Queue(bytes.NewBufferString("fresh"), MessagePriorityNormal, time.Now().Add(time.Hour))
+	s.Queue(bytes.NewBufferString("no deadline"), MessagePriorityLow, time.Time{})
+	time.Sleep(20 * time.Millisecond)
+
+	bs.unblock <- struct{}{}
+	bs.expectSent(t, "fresh")
+	bs.unblock <- struct{}{}
+	bs.expectSent(t, "no deadline")
+}
+
+func TestDatagramSenderNotifyDrained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bs := newBlockingSender()
+	defer close(bs.unblock)
+	s := newDatagramSender(ctx, bs.send)
+
+	s.Queue(bytes.NewBufferString("first"), MessagePriorityNormal, time.Time{})
+	bs.expectSent(t, "first")
+	s.Queue(bytes.NewBufferString("a"), MessagePriorityNormal, time.Time{})
+	s.Queue(bytes.NewBufferString("b"), MessagePriorityLow, time.Time{})
+	s.Queue(bytes.NewBufferString("c"), MessagePriorityHigh, time.Time{})
+	require.Equal(t, 3, s.Len())
+
+	select {
+	case <-s.NotifyDrained(3):
+	default:
+		t.Fatal("expected the channel to be closed")
+	}
+	drained := s.NotifyDrained(1)
+	bs.unblock <- struct{}{}
+	bs.expectSent(t, "c")
+	select {
+	case <-drained:
+		t.Fatal("didn't expect the queue to be drained yet")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bs.unblock <- struct{}{}
+	bs.expectSent(t, "a")
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, 1, s.Len())
+
+	// closing clears the queue
+	s.Queue(bytes.NewBufferString("d"), MessagePriorityLow, time.Time{})
+	s.Queue(bytes.NewBufferString("e"), MessagePriorityLow, time.Time{})
+	empty := s.NotifyDrained(0)
+	cancel()
+	bs.unblock <- struct{}{}
+	select {
+	case <-empty:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,153 @@
+package webtransport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// datagramStatsFrameType is the (non-standard) HTTP/3 frame type used to exchange datagram statistics.
+// Every frame carries the session ID, followed by the number of datagrams sent and received on that session.
+const datagramStatsFrameType = 0x57544453
+
+// DatagramStats are the datagram statistics reported by the peer for a session.
+// The number of datagrams lost on the way to the peer can be estimated by comparing
+// Received to the number of datagrams sent on the session.
+type DatagramStats struct {
+	// Sent is the number of datagrams the peer sent on this session.
+	Sent uint64
+	// Received is the number of datagrams the peer received on this session.
+	Received uint64
+	// ReportTime is the time when the report was received.
+	ReportTime time.Time
+}
+
+// datagramCounters counts the datagrams sent and received on a session,
+// and holds the last stats reported by the peer.
+type datagramCounters struct {
+	// accessed atomically, must be 64-bit aligned
+	sent, received uint64
+
+	mx        sync.Mutex
+	peer      DatagramStats
+	peerValid bool
+}
+
+func (c *datagramCounters) setPeerStats(s DatagramStats) {
+	c.mx.Lock()
+	c.peer = s
+	c.peerValid = true
+	c.mx.Unlock()
+}
+
+// PeerDatagramStats returns the datagram statistics last reported by the peer.
+// Peers only report statistics if configured to do so (see DatagramStatsInterval on the Server and the Dialer).
+// It returns false if no report has been received (yet).
+func (c *Conn) PeerDatagramStats() (DatagramStats, bool) {
+	c.datagramStats.mx.Lock()
+	defer c.datagramStats.mx.Unlock()
+
+	return c.datagramStats.peer, c.datagramStats.peerValid
+}
+
+// reportDatagramStats periodically sends the session's datagram statistics to the peer.
+// It returns when the session is closed.
+func (c *Conn) reportDatagramStats(interval time.Duration) {
+	str, err := c.qconn.OpenStreamSync(c.ctx)
+	if err != nil {
+		return
+	}
+	defer str.CancelWrite(0)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var payload, frame bytes.Buffer
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		payload.Reset()
+		quicvarint.Write(&payload, uint64(c.sessionID))
+		quicvarint.Write(&payload, atomic.LoadUint64(&c.datagramStats.sent))
+		quicvarint.Write(&payload, atomic.LoadUint64(&c.datagramStats.received))
+		frame.Reset()
+		quicvarint.Write(&frame, datagramStatsFrameType)
+		quicvarint.Write(&frame, uint64(payload.Len()))
+		frame.Write(payload.Bytes())
+		if _, err := str.Write(frame.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// maxDatagramStatsFrameLen is the maximum length of a datagram stats frame.
+// It is enough to hold 3 varints.
+const maxDatagramStatsFrameLen = 3 * 8
+
+// handleDatagramStatsStream reads the datagram statistics reported by the peer.
+// The frame type of the first frame must already have been consumed.
+// Reports for sessions that don't exist (yet) are ignored.
+func (m *sessionManager) handleDatagramStatsStream(qconn quic.Connection, str quic.Stream) {
+	defer str.CancelRead(0)
+	defer str.CancelWrite(0)
+
+	r := quicvarint.NewReader(str)
+	buf := make([]byte, maxDatagramStatsFrameLen)
+	for first := true; ; first = false {
+		if !first {
+			ft, err := quicvarint.Read(r)
+			if err != nil {
+				return
+			}
+			if ft != datagramStatsFrameType {
+				return
+			}
+		}
+		id, stats, err := readDatagramStatsFrame(r, buf)
+		if err != nil {
+			return
+		}
+		stats.ReportTime = time.Now()
+		m.mx.Lock()
+		sess, ok := m.conns[sessionKey{qconn: qconn, id: id}]
+		m.mx.Unlock()
+		if ok && sess.conn != nil {
+			sess.conn.datagramStats.setPeerStats(stats)
+		}
+	}
+}
+
+// readDatagramStatsFrame reads a datagram stats frame, starting after the frame type.
+func readDatagramStatsFrame(r quicvarint.Reader, buf []byte) (sessionID, DatagramStats, error) {
+	l, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, DatagramStats{}, err
+	}
+	if l > uint64(len(buf)) {
+		return 0, DatagramStats{}, errors.New("datagram stats frame too long")
+	}
+	if _, err := io.ReadFull(r, buf[:l]); err != nil {
+		return 0, DatagramStats{}, err
+	}
+	br := bytes.NewReader(buf[:l])
+	id, err := quicvarint.Read(br)
+	if err != nil {
+		return 0, DatagramStats{}, err
+	}
+	var stats DatagramStats
+	if stats.Sent, err = quicvarint.Read(br); err != nil {
+		return 0, DatagramStats{}, err
+	}
+	if stats.Received, err = quicvarint.Read(br); err != nil {
+		return 0, DatagramStats{}, err
+	}
+	return sessionID(id), stats, nil
+}
@@ -0,0 +1,88 @@
+package webtransport
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// connDeadline is the deadline set using Conn.SetDeadline.
+// Like the deadlines of net.Pipe, the channel is only replaced once it was closed,
+// such that a deadline that is extended or removed also applies to calls that are already blocked.
+type connDeadline struct {
+	mx    sync.Mutex
+	timer *time.Timer
+	done  chan struct{} // closed when the deadline expires
+}
+
+func newConnDeadline() *connDeadline {
+	return &connDeadline{done: make(chan struct{})}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.done // wait for the timer to close the channel
+	}
+	d.timer = nil
+
+	expired := isClosedChan(d.done)
+	if t.IsZero() {
+		if expired {
+			d.done = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.done = make(chan struct{})
+		}
+		done := d.done
+		d.timer = time.AfterFunc(dur, func() { close(done) })
+		return
+	}
+	if !expired {
+		close(d.done)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *connDeadline) wait() <-chan struct{} {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.done
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetDeadline sets a deadline for the operations on the session: AcceptStream, AcceptUniStream, OpenStreamSync, OpenUniStreamSync,
+// SendMessage, SendMessageContext, ReceiveMessage and ReceiveMessageWithInfo.
+// Once the deadline expires, these calls return os.ErrDeadlineExceeded, including calls that
+// are already blocked. Unlike a context passed to the individual calls, the deadline bounds all of them,
+// which is useful if a whole exchange has to be finished by a certain time.
+// The deadline can be extended by calling SetDeadline again. A zero value for t means that
+// operations don't time out. The deadline doesn't apply to the session's streams (see Stream.SetDeadline).
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.ctx.Err() != nil {
+		return c.sessionError()
+	}
+	c.deadline.set(t)
+	return nil
+}
+
+// deadlineError returns os.ErrDeadlineExceeded if the deadline set using SetDeadline expired.
+func (c *Conn) deadlineError() error {
+	if isClosedChan(c.deadline.wait()) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
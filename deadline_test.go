@@ -0,0 +1,79 @@
+package webtransport_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnDeadline(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	timeout := scaleDuration(50 * time.Millisecond)
+	require.NoError(t, server.SetDeadline(time.Now().Add(timeout)))
+	start := time.Now()
+	_, err := server.AcceptStream(context.Background())
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.GreaterOrEqual(t, time.Since(start), timeout)
+
+	// all operations fail once the deadline expired
+	_, err = server.ReceiveMessage(context.Background())
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.ErrorIs(t, server.SendMessage([]byte("foobar")), os.ErrDeadlineExceeded)
+	require.ErrorIs(t, server.SendMessageContext(context.Background(), []byte("foobar")), os.ErrDeadlineExceeded)
+	_, err = server.OpenStreamSync(context.Background())
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = server.OpenUniStreamSync(context.Background())
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// removing the deadline
+	require.NoError(t, server.SetDeadline(time.Time{}))
+	require.NoError(t, server.SendMessage([]byte("foobar")))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := client.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+}
+
+func TestConnDeadlineBlockedCalls(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	require.NoError(t, server.SetDeadline(time.Now().Add(scaleDuration(50*time.Millisecond))))
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := server.ReceiveMessage(context.Background())
+		errChan <- err
+	}()
+	// Extending the deadline applies to calls that are already blocked.
+	time.Sleep(scaleDuration(10 * time.Millisecond))
+	require.NoError(t, server.SetDeadline(time.Now().Add(time.Hour)))
+	select {
+	case err := <-errChan:
+		t.Fatalf("ReceiveMessage returned: %v", err)
+	case <-time.After(scaleDuration(100 * time.Millisecond)):
+	}
+	// So does moving it to the past.
+	require.NoError(t, server.SetDeadline(time.Now().Add(-time.Second)))
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConnDeadlineClosedSession(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	require.NoError(t, server.Close())
+	require.ErrorIs(t, server.SetDeadline(time.Now()), webtransport.ErrSessionClosed)
+}
@@ -0,0 +1,102 @@
+package webtransport
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// DebugState is a snapshot of the state of the session manager, which dispatches incoming streams and
+// datagrams to the sessions. It helps diagnosing streams that are never accepted, e.g. because the
+// session they belong to is never established.
+type DebugState struct {
+	// PendingSessions are the sessions that streams were received for, but that are not established yet,
+	// ordered by the time the first stream was received.
+	PendingSessions []PendingSessionState
+	// BufferedStreams is the number of streams waiting for their session to be established.
+	BufferedStreams int
+	// RejectedStreams is the number of streams that were reset (or paused, see BufferedStreamConfig)
+	// because their session was not established within the StreamReorderingTimeout.
+	RejectedStreams uint64
+	// MemoryLimitRejectedStreams is the number of streams that were reset because the streams waiting for
+	// their session to be established exceeded the SessionMemoryLimit. Once a session is established,
+	// streams rejected because of the limit are counted in the session's stats (see SessionStats).
+	MemoryLimitRejectedStreams uint64
+	// BufferLimitRejectedStreams is the number of streams that were reset because the number of streams
+	// waiting for their session to be established reached MaxBufferedStreams.
+	BufferLimitRejectedStreams uint64
+	// DroppedDatagrams is the number of datagrams that were dropped (see DroppedDatagrams).
+	DroppedDatagrams uint64
+	// WaitingGoroutines is the number of go routines waiting for sessions to be established.
+	// There is one go routine for every buffered stream.
+	WaitingGoroutines int
+	// Goroutines is the number of go routines run by the session manager, including the waiting go routines,
+	// and the go routines receiving datagrams.
+	Goroutines int
+}
+
+// PendingSessionState describes a session that streams were received for, but that is not established yet.
+type PendingSessionState struct {
+	RemoteAddr net.Addr
+	SessionID  uint64
+	// BufferedStreams are the IDs of the streams waiting for the session to be established,
+	// in the order they were received. This includes paused streams.
+	BufferedStreams []quic.StreamID
+	// Since is the time when the first stream for the session was received.
+	Since time.Time
+}
+
+// DebugState returns a snapshot of the state of the session manager.
+func (m *sessionManager) DebugState() DebugState {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	state := DebugState{
+		RejectedStreams:            m.rejectedStreams,
+		MemoryLimitRejectedStreams: m.memoryRejectedStreams,
+		BufferLimitRejectedStreams: m.limitRejectedStreams,
+		DroppedDatagrams:           m.droppedDatagrams,
+	}
+	if m.refCount != nil { // nil if the Dialer wasn't used yet
+		state.Goroutines = m.refCount.Count()
+	}
+	for key, sess := range m.conns {
+		if sess.conn != nil {
+			continue
+		}
+		state.WaitingGoroutines += sess.counter
+		state.BufferedStreams += len(sess.pending)
+		ids := make([]quic.StreamID, 0, len(sess.pending))
+		for _, p := range sess.pending {
+			ids = append(ids, p.StreamID())
+		}
+		state.PendingSessions = append(state.PendingSessions, PendingSessionState{
+			RemoteAddr:      key.qconn.RemoteAddr(),
+			SessionID:       uint64(key.id),
+			BufferedStreams: ids,
+			Since:           sess.since,
+		})
+	}
+	sort.Slice(state.PendingSessions, func(i, j int) bool {
+		return state.PendingSessions[i].Since.Before(state.PendingSessions[j].Since)
+	})
+	return state
+}
+
+// DebugState returns a snapshot of the state of the session manager, which dispatches incoming streams
+// and datagrams to the sessions. It is meant for diagnosing streams that never arrive, e.g. by
+// exposing it on a debug endpoint.
+func (s *Server) DebugState() DebugState {
+	if err := s.initialize(); err != nil {
+		return DebugState{}
+	}
+	return s.conns.DebugState()
+}
+
+// DebugState returns a snapshot of the state of the session manager, which dispatches incoming streams
+// and datagrams to the sessions.
+func (d *Dialer) DebugState() DebugState {
+	return d.conns.DebugState()
+}
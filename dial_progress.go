@@ -0,0 +1,85 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// H3_CLOSED_CRITICAL_STREAM, H3_SETTINGS_ERROR and H3_MISSING_SETTINGS
+	closedCriticalStreamErrorCode quic.ApplicationErrorCode = 0x104
+	settingsErrorCode             quic.ApplicationErrorCode = 0x109
+	missingSettingsErrorCode      quic.ApplicationErrorCode = 0x10a
+)
+
+type dialProgressKey struct{}
+
+// dialProgress tracks the progress of a single Dial call.
+// The QUIC handshake is only observed if the Dial call establishes a new QUIC connection,
+// otherwise the session is established on an existing QUIC connection.
+type dialProgress struct {
+	phase uint32 // a DialPhase, accessed atomically
+}
+
+func withDialProgress(ctx context.Context) (context.Context, *dialProgress) {
+	p := &dialProgress{phase: uint32(DialPhaseConnect)}
+	return context.WithValue(ctx, dialProgressKey{}, p), p
+}
+
+func (p *dialProgress) setPhase(phase DialPhase) {
+	if p != nil {
+		atomic.StoreUint32(&p.phase, uint32(phase))
+	}
+}
+
+func (p *dialProgress) Phase() DialPhase {
+	return DialPhase(atomic.LoadUint32(&p.phase))
+}
+
+type dialFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
+
+// trackDialProgress wraps the dial function used by the http3.RoundTripper,
+// such that it records the progress of the handshake in the dialProgress carried by the context.
+// The http3.RoundTripper calls the dial function with the context of the request.
+func trackDialProgress(dial dialFunc) dialFunc {
+	if dial == nil {
+		dial = quic.DialAddrEarlyContext
+	}
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		p, _ := ctx.Value(dialProgressKey{}).(*dialProgress)
+		p.setPhase(DialPhaseQUICHandshake)
+		conn, err := dial(ctx, addr, tlsCfg, cfg)
+		if err == nil {
+			p.setPhase(DialPhaseConnect)
+		}
+		return conn, err
+	}
+}
+
+// dialErrorPhase determines the phase in which establishing the session failed.
+func dialErrorPhase(err error, p *dialProgress) DialPhase {
+	var (
+		opErr   *net.OpError
+		dnsErr  *net.DNSError
+		addrErr *net.AddrError
+		hsErr   *quic.HandshakeTimeoutError
+		appErr  *quic.ApplicationError
+	)
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr), errors.As(err, &addrErr):
+		return DialPhaseUDP
+	case errors.As(err, &hsErr):
+		return DialPhaseQUICHandshake
+	case errors.As(err, &appErr):
+		switch appErr.ErrorCode {
+		case closedCriticalStreamErrorCode, settingsErrorCode, missingSettingsErrorCode:
+			return DialPhaseSettings
+		}
+	}
+	return p.Phase()
+}
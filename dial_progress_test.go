@@ -0,0 +1,44 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialErrorPhase(t *testing.T) {
+	_, p := withDialProgress(context.Background())
+	require.Equal(t, DialPhaseConnect, dialErrorPhase(errors.New("foobar"), p))
+	require.Equal(t, DialPhaseUDP, dialErrorPhase(&net.OpError{Op: "write", Net: "udp", Err: errors.New("unreachable")}, p))
+	require.Equal(t, DialPhaseUDP, dialErrorPhase(fmt.Errorf("dial: %w", &net.DNSError{Name: "example.com"}), p))
+	require.Equal(t, DialPhaseQUICHandshake, dialErrorPhase(&quic.HandshakeTimeoutError{}, p))
+	require.Equal(t, DialPhaseSettings, dialErrorPhase(&quic.ApplicationError{ErrorCode: missingSettingsErrorCode}, p))
+	require.Equal(t, DialPhaseConnect, dialErrorPhase(&quic.ApplicationError{ErrorCode: 0x100}, p))
+
+	p.setPhase(DialPhaseQUICHandshake)
+	require.Equal(t, DialPhaseQUICHandshake, dialErrorPhase(context.DeadlineExceeded, p))
+}
+
+func TestTrackDialProgress(t *testing.T) {
+	ctx, p := withDialProgress(context.Background())
+	dial := trackDialProgress(func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+		require.Equal(t, DialPhaseQUICHandshake, p.Phase())
+		return nil, nil
+	})
+	_, err := dial(ctx, "localhost:443", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, DialPhaseConnect, p.Phase())
+
+	// the context doesn't need to carry a dialProgress
+	dial = trackDialProgress(func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+		return nil, nil
+	})
+	_, err = dial(context.Background(), "localhost:443", nil, nil)
+	require.NoError(t, err)
+}
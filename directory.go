@@ -0,0 +1,141 @@
+package webtransport
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A SessionEntry describes a session registered in a SessionDirectory.
+type SessionEntry struct {
+	// Key is the application key the session is registered with, i.e. the session's label (see Conn.SetLabel).
+	Key string
+	// Node is the NodeID of the server the session is established with.
+	Node string
+	// Session is the session's identifier (see Conn.String).
+	Session    string
+	RemoteAddr string
+	Path       string
+	// Established is the time when the session was established.
+	Established time.Time
+}
+
+// A SessionDirectory keeps track of the sessions established with a cluster of servers,
+// which allows locating the node a client is connected to, e.g. to send a message to a user
+// regardless of the node the user is connected to.
+// MemorySessionDirectory is an implementation for a single server. Implementations for clusters
+// are expected to use a shared store, e.g. Redis or etcd.
+// Implementations must be safe for concurrent use.
+type SessionDirectory interface {
+	// Register is called when a session is established.
+	Register(context.Context, SessionEntry) error
+	// Unregister is called when a session ends, with the same entry that was registered.
+	Unregister(context.Context, SessionEntry) error
+	// Lookup returns the sessions registered with the key, on all nodes.
+	Lookup(ctx context.Context, key string) ([]SessionEntry, error)
+}
+
+// MemorySessionDirectory is a SessionDirectory that keeps the sessions in memory.
+// The zero value is ready for use.
+type MemorySessionDirectory struct {
+	mx      sync.Mutex
+	entries map[string]map[memoryDirectoryID]SessionEntry // by key
+}
+
+var _ SessionDirectory = &MemorySessionDirectory{}
+
+type memoryDirectoryID struct {
+	node, session string
+}
+
+func (d *MemorySessionDirectory) Register(_ context.Context, e SessionEntry) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.entries == nil {
+		d.entries = make(map[string]map[memoryDirectoryID]SessionEntry)
+	}
+	m, ok := d.entries[e.Key]
+	if !ok {
+		m = make(map[memoryDirectoryID]SessionEntry)
+		d.entries[e.Key] = m
+	}
+	m[memoryDirectoryID{node: e.Node, session: e.Session}] = e
+	return nil
+}
+
+func (d *MemorySessionDirectory) Unregister(_ context.Context, e SessionEntry) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	m, ok := d.entries[e.Key]
+	if !ok {
+		return nil
+	}
+	delete(m, memoryDirectoryID{node: e.Node, session: e.Session})
+	if len(m) == 0 {
+		delete(d.entries, e.Key)
+	}
+	return nil
+}
+
+// Lookup returns the sessions registered with the key, ordered by the time they were established.
+func (d *MemorySessionDirectory) Lookup(_ context.Context, key string) ([]SessionEntry, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	entries := make([]SessionEntry, 0, len(d.entries[key]))
+	for _, e := range d.entries[key] {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Established.Equal(entries[j].Established) {
+			return entries[i].Established.Before(entries[j].Established)
+		}
+		return entries[i].Session < entries[j].Session
+	})
+	return entries, nil
+}
+
+// LookupSessions looks up the sessions registered with the key in the SessionDirectory.
+// Entries with the server's NodeID belong to sessions established with this server,
+// which can be obtained using SessionsByLabel.
+func (s *Server) LookupSessions(ctx context.Context, key string) ([]SessionEntry, error) {
+	if err := s.initialize(); err != nil {
+		return nil, err
+	}
+	return s.directory.Lookup(ctx, key)
+}
+
+// registerSession registers the session in the SessionDirectory, if it has a label,
+// and unregisters it once it ends.
+func (s *Server) registerSession(c *Conn, r *http.Request) {
+	key := c.Label()
+	if key == "" {
+		return
+	}
+	e := SessionEntry{
+		Key:         key,
+		Node:        s.nodeID,
+		Session:     c.String(),
+		RemoteAddr:  c.RemoteAddr().String(),
+		Path:        r.URL.Path,
+		Established: time.Now(),
+	}
+	if err := s.directory.Register(context.Background(), e); err != nil {
+		c.logf(LogLevelError, "registering session failed: %s", err)
+		return
+	}
+	c.goLabeled(func() {
+		select {
+		case <-c.Context().Done():
+		case <-c.qconn.Context().Done():
+		case <-s.ctx.Done():
+		}
+		if err := s.directory.Unregister(context.Background(), e); err != nil {
+			c.logf(LogLevelError, "unregistering session failed: %s", err)
+		}
+	})
+}
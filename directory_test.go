@@ -0,0 +1,37 @@
+package webtransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySessionDirectory(t *testing.T) {
+	var d MemorySessionDirectory
+	now := time.Now()
+	e1 := SessionEntry{Key: "alice", Node: "a", Session: "s1", Established: now}
+	e2 := SessionEntry{Key: "alice", Node: "b", Session: "s1", Established: now.Add(-time.Second)}
+	e3 := SessionEntry{Key: "bob", Node: "a", Session: "s2", Established: now}
+	for _, e := range []SessionEntry{e1, e2, e3} {
+		require.NoError(t, d.Register(context.Background(), e))
+	}
+
+	entries, err := d.Lookup(context.Background(), "alice")
+	require.NoError(t, err)
+	require.Equal(t, []SessionEntry{e2, e1}, entries)
+	entries, err = d.Lookup(context.Background(), "carol")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, d.Unregister(context.Background(), e2))
+	require.NoError(t, d.Unregister(context.Background(), e2)) // unregistering twice is a no-op
+	entries, err = d.Lookup(context.Background(), "alice")
+	require.NoError(t, err)
+	require.Equal(t, []SessionEntry{e1}, entries)
+
+	require.NoError(t, d.Unregister(context.Background(), e1))
+	require.NoError(t, d.Unregister(context.Background(), e3))
+	require.Empty(t, d.entries)
+}
@@ -0,0 +1,75 @@
+package webtransport
+
+import (
+	"strconv"
+	"sync"
+)
+
+// SessionErrorCode is an application error code used when closing a session,
+// sent to the peer in the CLOSE_WEBTRANSPORT_SESSION capsule.
+type SessionErrorCode uint32
+
+var (
+	errorCodeNamesMx      sync.RWMutex
+	errorCodeNames        = make(map[ErrorCode]string)
+	sessionErrorCodeNames = make(map[SessionErrorCode]string)
+)
+
+// RegisterErrorCodes registers names for the application's stream error codes (see Stream.CancelRead
+// and Stream.CancelWrite). The names are returned by ErrorCode.String, and included in the message of
+// StreamErrors, which makes logs easier to read. Applications usually define their error codes as constants,
+// and register their names in an init function. Registering a name for a code that is already registered
+// replaces the name. It is safe to call RegisterErrorCodes concurrently.
+func RegisterErrorCodes(names map[ErrorCode]string) {
+	errorCodeNamesMx.Lock()
+	defer errorCodeNamesMx.Unlock()
+
+	for code, name := range names {
+		errorCodeNames[code] = name
+	}
+}
+
+// RegisterSessionErrorCodes registers names for the application's session error codes.
+// See RegisterErrorCodes.
+func RegisterSessionErrorCodes(names map[SessionErrorCode]string) {
+	errorCodeNamesMx.Lock()
+	defer errorCodeNamesMx.Unlock()
+
+	for code, name := range names {
+		sessionErrorCodeNames[code] = name
+	}
+}
+
+func (e ErrorCode) name() (string, bool) {
+	errorCodeNamesMx.RLock()
+	defer errorCodeNamesMx.RUnlock()
+
+	name, ok := errorCodeNames[e]
+	return name, ok
+}
+
+// String returns the name registered using RegisterErrorCodes,
+// or the decimal value if no name was registered.
+func (e ErrorCode) String() string {
+	if name, ok := e.name(); ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(e), 10)
+}
+
+func (e SessionErrorCode) name() (string, bool) {
+	errorCodeNamesMx.RLock()
+	defer errorCodeNamesMx.RUnlock()
+
+	name, ok := sessionErrorCodeNames[e]
+	return name, ok
+}
+
+// String returns the name registered using RegisterSessionErrorCodes,
+// or the decimal value if no name was registered.
+func (e SessionErrorCode) String() string {
+	if name, ok := e.name(); ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(e), 10)
+}
@@ -33,9 +33,67 @@ func httpCodeToWebtransportCode(h quic.StreamErrorCode) (ErrorCode, error) {
 // H3_WEBTRANSPORT_BUFFERED_STREAM_REJECTED error.
 const WebTransportBufferedStreamRejectedErrorCode quic.StreamErrorCode = 0x3994bd84
 
+// WebTransportSessionGoneErrorCode is the error code of the WEBTRANSPORT_SESSION_GONE error.
+// Streams that are still associated with a session when it is closed are reset with this error code.
+const WebTransportSessionGoneErrorCode quic.StreamErrorCode = 0x170d7b68
+
+// requestRejectedErrorCode is the H3_REQUEST_REJECTED error code.
+// Streams opened by the peer while the session is draining are reset with it: it says that the stream
+// wasn't processed at all, so the peer can safely retry it on a new session. Neither
+// WebTransportBufferedStreamRejectedErrorCode (which is about buffering limits) nor
+// WebTransportSessionGoneErrorCode (which makes the peer consider the session closed) fit.
+const requestRejectedErrorCode quic.StreamErrorCode = 0x10b
+
+const (
+	// internalErrorCode is the H3_INTERNAL_ERROR error code.
+	internalErrorCode quic.ApplicationErrorCode = 0x102
+	// idErrorCode is the H3_ID_ERROR error code.
+	idErrorCode quic.ApplicationErrorCode = 0x108
+	// datagramErrorCode is the H3_DATAGRAM_ERROR error code (RFC 9297).
+	datagramErrorCode quic.ApplicationErrorCode = 0x33
+)
+
+// A ProtocolViolationError describes a protocol violation by the peer.
+// In strict mode, the QUIC connection is closed with ErrorCode and Message.
+type ProtocolViolationError struct {
+	ErrorCode quic.ApplicationErrorCode
+	Message   string
+}
+
+func (e *ProtocolViolationError) Error() string {
+	return fmt.Sprintf("webtransport: protocol violation (error code %#x): %s", uint64(e.ErrorCode), e.Message)
+}
+
+// StreamDirection is the direction of a stream.
+type StreamDirection uint8
+
+const (
+	// StreamDirectionRead is the receive direction of a stream.
+	StreamDirectionRead StreamDirection = iota + 1
+	// StreamDirectionWrite is the send direction of a stream.
+	StreamDirectionWrite
+)
+
+func (d StreamDirection) String() string {
+	switch d {
+	case StreamDirectionRead:
+		return "read"
+	case StreamDirectionWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
 // StreamError is the error that is returned from stream operations (Read, Write) when the stream is canceled.
 type StreamError struct {
 	ErrorCode ErrorCode
+	// Remote says if the stream was canceled by the peer: A RESET_STREAM frame cancels the read direction,
+	// and a STOP_SENDING frame cancels the write direction. Otherwise, the stream was canceled locally,
+	// using CancelRead or CancelWrite.
+	Remote bool
+	// Direction is the direction of the stream that was canceled.
+	Direction StreamDirection
 }
 
 func (e *StreamError) Is(target error) bool {
@@ -44,5 +102,142 @@ func (e *StreamError) Is(target error) bool {
 }
 
 func (e *StreamError) Error() string {
-	return fmt.Sprintf("stream canceled with error code %d", e.ErrorCode)
+	msg := "stream canceled"
+	if e.Direction != 0 {
+		if e.Remote {
+			msg = fmt.Sprintf("%s direction of stream canceled by the peer", e.Direction)
+		} else {
+			msg = fmt.Sprintf("%s direction of stream canceled locally", e.Direction)
+		}
+	}
+	if name, ok := e.ErrorCode.name(); ok {
+		return fmt.Sprintf("%s with error code %d (%s)", msg, e.ErrorCode, name)
+	}
+	return fmt.Sprintf("%s with error code %d", msg, e.ErrorCode)
+}
+
+// A SessionError is returned by the operations on a session and its streams once the session is closed.
+// It matches ErrSessionClosed when using errors.Is.
+type SessionError struct {
+	// Remote says if the session was closed by the peer. It is false if the session was closed locally,
+	// or if the QUIC connection was closed without the peer closing the session first.
+	Remote bool
+	// ErrorCode and Message are the application error code and message passed to CloseWithError.
+	ErrorCode SessionErrorCode
+	Message   string
+}
+
+func (e *SessionError) Is(target error) bool {
+	if target == ErrSessionClosed {
+		return true
+	}
+	_, ok := target.(*SessionError)
+	return ok
+}
+
+func (e *SessionError) Error() string {
+	msg := "webtransport: session closed"
+	if e.Remote {
+		msg += " by the peer"
+	}
+	if e.ErrorCode != 0 {
+		if name, ok := e.ErrorCode.name(); ok {
+			msg += fmt.Sprintf(" with error code %d (%s)", e.ErrorCode, name)
+		} else {
+			msg += fmt.Sprintf(" with error code %d", e.ErrorCode)
+		}
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// A DialPhase is a phase of establishing a WebTransport session.
+type DialPhase uint8
+
+const (
+	// DialPhaseUDP is the phase of resolving the server's address and sending the first packets.
+	DialPhaseUDP DialPhase = iota
+	// DialPhaseQUICHandshake is the QUIC handshake (including the TLS handshake).
+	DialPhaseQUICHandshake
+	// DialPhaseSettings is the exchange of the HTTP/3 SETTINGS.
+	DialPhaseSettings
+	// DialPhaseConnect is the extended CONNECT request, i.e. waiting for the server's response.
+	DialPhaseConnect
+)
+
+func (p DialPhase) String() string {
+	switch p {
+	case DialPhaseUDP:
+		return "UDP"
+	case DialPhaseQUICHandshake:
+		return "QUIC handshake"
+	case DialPhaseSettings:
+		return "HTTP/3 settings"
+	case DialPhaseConnect:
+		return "CONNECT"
+	default:
+		return fmt.Sprintf("unknown phase %d", uint8(p))
+	}
+}
+
+// A DialError is returned by Dialer.Dial if the session couldn't be established.
+// It says which phase of establishing the session failed.
+type DialError struct {
+	Phase DialPhase
+	// StatusCode is the status code of the response, if the server rejected the CONNECT request.
+	StatusCode int
+	// Err is the underlying error. It is nil if the server rejected the CONNECT request.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("webtransport: CONNECT rejected with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("webtransport: dial failed during %s: %s", e.Phase, e.Err)
 }
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+var (
+	// ErrTooManySessions is used when a session is rejected because the Server's MaxSessions limit was reached.
+	ErrTooManySessions = errors.New("webtransport: too many sessions")
+	// ErrSessionRateExceeded is used when a session is rejected because the Server's SessionRateLimit was exceeded.
+	ErrSessionRateExceeded = errors.New("webtransport: session rate exceeded")
+	// ErrDatagramsNotSupported is used when a request is rejected because the client doesn't support datagrams,
+	// and the Server's RequireDatagrams is set.
+	ErrDatagramsNotSupported = errors.New("webtransport: client doesn't support datagrams")
+)
+
+// An UpgradeError is returned by Server.Upgrade if the client doesn't support what's required to establish
+// the session: if it didn't offer WebTransport, or if it doesn't support datagrams (see Server.RequireDatagrams).
+// Unlike for a SessionRejectedError, no response has been sent: the handler should respond with StatusCode.
+type UpgradeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *UpgradeError) Error() string { return e.Err.Error() }
+
+func (e *UpgradeError) Unwrap() error { return e.Err }
+
+// A SessionRejectedError is returned by Server.Upgrade if the Server's OnSessionRequest rejected the request,
+// or if the request was rejected because of the Server's MaxSessions or SessionRateLimit.
+// The response has already been sent.
+type SessionRejectedError struct {
+	StatusCode int
+	// Err is the error returned by OnSessionRequest (which may be nil),
+	// or ErrTooManySessions or ErrSessionRateExceeded.
+	Err error
+}
+
+func (e *SessionRejectedError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("webtransport: session request rejected with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("webtransport: session request rejected with status %d: %s", e.StatusCode, e.Err)
+}
+
+func (e *SessionRejectedError) Unwrap() error { return e.Err }
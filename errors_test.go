@@ -1,6 +1,8 @@
 package webtransport
 
 import (
+	"errors"
+	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/stretchr/testify/require"
 	"math"
@@ -35,3 +37,35 @@ func TestErrorCodeConversionErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestErrorCodeNames(t *testing.T) {
+	require.Equal(t, "200", ErrorCode(200).String())
+	require.Equal(t, "stream canceled with error code 200", (&StreamError{ErrorCode: 200}).Error())
+
+	RegisterErrorCodes(map[ErrorCode]string{200: "MY_ERROR"})
+	defer func() {
+		errorCodeNamesMx.Lock()
+		delete(errorCodeNames, 200)
+		errorCodeNamesMx.Unlock()
+	}()
+	require.Equal(t, "MY_ERROR", ErrorCode(200).String())
+	require.Equal(t, "stream canceled with error code 200 (MY_ERROR)", (&StreamError{ErrorCode: 200}).Error())
+
+	require.Equal(t, "1337", SessionErrorCode(1337).String())
+	RegisterSessionErrorCodes(map[SessionErrorCode]string{1337: "SESSION_ERROR"})
+	defer func() {
+		errorCodeNamesMx.Lock()
+		delete(sessionErrorCodeNames, 1337)
+		errorCodeNamesMx.Unlock()
+	}()
+	require.Equal(t, "SESSION_ERROR", SessionErrorCode(1337).String())
+	require.Equal(t, "webtransport: session closed by the peer with error code 1337 (SESSION_ERROR): bye", (&SessionError{Remote: true, ErrorCode: 1337, Message: "bye"}).Error())
+}
+
+func TestSessionError(t *testing.T) {
+	require.Equal(t, "webtransport: session closed", (&SessionError{}).Error())
+	require.Equal(t, "webtransport: session closed with error code 42: bye", (&SessionError{ErrorCode: 42, Message: "bye"}).Error())
+	require.ErrorIs(t, &SessionError{Remote: true}, ErrSessionClosed)
+	require.ErrorIs(t, fmt.Errorf("wrapped: %w", &SessionError{}), &SessionError{})
+	require.False(t, errors.Is(ErrSessionClosed, &SessionError{}))
+}
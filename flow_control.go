@@ -0,0 +1,153 @@
+package webtransport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// StreamStats are statistics about the send direction of a stream.
+type StreamStats struct {
+	// FlowControlStalls is the number of times sending was blocked by the flow control limit
+	// that the peer granted for the stream, i.e. because the peer didn't read the data fast enough.
+	FlowControlStalls uint64
+	// FlowControlStallDuration is the cumulative time sending was blocked by flow control,
+	// including the time of a stall that is still ongoing.
+	FlowControlStallDuration time.Duration
+}
+
+// streamStalls tracks the flow control stalls of the send direction of a stream.
+// A stall starts when quic-go sends a STREAM_DATA_BLOCKED frame, and ends when
+// the peer increases the limit by sending a MAX_STREAM_DATA frame.
+type streamStalls struct {
+	onBlocked   func()              // may be nil
+	onUnblocked func(time.Duration) // may be nil
+
+	mx        sync.Mutex
+	stalls    uint64
+	duration  time.Duration
+	maxData   logging.ByteCount // the highest flow control limit received
+	blockedAt logging.ByteCount // the limit the stream is blocked at
+	since     time.Time         // when the ongoing stall started, zero if the stream is not blocked
+}
+
+func (s *streamStalls) blocked(limit logging.ByteCount) {
+	s.mx.Lock()
+	if !s.since.IsZero() || s.maxData > limit { // the limit was already increased
+		s.mx.Unlock()
+		return
+	}
+	s.stalls++
+	s.blockedAt = limit
+	s.since = time.Now()
+	s.mx.Unlock()
+
+	if s.onBlocked != nil {
+		s.onBlocked()
+	}
+}
+
+func (s *streamStalls) unblocked(limit logging.ByteCount) {
+	s.mx.Lock()
+	if limit > s.maxData {
+		s.maxData = limit
+	}
+	if s.since.IsZero() || limit <= s.blockedAt {
+		s.mx.Unlock()
+		return
+	}
+	stalled := time.Since(s.since)
+	s.duration += stalled
+	s.since = time.Time{}
+	s.mx.Unlock()
+
+	if s.onUnblocked != nil {
+		s.onUnblocked(stalled)
+	}
+}
+
+func (s *streamStalls) stats() StreamStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	d := s.duration
+	if !s.since.IsZero() {
+		d += time.Since(s.since)
+	}
+	return StreamStats{FlowControlStalls: s.stalls, FlowControlStallDuration: d}
+}
+
+// watchStalls starts tracking the flow control stalls of a stream.
+func (m *connMetrics) watchStalls(id quic.StreamID, s *streamStalls) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.stallWatches == nil {
+		m.stallWatches = make(map[quic.StreamID]*streamStalls)
+	}
+	m.stallWatches[id] = s
+}
+
+// unwatchStalls stops tracking the flow control stalls of a stream.
+func (m *connMetrics) unwatchStalls(id quic.StreamID) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	delete(m.stallWatches, id)
+}
+
+func (m *connMetrics) getStalls(id quic.StreamID) *streamStalls {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.stallWatches[id]
+}
+
+func (m *connMetrics) streamBlocked(f *logging.StreamDataBlockedFrame) {
+	if s := m.getStalls(f.StreamID); s != nil {
+		s.blocked(f.MaximumStreamData)
+	}
+}
+
+func (m *connMetrics) streamUnblocked(f *logging.MaxStreamDataFrame) {
+	if s := m.getStalls(f.StreamID); s != nil {
+		s.unblocked(f.MaximumStreamData)
+	}
+}
+
+// trackStalls sets up tracking of the flow control stalls of a stream,
+// until the send direction of the stream is done.
+func (c *Conn) trackStalls(s *sendStream, id quic.StreamID) {
+	if c.metrics == nil {
+		return
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return
+	}
+	s.stalls = &streamStalls{}
+	if c.tracer != nil {
+		s.stalls.onBlocked = func() { c.tracer.StreamFlowControlBlocked(c, id) }
+		s.stalls.onUnblocked = func(d time.Duration) { c.tracer.StreamFlowControlUnblocked(c, id, d) }
+	}
+	m.watchStalls(id, s.stalls)
+	onDone := s.onDone
+	s.onDone = func() {
+		m.unwatchStalls(id)
+		if onDone != nil {
+			onDone()
+		}
+	}
+}
+
+// Stats returns statistics about the send direction of the stream.
+// Flow control stalls are tracked while the send direction is open, for streams of sessions
+// established by a Server or a Dialer.
+func (s *sendStream) Stats() StreamStats {
+	if s.stalls == nil {
+		return StreamStats{}
+	}
+	return s.stalls.stats()
+}
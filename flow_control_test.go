@@ -0,0 +1,57 @@
+package webtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamStalls(t *testing.T) {
+	m := &connMetrics{}
+	tr := &connMetricsTracer{metrics: m}
+	var blocked int
+	var unblocked []time.Duration
+	s := &streamStalls{
+		onBlocked:   func() { blocked++ },
+		onUnblocked: func(d time.Duration) { unblocked = append(unblocked, d) },
+	}
+	m.watchStalls(4, s)
+
+	hdr := &logging.ExtendedHeader{}
+	tr.SentPacket(hdr, 1000, nil, []logging.Frame{
+		&logging.StreamDataBlockedFrame{StreamID: 4, MaximumStreamData: 100},
+		&logging.StreamDataBlockedFrame{StreamID: 8, MaximumStreamData: 100},
+	})
+	require.Equal(t, 1, blocked)
+	// retransmissions of the STREAM_DATA_BLOCKED frame don't count as a new stall
+	tr.SentPacket(hdr, 1000, nil, []logging.Frame{&logging.StreamDataBlockedFrame{StreamID: 4, MaximumStreamData: 100}})
+	require.Equal(t, 1, blocked)
+	// reordered MAX_STREAM_DATA frames don't unblock the stream
+	tr.ReceivedPacket(hdr, 1000, []logging.Frame{&logging.MaxStreamDataFrame{StreamID: 4, MaximumStreamData: 100}})
+	require.Empty(t, unblocked)
+	time.Sleep(5 * time.Millisecond)
+	tr.ReceivedPacket(hdr, 1000, []logging.Frame{&logging.MaxStreamDataFrame{StreamID: 4, MaximumStreamData: 200}})
+	require.Len(t, unblocked, 1)
+	require.GreaterOrEqual(t, unblocked[0], 5*time.Millisecond)
+	stats := s.stats()
+	require.Equal(t, uint64(1), stats.FlowControlStalls)
+	require.Equal(t, unblocked[0], stats.FlowControlStallDuration)
+
+	// A STREAM_DATA_BLOCKED frame sent after the limit was already increased doesn't start a stall.
+	tr.ReceivedPacket(hdr, 1000, []logging.Frame{&logging.MaxStreamDataFrame{StreamID: 4, MaximumStreamData: 300}})
+	tr.SentPacket(hdr, 1000, nil, []logging.Frame{&logging.StreamDataBlockedFrame{StreamID: 4, MaximumStreamData: 200}})
+	require.Equal(t, 1, blocked)
+
+	tr.SentPacket(hdr, 1000, nil, []logging.Frame{&logging.StreamDataBlockedFrame{StreamID: 4, MaximumStreamData: 300}})
+	require.Equal(t, 2, blocked)
+	require.Equal(t, uint64(2), s.stats().FlowControlStalls)
+	require.Greater(t, s.stats().FlowControlStallDuration, stats.FlowControlStallDuration)
+
+	m.unwatchStalls(4)
+	require.Empty(t, m.stallWatches)
+	tr.ReceivedPacket(hdr, 1000, []logging.Frame{&logging.MaxStreamDataFrame{StreamID: 4, MaximumStreamData: 400}})
+	require.Len(t, unblocked, 1)
+}
@@ -0,0 +1,67 @@
+//go:build go1.18
+// +build go1.18
+
+package webtransport
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+func FuzzReadSessionID(f *testing.F) {
+	f.Add([]byte{0x0})
+	f.Add([]byte{0x40, 0x4})
+	f.Add([]byte{0xc0, 0, 0, 0, 0, 0, 0, 0x4})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		id, err := readSessionID(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if uint64(id) > quicvarint.Max {
+			t.Fatalf("session ID exceeds varint range: %d", id)
+		}
+		b := &bytes.Buffer{}
+		quicvarint.Write(b, uint64(id))
+		id2, err := readSessionID(b)
+		if err != nil {
+			t.Fatalf("failed to parse re-encoded session ID: %s", err)
+		}
+		if id != id2 {
+			t.Fatalf("re-encoded session ID doesn't match: %d vs %d", id, id2)
+		}
+	})
+}
+
+func FuzzParseDatagram(f *testing.F) {
+	f.Add([]byte{0x0, 'f', 'o', 'o'})
+	f.Add([]byte{0x40, 0x1})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'f', 'o', 'o'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		id, payload, err := parseDatagram(data)
+		if err != nil {
+			return
+		}
+		if id%4 != 0 {
+			t.Fatalf("invalid session ID: %d", id)
+		}
+		if uint64(id) > quicvarint.Max {
+			t.Fatalf("session ID exceeds varint range: %d", id)
+		}
+		if !bytes.HasSuffix(data, payload) {
+			t.Fatal("payload is not a suffix of the datagram")
+		}
+		// a datagram for the same session, with the same payload
+		b := &bytes.Buffer{}
+		quicvarint.Write(b, uint64(id/4))
+		b.Write(payload)
+		id2, payload2, err := parseDatagram(b.Bytes())
+		if err != nil {
+			t.Fatalf("failed to parse re-encoded datagram: %s", err)
+		}
+		if id != id2 || !bytes.Equal(payload, payload2) {
+			t.Fatal("re-encoded datagram doesn't match")
+		}
+	})
+}
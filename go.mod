@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/lucas-clemente/quic-go v0.27.1-0.20220416130901-6d4a69418397
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 )
 
 require (
@@ -21,7 +22,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/tools v0.1.1 // indirect
@@ -0,0 +1,225 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// HTTP/3 stream and frame types needed to find GOAWAY frames on the server's control stream
+// (see also dataFrameType).
+const (
+	controlStreamType = 0x0
+	headersFrameType  = 0x1
+	settingsFrameType = 0x4
+	goAwayFrameType   = 0x7
+)
+
+// maxControlStreamPrefix limits the amount of data buffered while looking for the end of the SETTINGS frame.
+const maxControlStreamPrefix = 1 << 14
+
+// goAwayConn wraps the QUIC connections dialed by the Dialer, to watch the server's control stream for GOAWAY frames.
+// quic-go's HTTP/3 client only reads the SETTINGS frame from the control stream, and ignores all frames sent afterwards.
+type goAwayConn struct {
+	quic.EarlyConnection
+
+	onGoAway func(*goAwayConn)
+	goneAway int32 // accessed atomically, set to 1 once a GOAWAY frame was received
+}
+
+var _ quic.EarlyConnection = &goAwayConn{}
+
+func (c *goAwayConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	str, err := c.EarlyConnection.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &controlStreamWatcher{ReceiveStream: str, onGoAway: c.receivedGoAway}, nil
+}
+
+func (c *goAwayConn) receivedGoAway() {
+	if atomic.CompareAndSwapInt32(&c.goneAway, 0, 1) {
+		c.onGoAway(c)
+	}
+}
+
+// hasGoneAway says if the server sent a GOAWAY frame on the connection.
+func (c *goAwayConn) hasGoneAway() bool {
+	return atomic.LoadInt32(&c.goneAway) == 1
+}
+
+// wrapDial wraps the dial function used by the http3.RoundTripper, such that GOAWAY frames received
+// on the QUIC connections are handled by the Dialer, and WebTransport unidirectional streams opened
+// by the server are passed to the session manager (see uniStreamConn).
+func (d *Dialer) wrapDial(rt *http3.RoundTripper, dial dialFunc) dialFunc {
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		conn, err := dial(ctx, addr, tlsCfg, cfg)
+		if err != nil {
+			return nil, err
+		}
+		// The goAwayConn is the connection used by the http3.RoundTripper,
+		// so streams are associated with sessions on that connection.
+		c := &goAwayConn{onGoAway: func(c *goAwayConn) { d.goAway(rt, c) }}
+		c.EarlyConnection = &uniStreamConn{
+			EarlyConnection: conn,
+			onStream:        func(str quic.ReceiveStream, id sessionID) { d.conns.AddUniStream(c, str, id) },
+		}
+		return c, nil
+	}
+}
+
+// controlStreamWatcher passes the data of a unidirectional stream through to quic-go's HTTP/3 client.
+// On the control stream, it takes over reading once the client has read the SETTINGS frame,
+// and reads the frames sent afterwards, looking for GOAWAY frames.
+type controlStreamWatcher struct {
+	quic.ReceiveStream
+	onGoAway func()
+
+	buf  []byte // the data read by the client, until the end of the SETTINGS frame
+	done bool   // set once the client has read the SETTINGS frame, or if this is not the control stream
+}
+
+func (w *controlStreamWatcher) Read(b []byte) (int, error) {
+	n, err := w.ReceiveStream.Read(b)
+	if w.done {
+		return n, err
+	}
+	w.buf = append(w.buf, b[:n]...)
+	end := settingsFrameEnd(w.buf)
+	if end == 0 && err == nil && len(w.buf) <= maxControlStreamPrefix {
+		return n, err
+	}
+	w.done = true
+	if end > 0 && err == nil {
+		// The client doesn't read beyond the SETTINGS frame. If it did, it ignores that data.
+		rest := w.buf[end:]
+		go w.readFrames(io.MultiReader(bytes.NewReader(rest), w.ReceiveStream))
+	}
+	w.buf = nil
+	return n, err
+}
+
+// readFrames reads the frames following the SETTINGS frame, until the stream or the QUIC connection is closed.
+func (w *controlStreamWatcher) readFrames(r io.Reader) {
+	qr := quicvarint.NewReader(r)
+	for {
+		typ, err := quicvarint.Read(qr)
+		if err != nil {
+			return
+		}
+		l, err := quicvarint.Read(qr)
+		if err != nil {
+			return
+		}
+		if _, err := io.CopyN(io.Discard, qr, int64(l)); err != nil {
+			return
+		}
+		if typ == goAwayFrameType {
+			w.onGoAway()
+		}
+	}
+}
+
+// settingsFrameEnd returns the offset of the end of the SETTINGS frame, if b starts with the header of a control stream.
+// It returns 0 if more data is needed, and -1 if this is not a control stream, or if the client
+// won't read up to the SETTINGS frame (since it closes the connection if the first frame is a DATA or HEADERS frame).
+func settingsFrameEnd(b []byte) int {
+	r := bytes.NewReader(b)
+	typ, err := quicvarint.Read(r)
+	if err != nil {
+		return 0
+	}
+	if typ != controlStreamType {
+		return -1
+	}
+	for {
+		ft, err := quicvarint.Read(r)
+		if err != nil {
+			return 0
+		}
+		l, err := quicvarint.Read(r)
+		if err != nil {
+			return 0
+		}
+		if ft == dataFrameType || ft == headersFrameType || l > maxControlStreamPrefix {
+			return -1
+		}
+		if uint64(r.Len()) < l {
+			return 0
+		}
+		if ft == settingsFrameType {
+			return len(b) - r.Len() + int(l)
+		}
+		r.Seek(int64(l), io.SeekCurrent)
+	}
+}
+
+// goAway handles a GOAWAY frame: the server won't process any new requests on the QUIC connection.
+// The sessions established on the connection are notified (see Conn.PeerDraining),
+// and subsequent sessions are dialed on a new QUIC connection.
+func (d *Dialer) goAway(rt *http3.RoundTripper, qconn quic.Connection) {
+	d.logger.Logf(LogComponentClient, LogLevelInfo, "received GOAWAY from %s", qconn.RemoteAddr())
+	for _, conn := range d.conns.Sessions(qconn) {
+		conn.setPeerDraining()
+	}
+	d.retireRoundTripper(rt)
+}
+
+// retireRoundTripper replaces the round tripper used by Dial, such that new sessions are established
+// on new QUIC connections. The retired round tripper is closed once the last session dialed using it is closed.
+// Round trippers configured by the application (see Dialer.RoundTripper) can't be replaced.
+func (d *Dialer) retireRoundTripper(rt *http3.RoundTripper) {
+	d.rtMx.Lock()
+	if rt != d.roundTripper || d.RoundTripper != nil {
+		d.rtMx.Unlock()
+		return
+	}
+	newRT, err := d.newRoundTripper(nil)
+	if err != nil {
+		d.rtMx.Unlock()
+		d.logger.Logf(LogComponentClient, LogLevelError, "failed to replace round tripper: %s", err)
+		return
+	}
+	d.roundTripper = newRT
+	unused := d.rtUsers[rt] == 0
+	if !unused {
+		d.retiredRTs[rt] = struct{}{}
+	}
+	d.rtMx.Unlock()
+	if unused {
+		rt.Close()
+	}
+}
+
+// acquireRoundTripper returns the round tripper used by Dial.
+// releaseRoundTripper must be called once the dial failed, or once the session is closed.
+func (d *Dialer) acquireRoundTripper() *http3.RoundTripper {
+	d.rtMx.Lock()
+	defer d.rtMx.Unlock()
+
+	rt := d.roundTripper
+	d.rtUsers[rt]++
+	return rt
+}
+
+func (d *Dialer) releaseRoundTripper(rt *http3.RoundTripper) {
+	d.rtMx.Lock()
+	d.rtUsers[rt]--
+	if d.rtUsers[rt] > 0 {
+		d.rtMx.Unlock()
+		return
+	}
+	delete(d.rtUsers, rt)
+	_, retired := d.retiredRTs[rt]
+	delete(d.retiredRTs, rt)
+	d.rtMx.Unlock()
+	if retired {
+		rt.Close()
+	}
+}
@@ -0,0 +1,117 @@
+package webtransport
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+)
+
+// handlerPanicErrorCode is the error code used to reset streams when a handler panics.
+const handlerPanicErrorCode ErrorCode = 0
+
+// A PanicHandler is called when a handler passed to HandleStreams or HandleMessages panics.
+// For stream handlers, str is the stream that was being handled, for message handlers str is nil.
+// p is the value passed to panic.
+type PanicHandler func(sess Session, str Stream, p interface{})
+
+func logPanic(c *Conn, p interface{}) {
+	c.logf(LogLevelError, "panic serving session: %v\n%s", p, panicStack())
+}
+
+func panicStack() []byte {
+	// Copied from net/http/server.go
+	const size = 64 << 10
+	buf := make([]byte, size)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// HandleStreams accepts streams on this session, and calls handler for every stream in a separate go routine.
+// If MaxConcurrentStreamHandlers is configured on the Server or Dialer and that number of handlers is running,
+// the handler for an accepted stream is started once another handler returns, and no further streams
+// are accepted in the meantime. Sessions waiting for streams don't count towards the limit.
+// If the handler panics, the stream is reset with error code 0, and the panic is reported to the PanicHandler
+// configured on the Server or Dialer.
+// It blocks until the context is cancelled, or the session is closed.
+func (c *Conn) HandleStreams(ctx context.Context, handler func(Stream)) error {
+	// Handlers are labeled with the session's profiler labels, in addition to the labels carried by ctx.
+	labelCtx := pprof.WithLabels(ctx, c.profLabels)
+	for {
+		str, err := c.AcceptStream(ctx)
+		if err != nil {
+			return err
+		}
+		// The slot is only taken once a stream was accepted, so that idle sessions don't hold any slots.
+		if c.handlerSem != nil {
+			select {
+			case c.handlerSem <- struct{}{}:
+			case <-ctx.Done():
+				str.CancelRead(0)
+				str.CancelWrite(0)
+				return ctx.Err()
+			case <-c.ctx.Done():
+				return c.sessionError()
+			}
+		}
+		c.refCount.GoHandler(labelCtx, func() { c.runStreamHandler(str, handler) })
+	}
+}
+
+func (c *Conn) runStreamHandler(str Stream, handler func(Stream)) {
+	if c.handlerSem != nil {
+		defer func() { <-c.handlerSem }()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			str.CancelWrite(handlerPanicErrorCode)
+			str.CancelRead(handlerPanicErrorCode)
+			c.reportPanic(str, p)
+		}
+	}()
+	handler(str)
+}
+
+// HandleMessages receives datagrams on this session, and calls handler for every datagram.
+// Datagrams are handled sequentially, in the order they were received.
+// If the handler panics, the session is closed, and the panic is reported to the PanicHandler
+// configured on the Server or Dialer.
+// It blocks until the context is cancelled, or the session is closed.
+// The handler is called with the session's profiler labels set, in addition to the labels carried by ctx.
+func (c *Conn) HandleMessages(ctx context.Context, handler func([]byte)) error {
+	var err error
+	pprof.Do(ctx, c.profLabels, func(ctx context.Context) {
+		err = c.handleMessages(ctx, handler)
+	})
+	return err
+}
+
+func (c *Conn) handleMessages(ctx context.Context, handler func([]byte)) error {
+	for {
+		b, err := c.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if panicked := c.runMessageHandler(b, handler); panicked {
+			c.Close()
+			return c.sessionError()
+		}
+	}
+}
+
+func (c *Conn) runMessageHandler(b []byte, handler func([]byte)) (panicked bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			panicked = true
+			c.reportPanic(nil, p)
+		}
+	}()
+	handler(b)
+	return false
+}
+
+func (c *Conn) reportPanic(str Stream, p interface{}) {
+	if c.panicHandler == nil {
+		logPanic(c, p)
+		return
+	}
+	c.panicHandler(c, str, p)
+}
@@ -0,0 +1,228 @@
+package webtransport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/http3"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleStreamsPanic(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	type reportedPanic struct {
+		str webtransport.Stream
+		p   interface{}
+	}
+	panicChan := make(chan reportedPanic, 1)
+	tracer := &recordingTracer{}
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		PanicHandler: func(_ webtransport.Session, str webtransport.Stream, p interface{}) {
+			panicChan <- reportedPanic{str: str, p: p}
+		},
+		Tracer: tracer,
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		connChan <- conn
+		conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			data, err := io.ReadAll(str)
+			require.NoError(t, err)
+			if string(data) == "panic" {
+				panic("foobar")
+			}
+			str.Write(data)
+			str.Close()
+		})
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	str.SetDeadline(time.Now().Add(time.Second))
+	_, err = str.Write([]byte("panic"))
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+	_, err = io.ReadAll(str)
+	var streamErr *webtransport.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, webtransport.ErrorCode(0), streamErr.ErrorCode)
+	select {
+	case r := <-panicChan:
+		require.NotNil(t, r.str)
+		require.Equal(t, "foobar", r.p)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Contains(t, tracer.Events(), fmt.Sprintf("stream %d reset (code: 0, remote: false)", str.StreamID()))
+
+	// the session is still usable
+	sendDataAndCheckEcho(t, conn)
+
+	// The reset stream is done, so closing the session gracefully doesn't wait for it.
+	sconn := <-connChan
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(5*time.Second))
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, sconn.CloseGracefully(ctx))
+	require.Less(t, time.Since(start), scaleDuration(time.Second))
+}
+
+func TestHandleMessagesPanic(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	type reportedPanic struct {
+		str webtransport.Stream
+		p   interface{}
+	}
+	panicChan := make(chan reportedPanic, 1)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		PanicHandler: func(_ webtransport.Session, str webtransport.Stream, p interface{}) {
+			panicChan <- reportedPanic{str: str, p: p}
+		},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		connChan <- conn
+		conn.HandleMessages(context.Background(), func([]byte) { panic("foobar") })
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sconn := <-connChan
+
+	require.NoError(t, conn.SendMessage([]byte("foobar")))
+	select {
+	case r := <-panicChan:
+		require.Nil(t, r.str)
+		require.Equal(t, "foobar", r.p)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case <-sconn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("session wasn't closed")
+	}
+}
+
+func TestHandleStreamsConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                          http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		MaxConcurrentStreamHandlers: limit,
+	}
+	defer s.Close()
+	running := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			running <- struct{}{}
+			<-unblock
+			str.Close()
+		})
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2*limit; i++ {
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		_, err = str.Write([]byte("foobar"))
+		require.NoError(t, err)
+	}
+	for i := 0; i < limit; i++ {
+		select {
+		case <-running:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	select {
+	case <-running:
+		t.Fatal("too many concurrent handlers")
+	case <-time.After(scaleDuration(50 * time.Millisecond)):
+	}
+	close(unblock)
+	for i := 0; i < limit; i++ {
+		select {
+		case <-running:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestHandleStreamsConcurrencyLimitIdleSessions(t *testing.T) {
+	const limit = 2
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                          http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		MaxConcurrentStreamHandlers: limit,
+	}
+	defer s.Close()
+	handled := make(chan struct{}, 1)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		conn.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			handled <- struct{}{}
+			str.Close()
+		})
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	// more idle sessions than slots
+	for i := 0; i < 2*limit; i++ {
+		_, _, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+	}
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	select {
+	case <-handled:
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("the handler wasn't run")
+	}
+}
@@ -0,0 +1,107 @@
+package webtransport
+
+import (
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// HandshakeInfo describes the QUIC handshake of the connection a session was established on.
+// Handshake details apply to the QUIC connection: they are shared by all sessions on the connection.
+type HandshakeInfo struct {
+	// Version is the negotiated QUIC version.
+	Version quic.VersionNumber
+	// Retry says if the server sent a Retry packet to validate the client's address
+	// (see Server.RequireAddressValidation).
+	Retry bool
+	// Duration is the duration of the handshake. For clients, it is measured from sending the first packet
+	// until the handshake completed, including the round trip of a Retry. For servers, it is measured
+	// from receiving the first packet of the connection (i.e. after a Retry), until the handshake completed.
+	Duration time.Duration
+	// Resumed says if the TLS session was resumed using a session ticket from a previous connection.
+	Resumed bool
+	// Used0RTT says if 0-RTT data was both offered and accepted.
+	Used0RTT bool
+}
+
+// startedHandshake records the start of the handshake.
+func (m *connMetrics) startedHandshake() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.handshakeStart.IsZero() {
+		m.handshakeStart = time.Now()
+	}
+}
+
+// negotiatedVersion records the QUIC version used on the connection.
+func (m *connMetrics) negotiatedVersion(v logging.VersionNumber) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.version = v
+	m.hasVersion = true
+}
+
+// setRetry records that a Retry was performed, which is the case if the server
+// sent the retry_source_connection_id transport parameter.
+func (m *connMetrics) setRetry(p *logging.TransportParameters) {
+	if p.RetrySourceConnectionID == nil {
+		return
+	}
+	m.mx.Lock()
+	m.retry = true
+	m.mx.Unlock()
+}
+
+// updatedKey records the end of the handshake, once the 1-RTT key of the peer is installed:
+// at that point, the client received the server's Finished message, and vice versa.
+func (m *connMetrics) updatedKey(encLevel logging.EncryptionLevel, pers logging.Perspective) {
+	if encLevel != logging.Encryption1RTT || pers == m.perspective {
+		return
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.handshakeDuration == 0 && !m.handshakeStart.IsZero() {
+		m.handshakeDuration = time.Since(m.handshakeStart)
+	}
+}
+
+func (m *connMetrics) HandshakeInfo() (HandshakeInfo, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if !m.hasVersion {
+		return HandshakeInfo{}, false
+	}
+	return HandshakeInfo{
+		Version:  m.version,
+		Retry:    m.retry,
+		Duration: m.handshakeDuration,
+	}, true
+}
+
+// HandshakeInfo returns details about the handshake of the underlying QUIC connection:
+// the negotiated QUIC version, whether a Retry was performed, the handshake duration,
+// and whether the TLS session was resumed.
+// Operators can use it to track the rollout of QUIC versions, and to diagnose slow connection establishment.
+// It returns false if the handshake details are not known.
+func (c *Conn) HandshakeInfo() (HandshakeInfo, bool) {
+	if c.metrics == nil {
+		return HandshakeInfo{}, false
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return HandshakeInfo{}, false
+	}
+	info, ok := m.HandshakeInfo()
+	if !ok {
+		return HandshakeInfo{}, false
+	}
+	state := c.qconn.ConnectionState().TLS
+	info.Resumed = state.DidResume
+	info.Used0RTT = state.Used0RTT
+	return info, true
+}
@@ -0,0 +1,114 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// noErrorCode is the H3_NO_ERROR error code.
+const noErrorCode quic.ApplicationErrorCode = 0x100
+
+var errUpgradeTimeout = errors.New("webtransport: upgrade timeout")
+
+// connTrackingListener notifies the server of every QUIC connection it accepts.
+// The http3.Server doesn't provide a way to observe new connections.
+type connTrackingListener struct {
+	quic.EarlyListener
+	onConn func(quic.EarlyConnection)
+}
+
+func (l *connTrackingListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	conn, err := l.EarlyListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.onConn(conn)
+	return conn, nil
+}
+
+// handshakeTracker closes QUIC connections on which no session is established within the HandshakeTimeout.
+type handshakeTracker struct {
+	mx    sync.Mutex
+	conns map[quic.Connection]chan struct{} // closed once the first session is established
+}
+
+func newHandshakeTracker() *handshakeTracker {
+	return &handshakeTracker{conns: make(map[quic.Connection]chan struct{})}
+}
+
+// Track starts the timer for a new QUIC connection.
+func (t *handshakeTracker) Track(ctx context.Context, refCount *refCounter, qconn quic.Connection, timeout time.Duration, l *logger) {
+	established := make(chan struct{})
+	t.mx.Lock()
+	t.conns[qconn] = established
+	t.mx.Unlock()
+
+	refCount.Go(connLabelContext(qconn, nil), func() {
+		defer func() {
+			t.mx.Lock()
+			delete(t.conns, qconn)
+			t.mx.Unlock()
+		}()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			if l.Enabled(LogComponentSessionManager, LogLevelDebug) {
+				l.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] closing connection, no session established within %s", connString(qconn), timeout)
+			}
+			qconn.CloseWithError(noErrorCode, "webtransport: handshake timeout")
+		case <-established:
+		case <-qconn.Context().Done():
+		case <-ctx.Done():
+		}
+	})
+}
+
+// Established is called when a session is established on a QUIC connection.
+func (t *handshakeTracker) Established(qconn quic.Connection) {
+	if t == nil {
+		return
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if c, ok := t.conns[qconn]; ok {
+		close(c)
+		delete(t.conns, qconn)
+	}
+}
+
+type upgradeTimerKey struct{}
+
+// upgradeTimeoutHandler wraps the handler, such that WebTransport CONNECT requests that are not
+// upgraded within the timeout are cancelled.
+func upgradeTimeoutHandler(h http.Handler, timeout time.Duration) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Proto != protocolHeader {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		timer := time.AfterFunc(timeout, cancel)
+		defer timer.Stop()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(ctx, upgradeTimerKey{}, timer)))
+	})
+}
+
+// stopUpgradeTimer stops the timer started by the upgradeTimeoutHandler.
+// It returns errUpgradeTimeout if the timer already expired.
+func stopUpgradeTimer(r *http.Request) error {
+	timer, ok := r.Context().Value(upgradeTimerKey{}).(*time.Timer)
+	if ok && !timer.Stop() {
+		return errUpgradeTimeout
+	}
+	return nil
+}
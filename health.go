@@ -0,0 +1,101 @@
+package webtransport
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthStatus describes the state of a Server, as reported by HealthHandler and ReadinessHandler.
+type HealthStatus struct {
+	// Status is "ok" if the check passed, and "unavailable" otherwise.
+	Status string `json:"status"`
+	// Listeners is the number of running calls to Serve, ListenAndServe, ListenAndServeTLS and ListenAndServeContext.
+	Listeners int `json:"listeners"`
+	// Sessions is the number of active sessions.
+	Sessions int `json:"sessions"`
+	// Draining is true once the server is shutting down (see ListenAndServeContext).
+	Draining bool `json:"draining"`
+	// Closed is true once the server was closed.
+	Closed bool `json:"closed"`
+}
+
+// trackListener counts a running Serve call.
+// The returned function must be called when it returns.
+func (s *Server) trackListener() func() {
+	atomic.AddInt32(&s.listeners, 1)
+	return func() { atomic.AddInt32(&s.listeners, -1) }
+}
+
+func (s *Server) healthStatus() HealthStatus {
+	s.initialize()
+	// If the server was closed before being initialized, the context is not set.
+	closed := s.ctx == nil || s.ctx.Err() != nil
+	s.sessionsMx.Lock()
+	numSessions := len(s.sessions)
+	s.sessionsMx.Unlock()
+	return HealthStatus{
+		Listeners: int(atomic.LoadInt32(&s.listeners)),
+		Sessions:  numSessions,
+		Draining:  s.isShuttingDown(),
+		Closed:    closed,
+	}
+}
+
+// HealthHandler returns a handler for liveness probes.
+// It responds with status 200 unless the server was closed, in which case it responds with status 503.
+// The body is the HealthStatus, encoded as JSON.
+// Since orchestrators usually probe using HTTP/1.1 or HTTP/2, the handler can be served by a TCP-based http.Server.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.healthStatus()
+		writeHealthStatus(w, st, !st.Closed)
+	})
+}
+
+// ReadinessHandler returns a handler for readiness probes.
+// It responds with status 200 if the server is serving at least one listener, and is not shutting down or closed.
+// Otherwise, it responds with status 503.
+// The body is the HealthStatus, encoded as JSON.
+// Since orchestrators usually probe using HTTP/1.1 or HTTP/2, the handler can be served by a TCP-based http.Server.
+func (s *Server) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.healthStatus()
+		writeHealthStatus(w, st, st.Listeners > 0 && !st.Draining && !st.Closed)
+	})
+}
+
+func writeHealthStatus(w http.ResponseWriter, st HealthStatus, ok bool) {
+	status := http.StatusOK
+	st.Status = "ok"
+	if !ok {
+		status = http.StatusServiceUnavailable
+		st.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&st)
+}
+
+// healthCheckHandler serves the health checks, and passes all other requests to h.
+func (s *Server) healthCheckHandler(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	health := s.HealthHandler()
+	ready := s.ReadinessHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			switch r.URL.Path {
+			case "/healthz":
+				health.ServeHTTP(w, r)
+				return
+			case "/readyz":
+				ready.ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,303 @@
+package webtransport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// HeartbeatTransport selects how the probes of the heartbeat watchdog are sent.
+type HeartbeatTransport uint8
+
+const (
+	// HeartbeatStream sends probes on a dedicated stream. Probes are delivered reliably,
+	// but they are subject to flow control, and are delayed by packet loss.
+	HeartbeatStream HeartbeatTransport = iota
+	// HeartbeatDatagram sends probes in QUIC datagrams. A lost datagram counts as a missed probe.
+	// If datagrams are disabled for the session, probes are sent on a stream.
+	HeartbeatDatagram
+)
+
+func (t HeartbeatTransport) String() string {
+	switch t {
+	case HeartbeatStream:
+		return "stream"
+	case HeartbeatDatagram:
+		return "datagram"
+	default:
+		return fmt.Sprintf("unknown transport %d", uint8(t))
+	}
+}
+
+// HeartbeatConfig configures a watchdog that periodically probes the liveness of the peer's session,
+// and closes the session if the peer misses too many probes in a row.
+// QUIC keep-alives only show that the peer's QUIC stack is running: the peer answers probes only
+// as long as the session exists on its side, i.e. as long as it didn't close the session,
+// and as long as its WebTransport stack is processing the session's data.
+// The probes use a non-standard extension, so the watchdog should only be enabled if the peer is known
+// to support it (e.g. if it uses webtransport-go). Peers using webtransport-go always answer probes.
+type HeartbeatConfig struct {
+	// Interval is the interval at which probes are sent.
+	// A probe is missed if the peer doesn't answer it before the next probe is sent.
+	Interval time.Duration
+	// MaxMissed is the number of probes the peer may miss in a row before the session is closed.
+	// Defaults to 3.
+	MaxMissed int
+	// Transport selects how probes are sent. Defaults to HeartbeatStream.
+	Transport HeartbeatTransport
+	// ErrorCode is the application error code the session is closed with. On the server side, it is
+	// sent to the client in a CLOSE_WEBTRANSPORT_SESSION capsule, with the same restrictions as for
+	// SlowConsumerConfig.ErrorCode.
+	ErrorCode SessionErrorCode
+	// OnTimeout is called when the peer missed MaxMissed probes, before the session is closed.
+	// It must not block.
+	OnTimeout func(Session)
+}
+
+func (c *HeartbeatConfig) maxMissed() int {
+	if c.MaxMissed <= 0 {
+		return 3
+	}
+	return c.MaxMissed
+}
+
+// heartbeatFrameType is the (non-standard) HTTP/3 frame type used to send heartbeat probes on a stream.
+// The stream is opened by the endpoint sending the probes, and the peer answers on the same stream.
+const heartbeatFrameType = 0x57544842
+
+// heartbeatSessionID is the session ID of datagrams carrying heartbeat probes. It corresponds to the largest
+// Quarter Stream ID, which can't be used by any session, since the stream ID would exceed the limit.
+const heartbeatSessionID = sessionID(quicvarint.Max / 4 * 4)
+
+// Every heartbeat message carries the session ID, the message type and a sequence number.
+// The answer to a ping carries the sequence number of the ping.
+const (
+	heartbeatPing = 0x0
+	heartbeatPong = 0x1
+)
+
+// maxHeartbeatMessageLen is the maximum length of a heartbeat message: 3 varints.
+const maxHeartbeatMessageLen = 3 * 8
+
+// heartbeatTimeoutMessage is the error message sent in the CLOSE_WEBTRANSPORT_SESSION capsule.
+const heartbeatTimeoutMessage = "heartbeat timeout"
+
+func appendHeartbeatMessage(b *bytes.Buffer, id sessionID, typ, seq uint64) {
+	quicvarint.Write(b, uint64(id))
+	quicvarint.Write(b, typ)
+	quicvarint.Write(b, seq)
+}
+
+func parseHeartbeatMessage(b []byte) (id sessionID, typ, seq uint64, err error) {
+	r := bytes.NewReader(b)
+	v, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if typ, err = quicvarint.Read(r); err != nil {
+		return 0, 0, 0, err
+	}
+	if typ != heartbeatPing && typ != heartbeatPong {
+		return 0, 0, 0, errors.New("invalid heartbeat message type")
+	}
+	if seq, err = quicvarint.Read(r); err != nil {
+		return 0, 0, 0, err
+	}
+	return sessionID(v), typ, seq, nil
+}
+
+// writeHeartbeatFrame writes a heartbeat message in a heartbeat frame.
+func writeHeartbeatFrame(w io.Writer, id sessionID, typ, seq uint64) error {
+	var msg, frame bytes.Buffer
+	appendHeartbeatMessage(&msg, id, typ, seq)
+	quicvarint.Write(&frame, heartbeatFrameType)
+	quicvarint.Write(&frame, uint64(msg.Len()))
+	frame.Write(msg.Bytes())
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+// readHeartbeatFrame reads a heartbeat frame, starting after the frame type.
+func readHeartbeatFrame(r quicvarint.Reader) (sessionID, uint64, uint64, error) {
+	l, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if l > maxHeartbeatMessageLen {
+		return 0, 0, 0, errors.New("heartbeat frame too long")
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, 0, err
+	}
+	return parseHeartbeatMessage(buf)
+}
+
+// watchHeartbeat periodically probes the liveness of the peer's session, and closes the session
+// if the peer misses too many probes. It returns when the session or the QUIC connection is closed.
+func (c *Conn) watchHeartbeat(conf *HeartbeatConfig) {
+	var send func(seq uint64) error
+	if conf.Transport == HeartbeatDatagram && !c.datagramsDisabled {
+		send = c.sendHeartbeatDatagram
+	} else {
+		var str quic.Stream
+		defer func() {
+			if str != nil {
+				str.CancelRead(0)
+				str.CancelWrite(0)
+			}
+		}()
+		send = func(seq uint64) error {
+			// If the peer doesn't allow opening a stream, the probe is missed.
+			if str == nil {
+				s, err := c.qconn.OpenStream()
+				if err != nil {
+					return err
+				}
+				str = s
+				c.goLabeled(func() { c.readHeartbeatStream(s) })
+			}
+			return writeHeartbeatFrame(str, c.sessionID, heartbeatPing, seq)
+		}
+	}
+
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	var seq uint64
+	var missed int
+	for {
+		seq++
+		if err := send(seq); err != nil {
+			c.logf(LogLevelDebug, "sending heartbeat failed: %s", err)
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.qconn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadUint64(&c.heartbeatAcked) >= seq {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed < conf.maxMissed() {
+			continue
+		}
+		c.logf(LogLevelInfo, "peer missed %d heartbeats", missed)
+		if conf.OnTimeout != nil {
+			conf.OnTimeout(c)
+		}
+		c.closeWithReason(&SessionError{ErrorCode: conf.ErrorCode, Message: heartbeatTimeoutMessage}, heartbeatTimeoutMessage)
+		return
+	}
+}
+
+func (c *Conn) sendHeartbeatDatagram(seq uint64) error {
+	var b bytes.Buffer
+	quicvarint.Write(&b, uint64(heartbeatSessionID/4))
+	appendHeartbeatMessage(&b, c.sessionID, heartbeatPing, seq)
+	return c.sendMessage(b.Bytes(), nil)
+}
+
+// readHeartbeatStream reads the answers to the probes sent on a heartbeat stream.
+func (c *Conn) readHeartbeatStream(str quic.Stream) {
+	r := quicvarint.NewReader(str)
+	for {
+		ft, err := quicvarint.Read(r)
+		if err != nil || ft != heartbeatFrameType {
+			return
+		}
+		id, typ, seq, err := readHeartbeatFrame(r)
+		if err != nil {
+			return
+		}
+		if id == c.sessionID && typ == heartbeatPong {
+			c.heartbeatAnswered(seq)
+		}
+	}
+}
+
+// heartbeatAnswered records that the peer answered the probe with sequence number seq.
+func (c *Conn) heartbeatAnswered(seq uint64) {
+	for {
+		acked := atomic.LoadUint64(&c.heartbeatAcked)
+		if seq <= acked || atomic.CompareAndSwapUint64(&c.heartbeatAcked, acked, seq) {
+			return
+		}
+	}
+}
+
+// session returns the established session with the given ID, or nil.
+func (m *sessionManager) session(qconn quic.Connection, id sessionID) *Conn {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if sess, ok := m.conns[sessionKey{qconn: qconn, id: id}]; ok {
+		return sess.conn
+	}
+	return nil
+}
+
+// AddHeartbeatStream handles a stream on which the peer sends heartbeat probes.
+func (m *sessionManager) AddHeartbeatStream(qconn quic.Connection, str quic.Stream) {
+	m.refCount.Go(connLabelContext(qconn, nil), func() { m.handleHeartbeatStream(qconn, str) })
+}
+
+// handleHeartbeatStream answers the probes sent by the peer on a heartbeat stream.
+// The frame type of the first frame must already have been consumed.
+// Probes for sessions that don't exist (any more) are not answered.
+func (m *sessionManager) handleHeartbeatStream(qconn quic.Connection, str quic.Stream) {
+	defer str.CancelRead(0)
+	defer str.CancelWrite(0)
+
+	r := quicvarint.NewReader(str)
+	for first := true; ; first = false {
+		if !first {
+			ft, err := quicvarint.Read(r)
+			if err != nil || ft != heartbeatFrameType {
+				return
+			}
+		}
+		id, typ, seq, err := readHeartbeatFrame(r)
+		if err != nil {
+			return
+		}
+		if typ != heartbeatPing || m.session(qconn, id) == nil {
+			continue
+		}
+		if err := writeHeartbeatFrame(str, id, heartbeatPong, seq); err != nil {
+			return
+		}
+	}
+}
+
+// handleHeartbeatDatagram handles a datagram carrying a heartbeat message (without the Quarter Stream ID).
+func (m *sessionManager) handleHeartbeatDatagram(qconn quic.Connection, b []byte) (DatagramDropReason, error) {
+	id, typ, seq, err := parseHeartbeatMessage(b)
+	if err != nil {
+		return DatagramDropMalformed, err
+	}
+	conn := m.session(qconn, id)
+	if conn == nil { // the session might just have been closed, this is not a protocol violation
+		return 0, nil
+	}
+	if typ == heartbeatPong {
+		conn.heartbeatAnswered(seq)
+		return 0, nil
+	}
+	var pong bytes.Buffer
+	quicvarint.Write(&pong, uint64(heartbeatSessionID/4))
+	appendHeartbeatMessage(&pong, id, heartbeatPong, seq)
+	if err := conn.sendMessage(pong.Bytes(), nil); err != nil {
+		conn.logf(LogLevelDebug, "answering heartbeat failed: %s", err)
+	}
+	return 0, nil
+}
@@ -0,0 +1,58 @@
+package webtransport
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatMessage(t *testing.T) {
+	var b bytes.Buffer
+	appendHeartbeatMessage(&b, 4, heartbeatPong, 1337)
+	id, typ, seq, err := parseHeartbeatMessage(b.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, sessionID(4), id)
+	require.Equal(t, uint64(heartbeatPong), typ)
+	require.Equal(t, uint64(1337), seq)
+
+	for i := 0; i < b.Len(); i++ {
+		_, _, _, err := parseHeartbeatMessage(b.Bytes()[:i])
+		require.Error(t, err)
+	}
+
+	b.Reset()
+	appendHeartbeatMessage(&b, 4, 2, 1)
+	_, _, _, err = parseHeartbeatMessage(b.Bytes())
+	require.EqualError(t, err, "invalid heartbeat message type")
+}
+
+func TestHeartbeatFrame(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, writeHeartbeatFrame(&b, 8, heartbeatPing, 42))
+	r := quicvarint.NewReader(&b)
+	ft, err := quicvarint.Read(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(heartbeatFrameType), ft)
+	id, typ, seq, err := readHeartbeatFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, sessionID(8), id)
+	require.Equal(t, uint64(heartbeatPing), typ)
+	require.Equal(t, uint64(42), seq)
+
+	b.Reset()
+	quicvarint.Write(&b, maxHeartbeatMessageLen+1)
+	_, _, _, err = readHeartbeatFrame(quicvarint.NewReader(&b))
+	require.EqualError(t, err, "heartbeat frame too long")
+}
+
+func TestHeartbeatAnswered(t *testing.T) {
+	c := &Conn{}
+	c.heartbeatAnswered(2)
+	c.heartbeatAnswered(1) // reordered answers don't decrease the sequence number
+	require.Equal(t, uint64(2), c.heartbeatAcked)
+	c.heartbeatAnswered(3)
+	require.Equal(t, uint64(3), c.heartbeatAcked)
+}
@@ -0,0 +1,188 @@
+package webtransport
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// A LogLevel controls which messages are logged.
+// Every level includes the messages of the levels below it.
+type LogLevel uint8
+
+const (
+	// LogLevelNothing disables logging.
+	LogLevelNothing LogLevel = iota
+	// LogLevelError logs errors, e.g. panics in handlers and protocol violations by the peer.
+	LogLevelError
+	// LogLevelInfo logs noteworthy events that are not errors, e.g. rejected sessions.
+	LogLevelInfo
+	// LogLevelDebug logs events that are only relevant for debugging, e.g. dropped datagrams.
+	LogLevelDebug
+)
+
+// A LogComponent is a part of the library that emits log messages.
+type LogComponent uint8
+
+const (
+	// LogComponentClient is the Dialer.
+	LogComponentClient LogComponent = iota
+	// LogComponentConn are the WebTransport sessions.
+	LogComponentConn
+	// LogComponentSessionManager dispatches incoming streams and datagrams to the sessions.
+	LogComponentSessionManager
+
+	numLogComponents
+)
+
+func (c LogComponent) String() string {
+	switch c {
+	case LogComponentClient:
+		return "client"
+	case LogComponentConn:
+		return "conn"
+	case LogComponentSessionManager:
+		return "session manager"
+	default:
+		return fmt.Sprintf("unknown component %d", uint8(c))
+	}
+}
+
+// defaultLogSampleInterval is the default value for LogConfig.SampleInterval.
+const defaultLogSampleInterval = time.Second
+
+// LogConfig configures the logging of a Server or a Dialer.
+// Messages about a session are prefixed with the session's identifier (see Conn.String),
+// which allows correlating messages in logs of servers handling many sessions.
+type LogConfig struct {
+	// Level is the log level of all components that are not configured in ComponentLevels.
+	Level LogLevel
+	// ComponentLevels sets the log level of individual components.
+	ComponentLevels map[LogComponent]LogLevel
+
+	// SampleInterval limits how often high-frequency events (e.g. dropped datagrams) are logged.
+	// Every kind of event is logged at most once per interval, together with the number of
+	// events that were suppressed since it was last logged.
+	// Defaults to 1 second. If negative, all events are logged.
+	SampleInterval time.Duration
+
+	// Printf outputs a log message.
+	// Defaults to log.Printf.
+	Printf func(format string, args ...interface{})
+}
+
+type logSample struct {
+	last       time.Time
+	suppressed int
+}
+
+type logger struct {
+	levels         [numLogComponents]uint32 // LogLevels, accessed atomically, so they can be changed at runtime
+	sampleInterval time.Duration
+	printf         func(format string, args ...interface{})
+
+	mx      sync.Mutex
+	samples map[string]*logSample
+}
+
+// defaultLogger is used if no LogConfig is set (i.e. the logger is nil). It only logs errors.
+var defaultLogger = newLogger(&LogConfig{Level: LogLevelError})
+
+func newLogger(conf *LogConfig) *logger {
+	if conf == nil {
+		return nil
+	}
+	l := &logger{
+		sampleInterval: conf.SampleInterval,
+		printf:         conf.Printf,
+		samples:        make(map[string]*logSample),
+	}
+	l.setLevels(conf.Level, conf.ComponentLevels)
+	if l.sampleInterval == 0 {
+		l.sampleInterval = defaultLogSampleInterval
+	}
+	if l.printf == nil {
+		l.printf = log.Printf
+	}
+	return l
+}
+
+// setLevels sets the log level of all components.
+func (l *logger) setLevels(lvl LogLevel, componentLevels map[LogComponent]LogLevel) {
+	for i := range l.levels {
+		compLvl := lvl
+		if cl, ok := componentLevels[LogComponent(i)]; ok {
+			compLvl = cl
+		}
+		atomic.StoreUint32(&l.levels[i], uint32(compLvl))
+	}
+}
+
+// Enabled says if messages of the given level are logged for the component.
+// It is safe to call on a nil logger, in which case the defaultLogger is used.
+func (l *logger) Enabled(comp LogComponent, lvl LogLevel) bool {
+	if l == nil {
+		l = defaultLogger
+	}
+	return comp < numLogComponents && lvl != LogLevelNothing && uint32(lvl) <= atomic.LoadUint32(&l.levels[comp])
+}
+
+// Logf logs a message.
+func (l *logger) Logf(comp LogComponent, lvl LogLevel, format string, args ...interface{}) {
+	if !l.Enabled(comp, lvl) {
+		return
+	}
+	if l == nil {
+		l = defaultLogger
+	}
+	l.printf("webtransport: "+format, args...)
+}
+
+// Sampledf logs a message for a high-frequency event.
+// Events of the same kind are logged at most once per sample interval.
+func (l *logger) Sampledf(comp LogComponent, lvl LogLevel, event string, format string, args ...interface{}) {
+	if !l.Enabled(comp, lvl) {
+		return
+	}
+	if l == nil {
+		l = defaultLogger
+	}
+	if l.sampleInterval > 0 {
+		now := time.Now()
+		l.mx.Lock()
+		s, ok := l.samples[event]
+		if !ok {
+			s = &logSample{}
+			l.samples[event] = s
+		}
+		if !s.last.IsZero() && now.Sub(s.last) < l.sampleInterval {
+			s.suppressed++
+			l.mx.Unlock()
+			return
+		}
+		suppressed := s.suppressed
+		s.last = now
+		s.suppressed = 0
+		l.mx.Unlock()
+		if suppressed > 0 {
+			format += " (%d similar messages suppressed)"
+			args = append(args, suppressed)
+		}
+	}
+	l.printf("webtransport: "+format, args...)
+}
+
+// sessionString returns the identifier of a session, as returned by Conn.String.
+func sessionString(qconn quic.Connection, id sessionID) string {
+	return fmt.Sprintf("%s (session %d, conn %s)", qconn.RemoteAddr(), id, connectionID(qconn))
+}
+
+// connString returns the identifier of a QUIC connection, for log messages that can't be
+// attributed to a single session.
+func connString(qconn quic.Connection) string {
+	return fmt.Sprintf("%s (conn %s)", qconn.RemoteAddr(), connectionID(qconn))
+}
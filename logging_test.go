@@ -0,0 +1,76 @@
+package webtransport
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type logRecorder struct {
+	mx       sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) Printf(format string, args ...interface{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf(format, args...))
+}
+
+func (r *logRecorder) Messages() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var r logRecorder
+	l := newLogger(&LogConfig{
+		Level:           LogLevelInfo,
+		ComponentLevels: map[LogComponent]LogLevel{LogComponentConn: LogLevelNothing, LogComponentClient: LogLevelDebug},
+		Printf:          r.Printf,
+	})
+	require.True(t, l.Enabled(LogComponentSessionManager, LogLevelInfo))
+	require.False(t, l.Enabled(LogComponentSessionManager, LogLevelDebug))
+	require.False(t, l.Enabled(LogComponentConn, LogLevelError))
+	require.True(t, l.Enabled(LogComponentClient, LogLevelDebug))
+
+	l.Logf(LogComponentSessionManager, LogLevelInfo, "foo %d", 1)
+	l.Logf(LogComponentSessionManager, LogLevelDebug, "bar")
+	l.Logf(LogComponentConn, LogLevelError, "baz")
+	l.Logf(LogComponentClient, LogLevelDebug, "foobar")
+	require.Equal(t, []string{"webtransport: foo 1", "webtransport: foobar"}, r.Messages())
+}
+
+func TestLoggerDefault(t *testing.T) {
+	var l *logger
+	require.True(t, l.Enabled(LogComponentConn, LogLevelError))
+	require.False(t, l.Enabled(LogComponentConn, LogLevelInfo))
+	require.False(t, l.Enabled(LogComponentSessionManager, LogLevelNothing))
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var r logRecorder
+	l := newLogger(&LogConfig{Level: LogLevelDebug, SampleInterval: 50 * time.Millisecond, Printf: r.Printf})
+	for i := 0; i < 5; i++ {
+		l.Sampledf(LogComponentConn, LogLevelDebug, "foo", "foo %d", i)
+	}
+	l.Sampledf(LogComponentConn, LogLevelDebug, "bar", "bar")
+	require.Equal(t, []string{"webtransport: foo 0", "webtransport: bar"}, r.Messages())
+
+	time.Sleep(60 * time.Millisecond)
+	l.Sampledf(LogComponentConn, LogLevelDebug, "foo", "foo %d", 5)
+	require.Equal(t, "webtransport: foo 5 (4 similar messages suppressed)", r.Messages()[2])
+}
+
+func TestLoggerSamplingDisabled(t *testing.T) {
+	var r logRecorder
+	l := newLogger(&LogConfig{Level: LogLevelDebug, SampleInterval: -1, Printf: r.Printf})
+	for i := 0; i < 3; i++ {
+		l.Sampledf(LogComponentConn, LogLevelDebug, "foo", "foo")
+	}
+	require.Len(t, r.Messages(), 3)
+}
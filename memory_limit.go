@@ -0,0 +1,49 @@
+package webtransport
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// streamMemoryCost is the amount of memory accounted for a stream that is waiting to be accepted.
+// This is an estimate of the state held for the stream, by this package and by quic-go.
+const streamMemoryCost = 1 << 10
+
+// reserveMemory accounts for n bytes held in the session's buffers.
+// It returns false if this would exceed the session's memory limit.
+func (c *Conn) reserveMemory(n int) bool {
+	for {
+		used := atomic.LoadInt64(&c.counters.bufferedBytes)
+		if c.memoryLimit > 0 && used+int64(n) > int64(c.memoryLimit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.counters.bufferedBytes, used, used+int64(n)) {
+			if used == 0 {
+				atomic.StoreInt64(&c.counters.waitingSince, time.Now().UnixNano())
+			}
+			return true
+		}
+	}
+}
+
+// releaseMemory releases memory reserved using reserveMemory.
+func (c *Conn) releaseMemory(n int) {
+	atomic.AddInt64(&c.counters.bufferedBytes, -int64(n))
+}
+
+// consumed releases the memory of a stream or datagram that was consumed by the application.
+// It keeps track of how long data has been waiting without the application consuming any of it,
+// which is used to detect slow consumers.
+func (c *Conn) consumed(n int) {
+	if atomic.AddInt64(&c.counters.bufferedBytes, -int64(n)) == 0 {
+		atomic.StoreInt64(&c.counters.waitingSince, 0)
+		return
+	}
+	atomic.StoreInt64(&c.counters.waitingSince, time.Now().UnixNano())
+}
+
+// exceedsMemoryLimit says if adding another stream to the pending streams of a session that is not
+// established yet would exceed the memory limit.
+func (m *sessionManager) exceedsMemoryLimit(pending int) bool {
+	return m.memoryLimit > 0 && (pending+1)*streamMemoryCost > m.memoryLimit
+}
@@ -0,0 +1,82 @@
+package webtransport
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLimitDatagrams(t *testing.T) {
+	c := newConn(0, nil, nil)
+	c.memoryLimit = 10
+
+	c.addDatagram([]byte("foobar"), MessageInfo{})
+	c.addDatagram([]byte("foobar"), MessageInfo{}) // exceeds the limit
+	stats := c.Stats()
+	require.Equal(t, uint64(6), stats.BufferedBytes)
+	require.Equal(t, uint64(1), stats.MemoryLimitDroppedDatagrams)
+	require.Equal(t, uint64(1), stats.DatagramsReceived)
+
+	b, err := c.ReceiveMessage(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+	require.Zero(t, c.Stats().BufferedBytes)
+	c.addDatagram([]byte("raboof"), MessageInfo{})
+	require.Equal(t, uint64(6), c.Stats().BufferedBytes)
+}
+
+func TestMemoryLimitStreams(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	c.memoryLimit = 2 * streamMemoryCost
+
+	for i := 0; i < 2; i++ {
+		_, remote := openTestStream(t, client, server)
+		c.addStream(remote)
+	}
+	local, remote := openTestStream(t, client, server)
+	c.addStream(remote) // exceeds the limit
+	requireStreamReset(t, local, WebTransportBufferedStreamRejectedErrorCode)
+	stats := c.Stats()
+	require.Equal(t, uint64(2*streamMemoryCost), stats.BufferedBytes)
+	require.Equal(t, uint64(1), stats.MemoryLimitRejectedStreams)
+
+	// Once a stream is accepted, a new stream can be queued.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := c.AcceptStream(ctx)
+	require.NoError(t, err)
+	_, remote = openTestStream(t, client, server)
+	c.addStream(remote)
+	require.Equal(t, uint64(1), c.Stats().MemoryLimitRejectedStreams)
+
+	// Closing the session releases the memory.
+	c.addDatagram([]byte("foobar"), MessageInfo{})
+	require.NoError(t, c.Close())
+	require.Zero(t, c.Stats().BufferedBytes)
+}
+
+func TestMemoryLimitPendingStreams(t *testing.T) {
+	m := newSessionManager(time.Hour)
+	m.memoryLimit = 2 * streamMemoryCost
+	defer m.Close()
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	for i := 0; i < 2; i++ {
+		_, remote := openTestStream(t, client, server)
+		m.AddStream(server, remote, 0)
+	}
+	local, remote := openTestStream(t, client, server)
+	m.AddStream(server, remote, 0) // exceeds the limit
+	requireStreamReset(t, local, WebTransportBufferedStreamRejectedErrorCode)
+
+	state := m.DebugState()
+	require.Equal(t, 2, state.BufferedStreams)
+	require.Equal(t, uint64(1), state.MemoryLimitRejectedStreams)
+}
@@ -0,0 +1,344 @@
+package webtransport
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// BandwidthEstimate is the sender's view of the bandwidth available on a QUIC connection.
+// Since all sessions on a QUIC connection share the connection's congestion controller,
+// the estimate applies to the connection as a whole.
+type BandwidthEstimate struct {
+	// CongestionWindow is the current congestion window, in bytes.
+	CongestionWindow uint64
+	// BytesInFlight is the number of bytes sent, but not yet acknowledged or declared lost.
+	BytesInFlight uint64
+	// SmoothedRTT is the smoothed round-trip time.
+	SmoothedRTT time.Duration
+	// Bandwidth is the estimated bandwidth in bits per second,
+	// calculated from the congestion window and the smoothed RTT.
+	Bandwidth uint64
+}
+
+// ECNCounts are the ECN counts reported by the peer in ACK frames (RFC 9000, section 13.4).
+type ECNCounts struct {
+	ECT0, ECT1, ECNCE uint64
+}
+
+// connMetrics holds the metrics of a single QUIC connection.
+type connMetrics struct {
+	mx        sync.Mutex
+	bandwidth BandwidthEstimate
+	hasData   bool
+	ecn       ECNCounts
+	hasECN    bool
+	// connection IDs, indexed by sequence number
+	localConnIDs, remoteConnIDs map[uint64]logging.ConnectionID
+	// acknowledgment tracking of stream data, see watchStreamAck
+	ackWatches     map[quic.StreamID]*streamAckWatch
+	watchedPackets map[logging.PacketNumber][]logging.StreamFrame // application data packets carrying frames of watched streams
+	// flow control stalls of streams, see trackStalls
+	stallWatches map[quic.StreamID]*streamStalls
+	// stream limits, see StreamBudget
+	perspective           logging.Perspective
+	hasStreamLimits       bool
+	maxBidi, maxUni       uint64 // the peer's stream limits
+	openedBidi, openedUni uint64 // the number of streams opened by this endpoint
+	// delivery tracking of datagrams, see sendDatagram
+	datagramSendMx   sync.Mutex // serializes handing datagrams to QUIC
+	pendingDatagrams []*pendingDatagram
+	sentDatagrams    map[logging.PacketNumber]chan<- DatagramResult
+	datagramsClosed  bool
+	// handshake details, see HandshakeInfo
+	version           logging.VersionNumber
+	hasVersion        bool
+	retry             bool
+	handshakeStart    time.Time
+	handshakeDuration time.Duration
+	// the peer's max_datagram_frame_size transport parameter, see peerSupportsDatagrams
+	peerMaxDatagramSize logging.ByteCount
+	hasPeerParams       bool
+}
+
+// peerSupportsDatagrams says if the peer supports QUIC datagrams, and if this is known (yet).
+// quic-go's ConnectionState also reports datagram support for peers that sent a max_datagram_frame_size of 0,
+// which quic-go itself does if datagrams are disabled.
+func (m *connMetrics) peerSupportsDatagrams() (supported, known bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.peerMaxDatagramSize > 0, m.hasPeerParams
+}
+
+func (m *connMetrics) BandwidthEstimate() (BandwidthEstimate, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.bandwidth, m.hasData
+}
+
+func (m *connMetrics) ECNCounts() (ECNCounts, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.ecn, m.hasECN
+}
+
+func (m *connMetrics) setConnID(ids *map[uint64]logging.ConnectionID, seq uint64, id logging.ConnectionID) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if *ids == nil {
+		*ids = make(map[uint64]logging.ConnectionID)
+	}
+	(*ids)[seq] = id
+}
+
+// retireConnIDs removes the connection IDs with sequence numbers in the range [from, to).
+func (m *connMetrics) retireConnIDs(ids *map[uint64]logging.ConnectionID, from, to uint64) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for seq := range *ids {
+		if seq >= from && seq < to {
+			delete(*ids, seq)
+		}
+	}
+}
+
+// ConnectionIDs returns the active connection IDs, ordered by sequence number.
+func (m *connMetrics) ConnectionIDs() QUICConnectionIDs {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return QUICConnectionIDs{Local: sortedConnIDs(m.localConnIDs), Remote: sortedConnIDs(m.remoteConnIDs)}
+}
+
+func sortedConnIDs(ids map[uint64]logging.ConnectionID) []ConnectionID {
+	seqs := make([]uint64, 0, len(ids))
+	for seq := range ids {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	l := make([]ConnectionID, 0, len(seqs))
+	for _, seq := range seqs {
+		l = append(l, ConnectionID(append([]byte(nil), ids[seq]...)))
+	}
+	return l
+}
+
+// metricsTracer is a logging.Tracer that collects metrics for QUIC connections.
+// Metrics are associated with a quic.Connection using the quic.ConnectionTracingKey.
+type metricsTracer struct {
+	mx    sync.Mutex
+	conns map[uint64]*connMetrics
+}
+
+var _ logging.Tracer = &metricsTracer{}
+
+func newMetricsTracer() *metricsTracer {
+	return &metricsTracer{conns: make(map[uint64]*connMetrics)}
+}
+
+// addToConfig returns a copy of the quic.Config that has the metricsTracer added.
+func (t *metricsTracer) addToConfig(conf *quic.Config) *quic.Config {
+	if conf == nil {
+		conf = &quic.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	if conf.Tracer == nil {
+		conf.Tracer = t
+	} else {
+		conf.Tracer = logging.NewMultiplexedTracer(conf.Tracer, t)
+	}
+	return conf
+}
+
+func (t *metricsTracer) TracerForConnection(ctx context.Context, pers logging.Perspective, _ logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	m := &connMetrics{perspective: pers}
+	t.mx.Lock()
+	t.conns[id] = m
+	t.mx.Unlock()
+	return &connMetricsTracer{
+		metrics: m,
+		onClose: func() {
+			t.mx.Lock()
+			delete(t.conns, id)
+			t.mx.Unlock()
+		},
+	}
+}
+
+func (t *metricsTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+func (t *metricsTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// Get returns the metrics for a QUIC connection.
+// It returns nil if no metrics are available for this connection.
+func (t *metricsTracer) Get(qconn quic.Connection) *connMetrics {
+	id, ok := qconn.Context().Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return t.conns[id]
+}
+
+type connMetricsTracer struct {
+	metrics *connMetrics
+	onClose func()
+
+	// The initial connection IDs (with sequence number 0) are taken from the first long header packet
+	// sent and received. Later long header packets must not resurrect a retired connection ID.
+	sawLocalConnID, sawRemoteConnID bool
+}
+
+var _ logging.ConnectionTracer = &connMetricsTracer{}
+
+func (t *connMetricsTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+	srtt := rttStats.SmoothedRTT()
+	var bandwidth uint64
+	if srtt > 0 {
+		bandwidth = uint64(float64(cwnd) * 8 / srtt.Seconds())
+	}
+	t.metrics.mx.Lock()
+	t.metrics.bandwidth = BandwidthEstimate{
+		CongestionWindow: uint64(cwnd),
+		BytesInFlight:    uint64(bytesInFlight),
+		SmoothedRTT:      srtt,
+		Bandwidth:        bandwidth,
+	}
+	t.metrics.hasData = true
+	t.metrics.mx.Unlock()
+}
+
+func (t *connMetricsTracer) Close() {
+	t.metrics.closeDatagrams()
+	t.onClose()
+}
+
+func (t *connMetricsTracer) StartedConnection(net.Addr, net.Addr, logging.ConnectionID, logging.ConnectionID) {
+	t.metrics.startedHandshake()
+}
+func (t *connMetricsTracer) NegotiatedVersion(v logging.VersionNumber, _, _ []logging.VersionNumber) {
+	t.metrics.negotiatedVersion(v)
+}
+func (t *connMetricsTracer) ClosedConnection(error) {}
+func (t *connMetricsTracer) SentTransportParameters(p *logging.TransportParameters) {
+	if t.metrics.perspective == logging.PerspectiveServer {
+		t.metrics.setRetry(p)
+	}
+}
+func (t *connMetricsTracer) ReceivedTransportParameters(p *logging.TransportParameters) {
+	t.metrics.setStreamLimits(uint64(p.MaxBidiStreamNum), uint64(p.MaxUniStreamNum))
+	t.metrics.mx.Lock()
+	t.metrics.peerMaxDatagramSize = p.MaxDatagramFrameSize
+	t.metrics.hasPeerParams = true
+	t.metrics.mx.Unlock()
+	if t.metrics.perspective == logging.PerspectiveClient {
+		t.metrics.setRetry(p)
+	}
+}
+func (t *connMetricsTracer) RestoredTransportParameters(p *logging.TransportParameters) {
+	t.metrics.setStreamLimits(uint64(p.MaxBidiStreamNum), uint64(p.MaxUniStreamNum))
+}
+func (t *connMetricsTracer) SentPacket(hdr *logging.ExtendedHeader, _ logging.ByteCount, _ *logging.AckFrame, frames []logging.Frame) {
+	if hdr.IsLongHeader && !t.sawLocalConnID {
+		t.sawLocalConnID = true
+		t.metrics.setConnID(&t.metrics.localConnIDs, 0, hdr.SrcConnectionID)
+	}
+	if typ := logging.PacketTypeFromHeader(&hdr.Header); typ == logging.PacketType1RTT || typ == logging.PacketType0RTT {
+		t.metrics.sentStreamFrames(hdr.PacketNumber, frames)
+	}
+	for _, f := range frames {
+		switch f := f.(type) {
+		case *logging.NewConnectionIDFrame:
+			t.metrics.setConnID(&t.metrics.localConnIDs, f.SequenceNumber, f.ConnectionID)
+		case *logging.RetireConnectionIDFrame:
+			t.metrics.retireConnIDs(&t.metrics.remoteConnIDs, f.SequenceNumber, f.SequenceNumber+1)
+		case *logging.StreamFrame:
+			t.metrics.openedStream(f.StreamID)
+		case *logging.ResetStreamFrame:
+			t.metrics.openedStream(f.StreamID)
+		case *logging.DatagramFrame:
+			t.metrics.sentDatagram(hdr.PacketNumber, f.Length)
+		case *logging.StreamDataBlockedFrame:
+			t.metrics.streamBlocked(f)
+		}
+	}
+}
+func (t *connMetricsTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (t *connMetricsTracer) ReceivedRetry(*logging.Header) {}
+func (t *connMetricsTracer) ReceivedPacket(hdr *logging.ExtendedHeader, _ logging.ByteCount, frames []logging.Frame) {
+	if hdr.IsLongHeader && !t.sawRemoteConnID {
+		t.sawRemoteConnID = true
+		t.metrics.setConnID(&t.metrics.remoteConnIDs, 0, hdr.SrcConnectionID)
+	}
+	for _, f := range frames {
+		switch f := f.(type) {
+		case *logging.AckFrame:
+			if f.ECT0+f.ECT1+f.ECNCE == 0 {
+				continue
+			}
+			t.metrics.mx.Lock()
+			t.metrics.ecn = ECNCounts{ECT0: f.ECT0, ECT1: f.ECT1, ECNCE: f.ECNCE}
+			t.metrics.hasECN = true
+			t.metrics.mx.Unlock()
+		case *logging.NewConnectionIDFrame:
+			t.metrics.setConnID(&t.metrics.remoteConnIDs, f.SequenceNumber, f.ConnectionID)
+			t.metrics.retireConnIDs(&t.metrics.remoteConnIDs, 0, f.RetirePriorTo)
+		case *logging.RetireConnectionIDFrame:
+			t.metrics.retireConnIDs(&t.metrics.localConnIDs, f.SequenceNumber, f.SequenceNumber+1)
+		case *logging.MaxStreamsFrame:
+			if f.Type == logging.StreamTypeBidi {
+				t.metrics.setStreamLimits(uint64(f.MaxStreamNum), 0)
+			} else {
+				t.metrics.setStreamLimits(0, uint64(f.MaxStreamNum))
+			}
+		case *logging.MaxStreamDataFrame:
+			t.metrics.streamUnblocked(f)
+		}
+	}
+}
+func (t *connMetricsTracer) BufferedPacket(logging.PacketType) {}
+func (t *connMetricsTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (t *connMetricsTracer) AcknowledgedPacket(encLevel logging.EncryptionLevel, pn logging.PacketNumber) {
+	if encLevel == logging.Encryption1RTT || encLevel == logging.Encryption0RTT {
+		t.metrics.ackedPacket(pn, true)
+		t.metrics.ackedDatagram(pn, true)
+	}
+}
+func (t *connMetricsTracer) LostPacket(encLevel logging.EncryptionLevel, pn logging.PacketNumber, _ logging.PacketLossReason) {
+	if encLevel == logging.Encryption1RTT || encLevel == logging.Encryption0RTT {
+		t.metrics.ackedPacket(pn, false)
+		t.metrics.ackedDatagram(pn, false)
+	}
+}
+func (t *connMetricsTracer) UpdatedCongestionState(logging.CongestionState) {}
+func (t *connMetricsTracer) UpdatedPTOCount(uint32)                         {}
+func (t *connMetricsTracer) UpdatedKeyFromTLS(encLevel logging.EncryptionLevel, pers logging.Perspective) {
+	t.metrics.updatedKey(encLevel, pers)
+}
+func (t *connMetricsTracer) UpdatedKey(logging.KeyPhase, bool)              {}
+func (t *connMetricsTracer) DroppedEncryptionLevel(logging.EncryptionLevel) {}
+func (t *connMetricsTracer) DroppedKey(logging.KeyPhase)                    {}
+func (t *connMetricsTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {
+}
+func (t *connMetricsTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+func (t *connMetricsTracer) LossTimerCanceled()                                          {}
+func (t *connMetricsTracer) Debug(string, string)                                        {}
@@ -0,0 +1,558 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+const (
+	// pipeMaxIncomingStreams is the number of streams that can be opened, but not yet accepted,
+	// similar to QUIC's stream limit.
+	pipeMaxIncomingStreams = 100
+	// pipeDatagramQueueLen is the number of datagrams queued on a pipe.
+	// Datagrams are dropped when the queue is full.
+	pipeDatagramQueueLen = 128
+)
+
+var errPipeClosed = errors.New("webtransport: pipe closed")
+
+// Pipe creates a pair of connected WebTransport sessions, backed by an in-memory transport.
+// No packets are sent on the network, and no TLS handshake is performed,
+// which makes it possible to quickly and deterministically test code handling WebTransport sessions.
+// Streams and datagrams behave like their QUIC counterparts, with the exception of flow control:
+// Writes to a stream never block.
+// Closing one session closes the other one as well.
+func Pipe() (client, server *Conn) {
+	cconn, sconn := newPipeConns()
+	return newPipeSession(cconn), newPipeSession(sconn)
+}
+
+// newPipeConns creates the two ends of an in-memory QUIC connection.
+func newPipeConns() (client, server *pipeConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client = newPipeConn(ctx, cancel, true)
+	server = newPipeConn(ctx, cancel, false)
+	client.peer = server
+	server.peer = client
+	server.closeState = client.closeState
+	return client, server
+}
+
+// newPipeSession creates a new session on one end of the pipe.
+// Streams and datagrams are dispatched by a sessionManager, the same way as for QUIC connections.
+// Closing the session waits for the go routines accepting streams to return.
+func newPipeSession(qconn *pipeConn) *Conn {
+	m := newSessionManager(5 * time.Second)
+	var wg sync.WaitGroup
+	// The CONNECT request would have been sent on the client's first bidirectional stream.
+	conn := newConn(0, qconn, &pipeRequestStream{conn: qconn, wg: &wg})
+	conn.setProfilerLabels("")
+	m.AddSession(qconn, 0, conn) // can't fail, this is the only session
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			str, err := qconn.AcceptUniStream(context.Background())
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := quicvarint.NewReader(str)
+				typ, err := quicvarint.Read(r)
+				if err != nil || typ != webTransportUniStreamType {
+					str.CancelRead(WebTransportBufferedStreamRejectedErrorCode)
+					return
+				}
+				id, err := readSessionID(r)
+				if err != nil {
+					return
+				}
+				m.AddUniStream(qconn, str, id)
+			}()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			str, err := qconn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			// The stream header might not have been written yet,
+			// so we need to read it in a separate go routine.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := quicvarint.NewReader(str)
+				typ, err := quicvarint.Read(r)
+				if err != nil || typ != webTransportFrameType {
+					str.CancelRead(WebTransportBufferedStreamRejectedErrorCode)
+					str.CancelWrite(WebTransportBufferedStreamRejectedErrorCode)
+					return
+				}
+				id, err := readSessionID(r)
+				if err != nil {
+					return
+				}
+				m.AddStream(qconn, str, id)
+			}()
+		}
+	}()
+	go func() {
+		wg.Wait()
+		m.Close()
+		conn.closeWithReason(connClosedError(qconn), connClosedReason)
+	}()
+	return conn
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is one end of an in-memory quic.Connection.
+type pipeConn struct {
+	ctx       context.Context // shared by both ends of the pipe
+	ctxCancel context.CancelFunc
+
+	isClient bool
+	peer     *pipeConn
+	// closeState is shared by both ends of the pipe
+	closeState *pipeCloseState
+
+	mx          sync.Mutex
+	nextBidi    quic.StreamID
+	nextUni     quic.StreamID
+	acceptQueue chan quic.Stream
+	uniQueue    chan quic.ReceiveStream
+	datagrams   chan []byte
+}
+
+var _ quic.Connection = &pipeConn{}
+
+func newPipeConn(ctx context.Context, cancel context.CancelFunc, isClient bool) *pipeConn {
+	c := &pipeConn{
+		ctx:         ctx,
+		ctxCancel:   cancel,
+		isClient:    isClient,
+		acceptQueue: make(chan quic.Stream, pipeMaxIncomingStreams),
+		uniQueue:    make(chan quic.ReceiveStream, pipeMaxIncomingStreams),
+		datagrams:   make(chan []byte, pipeDatagramQueueLen),
+		closeState:  &pipeCloseState{},
+	}
+	// Stream IDs are assigned the same way as in QUIC.
+	// The client's first bidirectional stream is used for the CONNECT request.
+	if isClient {
+		c.nextBidi, c.nextUni = 4, 2
+	} else {
+		c.nextBidi, c.nextUni = 1, 3
+	}
+	return c
+}
+
+func (c *pipeConn) newStreamID(uni bool) quic.StreamID {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if uni {
+		id := c.nextUni
+		c.nextUni += 4
+		return id
+	}
+	id := c.nextBidi
+	c.nextBidi += 4
+	return id
+}
+
+func (c *pipeConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	select {
+	case str := <-c.acceptQueue:
+		return str, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.closeError()
+	}
+}
+
+func (c *pipeConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	select {
+	case str := <-c.uniQueue:
+		return str, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.closeError()
+	}
+}
+
+func (c *pipeConn) newStream() (local, remote *pipeStream) {
+	id := c.newStreamID(false)
+	send := newPipeBuffer(c.ctx, id)
+	recv := newPipeBuffer(c.ctx, id)
+	return &pipeStream{id: id, conn: c, send: send, recv: recv}, &pipeStream{id: id, conn: c.peer, send: recv, recv: send}
+}
+
+func (c *pipeConn) OpenStream() (quic.Stream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	local, remote := c.newStream()
+	select {
+	case c.peer.acceptQueue <- remote:
+		return local, nil
+	default:
+		return nil, errors.New("webtransport: too many open streams")
+	}
+}
+
+func (c *pipeConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	local, remote := c.newStream()
+	select {
+	case c.peer.acceptQueue <- remote:
+		return local, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.closeError()
+	}
+}
+
+func (c *pipeConn) OpenUniStream() (quic.SendStream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	buf := newPipeBuffer(c.ctx, c.newStreamID(true))
+	select {
+	case c.peer.uniQueue <- &pipeStream{id: buf.id, conn: c.peer, recv: buf}:
+		return &pipeStream{id: buf.id, conn: c, send: buf}, nil
+	default:
+		return nil, errors.New("webtransport: too many open streams")
+	}
+}
+
+func (c *pipeConn) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	if c.ctx.Err() != nil {
+		return nil, c.closeError()
+	}
+	buf := newPipeBuffer(c.ctx, c.newStreamID(true))
+	select {
+	case c.peer.uniQueue <- &pipeStream{id: buf.id, conn: c.peer, recv: buf}:
+		return &pipeStream{id: buf.id, conn: c, send: buf}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.closeError()
+	}
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	if c.isClient {
+		return pipeAddr("client")
+	}
+	return pipeAddr("server")
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr { return c.peer.LocalAddr() }
+
+// pipeCloseState records the error code and message that a pipe was closed with.
+type pipeCloseState struct {
+	mx     sync.Mutex
+	closer *pipeConn // the end that called CloseWithError, nil if the pipe wasn't closed using CloseWithError
+	code   quic.ApplicationErrorCode
+	msg    string
+}
+
+// CloseWithError closes the pipe. Like for QUIC connections, operations on both ends of the pipe
+// then return a quic.ApplicationError carrying the error code and message.
+func (c *pipeConn) CloseWithError(code quic.ApplicationErrorCode, msg string) error {
+	c.closeState.mx.Lock()
+	if c.ctx.Err() == nil && c.closeState.closer == nil {
+		c.closeState.closer = c
+		c.closeState.code = code
+		c.closeState.msg = msg
+	}
+	c.closeState.mx.Unlock()
+	c.ctxCancel()
+	return nil
+}
+
+// closeError returns the error returned by operations on the closed pipe.
+func (c *pipeConn) closeError() error {
+	c.closeState.mx.Lock()
+	defer c.closeState.mx.Unlock()
+
+	if c.closeState.closer == nil {
+		return errPipeClosed
+	}
+	return &quic.ApplicationError{
+		Remote:       c.closeState.closer != c,
+		ErrorCode:    c.closeState.code,
+		ErrorMessage: c.closeState.msg,
+	}
+}
+
+func (c *pipeConn) Context() context.Context { return c.ctx }
+
+func (c *pipeConn) ConnectionState() quic.ConnectionState {
+	return quic.ConnectionState{SupportsDatagrams: true}
+}
+
+// SendMessage sends a datagram to the peer.
+// Like QUIC datagrams, datagrams are dropped if the peer doesn't receive them fast enough.
+func (c *pipeConn) SendMessage(b []byte) error {
+	if c.ctx.Err() != nil {
+		return c.closeError()
+	}
+	select {
+	case c.peer.datagrams <- append([]byte(nil), b...):
+	default:
+	}
+	return nil
+}
+
+func (c *pipeConn) ReceiveMessage() ([]byte, error) {
+	select {
+	case b := <-c.datagrams:
+		return b, nil
+	case <-c.ctx.Done():
+		return nil, c.closeError()
+	}
+}
+
+// pipeRequestStream takes the role of the stream that the CONNECT request was sent on.
+// Closing it closes the pipe, and waits for the go routines accepting streams to return.
+type pipeRequestStream struct {
+	conn *pipeConn
+	wg   *sync.WaitGroup
+}
+
+func (s *pipeRequestStream) Read([]byte) (int, error) {
+	<-s.conn.ctx.Done()
+	return 0, io.EOF
+}
+
+func (s *pipeRequestStream) Close() error {
+	s.conn.ctxCancel()
+	s.wg.Wait()
+	return nil
+}
+
+// pipeStream is one end of an in-memory stream.
+// For unidirectional streams, either send or recv is nil.
+type pipeStream struct {
+	id   quic.StreamID
+	conn *pipeConn // the end of the pipe this stream belongs to
+	send *pipeBuffer
+	recv *pipeBuffer
+}
+
+var _ quic.Stream = &pipeStream{}
+
+func (s *pipeStream) StreamID() quic.StreamID               { return s.id }
+func (s *pipeStream) Read(b []byte) (int, error)            { return s.closeError(s.recv.Read(b)) }
+func (s *pipeStream) CancelRead(code quic.StreamErrorCode)  { s.recv.CancelRead(code) }
+func (s *pipeStream) SetReadDeadline(t time.Time) error     { return s.recv.SetReadDeadline(t) }
+func (s *pipeStream) Write(b []byte) (int, error)           { return s.closeError(s.send.Write(b)) }
+func (s *pipeStream) Close() error                          { return s.send.Close() }
+func (s *pipeStream) CancelWrite(code quic.StreamErrorCode) { s.send.CancelWrite(code) }
+func (s *pipeStream) Context() context.Context              { return s.send.ctx }
+func (s *pipeStream) SetWriteDeadline(t time.Time) error    { return s.send.SetWriteDeadline(t) }
+
+// closeError replaces errPipeClosed with the error that the pipe was closed with (see pipeConn.closeError).
+func (s *pipeStream) closeError(n int, err error) (int, error) {
+	if err == errPipeClosed {
+		err = s.conn.closeError()
+	}
+	return n, err
+}
+
+func (s *pipeStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// pipeBuffer transports the data of one direction of a stream.
+type pipeBuffer struct {
+	id      quic.StreamID
+	connCtx context.Context // closed when the pipe is closed
+
+	ctx       context.Context // closed when the send side is closed
+	ctxCancel context.CancelFunc
+
+	mx sync.Mutex
+	// signal is closed (and replaced) every time the state of the buffer changes
+	signal        chan struct{}
+	data          []byte
+	fin           bool
+	resetCode     *quic.StreamErrorCode // set by CancelWrite
+	stopCode      *quic.StreamErrorCode // set by CancelRead
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newPipeBuffer(connCtx context.Context, id quic.StreamID) *pipeBuffer {
+	b := &pipeBuffer{
+		id:      id,
+		connCtx: connCtx,
+		signal:  make(chan struct{}),
+	}
+	b.ctx, b.ctxCancel = context.WithCancel(connCtx)
+	return b
+}
+
+// notify must be called with the mutex held.
+func (b *pipeBuffer) notify() {
+	close(b.signal)
+	b.signal = make(chan struct{})
+}
+
+func (b *pipeBuffer) Read(p []byte) (int, error) {
+	for {
+		b.mx.Lock()
+		if b.connCtx.Err() != nil {
+			b.mx.Unlock()
+			return 0, errPipeClosed
+		}
+		if b.resetCode != nil {
+			code := *b.resetCode
+			b.mx.Unlock()
+			return 0, &quic.StreamError{StreamID: b.id, ErrorCode: code}
+		}
+		if b.stopCode != nil {
+			b.mx.Unlock()
+			return 0, fmt.Errorf("read from canceled stream %d", b.id)
+		}
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.mx.Unlock()
+			return n, nil
+		}
+		if b.fin {
+			b.mx.Unlock()
+			return 0, io.EOF
+		}
+		deadline := b.readDeadline
+		signal := b.signal
+		b.mx.Unlock()
+
+		if deadline.IsZero() {
+			select {
+			case <-signal:
+			case <-b.connCtx.Done():
+			}
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-signal:
+		case <-t.C:
+		case <-b.connCtx.Done():
+		}
+		t.Stop()
+	}
+}
+
+func (b *pipeBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.connCtx.Err() != nil {
+		return 0, errPipeClosed
+	}
+	if b.stopCode != nil {
+		return 0, &quic.StreamError{StreamID: b.id, ErrorCode: *b.stopCode}
+	}
+	if b.fin || b.resetCode != nil {
+		return 0, fmt.Errorf("write on closed stream %d", b.id)
+	}
+	if !b.writeDeadline.IsZero() && !time.Now().Before(b.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	b.data = append(b.data, p...)
+	b.notify()
+	return len(p), nil
+}
+
+func (b *pipeBuffer) Close() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.resetCode != nil {
+		return fmt.Errorf("close called for canceled stream %d", b.id)
+	}
+	b.fin = true
+	b.ctxCancel()
+	b.notify()
+	return nil
+}
+
+func (b *pipeBuffer) CancelWrite(code quic.StreamErrorCode) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.resetCode != nil {
+		return
+	}
+	b.resetCode = &code
+	b.data = nil
+	b.ctxCancel()
+	b.notify()
+}
+
+func (b *pipeBuffer) CancelRead(code quic.StreamErrorCode) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.stopCode != nil {
+		return
+	}
+	b.stopCode = &code
+	b.data = nil
+	b.ctxCancel()
+	b.notify()
+}
+
+func (b *pipeBuffer) SetReadDeadline(t time.Time) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.readDeadline = t
+	b.notify()
+	return nil
+}
+
+func (b *pipeBuffer) SetWriteDeadline(t time.Time) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.writeDeadline = t
+	return nil
+}
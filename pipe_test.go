@@ -0,0 +1,134 @@
+package webtransport_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeStreams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	go newEchoHandler(t)(server)
+
+	sendDataAndCheckEcho(t, client)
+	sendDataAndCheckEcho(t, client)
+}
+
+func TestPipeStreamReset(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+	sstr.CancelRead(42)
+
+	_, err = str.Write([]byte("foobar"))
+	var strErr *webtransport.StreamError
+	require.True(t, errors.As(err, &strErr))
+	require.Equal(t, webtransport.ErrorCode(42), strErr.ErrorCode)
+}
+
+func TestPipeDeadline(t *testing.T) {
+	client, _ := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.SetReadDeadline(time.Now().Add(scaleDuration(20*time.Millisecond))))
+	_, err = str.Read([]byte{0})
+	var nerr interface{ Timeout() bool }
+	require.True(t, errors.As(err, &nerr))
+	require.True(t, nerr.Timeout())
+}
+
+func TestPipeDatagrams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	start := time.Now()
+	require.NoError(t, client.SendMessage([]byte("foo")))
+	require.NoError(t, server.SendMessage([]byte("bar")))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, info, err := server.ReceiveMessageWithInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), b)
+	require.False(t, info.ReceiveTime.Before(start))
+	require.False(t, info.ReceiveTime.After(time.Now()))
+	b, err = client.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), b)
+}
+
+func TestPipeQueuedDatagrams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	require.NoError(t, client.SendMessageWithPriority([]byte("foo"), webtransport.MessagePriorityHigh))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := server.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), b)
+
+	require.NoError(t, client.SendMessageWithTTL([]byte("bar"), time.Second))
+	b, err = server.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), b)
+
+	require.NoError(t, client.Close())
+	require.Error(t, client.SendMessageWithPriority([]byte("baz"), webtransport.MessagePriorityLow))
+}
+
+func TestPipeClose(t *testing.T) {
+	client, server := webtransport.Pipe()
+	require.NoError(t, server.Close())
+
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	_, err := client.AcceptStream(context.Background())
+	require.Error(t, err)
+	_, err = client.OpenStream()
+	require.Error(t, err)
+}
+
+func TestPipeUniStreams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenUniStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rstr, err := server.AcceptUniStream(ctx)
+	require.NoError(t, err)
+	require.Equal(t, str.StreamID(), rstr.StreamID())
+	data, err := io.ReadAll(rstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+}
@@ -0,0 +1,88 @@
+package webtransport
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxPriorityWait is the maximum time a write on a data stream waits for writes on CONNECT streams.
+// It bounds the delay if a CONNECT stream is blocked, e.g. because the client doesn't read it.
+const maxPriorityWait = 50 * time.Millisecond
+
+// priorityGate gives writes on the CONNECT streams of the sessions on a QUIC connection
+// priority over writes on data streams (see Server.DisableConnectStreamPriority).
+// quic-go doesn't support stream priorities: it sends the data of all streams round-robin, and all
+// streams share the connection's flow control window. Without the gate, a capsule can therefore be
+// delayed by bulk transfers, in particular if they use up the connection's flow control window.
+type priorityGate struct {
+	mx      sync.Mutex
+	pending int           // the number of writes on CONNECT streams in progress
+	clear   chan struct{} // closed once no write is pending any more
+}
+
+func newPriorityGate() *priorityGate {
+	return &priorityGate{}
+}
+
+// enter is called before writing on a CONNECT stream. leave must be called once the write returned.
+func (g *priorityGate) enter() {
+	if g == nil {
+		return
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	if g.pending == 0 {
+		g.clear = make(chan struct{})
+	}
+	g.pending++
+}
+
+func (g *priorityGate) leave() {
+	if g == nil {
+		return
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	g.pending--
+	if g.pending == 0 {
+		close(g.clear)
+	}
+}
+
+// busy says if a write on a CONNECT stream is in progress.
+func (g *priorityGate) busy() bool {
+	if g == nil {
+		return false
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	return g.pending > 0
+}
+
+// wait blocks while writes on CONNECT streams are in progress, for up to maxPriorityWait, or until ctx is done.
+func (g *priorityGate) wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mx.Lock()
+	if g.pending == 0 {
+		g.mx.Unlock()
+		return nil
+	}
+	clear := g.clear
+	g.mx.Unlock()
+
+	t := time.NewTimer(maxPriorityWait)
+	defer t.Stop()
+	select {
+	case <-clear:
+	case <-t.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
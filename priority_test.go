@@ -0,0 +1,85 @@
+package webtransport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityGate(t *testing.T) {
+	var nilGate *priorityGate
+	require.False(t, nilGate.busy())
+	require.NoError(t, nilGate.wait(context.Background()))
+	nilGate.enter()
+	nilGate.leave()
+
+	g := newPriorityGate()
+	require.NoError(t, g.wait(context.Background()))
+	g.enter()
+	g.enter()
+	require.True(t, g.busy())
+	done := make(chan error, 1)
+	go func() { done <- g.wait(context.Background()) }()
+	g.leave()
+	select {
+	case <-done:
+		t.Fatal("wait returned while a write is pending")
+	case <-time.After(10 * time.Millisecond):
+	}
+	g.leave()
+	require.False(t, g.busy())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	// waiting is bounded
+	g.enter()
+	defer g.leave()
+	start := time.Now()
+	require.NoError(t, g.wait(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), maxPriorityWait)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, g.wait(ctx), context.Canceled)
+}
+
+func TestConnectStreamPriority(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+	server.priority = newPriorityGate()
+
+	str, err := server.OpenStream()
+	require.NoError(t, err)
+
+	// writes on data streams are paused while a capsule is being sent
+	server.priority.enter()
+	written := make(chan error, 1)
+	go func() {
+		_, err := str.Write([]byte("foobar"))
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("write wasn't paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	server.priority.leave()
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	cstr, err := client.AcceptStream(context.Background())
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(cstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+}
@@ -0,0 +1,60 @@
+package webtransport
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Go routines started by this package carry pprof labels that identify the session
+// (or the QUIC connection) they're working on, so that CPU and goroutine profiles of busy servers
+// can be attributed to individual sessions.
+// The QUIC connection is identified by the same process-local identifier as in log messages (see Conn.String),
+// not by its QUIC connection ID.
+const (
+	profLabelConn       = "webtransport.conn"
+	profLabelRemoteAddr = "webtransport.remote_addr"
+	profLabelSession    = "webtransport.session"
+	profLabelPath       = "webtransport.path"
+)
+
+func connProfLabels(qconn quic.Connection) []string {
+	return []string{profLabelConn, connectionID(qconn), profLabelRemoteAddr, qconn.RemoteAddr().String()}
+}
+
+// connLabelContext returns a context carrying the profiler labels for a QUIC connection.
+// If id is not nil, the labels include the session ID.
+func connLabelContext(qconn quic.Connection, id *sessionID) context.Context {
+	labels := connProfLabels(qconn)
+	if id != nil {
+		labels = append(labels, profLabelSession, strconv.FormatUint(uint64(*id), 10))
+	}
+	return pprof.WithLabels(context.Background(), pprof.Labels(labels...))
+}
+
+// setProfilerLabels sets the profiler labels for the go routines started for this session.
+// It must be called before the session is handed to the application.
+func (c *Conn) setProfilerLabels(path string) {
+	labels := append(connProfLabels(c.qconn),
+		profLabelSession, strconv.FormatUint(uint64(c.sessionID), 10),
+		profLabelPath, path,
+	)
+	c.profLabels = pprof.Labels(labels...)
+	c.profLabelCtx = pprof.WithLabels(context.Background(), c.profLabels)
+}
+
+// goLabeled runs f in a new go routine, which is labeled with the profiler labels carried by ctx.
+func goLabeled(ctx context.Context, f func()) {
+	go func() {
+		pprof.SetGoroutineLabels(ctx)
+		f()
+	}()
+}
+
+// goLabeled runs f in a new go routine, which is labeled with the session's profiler labels.
+// If the session was accepted by a Server, the go routine is tracked by the Server.
+func (c *Conn) goLabeled(f func()) {
+	c.refCount.Go(c.profLabelCtx, f)
+}
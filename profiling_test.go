@@ -0,0 +1,91 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// labeledGoroutines returns the label sets of all goroutines that carry profiler labels.
+func labeledGoroutines(t *testing.T) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	var labels []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(l, "# labels: ") {
+			labels = append(labels, strings.TrimPrefix(l, "# labels: "))
+		}
+	}
+	return labels
+}
+
+func containsLabels(sets []string, labels ...string) bool {
+	for _, set := range sets {
+		found := true
+		for _, l := range labels {
+			if !strings.Contains(set, l) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProfilerLabelsStreamHandler(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("app", "foo"))
+	called := make(chan struct{})
+	done := make(chan struct{})
+	go server.HandleStreams(ctx, func(str Stream) {
+		close(called)
+		<-done
+	})
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	defer close(done)
+
+	// The handler is labeled with the labels of the session, and the labels carried by the context.
+	require.True(t, containsLabels(labeledGoroutines(t),
+		`"app":"foo"`,
+		`"`+profLabelSession+`":"0"`,
+		`"`+profLabelConn+`":"`+connectionID(server.qconn)+`"`,
+		`"`+profLabelRemoteAddr+`":"`+server.RemoteAddr().String()+`"`,
+		`"`+profLabelPath+`":""`,
+	))
+}
+
+func TestProfilerLabelsMessageHandler(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+
+	labels := make(chan []string, 1)
+	go server.HandleMessages(context.Background(), func([]byte) {
+		labels <- labeledGoroutines(t)
+	})
+	require.NoError(t, client.SendMessage([]byte("foobar")))
+	select {
+	case l := <-labels:
+		require.True(t, containsLabels(l, `"`+profLabelSession+`":"0"`, `"`+profLabelConn+`":"`+connectionID(server.qconn)+`"`))
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -1,5 +1,63 @@
 package webtransport
 
-const settingsEnableWebtransport = 0x2b603742
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+const (
+	settingsEnableWebtransport = 0x2b603742
+	// settingsH3Datagram is the setting used by quic-go to enable HTTP/3 datagrams.
+	settingsH3Datagram = 0xffd277
+)
+
+// mergeSettings merges the settings configured by the application into a new map,
+// and adds the settings required for WebTransport. Settings in later maps take precedence.
+// It returns an error if the application sets one of the settings required for WebTransport.
+func mergeSettings(settings ...map[uint64]uint64) (map[uint64]uint64, error) {
+	merged := map[uint64]uint64{settingsEnableWebtransport: 1}
+	for _, m := range settings {
+		for k, v := range m {
+			if k == settingsEnableWebtransport || k == settingsH3Datagram {
+				return nil, fmt.Errorf("webtransport: setting %#x is reserved for WebTransport", k)
+			}
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
 
 const protocolHeader = "webtransport"
+
+// maxDatagramQueueLen is the maximum number of datagrams queued per session, waiting to be received.
+const maxDatagramQueueLen = 128
+
+// readSessionID reads the session ID from the header of a WebTransport stream.
+// The frame type (for bidirectional streams) or the stream type (for unidirectional streams)
+// must already have been consumed.
+func readSessionID(r io.Reader) (sessionID, error) {
+	id, err := quicvarint.Read(quicvarint.NewReader(r))
+	if err != nil {
+		return 0, err
+	}
+	return sessionID(id), nil
+}
+
+// parseDatagram parses a datagram, which consists of the Quarter Stream ID followed by the payload.
+// It returns the session ID, and the payload.
+func parseDatagram(b []byte) (sessionID, []byte, error) {
+	r := bytes.NewReader(b)
+	qsid, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Stream IDs are varints, so the session ID can't exceed the maximum value of a varint.
+	if qsid > quicvarint.Max/4 {
+		return 0, nil, errors.New("invalid Quarter Stream ID")
+	}
+	return sessionID(qsid * 4), b[len(b)-r.Len():], nil
+}
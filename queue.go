@@ -0,0 +1,117 @@
+package webtransport
+
+import "github.com/lucas-clemente/quic-go"
+
+// streamQueue is a FIFO queue of streams, backed by a ring buffer.
+// Unlike a slice that is resliced on every pop, it reuses its backing array,
+// and it doesn't retain references to streams that were already popped.
+// It grows as needed. The number of streams is implicitly limited by QUIC's stream flow control.
+type streamQueue struct {
+	buf  []quic.ReceiveStream // quic.Streams in the queue of bidirectional streams
+	head int
+	n    int
+}
+
+func (q *streamQueue) Len() int { return q.n }
+
+func (q *streamQueue) Push(str quic.ReceiveStream) {
+	if q.n == len(q.buf) {
+		q.grow()
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = str
+	q.n++
+}
+
+// Pop removes the first stream from the queue.
+// It returns nil if the queue is empty.
+func (q *streamQueue) Pop() quic.ReceiveStream {
+	if q.n == 0 {
+		return nil
+	}
+	str := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return str
+}
+
+func (q *streamQueue) grow() {
+	size := 2 * len(q.buf)
+	if size == 0 {
+		size = 8
+	}
+	buf := make([]quic.ReceiveStream, size)
+	for i := 0; i < q.n; i++ {
+		buf[i] = q.buf[(q.head+i)%len(q.buf)]
+	}
+	q.buf = buf
+	q.head = 0
+}
+
+type receivedDatagram struct {
+	data []byte
+	info MessageInfo
+}
+
+// datagramQueue is a bounded FIFO queue of datagrams, backed by a ring buffer.
+// The backing array is allocated once, when the first datagram is pushed.
+type datagramQueue struct {
+	buf  []receivedDatagram
+	head int
+	n    int
+}
+
+func (q *datagramQueue) Len() int { return q.n }
+
+// Push adds a datagram to the queue.
+// It returns false if the queue is full, in which case the datagram is dropped.
+func (q *datagramQueue) Push(d receivedDatagram) bool {
+	if q.buf == nil {
+		q.buf = make([]receivedDatagram, maxDatagramQueueLen)
+	}
+	if q.n == len(q.buf) {
+		return false
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = d
+	q.n++
+	return true
+}
+
+// Pop removes the first datagram from the queue.
+// The queue must not be empty.
+func (q *datagramQueue) Pop() receivedDatagram {
+	b := q.buf[q.head]
+	q.buf[q.head] = receivedDatagram{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return b
+}
+
+// sendQueue is a FIFO queue of serialized datagrams waiting to be sent, backed by a ring buffer.
+// The backing array is allocated once, when the first datagram is pushed.
+// The caller is responsible for not pushing more than maxSendQueueLen datagrams.
+type sendQueue struct {
+	buf  []queuedDatagram
+	head int
+	n    int
+}
+
+func (q *sendQueue) Len() int { return q.n }
+
+func (q *sendQueue) Push(b queuedDatagram) {
+	if q.buf == nil {
+		q.buf = make([]queuedDatagram, maxSendQueueLen)
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = b
+	q.n++
+}
+
+// Pop removes the first datagram from the queue.
+// The queue must not be empty.
+func (q *sendQueue) Pop() queuedDatagram {
+	b := q.buf[q.head]
+	q.buf[q.head] = queuedDatagram{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return b
+}
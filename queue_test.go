@@ -0,0 +1,66 @@
+package webtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockStream is only used to tell streams apart.
+type mockStream struct {
+	quic.Stream
+	id int
+}
+
+func TestStreamQueue(t *testing.T) {
+	var q streamQueue
+	require.Nil(t, q.Pop())
+	var next, popped int
+	// interleave pushes and pops, so that the ring buffer wraps around and grows
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 7*round; i++ {
+			q.Push(&mockStream{id: next})
+			next++
+		}
+		for i := 0; i < 5*round; i++ {
+			str := q.Pop()
+			require.NotNil(t, str)
+			require.Equal(t, popped, str.(*mockStream).id)
+			popped++
+		}
+		require.Equal(t, next-popped, q.Len())
+	}
+	for q.Len() > 0 {
+		require.Equal(t, popped, q.Pop().(*mockStream).id)
+		popped++
+	}
+	require.Equal(t, next, popped)
+	require.Nil(t, q.Pop())
+	// popped streams are not retained
+	for _, str := range q.buf {
+		require.Nil(t, str)
+	}
+}
+
+func TestDatagramQueue(t *testing.T) {
+	var q datagramQueue
+	require.Zero(t, q.Len())
+	for i := 0; i < maxDatagramQueueLen; i++ {
+		require.True(t, q.Push(receivedDatagram{data: []byte{byte(i)}}))
+	}
+	require.False(t, q.Push(receivedDatagram{data: []byte("dropped")}))
+	require.Equal(t, maxDatagramQueueLen, q.Len())
+	require.Equal(t, []byte{0}, q.Pop().data)
+	now := time.Now()
+	require.True(t, q.Push(receivedDatagram{data: []byte("foobar"), info: MessageInfo{ReceiveTime: now}}))
+	for i := 1; i < maxDatagramQueueLen; i++ {
+		require.Equal(t, []byte{byte(i)}, q.Pop().data)
+	}
+	d := q.Pop()
+	require.Equal(t, []byte("foobar"), d.data)
+	require.Equal(t, now, d.info.ReceiveTime)
+	require.Zero(t, q.Len())
+}
@@ -0,0 +1,152 @@
+package webtransport
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// byteRange is a range of stream data, [start, end).
+type byteRange struct {
+	start, end uint64
+}
+
+// streamAckWatch tracks the acknowledgment of the data sent on a stream.
+type streamAckWatch struct {
+	sent  uint64      // the highest offset sent
+	acked []byteRange // sorted, non-overlapping and non-adjacent
+	done  chan struct{}
+}
+
+func (w *streamAckWatch) addAcked(r byteRange) {
+	w.acked = append(w.acked, r)
+	sort.Slice(w.acked, func(i, j int) bool { return w.acked[i].start < w.acked[j].start })
+	merged := w.acked[:1]
+	for _, r := range w.acked[1:] {
+		last := &merged[len(merged)-1]
+		if r.start > last.end {
+			merged = append(merged, r)
+			continue
+		}
+		if r.end > last.end {
+			last.end = r.end
+		}
+	}
+	w.acked = merged
+}
+
+// allAcked says if all data sent on the stream has been acknowledged.
+func (w *streamAckWatch) allAcked() bool {
+	return w.sent > 0 && len(w.acked) == 1 && w.acked[0].start == 0 && w.acked[0].end >= w.sent
+}
+
+// watchStreamAck starts tracking the acknowledgment of the data sent on a stream.
+// The returned channel is closed once data was sent on the stream, and all data sent has been
+// acknowledged by the peer. It must be called before any data is sent on the stream.
+func (m *connMetrics) watchStreamAck(id quic.StreamID) <-chan struct{} {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.ackWatches == nil {
+		m.ackWatches = make(map[quic.StreamID]*streamAckWatch)
+		m.watchedPackets = make(map[logging.PacketNumber][]logging.StreamFrame)
+	}
+	w := &streamAckWatch{done: make(chan struct{})}
+	m.ackWatches[id] = w
+	return w.done
+}
+
+// sentStreamFrames records the frames of watched streams sent in a packet.
+func (m *connMetrics) sentStreamFrames(pn logging.PacketNumber, frames []logging.Frame) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if len(m.ackWatches) == 0 {
+		return
+	}
+	for _, f := range frames {
+		sf, ok := f.(*logging.StreamFrame)
+		if !ok {
+			continue
+		}
+		w, ok := m.ackWatches[sf.StreamID]
+		if !ok {
+			continue
+		}
+		if end := uint64(sf.Offset + sf.Length); end > w.sent {
+			w.sent = end
+		}
+		m.watchedPackets[pn] = append(m.watchedPackets[pn], *sf)
+	}
+}
+
+// ackedPacket is called when a packet is acknowledged (acked is true) or declared lost.
+// Lost stream data is retransmitted in a new packet.
+func (m *connMetrics) ackedPacket(pn logging.PacketNumber, acked bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	frames, ok := m.watchedPackets[pn]
+	if !ok {
+		return
+	}
+	delete(m.watchedPackets, pn)
+	if !acked {
+		return
+	}
+	for _, f := range frames {
+		w, ok := m.ackWatches[f.StreamID]
+		if !ok {
+			continue
+		}
+		w.addAcked(byteRange{start: uint64(f.Offset), end: uint64(f.Offset + f.Length)})
+		if w.allAcked() {
+			close(w.done)
+			delete(m.ackWatches, f.StreamID)
+		}
+	}
+}
+
+// watchResponseAck starts tracking the acknowledgment of the response to the CONNECT request.
+// It must be called before the response is sent.
+func (c *Conn) watchResponseAck() {
+	if c.metrics == nil {
+		return
+	}
+	if m := c.metrics.Get(c.qconn); m != nil {
+		c.responseAcked = m.watchStreamAck(quic.StreamID(c.sessionID))
+	}
+}
+
+// Ready blocks until the peer is known to have processed the establishment of the session,
+// or until ctx is done.
+// On the server side, this is the case once the client has acknowledged the response to the
+// CONNECT request. Streams opened and datagrams sent before that are buffered by the client
+// for a limited time (see Dialer.StreamReorderingTimeout), until it has received the response.
+// Applications that must not rely on the client's buffering (e.g. if the client uses a different
+// implementation) can use Ready to wait for the session to be established on the client side.
+// On the client side, the session is established once Dial returns, so Ready returns immediately.
+// If the acknowledgment can't be tracked, Ready returns immediately as well.
+// It returns a SessionError if the session is closed before the peer acknowledged the response.
+func (c *Conn) Ready(ctx context.Context) error {
+	if c.responseAcked == nil {
+		return nil
+	}
+	select {
+	case <-c.responseAcked:
+		return nil
+	default:
+	}
+	select {
+	case <-c.responseAcked:
+		return nil
+	case <-c.ctx.Done():
+		return c.sessionError()
+	case <-c.qconn.Context().Done():
+		return c.sessionError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
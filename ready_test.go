@@ -0,0 +1,62 @@
+package webtransport
+
+import (
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamAckTracking(t *testing.T) {
+	m := &connMetrics{}
+	tr := &connMetricsTracer{metrics: m}
+	done := m.watchStreamAck(4)
+
+	shortHdr := func(pn logging.PacketNumber) *logging.ExtendedHeader {
+		return &logging.ExtendedHeader{PacketNumber: pn}
+	}
+	isDone := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	tr.SentPacket(shortHdr(1), 1000, nil, []logging.Frame{
+		&logging.StreamFrame{StreamID: 4, Offset: 0, Length: 100},
+		&logging.StreamFrame{StreamID: 8, Offset: 0, Length: 100},
+	})
+	tr.SentPacket(shortHdr(2), 1000, nil, []logging.Frame{&logging.StreamFrame{StreamID: 4, Offset: 100, Length: 50}})
+	// packet numbers of other packet number spaces don't acknowledge stream data
+	tr.AcknowledgedPacket(logging.EncryptionHandshake, 2)
+	tr.AcknowledgedPacket(logging.Encryption1RTT, 2)
+	require.False(t, isDone())
+	tr.LostPacket(logging.Encryption1RTT, 1, logging.PacketLossTimeThreshold)
+	require.False(t, isDone())
+	// the lost data is retransmitted
+	tr.SentPacket(shortHdr(3), 1000, nil, []logging.Frame{&logging.StreamFrame{StreamID: 4, Offset: 0, Length: 60}})
+	tr.SentPacket(shortHdr(4), 1000, nil, []logging.Frame{&logging.StreamFrame{StreamID: 4, Offset: 60, Length: 40}})
+	tr.AcknowledgedPacket(logging.Encryption1RTT, 4)
+	require.False(t, isDone())
+	tr.AcknowledgedPacket(logging.Encryption1RTT, 3)
+	require.True(t, isDone())
+	require.Empty(t, m.ackWatches)
+	require.Empty(t, m.watchedPackets)
+}
+
+func TestStreamAckRanges(t *testing.T) {
+	w := &streamAckWatch{}
+	require.False(t, w.allAcked())
+	w.addAcked(byteRange{start: 10, end: 20})
+	w.addAcked(byteRange{start: 30, end: 40})
+	w.addAcked(byteRange{start: 0, end: 10})
+	require.Equal(t, []byteRange{{0, 20}, {30, 40}}, w.acked)
+	w.sent = 40
+	require.False(t, w.allAcked())
+	w.addAcked(byteRange{start: 15, end: 35})
+	require.Equal(t, []byteRange{{0, 40}}, w.acked)
+	require.True(t, w.allAcked())
+}
@@ -0,0 +1,65 @@
+package webtransport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// refCounter tracks the go routines started by the package.
+// Unlike a sync.WaitGroup, it allows counting the go routines that are currently running.
+type refCounter struct {
+	n  int64 // accessed atomically, must be the first field for 64-bit alignment
+	wg sync.WaitGroup
+}
+
+func (r *refCounter) Add(delta int) {
+	atomic.AddInt64(&r.n, int64(delta))
+	r.wg.Add(delta)
+}
+
+func (r *refCounter) Done() {
+	atomic.AddInt64(&r.n, -1)
+	r.wg.Done()
+}
+
+// Wait waits for all go routines started using Go (and Add) to return.
+// It doesn't wait for handlers started using GoHandler.
+func (r *refCounter) Wait() {
+	r.wg.Wait()
+}
+
+// Count returns the number of go routines that are currently running.
+func (r *refCounter) Count() int {
+	return int(atomic.LoadInt64(&r.n))
+}
+
+// Go runs f in a new go routine, which is labeled with the profiler labels carried by ctx.
+// It is safe to call on a nil refCounter, in which case the go routine is not tracked.
+func (r *refCounter) Go(ctx context.Context, f func()) {
+	if r == nil {
+		goLabeled(ctx, f)
+		return
+	}
+	r.Add(1)
+	goLabeled(ctx, func() {
+		defer r.Done()
+		f()
+	})
+}
+
+// GoHandler runs an application-provided handler in a new go routine.
+// The go routine is counted, but Wait doesn't wait for it, since the package has no control
+// over when the handler returns.
+// It is safe to call on a nil refCounter, in which case the go routine is not tracked.
+func (r *refCounter) GoHandler(ctx context.Context, f func()) {
+	if r == nil {
+		goLabeled(ctx, f)
+		return
+	}
+	atomic.AddInt64(&r.n, 1)
+	goLabeled(ctx, func() {
+		defer atomic.AddInt64(&r.n, -1)
+		f()
+	})
+}
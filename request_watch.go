@@ -0,0 +1,53 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// connClosedReason is the close reason of sessions closed because the QUIC connection was closed.
+const connClosedReason = "connection closed"
+
+// watchRequest closes a session accepted by a Server once the underlying QUIC connection is closed,
+// or once the client canceled the CONNECT request, such that calls blocked in AcceptStream, ReceiveMessage etc.
+// return right away, instead of waiting for the application to close the session.
+//
+// The request's context is the context of the CONNECT stream: quic-go cancels it once the write direction
+// of the stream is closed. This happens when the client cancels the request (by sending STOP_SENDING),
+// but also when http3.Server closes the stream after the handler returned, which doesn't close the session.
+func (c *Conn) watchRequest(reqCtx context.Context) {
+	c.goLabeled(func() {
+		reqDone := reqCtx.Done()
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-c.qconn.Context().Done():
+				c.closeWithReason(connClosedError(c.qconn), connClosedReason)
+				return
+			case <-reqDone:
+				if c.requestCanceled() {
+					c.closeWithReason(&SessionError{Remote: true, Message: "CONNECT request canceled"}, "request canceled")
+					return
+				}
+				reqDone = nil // the handler returned, keep watching the QUIC connection
+			}
+		}
+	})
+}
+
+// requestCanceled says if the client canceled the CONNECT request, by asking the server to stop sending.
+func (c *Conn) requestCanceled() bool {
+	c.connectStrMx.Lock()
+	defer c.connectStrMx.Unlock()
+
+	if c.connectStr == nil {
+		return false
+	}
+	// A zero-length write doesn't send anything, but returns the error that the stream was canceled with.
+	_, err := c.connectStr.Write(nil)
+	var streamErr *quic.StreamError
+	return errors.As(err, &streamErr)
+}
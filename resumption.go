@@ -0,0 +1,109 @@
+package webtransport
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	// DefaultResumptionTokenHeader is the default name of the header carrying the resumption token,
+	// in the response when the token is issued, and in the request when the client resumes a session.
+	DefaultResumptionTokenHeader = "Webtransport-Resumption-Token"
+	// ResumedSessionHeader is the name of the response header carrying the ID of the session
+	// that is resumed, if the server accepted the resumption token.
+	ResumedSessionHeader = "Webtransport-Resumed-Session"
+)
+
+// ResumptionToken returns the token that can be presented to resume this session
+// when reconnecting (see Dialer.Resume).
+// On the server side, it is the token issued by the Server's IssueResumptionToken callback.
+// On the client side, it is the token sent by the server.
+// It returns an empty string if no token was issued.
+func (c *Conn) ResumptionToken() string {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	return c.resumptionToken
+}
+
+// ResumedSession returns the ID of the session this session resumes, as returned by the Server's
+// ResumeSession callback. Applications use it to restore the state of the previous session,
+// e.g. subscriptions.
+// It returns false if the session is not a resumption of a previous session.
+func (c *Conn) ResumedSession() (string, bool) {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	return c.resumedSession, c.resumed
+}
+
+func (c *Conn) setResumption(token, resumedSession string, resumed bool) {
+	c.valuesMx.Lock()
+	defer c.valuesMx.Unlock()
+
+	c.resumptionToken = token
+	c.resumedSession = resumedSession
+	c.resumed = resumed
+}
+
+func (s *Server) resumptionTokenHeader() string {
+	if s.ResumptionTokenHeader == "" {
+		return DefaultResumptionTokenHeader
+	}
+	return s.ResumptionTokenHeader
+}
+
+// resumeSession validates the resumption token presented by the client (if any),
+// issues a new token, and adds the respective response headers.
+func (s *Server) resumeSession(w http.ResponseWriter, c *Conn, r *http.Request) {
+	hdr := s.resumptionTokenHeader()
+	var resumedSession string
+	var resumed bool
+	if token := r.Header.Get(hdr); token != "" && s.ResumeSession != nil {
+		prior, err := s.ResumeSession(c, r, token)
+		if err != nil {
+			c.logf(LogLevelInfo, "rejected resumption token: %s", err)
+		} else {
+			resumedSession = prior
+			resumed = true
+			w.Header().Set(ResumedSessionHeader, prior)
+		}
+	}
+	var token string
+	if s.IssueResumptionToken != nil {
+		token = s.IssueResumptionToken(c, r)
+		if token != "" {
+			w.Header().Set(hdr, token)
+		}
+	}
+	c.setResumption(token, resumedSession, resumed)
+}
+
+func (d *Dialer) resumptionTokenHeader() string {
+	if d.ResumptionTokenHeader == "" {
+		return DefaultResumptionTokenHeader
+	}
+	return d.ResumptionTokenHeader
+}
+
+// Resume is like Dial, but presents a resumption token obtained from a previous session
+// (see Conn.ResumptionToken), asking the server to resume that session.
+// If the server accepts the token, the new session's ResumedSession method returns the ID of the
+// resumed session. Otherwise, the session is established as a new session.
+func (d *Dialer) Resume(ctx context.Context, urlStr string, reqHdr http.Header, token string) (*http.Response, *Conn, error) {
+	hdr := http.Header{}
+	if reqHdr != nil {
+		hdr = reqHdr.Clone()
+	}
+	hdr.Set(d.resumptionTokenHeader(), token)
+	return d.Dial(ctx, urlStr, hdr)
+}
+
+// setResumption stores the resumption token and the resumed session sent by the server.
+func (d *Dialer) setResumption(c *Conn, rsp *http.Response) {
+	resumedSession, resumed := "", false
+	if v := rsp.Header.Values(ResumedSessionHeader); len(v) > 0 {
+		resumedSession, resumed = v[0], true
+	}
+	c.setResumption(rsp.Header.Get(d.resumptionTokenHeader()), resumedSession, resumed)
+}
@@ -0,0 +1,226 @@
+package webtransport
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RuntimeConfig holds the parameters of a Server that can be changed while the server is running,
+// using Server.UpdateConfig.
+// The fields have the same meaning as the respective fields of the Server.
+type RuntimeConfig struct {
+	AllowedOrigins   []string
+	MaxSessions      int
+	SessionRateLimit float64
+	SessionRateBurst int
+
+	// LogLevel and ComponentLogLevels are the log levels (see LogConfig).
+	// They are initialized from the Server's Logging.
+	LogLevel           LogLevel
+	ComponentLogLevels map[LogComponent]LogLevel
+}
+
+func (c *RuntimeConfig) clone() RuntimeConfig {
+	conf := *c
+	if c.AllowedOrigins != nil {
+		conf.AllowedOrigins = append([]string(nil), c.AllowedOrigins...)
+	}
+	if c.ComponentLogLevels != nil {
+		conf.ComponentLogLevels = make(map[LogComponent]LogLevel, len(c.ComponentLogLevels))
+		for comp, lvl := range c.ComponentLogLevels {
+			conf.ComponentLogLevels[comp] = lvl
+		}
+	}
+	return conf
+}
+
+func (c *RuntimeConfig) validate() error {
+	if c.MaxSessions < 0 {
+		return fmt.Errorf("webtransport: invalid MaxSessions: %d", c.MaxSessions)
+	}
+	if c.SessionRateLimit < 0 || math.IsNaN(c.SessionRateLimit) || math.IsInf(c.SessionRateLimit, 0) {
+		return fmt.Errorf("webtransport: invalid SessionRateLimit: %f", c.SessionRateLimit)
+	}
+	if c.SessionRateBurst < 0 {
+		return fmt.Errorf("webtransport: invalid SessionRateBurst: %d", c.SessionRateBurst)
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "" {
+			return errors.New("webtransport: empty origin in AllowedOrigins")
+		}
+	}
+	return nil
+}
+
+// initialRuntimeConfig returns the runtime configuration set by the Server's fields.
+func (s *Server) initialRuntimeConfig() RuntimeConfig {
+	conf := RuntimeConfig{
+		AllowedOrigins:   s.AllowedOrigins,
+		MaxSessions:      s.MaxSessions,
+		SessionRateLimit: s.SessionRateLimit,
+		SessionRateBurst: s.SessionRateBurst,
+		LogLevel:         LogLevelError,
+	}
+	if s.Logging != nil {
+		conf.LogLevel = s.Logging.Level
+		conf.ComponentLogLevels = s.Logging.ComponentLevels
+	}
+	return conf.clone()
+}
+
+// Config returns the parameters that can be changed while the server is running.
+func (s *Server) Config() RuntimeConfig {
+	if err := s.initialize(); err != nil {
+		return s.initialRuntimeConfig()
+	}
+	s.configMx.RLock()
+	defer s.configMx.RUnlock()
+	return s.config.clone()
+}
+
+// UpdateConfig changes parameters of the server while it is running.
+// update is called with the current configuration, and modifies it.
+// If the modified configuration is invalid, it is discarded, and an error is returned.
+// The new configuration applies to requests for new sessions. Established sessions are not affected,
+// e.g. lowering MaxSessions doesn't close any sessions.
+// It is safe to call UpdateConfig concurrently.
+func (s *Server) UpdateConfig(update func(*RuntimeConfig)) error {
+	if err := s.initialize(); err != nil {
+		return err
+	}
+	s.configMx.Lock()
+	defer s.configMx.Unlock()
+
+	conf := s.config.clone()
+	update(&conf)
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	s.applyConfig(conf)
+	return nil
+}
+
+// applyConfig applies the runtime configuration.
+// configMx must be held.
+func (s *Server) applyConfig(conf RuntimeConfig) {
+	s.config = conf.clone()
+	s.logger.setLevels(conf.LogLevel, conf.ComponentLogLevels)
+	s.sessionRate.SetLimit(conf.SessionRateLimit, conf.SessionRateBurst)
+}
+
+// checkOrigin checks the request's origin, using AllowedOrigins if set, and CheckOrigin otherwise.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	s.configMx.RLock()
+	allowedOrigins := s.config.AllowedOrigins
+	s.configMx.RUnlock()
+
+	if len(allowedOrigins) > 0 {
+		return originAllowed(r.Header.Get("Origin"), allowedOrigins)
+	}
+	return s.CheckOrigin(r)
+}
+
+// checkSessionRate enforces the SessionRateLimit.
+// If the request is rejected, it sends the response.
+func (s *Server) checkSessionRate(w http.ResponseWriter) error {
+	if !s.sessionRate.Allow(time.Now()) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return &SessionRejectedError{StatusCode: http.StatusTooManyRequests, Err: ErrSessionRateExceeded}
+	}
+	return nil
+}
+
+// reserveSession reserves a slot for a new session, respecting MaxSessions.
+// If the limit is reached, it sends the response.
+// If it succeeds, releaseSession must be called once the session was added (or the upgrade failed).
+func (s *Server) reserveSession(w http.ResponseWriter) error {
+	s.configMx.RLock()
+	max := s.config.MaxSessions
+	s.configMx.RUnlock()
+
+	s.sessionsMx.Lock()
+	defer s.sessionsMx.Unlock()
+	if max > 0 && len(s.sessions)+s.pendingSessions >= max {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return &SessionRejectedError{StatusCode: http.StatusServiceUnavailable, Err: ErrTooManySessions}
+	}
+	s.pendingSessions++
+	return nil
+}
+
+func (s *Server) releaseSession() {
+	s.sessionsMx.Lock()
+	s.pendingSessions--
+	s.sessionsMx.Unlock()
+}
+
+// originAllowed says if the origin is contained in the allowlist.
+// Requests without an Origin header are allowed: browsers always send one, so these requests
+// don't originate from a web page.
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, o := range allowed {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// A rateLimiter is a token bucket.
+// A zero rate means no limit.
+type rateLimiter struct {
+	mx     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// SetLimit changes the rate and the burst size.
+// If burst is zero, it defaults to the rate (rounded up), but at least 1.
+func (l *rateLimiter) SetLimit(rate float64, burst int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	b := float64(burst)
+	if burst == 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	if l.rate == 0 {
+		// start with a full bucket
+		l.tokens = b
+		l.last = time.Time{}
+	}
+	l.rate = rate
+	l.burst = b
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Allow consumes a token, if one is available.
+func (l *rateLimiter) Allow(now time.Time) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.rate == 0 {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,66 @@
+package webtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	require.True(t, l.Allow(now)) // no limit
+
+	l.SetLimit(2, 3)
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Allow(now))
+	}
+	require.False(t, l.Allow(now))
+	require.False(t, l.Allow(now.Add(400*time.Millisecond)))
+	require.True(t, l.Allow(now.Add(500*time.Millisecond)))
+	require.False(t, l.Allow(now.Add(500*time.Millisecond)))
+	// the bucket doesn't fill beyond the burst size
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Allow(now))
+	}
+	require.False(t, l.Allow(now))
+
+	// changing the limit keeps the current state of the bucket
+	l.SetLimit(10, 0)
+	require.False(t, l.Allow(now))
+	require.True(t, l.Allow(now.Add(100*time.Millisecond)))
+
+	l.SetLimit(0, 0)
+	require.True(t, l.Allow(now))
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	var l rateLimiter
+	l.SetLimit(0.5, 0)
+	now := time.Now()
+	require.True(t, l.Allow(now))
+	require.False(t, l.Allow(now))
+	require.True(t, l.Allow(now.Add(2*time.Second)))
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://example.com", "https://foo.example.com:8443/"}
+	require.True(t, originAllowed("", allowed))
+	require.True(t, originAllowed("https://example.com", allowed))
+	require.True(t, originAllowed("https://EXAMPLE.com", allowed))
+	require.True(t, originAllowed("https://foo.example.com:8443", allowed))
+	require.False(t, originAllowed("http://example.com", allowed))
+	require.False(t, originAllowed("https://foo.example.com", allowed))
+	require.False(t, originAllowed("https://example.com.evil.com", allowed))
+}
+
+func TestLoggerSetLevels(t *testing.T) {
+	var r logRecorder
+	l := newLogger(&LogConfig{Level: LogLevelError, Printf: r.Printf})
+	require.False(t, l.Enabled(LogComponentConn, LogLevelDebug))
+	l.setLevels(LogLevelDebug, map[LogComponent]LogLevel{LogComponentClient: LogLevelNothing})
+	require.True(t, l.Enabled(LogComponentConn, LogLevelDebug))
+	require.False(t, l.Enabled(LogComponentClient, LogLevelError))
+}
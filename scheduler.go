@@ -0,0 +1,147 @@
+package webtransport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// connScheduler schedules the datagrams sent and the streams opened by the sessions on a QUIC connection,
+// such that a session sending a lot of datagrams or opening a lot of streams can't starve the other sessions.
+// quic-go only accepts a single datagram at a time, and hands out stream IDs in the order OpenStreamSync
+// was called, so without scheduling, the session with the most concurrent calls wins.
+type connScheduler struct {
+	datagrams fairQueue
+	bidiOpens fairQueue
+	uniOpens  fairQueue
+}
+
+func newConnScheduler() *connScheduler {
+	return &connScheduler{
+		datagrams: fairQueue{waiters: make(map[*Conn][]chan struct{})},
+		bidiOpens: fairQueue{waiters: make(map[*Conn][]chan struct{})},
+		uniOpens:  fairQueue{waiters: make(map[*Conn][]chan struct{})},
+	}
+}
+
+// fairQueue grants turns to the sessions waiting for it in weighted round-robin order:
+// every session is granted up to its weight (see Conn.SetSchedulingWeight) turns in a row,
+// before the next session waiting is served. Only a single turn is granted at a time.
+type fairQueue struct {
+	mx      sync.Mutex
+	busy    bool // set while a turn is granted
+	waiters map[*Conn][]chan struct{}
+	ring    []*Conn // the sessions with waiters, in round-robin order
+	next    int     // index into ring of the session that is served next
+	current *Conn   // the session that was granted the last turn
+	credits int     // the number of turns the current session is granted before the next session is served
+}
+
+// acquire blocks until it's the session's turn, or until ctx is done.
+// If it returns nil, release must be called once the turn is done.
+func (q *fairQueue) acquire(ctx context.Context, c *Conn) error {
+	q.mx.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mx.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	if len(q.waiters[c]) == 0 {
+		q.ring = append(q.ring, c)
+	}
+	q.waiters[c] = append(q.waiters[c], ch)
+	q.mx.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		q.mx.Lock()
+		removed := q.removeWaiter(c, ch)
+		q.mx.Unlock()
+		if !removed { // the turn was granted concurrently
+			q.release()
+		}
+		return ctx.Err()
+	}
+}
+
+// release ends the current turn, and grants the next turn to a waiting session (if any).
+func (q *fairQueue) release() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	if len(q.ring) == 0 {
+		q.busy = false
+		q.current = nil
+		return
+	}
+	var c *Conn
+	if q.current != nil && q.credits > 0 && len(q.waiters[q.current]) > 0 {
+		c = q.current
+		q.credits--
+	} else {
+		if q.next >= len(q.ring) {
+			q.next = 0
+		}
+		c = q.ring[q.next]
+		q.next++
+		q.current = c
+		q.credits = c.schedulingWeight() - 1
+	}
+	ch := q.waiters[c][0]
+	q.waiters[c] = q.waiters[c][1:]
+	if len(q.waiters[c]) == 0 {
+		delete(q.waiters, c)
+		q.removeFromRing(c)
+	}
+	close(ch)
+}
+
+// removeWaiter removes a waiter whose context was cancelled.
+// It returns false if the waiter was already granted its turn.
+func (q *fairQueue) removeWaiter(c *Conn, ch chan struct{}) bool {
+	waiters := q.waiters[c]
+	for i, w := range waiters {
+		if w != ch {
+			continue
+		}
+		q.waiters[c] = append(waiters[:i], waiters[i+1:]...)
+		if len(q.waiters[c]) == 0 {
+			delete(q.waiters, c)
+			q.removeFromRing(c)
+		}
+		return true
+	}
+	return false
+}
+
+func (q *fairQueue) removeFromRing(c *Conn) {
+	for i, s := range q.ring {
+		if s != c {
+			continue
+		}
+		q.ring = append(q.ring[:i], q.ring[i+1:]...)
+		if i < q.next {
+			q.next--
+		}
+		return
+	}
+}
+
+// SetSchedulingWeight sets the weight of the session, if FairScheduling is enabled on the Server or the Dialer.
+// When multiple sessions on the same QUIC connection send datagrams or open streams at the same time,
+// a session with weight n is granted up to n datagrams (or streams) in a row, before the next session's turn.
+// The default weight is 1, i.e. all sessions are served round-robin. Weights smaller than 1 are treated as 1.
+// The weight also determines the session's share of the Server's (or the Dialer's) BandwidthLimit.
+func (c *Conn) SetSchedulingWeight(w int) {
+	atomic.StoreInt32(&c.weight, int32(w))
+}
+
+func (c *Conn) schedulingWeight() int {
+	if w := int(atomic.LoadInt32(&c.weight)); w > 1 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,91 @@
+package webtransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitForWaiters waits until n turns are queued for c.
+func waitForWaiters(t *testing.T, q *fairQueue, c *Conn, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		q.mx.Lock()
+		defer q.mx.Unlock()
+		return len(q.waiters[c]) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestFairQueueWeightedRoundRobin(t *testing.T) {
+	q := &newConnScheduler().datagrams
+	a, b := &Conn{}, &Conn{}
+	a.SetSchedulingWeight(2)
+
+	require.NoError(t, q.acquire(context.Background(), a)) // hold the turn while queueing
+	order := make(chan string, 8)
+	enqueue := func(c *Conn, name string, n int) {
+		go func() {
+			require.NoError(t, q.acquire(context.Background(), c))
+			order <- name
+			q.release()
+		}()
+		waitForWaiters(t, q, c, n)
+	}
+	for i := 1; i <= 4; i++ {
+		enqueue(a, "A", i)
+	}
+	for i := 1; i <= 4; i++ {
+		enqueue(b, "B", i)
+	}
+	q.release()
+
+	var got string
+	for i := 0; i < 8; i++ {
+		select {
+		case name := <-order:
+			got += name
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, got %s", got)
+		}
+	}
+	require.Equal(t, "AABAABBB", got)
+}
+
+func TestFairQueueCancel(t *testing.T) {
+	q := &newConnScheduler().datagrams
+	a, b := &Conn{}, &Conn{}
+	require.NoError(t, q.acquire(context.Background(), a))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() { errChan <- q.acquire(ctx, b) }()
+	waitForWaiters(t, q, b, 1)
+	cancel()
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	q.mx.Lock()
+	require.Empty(t, q.ring)
+	q.mx.Unlock()
+
+	q.release()
+	// the queue is idle again, and grants the turn immediately
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, q.acquire(ctx, b))
+	q.release()
+}
+
+func TestSchedulingWeight(t *testing.T) {
+	c := &Conn{}
+	require.Equal(t, 1, c.schedulingWeight())
+	c.SetSchedulingWeight(-1)
+	require.Equal(t, 1, c.schedulingWeight())
+	c.SetSchedulingWeight(3)
+	require.Equal(t, 3, c.schedulingWeight())
+}
@@ -2,18 +2,20 @@ package webtransport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
-	"github.com/lucas-clemente/quic-go/quicvarint"
 )
 
 const (
@@ -23,7 +25,8 @@ const (
 )
 
 const (
-	webTransportFrameType = 0x41
+	webTransportFrameType     = 0x41
+	webTransportUniStreamType = 0x54
 )
 
 type streamIDGetter interface {
@@ -41,6 +44,63 @@ type Server struct {
 	// after the first WebTransport stream(s) for that session.
 	// Defaults to 5 seconds.
 	StreamReorderingTimeout time.Duration
+	// BufferedStreams configures what happens to streams once the StreamReorderingTimeout fires.
+	// If unset, they are reset using WebTransportBufferedStreamRejectedErrorCode.
+	BufferedStreams *BufferedStreamConfig
+	// MaxBufferedStreams limits the number of streams waiting for their session to be established,
+	// across all sessions and QUIC connections. Every buffered stream is kept until the StreamReorderingTimeout
+	// fires, so without a limit, a client can make the server hold thousands of streams by opening streams
+	// for sessions that are never established. Once the limit is reached, new streams for sessions that are
+	// not established yet are reset using WebTransportBufferedStreamRejectedErrorCode (see DebugState).
+	// Streams for established sessions are not affected.
+	// If zero, the number of buffered streams is not limited.
+	MaxBufferedStreams int
+
+	// SessionMemoryLimit limits the memory (in bytes) a session may hold in buffers for data the application
+	// didn't consume yet: datagrams that were not received (using ReceiveMessage), and streams that were
+	// not accepted (using AcceptStream), including streams waiting for the session to be established.
+	// Every stream is accounted for with a fixed size, as an estimate of the state kept for it.
+	// Once the limit is reached, received datagrams are dropped, and new streams are reset using
+	// WebTransportBufferedStreamRejectedErrorCode, until the application catches up.
+	// This is reported in the session's stats (see SessionStats), and dropped datagrams are reported to the Tracer.
+	// This protects servers with many sessions against clients that send faster than the application consumes.
+	// If zero, the memory is not limited, although the datagram queue still has a fixed length.
+	SessionMemoryLimit int
+	// SlowConsumers configures the detection of sessions whose application doesn't consume
+	// the streams and datagrams received. If unset, slow consumers are not detected.
+	SlowConsumers *SlowConsumerConfig
+	// Heartbeat configures a watchdog that closes sessions whose client doesn't answer liveness probes.
+	// If unset, no probes are sent. Probes sent by the client are always answered.
+	Heartbeat *HeartbeatConfig
+
+	// FairScheduling schedules the datagrams sent and the streams opened (using OpenStreamSync and
+	// OpenUniStreamSync) by the sessions on the same QUIC connection in weighted round-robin order
+	// (see Conn.SetSchedulingWeight), such that a session sending a lot can't starve the other sessions.
+	// OpenStream and OpenUniStream don't block, and are therefore not scheduled.
+	FairScheduling bool
+
+	// BandwidthLimit limits the rate (in bytes per second) at which the sessions on a QUIC connection
+	// send data, on streams and in datagrams. When multiple sessions are sending, every session gets
+	// a share of the bandwidth in proportion to its scheduling weight (see Conn.SetSchedulingWeight).
+	// This can be used to guarantee real-time sessions a share of the uplink, when sharing a QUIC connection
+	// with sessions transferring bulk data. The rate of individual sessions is limited using Conn.SetBandwidthLimit.
+	// A value of 0 means no limit.
+	BandwidthLimit int
+
+	// DisableConnectStreamPriority disables prioritizing the CONNECT streams of sessions over their data streams.
+	// The CONNECT stream carries the capsules that control the session, e.g. the drain and close notifications.
+	// quic-go doesn't support stream priorities: it sends the data of all streams round-robin, and all streams
+	// share the connection's flow control window, so bulk transfers can delay capsules considerably.
+	// Therefore, by default, writes on the data streams of the sessions on a QUIC connection are paused
+	// while a capsule is being sent, for up to 50ms. Large writes are split, and only the remaining part is paused.
+	// Since only the server sends capsules, there's no equivalent option on the Dialer.
+	DisableConnectStreamPriority bool
+
+	// AdditionalSettings are HTTP/3 settings sent in addition to the settings required for WebTransport,
+	// e.g. to negotiate an application-specific extension. They are merged with H3.AdditionalSettings,
+	// and take precedence. The settings required for WebTransport (and for HTTP/3 datagrams) are added
+	// by the Server, and must not be set.
+	AdditionalSettings map[uint64]uint64
 
 	// CheckOrigin is used to validate the request origin, thereby preventing cross-site request forgery.
 	// CheckOrigin returns true if the request Origin header is acceptable.
@@ -48,14 +108,240 @@ type Server struct {
 	// matches the request's Host header.
 	CheckOrigin func(r *http.Request) bool
 
+	// AllowedOrigins is the list of origins (e.g. "https://example.com") that are allowed to establish sessions.
+	// If set, it is used instead of CheckOrigin. Requests without an Origin header are allowed.
+	// It can be changed while the server is running, using UpdateConfig.
+	AllowedOrigins []string
+	// MaxSessions is the maximum number of concurrent sessions.
+	// Once it is reached, Upgrade rejects requests with status 503, and returns a SessionRejectedError.
+	// It can be changed while the server is running, using UpdateConfig.
+	// If zero, there's no limit.
+	MaxSessions int
+	// SessionRateLimit is the maximum rate of new sessions, in sessions per second.
+	// Upgrade rejects requests exceeding it with status 429, and returns a SessionRejectedError.
+	// SessionRateBurst is the number of sessions that can be established at once. It defaults to
+	// SessionRateLimit (rounded up), but at least 1.
+	// They can be changed while the server is running, using UpdateConfig.
+	// If SessionRateLimit is zero, there's no limit.
+	SessionRateLimit float64
+	SessionRateBurst int
+
+	// OnSessionRequest is called by Upgrade for every CONNECT request, after checking the origin,
+	// allowing the application to accept or reject sessions in a central place, e.g. based on load or authentication.
+	// The returned headers are added to the response, regardless of whether the request is accepted.
+	// If it returns an error, or a status code other than 0 or 2xx, the request is rejected:
+	// the response is sent with the status code (defaulting to 403 if it is 0 or 2xx),
+	// and Upgrade returns a SessionRejectedError.
+	OnSessionRequest func(*http.Request) (status int, hdr http.Header, err error)
+	// OnSessionEstablished is called by Upgrade for every session, after the response was sent.
+	// Upgrade returns once it returns, so it should not block.
+	OnSessionEstablished func(*Conn, *http.Request)
+	// OnSessionClosed is called for every session established by Upgrade, once the session ends.
+	// The error is nil if the session was closed by the application (using Close or CloseGracefully),
+	// http.ErrServerClosed if the server was closed, and the error the QUIC connection was closed with otherwise.
+	OnSessionClosed func(*Conn, error)
+
+	// RoutingToken is called by Upgrade for every session before the response is sent.
+	// It returns the session's routing token (see Conn.SetRoutingToken), which is sent to the client
+	// in the RoutingTokenHeader response header. The client can present it when reconnecting,
+	// allowing a load balancer to route it to the same backend.
+	// If it returns an empty string, no header is sent.
+	RoutingToken func(*Conn, *http.Request) string
+	// RoutingTokenHeader is the name of the header that carries the routing token.
+	// Defaults to DefaultRoutingTokenHeader.
+	RoutingTokenHeader string
+
+	// IssueResumptionToken is called by Upgrade for every session before the response is sent.
+	// It returns a token that allows the client to resume the session when reconnecting (see Dialer.Resume),
+	// which is sent to the client in the ResumptionTokenHeader response header.
+	// If it returns an empty string, no header is sent.
+	IssueResumptionToken func(*Conn, *http.Request) string
+	// ResumeSession is called by Upgrade for requests that present a resumption token,
+	// before the response is sent. It validates the token, and returns the ID of the session
+	// that is resumed (see Conn.ResumedSession), which is also sent to the client.
+	// If it returns an error, the token is ignored, and the session is established as a new session.
+	ResumeSession func(c *Conn, r *http.Request, token string) (string, error)
+	// ResumptionTokenHeader is the name of the header that carries the resumption token.
+	// Defaults to DefaultResumptionTokenHeader.
+	ResumptionTokenHeader string
+
+	// SessionDirectory is notified of sessions that are established and closed.
+	// Sessions are registered with their label (see Conn.SetLabel) as the key, which has to be set
+	// before Upgrade returns, i.e. in OnSessionEstablished. Sessions without a label are not registered.
+	// Registering happens after OnSessionEstablished returns, and blocks Upgrade.
+	// Defaults to a MemorySessionDirectory.
+	SessionDirectory SessionDirectory
+	// NodeID identifies this server in the SessionDirectory.
+	// Defaults to the host name.
+	NodeID string
+
+	// BroadcastConcurrency is the maximum number of sessions that Broadcast and BroadcastStream
+	// send to concurrently.
+	// Defaults to 16.
+	BroadcastConcurrency int
+
+	// PanicHandler is called when a handler passed to Conn.HandleStreams or Conn.HandleMessages panics.
+	// If unset, the panic is logged.
+	PanicHandler PanicHandler
+
+	// MaxConcurrentStreamHandlers limits the number of handlers passed to Conn.HandleStreams
+	// that run concurrently, across all sessions.
+	// Once the limit is reached, no new streams are accepted until one of the handlers returns.
+	// Sessions blocked in HandleStreams waiting for a stream don't count towards the limit.
+	// If zero, there's no limit.
+	MaxConcurrentStreamHandlers int
+
+	// DSCP is the Differentiated Services Code Point (RFC 2474) that all packets are marked with.
+	// It has to fit in 6 bits. If zero, packets are not marked.
+	// For a packet conn passed to Serve, the DSCP is set on that packet conn.
+	DSCP uint8
+
+	// UDPBufferSizes are the sizes of the receive and send buffers of the UDP socket.
+	// Zero values leave the respective buffer size at the OS default.
+	// For a packet conn passed to Serve, the buffer sizes are set on that packet conn.
+	UDPBufferSizes UDPBufferSizes
+	// UDPBufferSizesCallback, if set, is called with the actual buffer sizes after setting UDPBufferSizes.
+	// The OS might not honor the requested sizes, e.g. on Linux, they are capped by the
+	// net.core.rmem_max and net.core.wmem_max sysctls, and the kernel reports double the requested size.
+	// It is not called on platforms that don't allow inspecting the buffer sizes.
+	UDPBufferSizesCallback func(requested, actual UDPBufferSizes)
+
+	// KeyLogWriter optionally specifies a destination for TLS master secrets
+	// in NSS key log format, which can be used to decrypt the QUIC packets, e.g. with Wireshark.
+	// Use of KeyLogWriter compromises security and should only be used for debugging.
+	KeyLogWriter io.Writer
+
+	// RequireAddressValidation is called for every new QUIC connection.
+	// If it returns true, the client's address is validated by sending a Retry packet
+	// (unless the client presented a valid address validation token), which protects against
+	// amplification attacks at the cost of an additional round trip.
+	// If unset, quic-go's default applies, which is to validate the address of every client.
+	// It must not be used together with H3.QuicConfig.AcceptToken.
+	RequireAddressValidation func(net.Addr) bool
+
+	// ConnectionIDLength is the length of the connection IDs the server chooses, in bytes.
+	// QUIC-aware load balancers that route on connection IDs typically require a certain length.
+	// It can be 0, or any value between 4 and 18. If zero, quic-go's default (4 bytes) is used.
+	// Note that quic-go generates connection IDs randomly; it doesn't allow encoding
+	// routing information into the connection ID.
+	ConnectionIDLength int
+
+	// StrictDatagrams makes the server close the QUIC connection with an H3_DATAGRAM_ERROR
+	// when it receives a malformed datagram, or a datagram for an unknown session.
+	// By default, these datagrams are dropped, and counted in DroppedDatagrams.
+	// Clients that send datagrams before receiving the response to their CONNECT request
+	// will fail in strict mode, as the server only knows the session once it has accepted it.
+	StrictDatagrams bool
+
+	// Strict enables validation of the client's behavior, to aid debugging of interoperability issues.
+	// If the client violates the protocol, the QUIC connection is closed with the respective HTTP/3 error code,
+	// and the violation is reported to ProtocolViolationHandler.
+	// The following violations are detected:
+	//  * streams with a session ID that is not a client-initiated bidirectional stream ID
+	//  * streams for sessions that are not established within StreamReorderingTimeout
+	//  * sessions that are established twice on the same stream
+	//  * malformed datagrams, and datagrams for unknown sessions (see StrictDatagrams)
+	// quic-go processes the HTTP/3 control stream internally, so it's not possible to detect
+	// streams that arrive before the client's SETTINGS.
+	Strict bool
+	// ProtocolViolationHandler is called when a protocol violation is detected in strict mode,
+	// or in StrictDatagrams mode.
+	// If unset, the violation is logged.
+	ProtocolViolationHandler func(quic.Connection, *ProtocolViolationError)
+
+	// DisableDatagrams disables support for datagrams: neither QUIC datagrams nor HTTP/3 datagrams
+	// (H3_DATAGRAM) are advertised to the client. This is useful for applications that only use streams,
+	// since it reduces the attack surface. Sending and receiving datagrams then fails with ErrDatagramsDisabled.
+	// Datagrams are also disabled for sessions with clients that don't support them.
+	DisableDatagrams bool
+	// RequireDatagrams makes Upgrade reject requests from clients that don't support datagrams, instead of
+	// establishing sessions that can't send or receive datagrams. Upgrade then returns an UpgradeError
+	// with status 400, wrapping ErrDatagramsNotSupported. It has no effect if DisableDatagrams is set.
+	RequireDatagrams bool
+
+	// DatagramStatsInterval is the interval at which datagram statistics are reported to the client
+	// (see Conn.PeerDatagramStats). If zero, no statistics are reported.
+	// The statistics are sent on a separate stream, using a non-standard HTTP/3 frame type.
+	// This should only be enabled if the client is known to support this extension (e.g. if it uses webtransport-go).
+	DatagramStatsInterval time.Duration
+
+	// Logging configures logging.
+	// If unset, errors are logged using log.Printf.
+	// The log levels can be changed while the server is running, using UpdateConfig.
+	Logging *LogConfig
+
+	// Tracer is notified of events on all sessions, and of datagrams and streams that
+	// can't be associated with a session.
+	Tracer Tracer
+
+	// HandshakeTimeout limits the time a client has to establish a session on a new QUIC connection,
+	// starting when the server accepts the QUIC connection. This includes the QUIC handshake,
+	// sending the CONNECT request, and the handler calling Upgrade.
+	// QUIC connections on which no session is established in time are closed with H3_NO_ERROR,
+	// which prevents clients from holding on to connections without using them for WebTransport.
+	// If zero, there's no limit.
+	HandshakeTimeout time.Duration
+	// UpgradeTimeout limits the time between receiving a CONNECT request and the handler calling Upgrade.
+	// Once it expires, the request's context is cancelled, and Upgrade returns an error.
+	// H3.Handler must be set before the server is started.
+	// If zero, there's no limit.
+	UpgradeTimeout time.Duration
+
+	// ShutdownTimeout is the time sessions are given to finish their streams when the server
+	// is shut down by cancelling the context passed to ListenAndServeContext.
+	// Defaults to 10 seconds.
+	ShutdownTimeout time.Duration
+
+	// AccessLog, if set, receives one entry for every session accepted using Upgrade,
+	// written when the session ends.
+	AccessLog io.Writer
+	// AccessLogFormat formats the entries written to AccessLog.
+	// Defaults to AccessLogCommon.
+	AccessLogFormat AccessLogFormat
+
+	// ServeHealthChecks makes the server respond to requests for /healthz and /readyz
+	// (see HealthHandler and ReadinessHandler), before passing requests to H3.Handler.
+	// H3.Handler must be set before the server is started.
+	ServeHealthChecks bool
+
+	// Audit, if set, records session lifecycle events: rejected and accepted sessions, and closed sessions.
+	Audit *AuditLog
+
+	listeners int32 // number of running Serve / ListenAndServe calls, accessed atomically
+
 	ctx       context.Context // is closed when Close is called
 	ctxCancel context.CancelFunc
-	refCount  sync.WaitGroup
+	refCount  *refCounter // tracks the go routines started for sessions accepted by this server
+
+	shutdownMx   sync.Mutex
+	shuttingDown bool // no new sessions are accepted during shutdown
 
 	initOnce sync.Once
 	initErr  error
 
-	conns *sessionManager
+	configMx    sync.RWMutex
+	config      RuntimeConfig // the parameters that can be changed at runtime, see UpdateConfig
+	sessionRate rateLimiter
+
+	conns      *sessionManager
+	directory  SessionDirectory
+	nodeID     string
+	handshakes *handshakeTracker // nil if HandshakeTimeout is not set
+
+	streamHandlerSem chan struct{}
+	metrics          *metricsTracer
+	logger           *logger
+	accessLog        *accessLogger // nil if AccessLog is not set
+
+	sessionsMx  sync.Mutex
+	sessions    map[*Conn]struct{}
+	adminCloses map[*Conn]string // sessions closed using CloseSession, and the reason
+	// pendingSessions is the number of sessions that were accepted, but not yet added to sessions.
+	// It's used to enforce MaxSessions.
+	pendingSessions int
+
+	udpConnsMx sync.Mutex
+	udpConns   []net.PacketConn // UDP sockets created by the server, closed when the server is closed
 }
 
 func (s *Server) initialize() error {
@@ -67,57 +353,275 @@ func (s *Server) initialize() error {
 
 func (s *Server) init() error {
 	s.ctx, s.ctxCancel = context.WithCancel(context.Background())
+	s.refCount = &refCounter{}
 	timeout := s.StreamReorderingTimeout
 	if timeout == 0 {
 		timeout = 5 * time.Second
 	}
 	s.conns = newSessionManager(timeout)
+	s.conns.strictDatagrams = s.StrictDatagrams
+	s.conns.strict = s.Strict
+	s.conns.onViolation = s.ProtocolViolationHandler
+	s.logger = newLogger(s.Logging)
+	if s.logger == nil {
+		// The server always uses its own logger, so that the log level can be changed using UpdateConfig.
+		s.logger = newLogger(&LogConfig{Level: LogLevelError})
+	}
+	s.conns.logger = s.logger
+	s.conns.tracer = s.Tracer
+	s.conns.bufferedStreams = s.BufferedStreams
+	s.conns.memoryLimit = s.SessionMemoryLimit
+	s.conns.maxBufferedStreams = s.MaxBufferedStreams
+	s.conns.fairScheduling = s.FairScheduling
+	s.conns.bandwidthLimit = s.BandwidthLimit
+	s.conns.connectStreamPriority = !s.DisableConnectStreamPriority
+	if s.AccessLog != nil {
+		s.accessLog = newAccessLogger(s.AccessLog, s.AccessLogFormat)
+	}
+	if s.HandshakeTimeout > 0 {
+		s.handshakes = newHandshakeTracker()
+	}
+	if s.UpgradeTimeout > 0 {
+		s.H3.Handler = upgradeTimeoutHandler(s.H3.Handler, s.UpgradeTimeout)
+	}
+	if s.ServeHealthChecks {
+		s.H3.Handler = s.healthCheckHandler(s.H3.Handler)
+	}
+	s.sessions = make(map[*Conn]struct{})
+	s.directory = s.SessionDirectory
+	if s.directory == nil {
+		s.directory = &MemorySessionDirectory{}
+	}
+	s.nodeID = s.NodeID
+	if s.nodeID == "" {
+		s.nodeID, _ = os.Hostname()
+	}
+	if s.MaxConcurrentStreamHandlers > 0 {
+		s.streamHandlerSem = make(chan struct{}, s.MaxConcurrentStreamHandlers)
+	}
 	if s.CheckOrigin == nil {
 		s.CheckOrigin = checkSameOrigin
 	}
+	if s.KeyLogWriter != nil && s.H3.Server != nil && s.H3.TLSConfig != nil {
+		tlsConf := s.H3.TLSConfig.Clone()
+		tlsConf.KeyLogWriter = s.KeyLogWriter
+		s.H3.TLSConfig = tlsConf
+	}
+
+	if err := validateConnectionIDLength(s.ConnectionIDLength); err != nil {
+		return err
+	}
+	conf := s.initialRuntimeConfig()
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	s.configMx.Lock()
+	s.applyConfig(conf)
+	s.configMx.Unlock()
 
 	// configure the http3.Server
-	if s.H3.AdditionalSettings == nil {
-		s.H3.AdditionalSettings = make(map[uint64]uint64)
+	s.metrics = newMetricsTracer()
+	s.H3.QuicConfig = s.metrics.addToConfig(s.H3.QuicConfig)
+	if s.ConnectionIDLength != 0 {
+		s.H3.QuicConfig.ConnectionIDLength = s.ConnectionIDLength
 	}
-	s.H3.AdditionalSettings[settingsEnableWebtransport] = 1
-	s.H3.EnableDatagrams = true
+	if s.RequireAddressValidation != nil {
+		if s.H3.QuicConfig.AcceptToken != nil {
+			return errors.New("AcceptToken already set")
+		}
+		s.H3.QuicConfig.AcceptToken = newAcceptToken(s.RequireAddressValidation)
+	}
+	settings, err := mergeSettings(s.H3.AdditionalSettings, s.AdditionalSettings)
+	if err != nil {
+		return err
+	}
+	s.H3.AdditionalSettings = settings
+	s.H3.EnableDatagrams = !s.DisableDatagrams
 	if s.H3.StreamHijacker != nil {
 		return errors.New("StreamHijacker already set")
 	}
 	s.H3.StreamHijacker = func(ft http3.FrameType, qconn quic.Connection, str quic.Stream) (bool /* hijacked */, error) {
+		if ft == datagramStatsFrameType {
+			s.conns.AddDatagramStatsStream(qconn, str)
+			return true, nil
+		}
+		if ft == heartbeatFrameType {
+			s.conns.AddHeartbeatStream(qconn, str)
+			return true, nil
+		}
 		if ft != webTransportFrameType {
 			return false, nil
 		}
-		id, err := quicvarint.Read(quicvarint.NewReader(str))
+		id, err := readSessionID(str)
 		if err != nil {
 			return false, err
 		}
-		s.conns.AddStream(qconn, str, sessionID(id))
+		s.conns.AddStream(qconn, str, id)
 		return true, nil
 	}
 	return nil
 }
 
+func (s *Server) socketOptions() *socketOptions {
+	return &socketOptions{
+		dscp:          s.DSCP,
+		bufferSizes:   s.UDPBufferSizes,
+		onBufferSizes: s.UDPBufferSizesCallback,
+	}
+}
+
 func (s *Server) Serve(conn net.PacketConn) error {
 	if err := s.initialize(); err != nil {
 		return err
 	}
-	return s.H3.Serve(conn)
+	defer s.trackListener()()
+	if err := s.socketOptions().apply(conn); err != nil {
+		return err
+	}
+	return s.serveConn(conn, s.H3.TLSConfig)
+}
+
+// serveConn serves the packet conn.
+// Unlike http3.Server.Serve, it allows receiving WebTransport unidirectional streams (see uniStreamConn),
+// and tracking the QUIC connections accepted.
+func (s *Server) serveConn(conn net.PacketConn, tlsConf *tls.Config) error {
+	if s.H3.Server == nil {
+		return errors.New("use of http3.Server without http.Server")
+	}
+	quicConf := s.H3.QuicConfig.Clone()
+	quicConf.EnableDatagrams = !s.DisableDatagrams
+	ln, err := quic.ListenEarly(conn, http3.ConfigureTLSConfig(tlsConf), quicConf)
+	if err != nil {
+		return err
+	}
+	ln = &uniStreamListener{EarlyListener: ln, onStream: s.conns.AddUniStream}
+	if s.handshakes != nil {
+		ln = &connTrackingListener{
+			EarlyListener: ln,
+			onConn: func(qconn quic.EarlyConnection) {
+				s.handshakes.Track(s.ctx, s.refCount, qconn, s.HandshakeTimeout, s.logger)
+			},
+		}
+	}
+	return s.H3.ServeListener(ln)
 }
 
 func (s *Server) ListenAndServe() error {
 	if err := s.initialize(); err != nil {
 		return err
 	}
-	return s.H3.ListenAndServe()
+	defer s.trackListener()()
+	conn, err := s.listenUDP(s.socketOptions())
+	if err != nil {
+		return err
+	}
+	return s.serveConn(conn, s.H3.TLSConfig)
+}
+
+// minShutdownLinger is the minimum time the server waits between closing all sessions
+// and closing the QUIC connections, when shutting down.
+const minShutdownLinger = 10 * time.Millisecond
+
+// ListenAndServeContext is like ListenAndServe, but shuts down the server once ctx is cancelled.
+// On shutdown, no new sessions are accepted, and all sessions are closed gracefully (see Conn.CloseGracefully),
+// giving them up to ShutdownTimeout to finish their streams. Then the server is closed.
+// Clients are notified that their sessions are draining (see Conn.PeerDraining), so they can reconnect elsewhere.
+// It returns nil if the server was shut down because ctx was cancelled.
+func (s *Server) ListenAndServeContext(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() { errChan <- s.ListenAndServe() }()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+	err := s.shutdown()
+	<-errChan
+	return err
+}
+
+// shutdown closes all sessions gracefully, and then closes the server.
+func (s *Server) shutdown() error {
+	s.shutdownMx.Lock()
+	s.shuttingDown = true
+	s.shutdownMx.Unlock()
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	sessions := s.Sessions()
+	var wg sync.WaitGroup
+	for _, c := range sessions {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.CloseGracefully(ctx)
+		}(c)
+	}
+	wg.Wait()
+
+	// Closing the server closes the QUIC connections right away, and quic-go doesn't tell us
+	// when the data sent on the streams has been received by the peer.
+	// Give the data that's still in flight a chance to arrive.
+	linger := minShutdownLinger
+	for _, c := range sessions {
+		if est, ok := c.BandwidthEstimate(); ok && 3*est.SmoothedRTT > linger {
+			linger = 3 * est.SmoothedRTT
+		}
+	}
+	t := time.NewTimer(linger)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return s.Close()
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.shutdownMx.Lock()
+	defer s.shutdownMx.Unlock()
+
+	return s.shuttingDown
 }
 
 func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if err := s.initialize(); err != nil {
 		return err
 	}
-	return s.H3.ListenAndServeTLS(certFile, keyFile)
+	defer s.trackListener()()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	conn, err := s.listenUDP(s.socketOptions())
+	if err != nil {
+		return err
+	}
+	return s.serveConn(conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		KeyLogWriter: s.KeyLogWriter,
+	})
+}
+
+// listenUDP creates a UDP socket on the server's address.
+// The socket is closed when the server is closed.
+func (s *Server) listenUDP(opts *socketOptions) (net.PacketConn, error) {
+	if s.H3.Server == nil {
+		return nil, errors.New("use of http3.Server without http.Server")
+	}
+	conn, err := opts.listenUDP(s.H3.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s.udpConnsMx.Lock()
+	s.udpConns = append(s.udpConns, conn)
+	s.udpConnsMx.Unlock()
+	return conn, nil
 }
 
 func (s *Server) Close() error {
@@ -126,34 +630,91 @@ func (s *Server) Close() error {
 	// It only happens if the server is closed without Serve / ListenAndServe having been called.
 	s.initOnce.Do(func() {})
 
+	// Close all sessions, which makes the go routines started for these sessions return.
+	// Sessions are removed from the registry once the server's context is cancelled,
+	// so they need to be collected first.
+	var sessions []*Conn
+	if s.sessions != nil {
+		sessions = s.Sessions()
+	}
 	if s.ctxCancel != nil {
 		s.ctxCancel()
 	}
+	for _, c := range sessions {
+		c.Close()
+	}
+	// Close the HTTP/3 server, since this closes all QUIC connections,
+	// and thereby makes the session manager's go routines return.
+	err := s.H3.Close()
 	if s.conns != nil {
 		s.conns.Close()
 	}
-	err := s.H3.Close()
-	s.refCount.Wait()
+	s.udpConnsMx.Lock()
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+	s.udpConns = nil
+	s.udpConnsMx.Unlock()
+	if s.refCount != nil {
+		s.refCount.Wait()
+	}
 	return err
 }
 
+// GoroutineCount returns the number of go routines that are currently running on behalf of the server.
+// This includes the go routines that dispatch streams and datagrams, the go routines started
+// for the sessions accepted by the server, and stream handlers started by Conn.HandleStreams.
+// Once Close has returned, it is zero, unless stream handlers are still running.
+func (s *Server) GoroutineCount() int {
+	if err := s.initialize(); err != nil {
+		return 0
+	}
+	return s.refCount.Count() + s.conns.refCount.Count()
+}
+
 func (s *Server) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	c, err := s.upgrade(w, r)
+	if err != nil {
+		s.rejectSession(w)
+	}
+	return c, err
+}
+
+// rejectSession resets the streams that were received for the session before its request was rejected.
+func (s *Server) rejectSession(w http.ResponseWriter) {
+	if err := s.initialize(); err != nil {
+		return
+	}
+	str, ok := w.(streamIDGetter)
+	if !ok {
+		return
+	}
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		return
+	}
+	qconn, ok := hijacker.StreamCreator().(quic.Connection)
+	if !ok {
+		return
+	}
+	s.conns.RejectSession(qconn, sessionID(str.StreamID()))
+}
+
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 	if r.Method != http.MethodConnect {
 		return nil, fmt.Errorf("expected CONNECT request, got %s", r.Method)
 	}
 	if r.Proto != protocolHeader {
 		return nil, fmt.Errorf("unexpected protocol: %s", r.Proto)
 	}
-	if v, ok := r.Header[webTransportDraftOfferHeaderKey]; !ok || len(v) != 1 || v[0] != "1" {
-		return nil, fmt.Errorf("missing or invalid %s header", webTransportDraftOfferHeaderKey)
+	if err := s.checkClientSupport(w, r); err != nil {
+		return nil, err
 	}
-	if !s.CheckOrigin(r) {
-		return nil, errors.New("webtransport: request origin not allowed")
+	if err := s.acceptRequest(w, r); err != nil {
+		s.Audit.sessionRejected(r, err)
+		return nil, err
 	}
-	w.Header().Add(webTransportDraftHeaderKey, webTransportDraftHeaderValue)
-	w.WriteHeader(200)
-	w.(http.Flusher).Flush()
-
+	defer s.releaseSession()
 	str, ok := w.(streamIDGetter)
 	if !ok { // should never happen, unless quic-go changed the API
 		return nil, errors.New("failed to get stream ID")
@@ -164,12 +725,289 @@ func (s *Server) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error)
 	if !ok { // should never happen, unless quic-go changed the API
 		return nil, errors.New("failed to hijack")
 	}
-	qconn := hijacker.StreamCreator()
+	qconn, ok := hijacker.StreamCreator().(quic.Connection)
+	if !ok { // should never happen, unless quic-go changed the API
+		return nil, errors.New("failed to get QUIC connection")
+	}
 	c := newConn(sID, qconn, r.Body)
-	s.conns.AddSession(qconn, sID, c)
+	c.panicHandler = s.PanicHandler
+	c.handlerSem = s.streamHandlerSem
+	c.metrics = s.metrics
+	c.logger = s.logger
+	c.tracer = s.Tracer
+	c.refCount = s.refCount
+	c.datagramsDisabled = s.DisableDatagrams || !s.clientSupportsDatagrams(qconn)
+	c.memoryLimit = s.SessionMemoryLimit
+	c.setProfilerLabels(r.URL.Path)
+	// Register the session before sending the response,
+	// so that datagrams the client sends right away can be dispatched.
+	if err := s.conns.AddSession(qconn, sID, c); err != nil {
+		return nil, err
+	}
+	s.addSession(c)
+	s.handshakes.Established(qconn)
+	if c.tracer != nil {
+		c.startTracing()
+	}
+	if s.accessLog != nil || s.OnSessionClosed != nil || s.Audit != nil {
+		var entry *AccessLogEntry
+		if s.accessLog != nil {
+			entry = newAccessLogEntry(c, r)
+		}
+		s.watchSession(c, qconn, entry)
+	}
+	if s.DatagramStatsInterval > 0 && !c.datagramsDisabled {
+		c.goLabeled(func() { c.reportDatagramStats(s.DatagramStatsInterval) })
+	}
+	if s.SlowConsumers != nil && s.SlowConsumers.Timeout > 0 {
+		c.goLabeled(func() { c.watchConsumer(s.SlowConsumers) })
+	}
+	if s.Heartbeat != nil && s.Heartbeat.Interval > 0 {
+		c.goLabeled(func() { c.watchHeartbeat(s.Heartbeat) })
+	}
+
+	c.watchResponseAck()
+	if s.RoutingToken != nil {
+		s.setRoutingToken(w, c, r)
+	}
+	if s.ResumeSession != nil || s.IssueResumptionToken != nil {
+		s.resumeSession(w, c, r)
+	}
+	w.Header().Add(webTransportDraftHeaderKey, webTransportDraftHeaderValue)
+	w.WriteHeader(200)
+	// Take over the CONNECT stream (this flushes the response), so that capsules can be sent on it.
+	// http3.Server still closes the stream once the handler returns.
+	if ds, ok := w.(http3.DataStreamer); ok {
+		c.setConnectStream(ds.DataStream())
+	} else {
+		w.(http.Flusher).Flush()
+	}
+	c.watchRequest(r.Context())
+	if s.Audit != nil {
+		s.Audit.sessionOpened(c, r)
+	}
+	if s.OnSessionEstablished != nil {
+		s.OnSessionEstablished(c, r)
+	}
+	s.registerSession(c, r)
 	return c, nil
 }
 
+// checkClientSupport checks that the client supports what's required to establish the session.
+// quic-go's http3.Server doesn't expose the client's SETTINGS. Clients only offer WebTransport
+// (using the Sec-Webtransport-Http3-Draft02 header) if they enabled it in their SETTINGS,
+// so the header is checked instead. Datagram support is derived from the QUIC transport parameters.
+func (s *Server) checkClientSupport(w http.ResponseWriter, r *http.Request) error {
+	if v, ok := r.Header[webTransportDraftOfferHeaderKey]; !ok || len(v) != 1 || v[0] != "1" {
+		return &UpgradeError{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing or invalid %s header", webTransportDraftOfferHeaderKey),
+		}
+	}
+	if !s.RequireDatagrams || s.DisableDatagrams {
+		return nil
+	}
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		return nil
+	}
+	if qconn, ok := hijacker.StreamCreator().(quic.Connection); ok && !s.clientSupportsDatagrams(qconn) {
+		return &UpgradeError{StatusCode: http.StatusBadRequest, Err: ErrDatagramsNotSupported}
+	}
+	return nil
+}
+
+// clientSupportsDatagrams says if the client supports QUIC datagrams.
+func (s *Server) clientSupportsDatagrams(qconn quic.Connection) bool {
+	if s.metrics != nil {
+		if m := s.metrics.Get(qconn); m != nil {
+			if supported, ok := m.peerSupportsDatagrams(); ok {
+				return supported
+			}
+		}
+	}
+	return qconn.ConnectionState().SupportsDatagrams
+}
+
+// acceptRequest decides if a session is accepted.
+func (s *Server) acceptRequest(w http.ResponseWriter, r *http.Request) error {
+	if !s.checkOrigin(r) {
+		return errors.New("webtransport: request origin not allowed")
+	}
+	if s.isShuttingDown() {
+		return errors.New("webtransport: server shutting down")
+	}
+	if err := s.checkSessionRate(w); err != nil {
+		return err
+	}
+	if s.OnSessionRequest != nil {
+		if err := s.checkSessionRequest(w, r); err != nil {
+			return err
+		}
+	}
+	if err := stopUpgradeTimer(r); err != nil {
+		return err
+	}
+	return s.reserveSession(w)
+}
+
+// checkSessionRequest calls OnSessionRequest.
+// If the request is rejected, it sends the response.
+func (s *Server) checkSessionRequest(w http.ResponseWriter, r *http.Request) error {
+	status, hdr, err := s.OnSessionRequest(r)
+	for k, v := range hdr {
+		for _, val := range v {
+			w.Header().Add(k, val)
+		}
+	}
+	accepted := status == 0 || (status >= 200 && status < 300)
+	if err == nil && accepted {
+		return nil
+	}
+	if accepted {
+		status = http.StatusForbidden
+	}
+	w.WriteHeader(status)
+	return &SessionRejectedError{StatusCode: status, Err: err}
+}
+
+// addSession adds the session to the registry of active sessions.
+// The session is removed once it is closed.
+func (s *Server) addSession(c *Conn) {
+	s.sessionsMx.Lock()
+	s.sessions[c] = struct{}{}
+	s.sessionsMx.Unlock()
+
+	c.goLabeled(func() {
+		select {
+		case <-c.Context().Done():
+		case <-s.ctx.Done():
+		}
+		s.sessionsMx.Lock()
+		delete(s.sessions, c)
+		s.sessionsMx.Unlock()
+	})
+}
+
+// watchSession writes the access log entry (if e is not nil), records the end of the session in the audit log,
+// and calls OnSessionClosed once the session ends.
+func (s *Server) watchSession(c *Conn, qconn quic.Connection, e *AccessLogEntry) {
+	start := time.Now()
+	c.goLabeled(func() {
+		var serverClosed bool
+		select {
+		case <-c.Context().Done():
+		case <-qconn.Context().Done():
+		case <-s.ctx.Done():
+			serverClosed = true
+		}
+		adminReason, adminClosed := s.takeAdminClose(c)
+		// the session is closed when the QUIC connection is closed (see watchRequest)
+		connClosed := c.Context().Err() == nil || c.closeReason == connClosedReason
+		if e != nil {
+			e.finish(c, serverClosed)
+			s.accessLog.Log(e)
+		}
+		if s.Audit != nil {
+			switch {
+			case adminClosed:
+				s.Audit.sessionClosed(c, start, AuditEventSessionAdminClosed, adminReason)
+			case serverClosed || s.ctx.Err() != nil:
+				s.Audit.sessionClosed(c, start, AuditEventSessionAdminClosed, "server closed")
+			case !connClosed:
+				s.Audit.sessionClosed(c, start, AuditEventSessionClosed, c.closeReason)
+			default:
+				s.Audit.sessionClosed(c, start, AuditEventSessionClosed, "connection closed: "+connCloseError(qconn).Error())
+			}
+		}
+		if s.OnSessionClosed != nil {
+			var err error
+			switch {
+			case serverClosed || s.ctx.Err() != nil: // Close closes all sessions after cancelling the server's context
+				err = http.ErrServerClosed
+			case !connClosed:
+			default:
+				err = connCloseError(qconn)
+			}
+			s.OnSessionClosed(c, err)
+		}
+	})
+}
+
+// CloseSession closes a session on behalf of the operator, e.g. to disconnect a misbehaving client.
+// The session is closed using Close, and the closure is recorded in the audit log as
+// an administrative close, with the given reason.
+func (s *Server) CloseSession(c *Conn, reason string) error {
+	if err := s.initialize(); err != nil {
+		return err
+	}
+	s.sessionsMx.Lock()
+	if _, ok := s.sessions[c]; ok && s.Audit != nil {
+		if s.adminCloses == nil {
+			s.adminCloses = make(map[*Conn]string)
+		}
+		s.adminCloses[c] = reason
+	}
+	s.sessionsMx.Unlock()
+	return c.Close()
+}
+
+// takeAdminClose returns the reason passed to CloseSession, if the session was closed using CloseSession.
+func (s *Server) takeAdminClose(c *Conn) (string, bool) {
+	s.sessionsMx.Lock()
+	defer s.sessionsMx.Unlock()
+
+	reason, ok := s.adminCloses[c]
+	delete(s.adminCloses, c)
+	return reason, ok
+}
+
+// DroppedDatagrams returns the number of datagrams that were dropped because they were malformed,
+// or because they didn't belong to a known session.
+func (s *Server) DroppedDatagrams() uint64 {
+	if err := s.initialize(); err != nil {
+		return 0
+	}
+	return s.conns.DroppedDatagrams()
+}
+
+// Sessions returns all active sessions.
+func (s *Server) Sessions() []*Conn {
+	return s.filterSessions(func(*Conn) bool { return true })
+}
+
+// SessionsByRemoteAddr returns all active sessions established from the given remote address.
+func (s *Server) SessionsByRemoteAddr(addr net.Addr) []*Conn {
+	return s.filterSessions(func(c *Conn) bool {
+		return c.RemoteAddr().String() == addr.String()
+	})
+}
+
+// SessionsByLabel returns all active sessions that were assigned the label using Conn.SetLabel.
+func (s *Server) SessionsByLabel(label string) []*Conn {
+	return s.filterSessions(func(c *Conn) bool { return c.Label() == label })
+}
+
+func (s *Server) filterSessions(f func(*Conn) bool) []*Conn {
+	s.sessionsMx.Lock()
+	defer s.sessionsMx.Unlock()
+
+	conns := make([]*Conn, 0, len(s.sessions))
+	for c := range s.sessions {
+		if f(c) {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+func validateConnectionIDLength(l int) error {
+	if l != 0 && (l < 4 || l > 18) {
+		return fmt.Errorf("webtransport: invalid connection ID length: %d", l)
+	}
+	return nil
+}
+
 // copied from https://github.com/gorilla/websocket
 func checkSameOrigin(r *http.Request) bool {
 	origin := r.Header.Get("Origin")
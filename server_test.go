@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,6 +13,11 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -50,9 +57,62 @@ func TestUpgradeFailures(t *testing.T) {
 		req.Proto = "webtransport"
 		_, err := s.Upgrade(httptest.NewRecorder(), req)
 		require.EqualError(t, err, "missing or invalid Sec-Webtransport-Http3-Draft02 header")
+		var upgradeErr *webtransport.UpgradeError
+		require.True(t, errors.As(err, &upgradeErr))
+		require.Equal(t, http.StatusBadRequest, upgradeErr.StatusCode)
 	})
 }
 
+func TestServerRequireDatagrams(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		RequireDatagrams: true,
+	}
+	defer s.Close()
+	errChan := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		errChan <- err
+		if err != nil {
+			var upgradeErr *webtransport.UpgradeError
+			if errors.As(err, &upgradeErr) {
+				w.WriteHeader(upgradeErr.StatusCode)
+			}
+			return
+		}
+		conn.Close()
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	for _, datagrams := range []bool{true, false} {
+		t.Run(fmt.Sprintf("datagrams: %t", datagrams), func(t *testing.T) {
+			rt := &http3.RoundTripper{
+				TLSClientConfig: &tls.Config{RootCAs: certPool},
+				EnableDatagrams: datagrams,
+			}
+			defer rt.Close()
+			rsp, err := rt.RoundTrip(newWebTransportRequest(t, url))
+			require.NoError(t, err)
+			if datagrams {
+				require.Equal(t, http.StatusOK, rsp.StatusCode)
+				require.NoError(t, <-errChan)
+				return
+			}
+			require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+			err = <-errChan
+			require.ErrorIs(t, err, webtransport.ErrDatagramsNotSupported)
+			var upgradeErr *webtransport.UpgradeError
+			require.True(t, errors.As(err, &upgradeErr))
+			require.Equal(t, http.StatusBadRequest, upgradeErr.StatusCode)
+		})
+	}
+}
+
 func newWebTransportRequest(t *testing.T, addr string) *http.Request {
 	t.Helper()
 	u, err := url.Parse(addr)
@@ -82,6 +142,20 @@ func createStreamAndWrite(t *testing.T, qconn http3.StreamCreator, sessionID uin
 	return str
 }
 
+func createUniStreamAndWrite(t *testing.T, qconn http3.StreamCreator, sessionID uint64, data []byte) quic.SendStream {
+	t.Helper()
+	str, err := qconn.OpenUniStream()
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, 0x54)
+	quicvarint.Write(buf, sessionID)
+	buf.Write(data)
+	_, err = str.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+	return str
+}
+
 func TestServerReorderedUpgradeRequest(t *testing.T) {
 	tlsConf, certPool := getTLSConf(t)
 	s := webtransport.Server{
@@ -139,6 +213,105 @@ func TestServerReorderedUpgradeRequest(t *testing.T) {
 	require.Equal(t, []byte("raboof"), data)
 }
 
+func TestServerReorderedStreamOrder(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server: &http.Server{TLSConfig: tlsConf},
+		},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn)
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		connChan <- c
+	})
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	defer rt.Close()
+	// This sends a request, so that we can hijack the connection. Stream ID: 0.
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/", port), nil)
+	require.NoError(t, err)
+	rsp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
+	// Open new streams for a WebTransport session we'll establish later. Stream IDs: 4, 8, 12, ...
+	const num = 10
+	var ids []quic.StreamID
+	for i := 0; i < num; i++ {
+		str := createStreamAndWrite(t, qconn, 4*num+4, []byte(strconv.Itoa(i)))
+		ids = append(ids, str.StreamID())
+		// make sure the stream headers are processed in order
+		time.Sleep(scaleDuration(5 * time.Millisecond))
+	}
+
+	rsp, err = rt.RoundTrip(newWebTransportRequest(t, fmt.Sprintf("https://localhost:%d/webtransport", port)))
+	require.NoError(t, err)
+	require.Equal(t, 200, rsp.StatusCode)
+	sconn := <-connChan
+	// The buffered streams are accepted in order, followed by streams received after the session was established.
+	ids = append(ids, createStreamAndWrite(t, qconn, 4*num+4, []byte(strconv.Itoa(num))).StreamID())
+	for i := 0; i <= num; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		sstr, err := sconn.AcceptStream(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, ids[i], sstr.StreamID())
+		data, err := io.ReadAll(sstr)
+		require.NoError(t, err)
+		require.Equal(t, []byte(strconv.Itoa(i)), data)
+	}
+}
+
+func TestServerReorderedUpgradeRequestRejected(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server: &http.Server{TLSConfig: tlsConf},
+		},
+		CheckOrigin: func(*http.Request) bool { return false },
+	}
+	defer s.Close()
+	addHandler(t, &s, func(*webtransport.Conn) {})
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	defer rt.Close()
+	// This sends a request, so that we can hijack the connection. Stream ID: 0.
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/", port), nil)
+	require.NoError(t, err)
+	rsp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
+	// Open a new stream for the WebTransport session we'll request next. Stream ID: 4.
+	str := createStreamAndWrite(t, qconn, 8, []byte("foobar"))
+	time.Sleep(scaleDuration(20 * time.Millisecond))
+
+	// The request is rejected. Stream ID: 8.
+	rsp, err = rt.RoundTrip(newWebTransportRequest(t, fmt.Sprintf("https://localhost:%d/webtransport", port)))
+	require.NoError(t, err)
+	require.Equal(t, 404, rsp.StatusCode)
+
+	// The buffered stream is reset right away, without waiting for the StreamReorderingTimeout.
+	require.NoError(t, str.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = str.Read([]byte{0})
+	var streamErr *quic.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, webtransport.WebTransportBufferedStreamRejectedErrorCode, streamErr.ErrorCode)
+}
+
 func TestServerReorderedUpgradeRequestTimeout(t *testing.T) {
 	timeout := scaleDuration(100 * time.Millisecond)
 	tlsConf, certPool := getTLSConf(t)
@@ -263,11 +436,1960 @@ func TestServerReorderedMultipleStreams(t *testing.T) {
 	require.Equal(t, []byte("raboof"), data)
 }
 
-func TestImmediateClose(t *testing.T) {
+// newReorderedResponseHandler returns a handler that opens streams for the session before
+// sending the response to the CONNECT request, simulating reordering of the response.
+// It waits for delay before accepting the session.
+func newReorderedResponseHandler(t *testing.T, s *webtransport.Server, data []string, delay time.Duration, strChan chan<- quic.Stream) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		id := w.(interface{ StreamID() quic.StreamID }).StreamID()
+		qconn := w.(http3.Hijacker).StreamCreator()
+		for _, d := range data {
+			strChan <- createStreamAndWrite(t, qconn, uint64(id), []byte(d))
+			// make sure the stream headers are processed in order
+			time.Sleep(scaleDuration(5 * time.Millisecond))
+		}
+		time.Sleep(delay)
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		<-conn.Context().Done()
+	})
+	return mux
+}
+
+func TestClientReorderedResponse(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	data := []string{"foo", "bar", "baz"}
+	strChan := make(chan quic.Stream, len(data))
+	s.H3.Handler = newReorderedResponseHandler(t, &s, data, scaleDuration(50*time.Millisecond), strChan)
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The streams were buffered until the session was established, and are accepted in order.
+	for _, d := range data {
+		str := <-strChan
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		cstr, err := conn.AcceptStream(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, str.StreamID(), cstr.StreamID())
+		b, err := io.ReadAll(cstr)
+		require.NoError(t, err)
+		require.Equal(t, []byte(d), b)
+	}
+	state := d.DebugState()
+	require.Empty(t, state.PendingSessions)
+	require.Zero(t, state.RejectedStreams)
+}
+
+func TestClientReorderedResponseTimeout(t *testing.T) {
+	timeout := scaleDuration(50 * time.Millisecond)
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	strChan := make(chan quic.Stream, 1)
+	s.H3.Handler = newReorderedResponseHandler(t, &s, []string{"foobar"}, 4*timeout, strChan)
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	type rejected struct {
+		sessionID uint64
+		id        quic.StreamID
+	}
+	rejectedChan := make(chan rejected, 1)
+	tracer := &recordingTracer{}
+	d := webtransport.Dialer{
+		TLSClientConf:           &tls.Config{RootCAs: certPool},
+		StreamReorderingTimeout: timeout,
+		BufferedStreams: &webtransport.BufferedStreamConfig{
+			ErrorCode: 0x1337,
+			OnRejected: func(_ quic.Connection, sessionID uint64, id quic.StreamID) {
+				rejectedChan <- rejected{sessionID: sessionID, id: id}
+			},
+		},
+		Tracer: tracer,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	str := <-strChan
+	var r rejected
+	select {
+	case r = <-rejectedChan:
+		require.Equal(t, str.StreamID(), r.id)
+	default:
+		t.Fatal("stream should have been rejected before the session was established")
+	}
+	require.Contains(t, tracer.Events(), fmt.Sprintf("buffered stream %d for session %d timed out", r.id, r.sessionID))
+	require.Equal(t, uint64(1), d.DebugState().RejectedStreams)
+	// The stream was reset by the client.
+	_, err = str.Read([]byte{0})
+	var streamErr *quic.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, quic.StreamErrorCode(0x1337), streamErr.ErrorCode)
+
+	// The stream is not accepted once the session is established.
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err = conn.AcceptStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// newReorderedUniStreamsHandler is like newReorderedResponseHandler, but opens unidirectional streams.
+func newReorderedUniStreamsHandler(t *testing.T, s *webtransport.Server, data []string, delay time.Duration, strChan chan<- quic.SendStream) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		id := w.(interface{ StreamID() quic.StreamID }).StreamID()
+		qconn := w.(http3.Hijacker).StreamCreator()
+		for _, d := range data {
+			strChan <- createUniStreamAndWrite(t, qconn, uint64(id), []byte(d))
+			// make sure the stream headers are processed in order
+			time.Sleep(scaleDuration(5 * time.Millisecond))
+		}
+		time.Sleep(delay)
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		<-conn.Context().Done()
+	})
+	return mux
+}
+
+func TestClientReorderedResponseUniStreams(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	data := []string{"foo", "bar", "baz"}
+	strChan := make(chan quic.SendStream, len(data))
+	s.H3.Handler = newReorderedUniStreamsHandler(t, &s, data, scaleDuration(50*time.Millisecond), strChan)
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The streams were buffered until the session was established, and are accepted in order.
+	for _, d := range data {
+		str := <-strChan
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		cstr, err := conn.AcceptUniStream(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, str.StreamID(), cstr.StreamID())
+		b, err := io.ReadAll(cstr)
+		require.NoError(t, err)
+		require.Equal(t, []byte(d), b)
+	}
+	require.Equal(t, uint64(len(data)), conn.Stats().StreamsAccepted)
+	state := d.DebugState()
+	require.Empty(t, state.PendingSessions)
+	require.Zero(t, state.RejectedStreams)
+}
+
+func TestClientReorderedResponseUniStreamsTimeout(t *testing.T) {
+	timeout := scaleDuration(50 * time.Millisecond)
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	strChan := make(chan quic.SendStream, 1)
+	s.H3.Handler = newReorderedUniStreamsHandler(t, &s, []string{"foobar"}, 4*timeout, strChan)
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	type rejected struct {
+		sessionID uint64
+		id        quic.StreamID
+	}
+	rejectedChan := make(chan rejected, 1)
+	tracer := &recordingTracer{}
+	d := webtransport.Dialer{
+		TLSClientConf:           &tls.Config{RootCAs: certPool},
+		StreamReorderingTimeout: timeout,
+		BufferedStreams: &webtransport.BufferedStreamConfig{
+			ErrorCode: 0x1337,
+			OnRejected: func(_ quic.Connection, sessionID uint64, id quic.StreamID) {
+				rejectedChan <- rejected{sessionID: sessionID, id: id}
+			},
+		},
+		Tracer: tracer,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	str := <-strChan
+	var r rejected
+	select {
+	case r = <-rejectedChan:
+		require.Equal(t, str.StreamID(), r.id)
+	default:
+		t.Fatal("stream should have been rejected before the session was established")
+	}
+	require.Contains(t, tracer.Events(), fmt.Sprintf("buffered stream %d for session %d timed out", r.id, r.sessionID))
+	require.Equal(t, uint64(1), d.DebugState().RejectedStreams)
+
+	// The stream is not accepted once the session is established.
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err = conn.AcceptUniStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, conn.Stats().StreamsAccepted)
+}
+
+func TestServerBufferedStreamErrorCode(t *testing.T) {
+	timeout := scaleDuration(50 * time.Millisecond)
+	tlsConf, certPool := getTLSConf(t)
+	type rejected struct {
+		sessionID uint64
+		id        quic.StreamID
+	}
+	rejectedChan := make(chan rejected, 1)
 	s := webtransport.Server{
 		H3: http3.Server{
-			Server: &http.Server{},
+			Server: &http.Server{TLSConfig: tlsConf},
+		},
+		StreamReorderingTimeout: timeout,
+		BufferedStreams: &webtransport.BufferedStreamConfig{
+			ErrorCode: 0x1337,
+			OnRejected: func(_ quic.Connection, sessionID uint64, id quic.StreamID) {
+				rejectedChan <- rejected{sessionID: sessionID, id: id}
+			},
 		},
 	}
-	require.NoError(t, s.Close())
+	defer s.Close()
+	addHandler(t, &s, func(*webtransport.Conn) {})
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	defer rt.Close()
+	// This sends a request, so that we can hijack the connection. Stream ID: 0.
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/", port), nil)
+	require.NoError(t, err)
+	rsp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
+	// Open a new stream for a WebTransport session that is never established. Stream ID: 4.
+	str := createStreamAndWrite(t, qconn, 8, []byte("foobar"))
+
+	select {
+	case r := <-rejectedChan:
+		require.Equal(t, uint64(8), r.sessionID)
+		require.Equal(t, str.StreamID(), r.id)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	_, err = str.Read([]byte{0})
+	var streamErr *quic.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	require.Equal(t, quic.StreamErrorCode(0x1337), streamErr.ErrorCode)
+}
+
+func TestServerBufferedStreamPause(t *testing.T) {
+	timeout := scaleDuration(50 * time.Millisecond)
+	tlsConf, certPool := getTLSConf(t)
+	rejectedChan := make(chan quic.StreamID, 1)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server: &http.Server{TLSConfig: tlsConf},
+		},
+		StreamReorderingTimeout: timeout,
+		BufferedStreams: &webtransport.BufferedStreamConfig{
+			Pause:      true,
+			OnRejected: func(_ quic.Connection, _ uint64, id quic.StreamID) { rejectedChan <- id },
+		},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn)
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		connChan <- c
+	})
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	defer rt.Close()
+	// This sends a request, so that we can hijack the connection. Stream ID: 0.
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/", port), nil)
+	require.NoError(t, err)
+	rsp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
+	// Open a new stream for a WebTransport session we'll establish later. Stream ID: 4.
+	str := createStreamAndWrite(t, qconn, 8, []byte("foobar"))
+
+	select {
+	case id := <-rejectedChan:
+		require.Equal(t, str.StreamID(), id)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	// The stream was paused, not reset.
+	require.NoError(t, str.SetReadDeadline(time.Now().Add(scaleDuration(50*time.Millisecond))))
+	_, err = str.Read([]byte{0})
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Once the session is established, the stream is accepted.
+	rsp, err = rt.RoundTrip(newWebTransportRequest(t, fmt.Sprintf("https://localhost:%d/webtransport", port)))
+	require.NoError(t, err)
+	require.Equal(t, 200, rsp.StatusCode)
+	sconn := <-connChan
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := sconn.AcceptStream(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+}
+
+func TestServerDebugState(t *testing.T) {
+	timeout := scaleDuration(200 * time.Millisecond)
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server: &http.Server{TLSConfig: tlsConf},
+		},
+		StreamReorderingTimeout: timeout,
+	}
+	defer s.Close()
+	addHandler(t, &s, func(*webtransport.Conn) {})
+	require.Empty(t, s.DebugState().PendingSessions)
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	defer rt.Close()
+	// This sends a request, so that we can hijack the connection. Stream ID: 0.
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/", port), nil)
+	require.NoError(t, err)
+	rsp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator()
+	// Open new streams for a WebTransport session that is never established. Stream IDs: 4 and 8.
+	start := time.Now()
+	str1 := createStreamAndWrite(t, qconn, 12, []byte("foo"))
+	time.Sleep(scaleDuration(5 * time.Millisecond))
+	str2 := createStreamAndWrite(t, qconn, 12, []byte("bar"))
+
+	require.Eventually(t, func() bool { return s.DebugState().BufferedStreams == 2 }, timeout/2, scaleDuration(5*time.Millisecond))
+	state := s.DebugState()
+	require.Len(t, state.PendingSessions, 1)
+	sess := state.PendingSessions[0]
+	require.Equal(t, uint64(12), sess.SessionID)
+	require.Equal(t, []quic.StreamID{str1.StreamID(), str2.StreamID()}, sess.BufferedStreams)
+	require.WithinDuration(t, start, sess.Since, timeout/2)
+	require.Equal(t, 2, state.WaitingGoroutines)
+	require.GreaterOrEqual(t, state.Goroutines, 2)
+	require.Zero(t, state.RejectedStreams)
+
+	// Once the reordering timeout fires, the streams are rejected.
+	require.Eventually(t, func() bool {
+		state := s.DebugState()
+		return state.RejectedStreams == 2 && len(state.PendingSessions) == 0
+	}, 5*timeout, scaleDuration(10*time.Millisecond))
+	state = s.DebugState()
+	require.Zero(t, state.BufferedStreams)
+	require.Zero(t, state.WaitingGoroutines)
+}
+
+func TestImmediateClose(t *testing.T) {
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server: &http.Server{},
+		},
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestServerSessionRegistry(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 2)
+	addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	var clientConns []*webtransport.Conn
+	for i := 0; i < 2; i++ {
+		d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+		defer d.Close()
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		clientConns = append(clientConns, conn)
+	}
+	sconn1 := <-connChan
+	sconn2 := <-connChan
+	require.Len(t, s.Sessions(), 2)
+	require.Equal(t, []*webtransport.Conn{sconn1}, s.SessionsByRemoteAddr(sconn1.RemoteAddr()))
+
+	sconn1.SetLabel("foo")
+	require.Equal(t, []*webtransport.Conn{sconn1}, s.SessionsByLabel("foo"))
+	require.Empty(t, s.SessionsByLabel("bar"))
+
+	require.NoError(t, sconn1.Close())
+	require.Eventually(t, func() bool { return len(s.Sessions()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []*webtransport.Conn{sconn2}, s.Sessions())
+}
+
+func TestServerDrainSession(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sconn := <-connChan
+	sconn.Drain()
+	require.True(t, sconn.Draining())
+	_, err = sconn.OpenStream()
+	require.Error(t, err)
+
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	str.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = str.Read([]byte{0})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, context.DeadlineExceeded)
+	// the session is still alive, only the stream was rejected
+	require.NotErrorIs(t, err, webtransport.ErrSessionClosed)
+	require.Contains(t, err.Error(), "session draining")
+	require.NoError(t, conn.Context().Err())
+}
+
+func TestServerBroadcast(t *testing.T) {
+	const numClients = 3
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                   http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		BroadcastConcurrency: 2,
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, numClients)
+	addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	var clientConns []*webtransport.Conn
+	for i := 0; i < numClients; i++ {
+		d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+		defer d.Close()
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		clientConns = append(clientConns, conn)
+		(<-connChan).SetLabel(strconv.Itoa(i))
+	}
+
+	require.NoError(t, s.Broadcast([]byte("foobar"), nil))
+	for _, conn := range clientConns {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		b, err := conn.ReceiveMessage(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), b)
+	}
+
+	require.NoError(t, s.Broadcast([]byte("raboof"), func(c webtransport.Session) bool { return c.Label() == "1" }))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := clientConns[1].ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("raboof"), b)
+	for _, i := range []int{0, 2} {
+		ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+		_, err := clientConns[i].ReceiveMessage(ctx)
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+}
+
+func TestServerBroadcastStream(t *testing.T) {
+	const numClients = 3
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                   http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		BroadcastConcurrency: 2,
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, numClients)
+	addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	var clientConns []*webtransport.Conn
+	for i := 0; i < numClients; i++ {
+		d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+		defer d.Close()
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		clientConns = append(clientConns, conn)
+		(<-connChan).SetLabel(strconv.Itoa(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.BroadcastStream(ctx, []byte("foobar"), func(c webtransport.Session) bool { return c.Label() != "1" }))
+	for _, i := range []int{0, 2} {
+		str, err := clientConns[i].AcceptUniStream(ctx)
+		require.NoError(t, err)
+		b, err := io.ReadAll(str)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), b)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err := clientConns[1].AcceptUniStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func dialRawSession(t *testing.T, s *webtransport.Server) (quic.Connection, *webtransport.Conn, func()) {
+	t.Helper()
+	tlsConf, certPool := getTLSConf(t)
+	s.H3.Server = &http.Server{TLSConfig: tlsConf}
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(udpConn)
+
+	rt := &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+		EnableDatagrams: true,
+	}
+	rsp, err := rt.RoundTrip(newWebTransportRequest(t, fmt.Sprintf("https://localhost:%d/webtransport", port)))
+	require.NoError(t, err)
+	require.Equal(t, 200, rsp.StatusCode)
+	qconn := rsp.Body.(http3.Hijacker).StreamCreator().(quic.Connection)
+	return qconn, <-connChan, func() { rt.Close() }
+}
+
+func TestServerSlowConsumer(t *testing.T) {
+	detected := make(chan webtransport.Session, 1)
+	s := &webtransport.Server{
+		SlowConsumers: &webtransport.SlowConsumerConfig{
+			Timeout:    scaleDuration(50 * time.Millisecond),
+			Close:      true,
+			OnDetected: func(sess webtransport.Session) { detected <- sess },
+		},
+	}
+	defer s.Close()
+	qconn, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	// The application never receives the datagram.
+	require.NoError(t, qconn.SendMessage([]byte{0, 'f', 'o', 'o'}))
+	select {
+	case sess := <-detected:
+		require.Equal(t, sconn, sess)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case <-sconn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+	require.Zero(t, sconn.Stats().BufferedBytes)
+}
+
+func TestHeartbeat(t *testing.T) {
+	for _, transport := range []webtransport.HeartbeatTransport{webtransport.HeartbeatStream, webtransport.HeartbeatDatagram} {
+		transport := transport
+		t.Run(transport.String(), func(t *testing.T) {
+			timedOut := make(chan webtransport.Session, 2)
+			conf := &webtransport.HeartbeatConfig{
+				Interval:  scaleDuration(10 * time.Millisecond),
+				MaxMissed: 2,
+				Transport: transport,
+				OnTimeout: func(sess webtransport.Session) { timedOut <- sess },
+			}
+			tlsConf, certPool := getTLSConf(t)
+			s := webtransport.Server{
+				H3:        http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+				Heartbeat: conf,
+			}
+			defer s.Close()
+			connChan := make(chan *webtransport.Conn, 1)
+			addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+			udpConn := getConn(t)
+			go s.Serve(udpConn)
+
+			d := webtransport.Dialer{
+				TLSClientConf: &tls.Config{RootCAs: certPool},
+				Heartbeat:     conf,
+			}
+			defer d.Close()
+			url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+			_, conn, err := d.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			sconn := <-connChan
+			defer sconn.Close()
+
+			// both endpoints answer the probes
+			time.Sleep(scaleDuration(100 * time.Millisecond))
+			require.NoError(t, conn.Context().Err())
+			require.NoError(t, sconn.Context().Err())
+			require.Empty(t, timedOut)
+		})
+	}
+}
+
+func TestServerHeartbeatTimeout(t *testing.T) {
+	timedOut := make(chan webtransport.Session, 1)
+	s := &webtransport.Server{
+		Heartbeat: &webtransport.HeartbeatConfig{
+			Interval:  scaleDuration(10 * time.Millisecond),
+			ErrorCode: 1337,
+			OnTimeout: func(sess webtransport.Session) { timedOut <- sess },
+		},
+	}
+	defer s.Close()
+	// The raw HTTP/3 client doesn't answer the probes.
+	_, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	start := time.Now()
+	select {
+	case sess := <-timedOut:
+		require.Equal(t, sconn, sess)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.GreaterOrEqual(t, time.Since(start), scaleDuration(20*time.Millisecond))
+	select {
+	case <-sconn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+	_, err := sconn.AcceptStream(context.Background())
+	var sessErr *webtransport.SessionError
+	require.ErrorAs(t, err, &sessErr)
+	require.False(t, sessErr.Remote)
+	require.Equal(t, webtransport.SessionErrorCode(1337), sessErr.ErrorCode)
+	require.Equal(t, "heartbeat timeout", sessErr.Message)
+}
+
+func TestServerDroppedDatagrams(t *testing.T) {
+	s := &webtransport.Server{}
+	defer s.Close()
+	qconn, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	// The session was established on stream 0, so Quarter Stream ID 1 doesn't belong to any session.
+	require.NoError(t, qconn.SendMessage([]byte{1, 'f', 'o', 'o'}))
+	require.NoError(t, qconn.SendMessage([]byte{0x40})) // truncated varint
+	require.NoError(t, qconn.SendMessage([]byte{0, 'b', 'a', 'r'}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := sconn.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), b)
+	require.Eventually(t, func() bool { return s.DroppedDatagrams() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServerLogging(t *testing.T) {
+	var mx sync.Mutex
+	var messages []string
+	s := &webtransport.Server{
+		Logging: &webtransport.LogConfig{
+			Level: webtransport.LogLevelDebug,
+			Printf: func(format string, args ...interface{}) {
+				mx.Lock()
+				messages = append(messages, fmt.Sprintf(format, args...))
+				mx.Unlock()
+			},
+		},
+	}
+	defer s.Close()
+	qconn, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	// dropped datagrams are sampled
+	for i := 0; i < 3; i++ {
+		require.NoError(t, qconn.SendMessage([]byte{1, 'f', 'o', 'o'}))
+	}
+	require.Eventually(t, func() bool { return s.DroppedDatagrams() == 3 }, time.Second, 10*time.Millisecond)
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, messages, 1)
+	require.Contains(t, messages[0], "dropped datagram")
+	// the log message contains the identifier of the QUIC connection the session was established on
+	m := regexp.MustCompile(`conn ([0-9a-f]{8})`).FindStringSubmatch(messages[0])
+	require.NotNil(t, m)
+	require.Contains(t, sconn.String(), "conn "+m[1])
+}
+
+func TestServerStrictDatagrams(t *testing.T) {
+	s := &webtransport.Server{StrictDatagrams: true}
+	defer s.Close()
+	qconn, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	require.NoError(t, qconn.SendMessage([]byte{0, 'f', 'o', 'o'}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := sconn.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), b)
+
+	require.NoError(t, qconn.SendMessage([]byte{1, 'b', 'a', 'r'}))
+	select {
+	case <-qconn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the connection to be closed")
+	}
+	var appErr *quic.ApplicationError
+	_, err = qconn.AcceptStream(context.Background())
+	require.ErrorAs(t, err, &appErr)
+	require.Equal(t, quic.ApplicationErrorCode(0x33), appErr.ErrorCode)
+	require.True(t, appErr.Remote)
+	require.Equal(t, uint64(1), s.DroppedDatagrams())
+}
+
+func TestServerStrictInvalidSessionID(t *testing.T) {
+	violations := make(chan *webtransport.ProtocolViolationError, 1)
+	s := &webtransport.Server{
+		Strict: true,
+		ProtocolViolationHandler: func(_ quic.Connection, err *webtransport.ProtocolViolationError) {
+			violations <- err
+		},
+	}
+	defer s.Close()
+	qconn, _, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	// 2 is the ID of a server-initiated bidirectional stream
+	createStreamAndWrite(t, qconn, 2, []byte("foobar"))
+	select {
+	case err := <-violations:
+		require.Equal(t, quic.ApplicationErrorCode(0x108), err.ErrorCode)
+		require.Contains(t, err.Error(), "invalid session ID 2")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the protocol violation")
+	}
+	select {
+	case <-qconn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the connection to be closed")
+	}
+	var appErr *quic.ApplicationError
+	_, err := qconn.AcceptStream(context.Background())
+	require.ErrorAs(t, err, &appErr)
+	require.Equal(t, quic.ApplicationErrorCode(0x108), appErr.ErrorCode)
+}
+
+func TestServerStrictUnknownSession(t *testing.T) {
+	violations := make(chan *webtransport.ProtocolViolationError, 1)
+	s := &webtransport.Server{
+		Strict:                  true,
+		StreamReorderingTimeout: scaleDuration(50 * time.Millisecond),
+		ProtocolViolationHandler: func(_ quic.Connection, err *webtransport.ProtocolViolationError) {
+			violations <- err
+		},
+	}
+	defer s.Close()
+	qconn, _, closeFn := dialRawSession(t, s)
+	defer closeFn()
+
+	createStreamAndWrite(t, qconn, 8, []byte("foobar"))
+	select {
+	case err := <-violations:
+		require.Equal(t, quic.ApplicationErrorCode(0x108), err.ErrorCode)
+		require.Contains(t, err.Error(), "for unknown session 8")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the protocol violation")
+	}
+}
+
+// packageGoroutines returns the stacks of all go routines running code of this package,
+// excluding the tests.
+func packageGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "marten-seemann/webtransport-go.") && !strings.Contains(g, "_test.") {
+			stacks = append(stacks, g)
+		}
+	}
+	return stacks
+}
+
+func TestServerCloseGoroutines(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                    http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		DatagramStatsInterval: 10 * time.Millisecond,
+		AccessLog:             io.Discard,
+		Tracer:                webtransport.NoopTracer{},
+	}
+	handlerRunning := make(chan struct{}, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		require.NoError(t, c.SendMessageWithPriority([]byte("foo"), webtransport.MessagePriorityHigh))
+		go c.HandleMessages(context.Background(), func([]byte) {})
+		c.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			handlerRunning <- struct{}{}
+			io.Copy(io.Discard, str) // returns when the QUIC connection is closed
+		})
+	})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	for i := 0; i < 3; i++ {
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		_, err = str.Write([]byte("foobar"))
+		require.NoError(t, err)
+		select {
+		case <-handlerRunning:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the stream handler")
+		}
+	}
+	require.Greater(t, s.GoroutineCount(), 3*2)
+	require.NotEmpty(t, packageGoroutines())
+
+	require.NoError(t, s.Close())
+	require.Eventually(t, func() bool { return s.GoroutineCount() == 0 }, time.Second, 10*time.Millisecond)
+	deadline := time.Now().Add(scaleDuration(time.Second))
+	for len(packageGoroutines()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Empty(t, packageGoroutines(), "leaked go routines")
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error)   { return v.([]byte), nil }
+func (bytesCodec) Unmarshal(b []byte) (interface{}, error) { return b, nil }
+
+func TestServerCloseWithDatagramChannel(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	chanChan := make(chan *webtransport.DatagramChannel, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		// Send is never closed.
+		ch := webtransport.NewDatagramChannel(c, bytesCodec{}, 1)
+		chanChan <- ch
+		<-c.Context().Done()
+	})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	ch := <-chanChan
+	ch.Send <- []byte("foobar")
+	data, err := conn.ReceiveMessage(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(scaleDuration(2 * time.Second)):
+		t.Fatal("Server.Close didn't return")
+	}
+	require.Zero(t, s.GoroutineCount())
+}
+
+func TestServerListenAndServeContext(t *testing.T) {
+	// find a free port
+	udpConn := getConn(t)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	require.NoError(t, udpConn.Close())
+
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{
+			Addr:      fmt.Sprintf("localhost:%d", port),
+			TLSConfig: tlsConf,
+		}},
+		ShutdownTimeout: scaleDuration(time.Second),
+	}
+	handlerStarted := make(chan struct{}, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) {
+		c.HandleStreams(context.Background(), func(str webtransport.Stream) {
+			handlerStarted <- struct{}{}
+			data, err := io.ReadAll(str)
+			if err != nil {
+				return
+			}
+			str.Write(data)
+			str.Close()
+		})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.ListenAndServeContext(ctx) }()
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", port)
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), time.Second)
+	defer dialCancel()
+	rsp, conn, err := d.Dial(dialCtx, url, nil)
+	require.NoError(t, err)
+	require.Equal(t, 200, rsp.StatusCode)
+
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	select {
+	case <-handlerStarted:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the stream handler")
+	}
+
+	// Shut down the server. The stream that's in flight can still be completed.
+	cancel()
+	time.Sleep(scaleDuration(50 * time.Millisecond))
+	_, err = str.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+	data, err := io.ReadAll(str)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+
+	select {
+	case err := <-serveErr:
+		require.NoError(t, err)
+	case <-time.After(scaleDuration(time.Second)):
+		t.Fatal("timeout waiting for ListenAndServeContext to return")
+	}
+	// The server doesn't accept new sessions anymore.
+	_, _, err = (&webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}).Dial(dialCtx, url, nil)
+	require.Error(t, err)
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		HandshakeTimeout: scaleDuration(100 * time.Millisecond),
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	t.Run("no session", func(t *testing.T) {
+		qconn, err := quic.DialAddr(
+			fmt.Sprintf("localhost:%d", port),
+			&tls.Config{RootCAs: certPool, NextProtos: []string{"h3"}},
+			&quic.Config{EnableDatagrams: true},
+		)
+		require.NoError(t, err)
+		start := time.Now()
+		select {
+		case <-qconn.Context().Done():
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("connection not closed")
+		}
+		require.Greater(t, time.Since(start), s.HandshakeTimeout/2)
+		_, err = qconn.AcceptStream(context.Background())
+		var appErr *quic.ApplicationError
+		require.ErrorAs(t, err, &appErr)
+		require.True(t, appErr.Remote)
+		require.Equal(t, quic.ApplicationErrorCode(0x100), appErr.ErrorCode)
+	})
+
+	t.Run("session established", func(t *testing.T) {
+		d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+		defer d.Close()
+		_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		time.Sleep(2 * s.HandshakeTimeout)
+		sendDataAndCheckEcho(t, conn)
+	})
+}
+
+func TestServerUpgradeTimeout(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:             http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		UpgradeTimeout: scaleDuration(50 * time.Millisecond),
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+	upgradeErr := make(chan error, 1)
+	s.H3.Handler.(*http.ServeMux).HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(scaleDuration(time.Second)):
+		}
+		_, err := s.Upgrade(w, r)
+		upgradeErr <- err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	start := time.Now()
+	rsp, _, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/slow", port), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	require.Less(t, time.Since(start), scaleDuration(time.Second))
+	require.EqualError(t, <-upgradeErr, "webtransport: upgrade timeout")
+
+	// sessions that are upgraded in time are not affected
+	_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(2 * s.UpgradeTimeout)
+	sendDataAndCheckEcho(t, conn)
+}
+
+func TestServerOnSessionRequest(t *testing.T) {
+	errUnauthorized := errors.New("missing token")
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		OnSessionRequest: func(r *http.Request) (int, http.Header, error) {
+			hdr := http.Header{"Server-Id": []string{"foo"}}
+			switch r.Header.Get("Token") {
+			case "":
+				return http.StatusUnauthorized, hdr, errUnauthorized
+			case "overloaded":
+				hdr.Set("Retry-After", "10")
+				return http.StatusServiceUnavailable, hdr, nil
+			case "invalid":
+				return 0, nil, errors.New("invalid token")
+			}
+			return 0, hdr, nil
+		},
+	}
+	defer s.Close()
+	upgradeErrs := make(chan error, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			upgradeErrs <- err
+			return
+		}
+		go newEchoHandler(t)(conn)
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	dial := func(token string) (*http.Response, *webtransport.Conn, error) {
+		hdr := http.Header{}
+		if token != "" {
+			hdr.Set("Token", token)
+		}
+		return d.Dial(context.Background(), url, hdr)
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		rsp, conn, err := dial("secret")
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, "foo", rsp.Header.Get("Server-Id"))
+		sendDataAndCheckEcho(t, conn)
+	})
+
+	t.Run("rejected with an error", func(t *testing.T) {
+		rsp, _, err := dial("")
+		require.Error(t, err)
+		require.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+		require.Equal(t, "foo", rsp.Header.Get("Server-Id"))
+		err = <-upgradeErrs
+		var rejectedErr *webtransport.SessionRejectedError
+		require.ErrorAs(t, err, &rejectedErr)
+		require.Equal(t, http.StatusUnauthorized, rejectedErr.StatusCode)
+		require.ErrorIs(t, err, errUnauthorized)
+		require.EqualError(t, err, "webtransport: session request rejected with status 401: missing token")
+	})
+
+	t.Run("rejected with a status code", func(t *testing.T) {
+		rsp, _, err := dial("overloaded")
+		require.Error(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+		require.Equal(t, "10", rsp.Header.Get("Retry-After"))
+		require.EqualError(t, <-upgradeErrs, "webtransport: session request rejected with status 503")
+	})
+
+	t.Run("rejected with an error, without a status code", func(t *testing.T) {
+		rsp, _, err := dial("invalid")
+		require.Error(t, err)
+		require.Equal(t, http.StatusForbidden, rsp.StatusCode)
+		require.EqualError(t, <-upgradeErrs, "webtransport: session request rejected with status 403: invalid token")
+	})
+}
+
+func TestServerSessionHooks(t *testing.T) {
+	type closeEvent struct {
+		conn *webtransport.Conn
+		err  error
+	}
+	established := make(chan string, 10)
+	closed := make(chan closeEvent, 10)
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		OnSessionEstablished: func(c *webtransport.Conn, r *http.Request) {
+			c.SetLabel(r.Header.Get("User"))
+			established <- r.URL.Path
+		},
+		OnSessionClosed: func(c *webtransport.Conn, err error) { closed <- closeEvent{conn: c, err: err} },
+	}
+	defer s.Close()
+	serverConns := make(chan *webtransport.Conn, 10)
+	addHandler(t, &s, func(c *webtransport.Conn) { serverConns <- c })
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	expectClosed := func(t *testing.T, sconn *webtransport.Conn) error {
+		t.Helper()
+		select {
+		case ev := <-closed:
+			require.Equal(t, sconn, ev.conn)
+			return ev.err
+		case <-time.After(time.Second):
+			t.Fatal("OnSessionClosed not called")
+		}
+		return nil
+	}
+
+	t.Run("closed by the application", func(t *testing.T) {
+		_, conn, err := d.Dial(context.Background(), url, http.Header{"User": []string{"alice"}})
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, "/webtransport", <-established)
+		sconn := <-serverConns
+		require.Equal(t, "alice", sconn.Label())
+		require.NoError(t, sconn.Close())
+		require.NoError(t, expectClosed(t, sconn))
+	})
+
+	t.Run("QUIC connection closed", func(t *testing.T) {
+		// sessions dialed with options use a dedicated QUIC connection, which is closed with the session
+		_, conn, err := d.DialWithOptions(context.Background(), url, nil, &webtransport.DialOptions{})
+		require.NoError(t, err)
+		<-established
+		sconn := <-serverConns
+		require.NoError(t, conn.Close())
+		var appErr *quic.ApplicationError
+		require.ErrorAs(t, expectClosed(t, sconn), &appErr)
+		require.True(t, appErr.Remote)
+	})
+
+	t.Run("server closed", func(t *testing.T) {
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		<-established
+		sconn := <-serverConns
+		require.NoError(t, s.Close())
+		require.ErrorIs(t, expectClosed(t, sconn), http.ErrServerClosed)
+	})
+}
+
+func TestServerHealthChecks(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		ServeHealthChecks: true,
+	}
+	defer s.Close()
+	addHandler(t, &s, func(c *webtransport.Conn) {})
+
+	probe := func(t *testing.T, h http.Handler) (int, webtransport.HealthStatus) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var st webtransport.HealthStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st))
+		return rec.Code, st
+	}
+
+	// the server is not ready before it's serving
+	code, st := probe(t, s.ReadinessHandler())
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, webtransport.HealthStatus{Status: "unavailable"}, st)
+	code, _ = probe(t, s.HealthHandler())
+	require.Equal(t, http.StatusOK, code)
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+	require.Eventually(t, func() bool {
+		code, _ := probe(t, s.ReadinessHandler())
+		return code == http.StatusOK
+	}, time.Second, 5*time.Millisecond)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the health checks are served over HTTP/3
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: certPool}}
+	defer rt.Close()
+	cl := &http.Client{Transport: rt}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rsp, err := cl.Get(fmt.Sprintf("https://localhost:%d%s", port, path))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+		require.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+		var st webtransport.HealthStatus
+		require.NoError(t, json.NewDecoder(rsp.Body).Decode(&st))
+		rsp.Body.Close()
+		require.Equal(t, webtransport.HealthStatus{Status: "ok", Listeners: 1, Sessions: 1}, st)
+	}
+
+	require.NoError(t, s.Close())
+	code, st = probe(t, s.HealthHandler())
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.True(t, st.Closed)
+	code, _ = probe(t, s.ReadinessHandler())
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestServerUpdateConfig(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:          http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		MaxSessions: 1,
+	}
+	defer s.Close()
+	addHandler(t, &s, func(c *webtransport.Conn) {})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	dial := func(t *testing.T, origin string) (int, *webtransport.Conn) {
+		t.Helper()
+		hdr := http.Header{}
+		if origin != "" {
+			hdr.Set("Origin", origin)
+		}
+		rsp, conn, err := d.Dial(context.Background(), url, hdr)
+		if err != nil {
+			var dialErr *webtransport.DialError
+			require.ErrorAs(t, err, &dialErr)
+			return dialErr.StatusCode, nil
+		}
+		return rsp.StatusCode, conn
+	}
+
+	t.Run("max sessions", func(t *testing.T) {
+		status, conn := dial(t, "")
+		require.Equal(t, http.StatusOK, status)
+		defer conn.Close()
+		status, _ = dial(t, "")
+		require.Equal(t, http.StatusServiceUnavailable, status)
+
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) { c.MaxSessions = 2 }))
+		require.Equal(t, 2, s.Config().MaxSessions)
+		status, conn2 := dial(t, "")
+		require.Equal(t, http.StatusOK, status)
+		defer conn2.Close()
+		status, _ = dial(t, "")
+		require.Equal(t, http.StatusServiceUnavailable, status)
+
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) { c.MaxSessions = 0 }))
+	})
+
+	t.Run("allowed origins", func(t *testing.T) {
+		status, _ := dial(t, "https://example.com")
+		require.Equal(t, 404, status) // rejected by the default CheckOrigin
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) {
+			c.AllowedOrigins = []string{"https://example.com"}
+		}))
+		status, conn := dial(t, "https://example.com")
+		require.Equal(t, http.StatusOK, status)
+		conn.Close()
+		status, _ = dial(t, "https://example.org")
+		require.Equal(t, 404, status)
+	})
+
+	t.Run("session rate", func(t *testing.T) {
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) {
+			c.SessionRateLimit = 0.001
+			c.SessionRateBurst = 2
+		}))
+		for i := 0; i < 2; i++ {
+			status, conn := dial(t, "")
+			require.Equal(t, http.StatusOK, status)
+			conn.Close()
+		}
+		status, _ := dial(t, "")
+		require.Equal(t, http.StatusTooManyRequests, status)
+
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) { c.SessionRateLimit = 0 }))
+		status, conn := dial(t, "")
+		require.Equal(t, http.StatusOK, status)
+		conn.Close()
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		require.EqualError(t,
+			s.UpdateConfig(func(c *webtransport.RuntimeConfig) {
+				c.MaxSessions = 42
+				c.SessionRateLimit = -1
+			}),
+			"webtransport: invalid SessionRateLimit: -1.000000",
+		)
+		require.Zero(t, s.Config().MaxSessions)
+	})
+
+	t.Run("log level", func(t *testing.T) {
+		require.Equal(t, webtransport.LogLevelError, s.Config().LogLevel)
+		require.NoError(t, s.UpdateConfig(func(c *webtransport.RuntimeConfig) { c.LogLevel = webtransport.LogLevelDebug }))
+		require.Equal(t, webtransport.LogLevelDebug, s.Config().LogLevel)
+	})
+}
+
+func TestServerSessionAffinity(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                 http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		ConnectionIDLength: 8,
+		RoutingToken: func(c *webtransport.Conn, r *http.Request) string {
+			ids, ok := c.QUICConnectionIDs()
+			require.True(t, ok)
+			require.NotEmpty(t, ids.Local)
+			return "backend-1"
+		},
+		RoutingTokenHeader: "Routing-Token",
+	}
+	defer s.Close()
+	serverConns := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) { serverConns <- c })
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	rsp, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "backend-1", rsp.Header.Get("Routing-Token"))
+	require.Empty(t, conn.RoutingToken())
+	sconn := <-serverConns
+	require.Equal(t, "backend-1", sconn.RoutingToken())
+
+	// The connection IDs issued by the server are the connection IDs the client uses to send packets.
+	// The server issues additional connection IDs after the handshake.
+	require.Eventually(t, func() bool {
+		serverIDs, ok := sconn.QUICConnectionIDs()
+		require.True(t, ok)
+		clientIDs, ok := conn.QUICConnectionIDs()
+		require.True(t, ok)
+		return len(serverIDs.Local) > 1 &&
+			fmt.Sprint(serverIDs.Local) == fmt.Sprint(clientIDs.Remote) &&
+			fmt.Sprint(serverIDs.Remote) == fmt.Sprint(clientIDs.Local)
+	}, time.Second, 10*time.Millisecond)
+	serverIDs, _ := sconn.QUICConnectionIDs()
+	for _, id := range serverIDs.Local {
+		require.Len(t, id, 8)
+	}
+}
+
+func TestServerSessionDirectory(t *testing.T) {
+	var dir webtransport.MemorySessionDirectory
+	tlsConf, certPool := getTLSConf(t)
+	newServer := func(node string) (*webtransport.Server, string) {
+		s := &webtransport.Server{
+			H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+			SessionDirectory: &dir,
+			NodeID:           node,
+			OnSessionEstablished: func(c *webtransport.Conn, r *http.Request) {
+				c.SetLabel(r.Header.Get("User"))
+			},
+		}
+		addHandler(t, s, func(c *webtransport.Conn) {})
+		udpConn := getConn(t)
+		go s.Serve(udpConn)
+		return s, fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	s1, url1 := newServer("node1")
+	defer s1.Close()
+	s2, url2 := newServer("node2")
+	defer s2.Close()
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	_, conn1, err := d.Dial(context.Background(), url1, http.Header{"User": []string{"alice"}})
+	require.NoError(t, err)
+	defer conn1.Close()
+	_, conn2, err := d.Dial(context.Background(), url2, http.Header{"User": []string{"alice"}})
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, conn3, err := d.Dial(context.Background(), url2, nil) // not registered, since it has no label
+	require.NoError(t, err)
+	defer conn3.Close()
+
+	entries, err := s1.LookupSessions(context.Background(), "alice")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "node1", entries[0].Node)
+	require.Equal(t, "node2", entries[1].Node)
+	for _, e := range entries {
+		require.Equal(t, "alice", e.Key)
+		require.Equal(t, "/webtransport", e.Path)
+	}
+	sessions := s1.SessionsByLabel("alice")
+	require.Len(t, sessions, 1)
+	require.Equal(t, sessions[0].String(), entries[0].Session)
+
+	sessions = s2.SessionsByLabel("alice")
+	require.Len(t, sessions, 1)
+	require.NoError(t, sessions[0].Close())
+	require.Eventually(t, func() bool {
+		entries, err := s1.LookupSessions(context.Background(), "alice")
+		require.NoError(t, err)
+		return len(entries) == 1 && entries[0].Node == "node1"
+	}, time.Second, 10*time.Millisecond)
+
+	// the sessions of a server are unregistered when the server is closed
+	require.NoError(t, s1.Close())
+	require.Eventually(t, func() bool {
+		entries, err := s2.LookupSessions(context.Background(), "alice")
+		require.NoError(t, err)
+		return len(entries) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerDrainNotification(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	mux := http.NewServeMux()
+	// The drain notification is sent on the CONNECT stream, which is closed when the handler returns.
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		connChan <- conn
+		<-conn.Context().Done()
+	})
+	mux.HandleFunc("/return", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		connChan <- conn
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	drained := make(chan *webtransport.Conn, 2)
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		OnDraining:    func(c *webtransport.Conn) { drained <- c },
+	}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	t.Run("drained", func(t *testing.T) {
+		_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		sconn := <-connChan
+		defer sconn.Close()
+		select {
+		case <-conn.PeerDraining():
+			t.Fatal("didn't expect a drain notification")
+		case <-time.After(scaleDuration(10 * time.Millisecond)):
+		}
+
+		sconn.Drain()
+		sconn.Drain()
+		select {
+		case <-conn.PeerDraining():
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the drain notification")
+		}
+		require.Equal(t, conn, <-drained)
+		require.False(t, conn.Draining())
+
+		// the session can still be used
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		require.NoError(t, str.Close())
+		time.Sleep(scaleDuration(10 * time.Millisecond))
+		require.Empty(t, drained)
+	})
+
+	t.Run("handler returned", func(t *testing.T) {
+		_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/return", port), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		sconn := <-connChan
+		require.NoError(t, sconn.CloseGracefully(context.Background()))
+		select {
+		case <-conn.PeerDraining():
+			t.Fatal("didn't expect a drain notification")
+		case <-time.After(scaleDuration(50 * time.Millisecond)):
+		}
+	})
+}
+
+func TestDialerGoAway(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	type session struct {
+		conn  *webtransport.Conn
+		qconn http3.StreamCreator
+	}
+	sessChan := make(chan session, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		sessChan <- session{conn: conn, qconn: w.(http3.Hijacker).StreamCreator()}
+		<-conn.Context().Done()
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	drained := make(chan *webtransport.Conn, 2)
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		OnDraining:    func(c *webtransport.Conn) { drained <- c },
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	_, conn1, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn1.Close()
+	sess1 := <-sessChan
+	defer sess1.conn.Close()
+	_, conn2, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn2.Close()
+	sess2 := <-sessChan
+	defer sess2.conn.Close()
+	require.Equal(t, conn1.LocalAddr(), conn2.LocalAddr())
+
+	// quic-go's http3.Server doesn't send GOAWAY frames.
+	// Open another control stream, which is ignored by the client, since it only reads the SETTINGS frame.
+	str, err := sess1.qconn.OpenUniStream()
+	require.NoError(t, err)
+	b := &bytes.Buffer{}
+	quicvarint.Write(b, 0x0)  // control stream
+	quicvarint.Write(b, 0x4)  // SETTINGS frame
+	quicvarint.Write(b, 0)    // length
+	quicvarint.Write(b, 0x21) // reserved frame type
+	quicvarint.Write(b, 3)    // length
+	b.WriteString("foo")
+	quicvarint.Write(b, 0x7) // GOAWAY frame
+	quicvarint.Write(b, 1)   // length
+	quicvarint.Write(b, 8)   // stream ID
+	_, err = str.Write(b.Bytes())
+	require.NoError(t, err)
+
+	for _, conn := range []*webtransport.Conn{conn1, conn2} {
+		select {
+		case <-conn.PeerDraining():
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the drain notification")
+		}
+		require.False(t, conn.Draining())
+	}
+	require.ElementsMatch(t, []*webtransport.Conn{conn1, conn2}, []*webtransport.Conn{<-drained, <-drained})
+
+	// existing sessions can still be used
+	cstr, err := conn1.OpenStream()
+	require.NoError(t, err)
+	_, err = cstr.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cstr.Close())
+	sstr, err := sess1.conn.AcceptStream(context.Background())
+	require.NoError(t, err)
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+
+	// new sessions are established on a new QUIC connection
+	_, conn3, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn3.Close()
+	sess3 := <-sessChan
+	defer sess3.conn.Close()
+	require.NotEqual(t, conn1.LocalAddr(), conn3.LocalAddr())
+	select {
+	case <-conn3.PeerDraining():
+		t.Fatal("didn't expect a drain notification")
+	case <-time.After(scaleDuration(10 * time.Millisecond)):
+	}
+	require.Empty(t, drained)
+}
+
+func TestServerSessionResumption(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	var mx sync.Mutex
+	var n int
+	tokens := make(map[string]string) // resumption token -> session ID
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		IssueResumptionToken: func(c *webtransport.Conn, r *http.Request) string {
+			mx.Lock()
+			defer mx.Unlock()
+			token := fmt.Sprintf("token-%d", n)
+			n++
+			tokens[token] = c.String()
+			return token
+		},
+		ResumeSession: func(c *webtransport.Conn, r *http.Request, token string) (string, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			id, ok := tokens[token]
+			if !ok {
+				return "", errors.New("unknown token")
+			}
+			delete(tokens, token)
+			return id, nil
+		},
+	}
+	defer s.Close()
+	serverConns := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) { serverConns <- c })
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	sconn := <-serverConns
+	require.Equal(t, "token-0", conn.ResumptionToken())
+	require.Equal(t, "token-0", sconn.ResumptionToken())
+	_, resumed := conn.ResumedSession()
+	require.False(t, resumed)
+	_, resumed = sconn.ResumedSession()
+	require.False(t, resumed)
+	require.NoError(t, conn.Close())
+	require.NoError(t, sconn.Close())
+
+	hdr := http.Header{"Foo": []string{"bar"}}
+	_, conn2, err := d.Resume(context.Background(), url, hdr, conn.ResumptionToken())
+	require.NoError(t, err)
+	defer conn2.Close()
+	require.Equal(t, http.Header{"Foo": []string{"bar"}}, hdr)
+	sconn2 := <-serverConns
+	id, resumed := sconn2.ResumedSession()
+	require.True(t, resumed)
+	require.Equal(t, sconn.String(), id)
+	id, resumed = conn2.ResumedSession()
+	require.True(t, resumed)
+	require.Equal(t, sconn.String(), id)
+	require.Equal(t, "token-1", conn2.ResumptionToken())
+
+	// the token can't be used twice
+	_, conn3, err := d.Resume(context.Background(), url, nil, conn.ResumptionToken())
+	require.NoError(t, err)
+	defer conn3.Close()
+	sconn3 := <-serverConns
+	_, resumed = sconn3.ResumedSession()
+	require.False(t, resumed)
+	_, resumed = conn3.ResumedSession()
+	require.False(t, resumed)
+}
+
+func TestServerStreamsAfterUpgrade(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	errChan := make(chan error, 1)
+	mux := http.NewServeMux()
+	// open a stream right after Upgrade, before the client has received the response
+	mux.HandleFunc("/open", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		str, err := conn.OpenStream()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, err = str.Write([]byte("foobar"))
+		str.Close()
+		errChan <- err
+	})
+	// wait for the client to acknowledge the response, then open a stream
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := conn.Ready(ctx); err != nil {
+			errChan <- err
+			return
+		}
+		// Ready returns immediately once the response was acknowledged
+		if err := conn.Ready(context.Background()); err != nil {
+			errChan <- err
+			return
+		}
+		str, err := conn.OpenStream()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, err = str.Write([]byte("foobar"))
+		str.Close()
+		errChan <- err
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, path := range []string{"open", "ready"} {
+		t.Run(path, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/%s", port, path), nil)
+				require.NoError(t, err)
+				require.NoError(t, conn.Ready(context.Background()))
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				str, err := conn.AcceptStream(ctx)
+				cancel()
+				require.NoError(t, err)
+				data, err := io.ReadAll(str)
+				require.NoError(t, err)
+				require.Equal(t, []byte("foobar"), data)
+				require.NoError(t, <-errChan)
+				require.NoError(t, conn.Close())
+			}
+		})
+	}
+}
+
+func TestServerSessionClosedWithRequest(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	acceptErr := make(chan error, 1)
+	mux := http.NewServeMux()
+	// The handler keeps running, such that the CONNECT stream stays open.
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		_, err = conn.AcceptStream(context.Background())
+		acceptErr <- err
+	})
+	// The handler returns right away, the session is used by another go routine.
+	mux.HandleFunc("/return", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		go func() {
+			for {
+				str, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					acceptErr <- err
+					return
+				}
+				str.Close()
+			}
+		}()
+	})
+	s.H3.Handler = mux
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	// Every session is dialed on a new QUIC connection, which is returned as well.
+	dial := func(t *testing.T, path string) (*webtransport.Conn, quic.Connection) {
+		t.Helper()
+		var qconn quic.Connection
+		d := webtransport.Dialer{
+			TLSClientConf: &tls.Config{RootCAs: certPool},
+			DialFunc: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+				c, err := quic.DialAddrEarlyContext(ctx, addr, tlsConf, conf)
+				qconn = c
+				return c, err
+			},
+		}
+		t.Cleanup(func() { d.Close() })
+		_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d%s", port, path), nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, qconn
+	}
+
+	requireAcceptErr := func(t *testing.T) *webtransport.SessionError {
+		t.Helper()
+		select {
+		case err := <-acceptErr:
+			require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+			var sessErr *webtransport.SessionError
+			require.True(t, errors.As(err, &sessErr))
+			return sessErr
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for AcceptStream to return")
+		}
+		return nil
+	}
+
+	t.Run("QUIC connection closed", func(t *testing.T) {
+		_, qconn := dial(t, "/webtransport")
+		qconn.CloseWithError(42, "bye")
+		sessErr := requireAcceptErr(t)
+		require.True(t, sessErr.Remote)
+		require.Contains(t, sessErr.Message, "bye")
+	})
+
+	t.Run("request canceled", func(t *testing.T) {
+		conn, _ := dial(t, "/webtransport")
+		require.NoError(t, conn.Close())
+		require.True(t, requireAcceptErr(t).Remote)
+	})
+
+	t.Run("handler returned", func(t *testing.T) {
+		conn, qconn := dial(t, "/return")
+		// the session is still usable after the handler returned
+		time.Sleep(scaleDuration(10 * time.Millisecond))
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		_, err = str.Write([]byte("foobar"))
+		require.NoError(t, err)
+		require.NoError(t, str.Close())
+		_, err = io.ReadAll(str)
+		require.NoError(t, err)
+		require.Empty(t, acceptErr)
+
+		qconn.CloseWithError(0, "")
+		requireAcceptErr(t)
+	})
 }
@@ -2,16 +2,17 @@ package webtransport
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
 )
 
 // sessionKey is used as a map key in the conns map
 type sessionKey struct {
-	qconn http3.StreamCreator
+	qconn quic.Connection
 	id    sessionID
 }
 
@@ -19,97 +20,562 @@ type sessionKey struct {
 type session struct {
 	created chan struct{} // is closed once the session map has been initialized
 	counter int           // how many streams are waiting for this session to be established
+	// streams waiting for this session to be established, in the order they were received
+	pending []pendingStream
+	since   time.Time // when the first stream for this session was received
 	conn    *Conn
 }
 
+// incomingStream is a stream opened by the peer, either bidirectional or unidirectional.
+type incomingStream struct {
+	quic.ReceiveStream
+	bidi bool // if set, the stream is a quic.Stream
+}
+
+// reject resets both directions of a bidirectional stream, or the receive direction of a unidirectional stream.
+func (s incomingStream) reject(code quic.StreamErrorCode) {
+	s.CancelRead(code)
+	if s.bidi {
+		s.ReceiveStream.(quic.Stream).CancelWrite(code)
+	}
+}
+
+// pendingStream is a stream waiting for its session to be established.
+type pendingStream struct {
+	incomingStream
+	received time.Time
+}
+
+// removePending removes a stream from the list of streams waiting for the session to be established.
+// It returns false if the stream wasn't in the list.
+func (s *session) removePending(str incomingStream) bool {
+	for i, p := range s.pending {
+		if p.incomingStream == str {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// datagramDispatcher receives datagrams on a QUIC connection, and dispatches them to the sessions.
+// It is created when the first session is established on a QUIC connection, and removed from
+// the datagramConns map once the QUIC connection is closed.
+type datagramDispatcher struct {
+	sessions int // number of established sessions on the QUIC connection
+	// Sessions that were closed. Datagrams for these sessions might still be in flight.
+	// They are dropped, but not treated as a protocol violation. Streams for these sessions are reset,
+	// and the session IDs can't be used for new sessions.
+	closed map[sessionID]struct{}
+	// The context of the go routine receiving datagrams, nil if it's not running.
+	// Datagrams are only received while there are sessions on the QUIC connection:
+	// the context is canceled once the last session was closed, which stops the go routine.
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	// shared by the sessions on the QUIC connection, nil if fair scheduling is disabled
+	scheduler *connScheduler
+	// shared by the sessions on the QUIC connection, nil if there's no bandwidth limit
+	shaper *connShaper
+	// shared by the sessions on the QUIC connection, nil if CONNECT streams are not prioritized
+	priority *priorityGate
+}
+
+// receiving says if the go routine receiving datagrams is running.
+func (d *datagramDispatcher) receiving() bool {
+	return d.ctx != nil && d.ctx.Err() == nil
+}
+
+// errSessionEstablished is returned by AddSession for sessions that were already established.
+var errSessionEstablished = errors.New("webtransport: session already established")
+
+// errDatagramClosedSession is returned by handleDatagram for datagrams for sessions that were closed.
+var errDatagramClosedSession = errors.New("datagram for closed session")
+
 type sessionManager struct {
-	refCount  sync.WaitGroup
+	refCount  *refCounter
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
 	timeout time.Duration
+	// If set, the QUIC connection is closed when a malformed datagram, or a datagram
+	// for an unknown session is received.
+	strictDatagrams bool
+	// If set, protocol violations by the peer cause the QUIC connection to be closed.
+	// This includes everything that strictDatagrams checks for.
+	strict bool
+	// called when a protocol violation is detected in strict mode
+	// If nil, the violation is logged.
+	onViolation func(quic.Connection, *ProtocolViolationError)
+	logger      *logger // nil if no LogConfig was set
+	tracer      Tracer  // may be nil
+	// configures the handling of streams that time out, may be nil
+	bufferedStreams *BufferedStreamConfig
+	// limits the memory held for the streams waiting for a session to be established, 0 means no limit
+	memoryLimit int
+	// limits the number of streams waiting for any session to be established, 0 means no limit
+	maxBufferedStreams int
+	// if set, datagrams and stream opens are scheduled among the sessions on a QUIC connection
+	fairScheduling bool
+	// limits the bandwidth used by the sessions on a QUIC connection, in bytes per second, 0 means no limit
+	bandwidthLimit int
+	// if set, writes on CONNECT streams are prioritized over writes on data streams
+	connectStreamPriority bool
 
 	mx    sync.Mutex
 	conns map[sessionKey]*session
+	// QUIC connections that we're receiving datagrams on
+	datagramConns map[quic.Connection]*datagramDispatcher
+	// QUIC connections with a dispatcher running, or a call to ReceiveMessage outstanding
+	datagramReceivers map[quic.Connection]*datagramReceiver
+	// number of datagrams that couldn't be dispatched to a session
+	droppedDatagrams uint64
+	// number of streams that were rejected because their session wasn't established in time
+	rejectedStreams uint64
+	// number of streams waiting for their session to be established, across all sessions
+	numBufferedStreams int
+	// number of streams that were rejected because of maxBufferedStreams
+	limitRejectedStreams uint64
+	// number of streams that were rejected because of the memory limit, before their session was established
+	memoryRejectedStreams uint64
 }
 
 func newSessionManager(timeout time.Duration) *sessionManager {
 	m := &sessionManager{
-		timeout: timeout,
-		conns:   make(map[sessionKey]*session),
+		refCount:          &refCounter{},
+		timeout:           timeout,
+		conns:             make(map[sessionKey]*session),
+		datagramConns:     make(map[quic.Connection]*datagramDispatcher),
+		datagramReceivers: make(map[quic.Connection]*datagramReceiver),
 	}
 	m.ctx, m.ctxCancel = context.WithCancel(context.Background())
 	return m
 }
 
-// AddStream adds a new stream to a WebTransport session.
+// AddStream adds a new bidirectional stream to a WebTransport session.
 // If the WebTransport session has not yet been established,
 // it starts a new go routine and waits for establishment of the session.
 // If that takes longer than timeout, the stream is reset.
-func (m *sessionManager) AddStream(qconn http3.StreamCreator, str quic.Stream, id sessionID) {
+// Streams are added to the session in the order AddStream (or AddUniStream) is called, i.e. the order their
+// headers were processed, regardless of whether they were buffered.
+func (m *sessionManager) AddStream(qconn quic.Connection, str quic.Stream, id sessionID) {
+	m.addStream(qconn, incomingStream{ReceiveStream: str, bidi: true}, id)
+}
+
+// AddUniStream adds a new unidirectional stream to a WebTransport session.
+// It is handled the same way as a bidirectional stream, see AddStream.
+func (m *sessionManager) AddUniStream(qconn quic.Connection, str quic.ReceiveStream, id sessionID) {
+	m.addStream(qconn, incomingStream{ReceiveStream: str}, id)
+}
+
+func (m *sessionManager) addStream(qconn quic.Connection, str incomingStream, id sessionID) {
+	if err := validateSessionID(str.StreamID(), id); err != nil {
+		str.reject(WebTransportBufferedStreamRejectedErrorCode)
+		if m.strict {
+			m.violation(qconn, idErrorCode, err.Error())
+		} else if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+			m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] reset stream: %s", connString(qconn), err)
+		}
+		return
+	}
+	if m.tracer != nil {
+		m.tracer.StreamIdentified(qconn, uint64(id), str.StreamID())
+	}
+
 	key := sessionKey{qconn: qconn, id: id}
 
 	m.mx.Lock()
-	defer m.mx.Unlock()
-
 	sess, ok := m.conns[key]
 	if ok && sess.conn != nil {
-		sess.conn.addStream(str)
+		conn := sess.conn
+		delivered := conn.addIncomingStream(str)
+		m.mx.Unlock()
+		if delivered {
+			conn.streamDelivered(str.StreamID(), 0)
+		}
+		return
+	}
+	defer m.mx.Unlock()
+
+	// Streams for a session that was closed are reset right away, instead of waiting for the session.
+	if d, ok := m.datagramConns[qconn]; ok {
+		if _, closed := d.closed[id]; closed {
+			str.reject(WebTransportSessionGoneErrorCode)
+			return
+		}
+	}
+	var pending int
+	if ok {
+		pending = len(sess.pending)
+	}
+	if m.exceedsMemoryLimit(pending) {
+		m.memoryRejectedStreams++
+		str.reject(WebTransportBufferedStreamRejectedErrorCode)
+		if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+			m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] reset stream %d for session %d: memory limit exceeded", connString(qconn), str.StreamID(), id)
+		}
+		return
+	}
+	if m.exceedsBufferedStreamLimit() {
+		m.limitRejectedStreams++
+		str.reject(WebTransportBufferedStreamRejectedErrorCode)
+		if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+			m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] reset stream %d for session %d: too many buffered streams", connString(qconn), str.StreamID(), id)
+		}
 		return
 	}
 	if !ok {
-		sess = &session{created: make(chan struct{})}
+		sess = &session{created: make(chan struct{}), since: time.Now()}
 		m.conns[key] = sess
 	}
 	sess.counter++
+	sess.pending = append(sess.pending, pendingStream{incomingStream: str, received: time.Now()})
+	m.numBufferedStreams++
 
-	m.refCount.Add(1)
-	go func() {
-		defer m.refCount.Done()
-		m.handleStream(str, sess, key)
-	}()
+	m.refCount.Go(connLabelContext(qconn, &id), func() { m.handleStream(str, sess, key) })
 }
 
-func (m *sessionManager) handleStream(str quic.Stream, session *session, key sessionKey) {
+func (m *sessionManager) handleStream(str incomingStream, session *session, key sessionKey) {
 	t := time.NewTimer(m.timeout)
 	defer t.Stop()
 
 	// When multiple streams are waiting for the same session to be established,
 	// the timeout is calculated for every stream separately.
+	// Once the session is established, AddSession adds the pending streams to the session.
 	select {
 	case <-session.created:
-		session.conn.addStream(str)
 	case <-t.C:
-		str.CancelRead(WebTransportBufferedStreamRejectedErrorCode)
-		str.CancelWrite(WebTransportBufferedStreamRejectedErrorCode)
+		m.mx.Lock()
+		established := session.conn != nil
+		if !established && !m.pauseBufferedStreams() && session.removePending(str) {
+			m.numBufferedStreams--
+		}
+		m.mx.Unlock()
+		if established {
+			break
+		}
+		paused := m.rejectBufferedStream(str, key)
+		if m.strict {
+			m.violation(key.qconn, idErrorCode, fmt.Sprintf("stream %d for unknown session %d", str.StreamID(), key.id))
+		} else if paused {
+			if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+				m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] paused stream %d, session was not established within %s",
+					sessionString(key.qconn, key.id), str.StreamID(), m.timeout)
+			}
+			// Keep the stream until the session is established, or until the QUIC connection is closed.
+			select {
+			case <-session.created:
+			case <-key.qconn.Context().Done():
+			case <-m.ctx.Done():
+			}
+		} else if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+			m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] reset stream %d, session was not established within %s",
+				sessionString(key.qconn, key.id), str.StreamID(), m.timeout)
+		}
 	case <-m.ctx.Done():
 	}
 
 	m.mx.Lock()
 	defer m.mx.Unlock()
 
+	if session.removePending(str) {
+		m.numBufferedStreams--
+	}
 	session.counter--
 	// Once no more streams are waiting for this session to be established,
 	// and this session is still outstanding, delete it from the map.
-	if session.counter == 0 && session.conn == nil {
+	// If the session was rejected, it was already deleted, and the map might contain a new entry for the key.
+	if session.counter == 0 && session.conn == nil && m.conns[key] == session {
 		delete(m.conns, key)
 	}
 }
 
+// validateSessionID checks that the session ID of a stream can refer to a WebTransport session.
+func validateSessionID(id quic.StreamID, sID sessionID) error {
+	// WebTransport sessions are established on client-initiated bidirectional streams.
+	if sID%4 != 0 {
+		return fmt.Errorf("invalid session ID %d on stream %d", sID, id)
+	}
+	return nil
+}
+
+// RejectSession is called when the request for a session was rejected.
+// Streams waiting for the session to be established are reset.
+func (m *sessionManager) RejectSession(qconn quic.Connection, id sessionID) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	key := sessionKey{qconn: qconn, id: id}
+	sess, ok := m.conns[key]
+	if !ok || sess.conn != nil {
+		return
+	}
+	for _, p := range sess.pending {
+		p.reject(WebTransportBufferedStreamRejectedErrorCode)
+	}
+	if len(sess.pending) > 0 && m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+		m.logger.Logf(LogComponentSessionManager, LogLevelDebug, "[%s] reset %d streams, session was rejected",
+			sessionString(qconn, id), len(sess.pending))
+	}
+	m.numBufferedStreams -= len(sess.pending)
+	sess.pending = nil
+	// The streams waiting for the session are woken up, and find that the session wasn't established.
+	close(sess.created)
+	delete(m.conns, key)
+}
+
 // AddSession adds a new WebTransport session.
-func (m *sessionManager) AddSession(qconn http3.StreamCreator, id sessionID, conn *Conn) {
+// When a session is added to a QUIC connection without any other sessions, it starts a new go routine
+// to receive datagrams on that connection, unless datagrams are disabled for the session.
+// The session is removed once it is closed, or once the QUIC connection is closed.
+// Its session ID can't be reused until the QUIC connection is closed.
+// It is an error to add the same session twice. In strict mode, this is a protocol violation.
+func (m *sessionManager) AddSession(qconn quic.Connection, id sessionID, conn *Conn) error {
+	delivered, err := m.addSession(qconn, id, conn)
+	// The tracer is called without holding the lock, so it can call back into the session manager.
+	for _, s := range delivered {
+		conn.streamDelivered(s.id, s.buffered)
+	}
+	if m.strict && errors.Is(err, errSessionEstablished) {
+		m.violation(qconn, idErrorCode, err.Error())
+	}
+	return err
+}
+
+// A deliveredStream is a buffered stream that was added to the accept queue of its session.
+type deliveredStream struct {
+	id       quic.StreamID
+	buffered time.Duration
+}
+
+// addSession adds the session, and returns the buffered streams that were delivered to it.
+func (m *sessionManager) addSession(qconn quic.Connection, id sessionID, conn *Conn) ([]deliveredStream, error) {
 	m.mx.Lock()
 	defer m.mx.Unlock()
 
 	key := sessionKey{qconn: qconn, id: id}
+	if sess, ok := m.conns[key]; ok && sess.conn != nil {
+		return nil, fmt.Errorf("%w: %d", errSessionEstablished, id)
+	}
+	if d, ok := m.datagramConns[qconn]; ok {
+		if _, closed := d.closed[id]; closed {
+			return nil, fmt.Errorf("webtransport: session %d was already closed", id)
+		}
+	}
+
+	d, ok := m.datagramConns[qconn]
+	if !ok {
+		d = &datagramDispatcher{}
+		m.datagramConns[qconn] = d
+		m.refCount.Go(connLabelContext(qconn, nil), func() { m.watchConn(qconn, d) })
+		if m.fairScheduling {
+			d.scheduler = newConnScheduler()
+		}
+		if m.bandwidthLimit > 0 {
+			d.shaper = newConnShaper(m.bandwidthLimit)
+		}
+		if m.connectStreamPriority {
+			d.priority = newPriorityGate()
+		}
+	}
+	// quic-go doesn't allow receiving datagrams if they were disabled.
+	if !conn.datagramsDisabled && !d.receiving() {
+		ctx, cancel := context.WithCancel(m.ctx)
+		d.ctx, d.ctxCancel = ctx, cancel
+		m.refCount.Go(connLabelContext(qconn, nil), func() { m.handleDatagrams(ctx, qconn, d) })
+	}
+	conn.scheduler = d.scheduler
+	conn.shaper = d.shaper
+	conn.priority = d.priority
+	d.sessions++
+	m.refCount.Go(connLabelContext(qconn, &id), func() { m.watchSession(key, conn) })
+
 	if sess, ok := m.conns[key]; ok {
 		sess.conn = conn
+		// Add the streams that were received before the session was established, in order.
+		var delivered []deliveredStream
+		for _, p := range sess.pending {
+			if conn.addIncomingStream(p.incomingStream) {
+				delivered = append(delivered, deliveredStream{id: p.StreamID(), buffered: time.Since(p.received)})
+			}
+		}
+		m.numBufferedStreams -= len(sess.pending)
+		sess.pending = nil
 		close(sess.created)
-		return
+		return delivered, nil
 	}
 	c := make(chan struct{})
 	close(c)
 	m.conns[key] = &session{created: c, conn: conn}
+	return nil, nil
+}
+
+// Sessions returns the established sessions on a QUIC connection.
+func (m *sessionManager) Sessions(qconn quic.Connection) []*Conn {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	var conns []*Conn
+	for key, sess := range m.conns {
+		if key.qconn == qconn && sess.conn != nil {
+			conns = append(conns, sess.conn)
+		}
+	}
+	return conns
+}
+
+// watchSession removes the session once it is closed, or once the QUIC connection is closed.
+func (m *sessionManager) watchSession(key sessionKey, conn *Conn) {
+	select {
+	case <-conn.ctx.Done():
+	case <-key.qconn.Context().Done():
+	case <-m.ctx.Done():
+		return
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if sess, ok := m.conns[key]; ok && sess.conn == conn {
+		delete(m.conns, key)
+	}
+	d, ok := m.datagramConns[key.qconn]
+	if !ok {
+		return
+	}
+	d.sessions--
+	if d.closed == nil {
+		d.closed = make(map[sessionID]struct{})
+	}
+	d.closed[key.id] = struct{}{}
+	if d.sessions > 0 || d.ctx == nil {
+		return
+	}
+	// This was the last session on the QUIC connection.
+	// If a new session is established on the connection later, datagrams are received again.
+	d.ctxCancel()
+	m.stopReceivingDatagrams(key.qconn)
+}
+
+// watchConn removes the dispatcher once the QUIC connection is closed.
+// It also forgets the connection's identifier used in logs (see connectionID).
+func (m *sessionManager) watchConn(qconn quic.Connection, d *datagramDispatcher) {
+	select {
+	case <-qconn.Context().Done():
+		forgetConnectionID(qconn)
+	case <-m.ctx.Done():
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if d.ctx != nil {
+		d.ctxCancel()
+	}
+	if m.datagramConns[qconn] == d {
+		delete(m.datagramConns, qconn)
+	}
+	m.stopReceivingDatagrams(qconn)
+}
+
+// handleDatagrams receives datagrams on a QUIC connection and dispatches them to the sessions.
+// Malformed datagrams and datagrams for sessions that don't exist (yet) are dropped,
+// or, in strict mode, cause the QUIC connection to be closed.
+// It returns when the QUIC connection is closed, or when ctx is canceled
+// because the last session on the QUIC connection was closed.
+// If dispatching a datagram panics (e.g. in a Tracer or ProtocolViolationHandler callback),
+// the panic is logged and the QUIC connection is closed, since its datagrams can't be received anymore.
+func (m *sessionManager) handleDatagrams(ctx context.Context, qconn quic.Connection, d *datagramDispatcher) {
+	defer func() {
+		m.mx.Lock()
+		if d.ctx == ctx {
+			d.ctxCancel()
+		}
+		m.stopReceivingDatagrams(qconn)
+		m.mx.Unlock()
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			m.logger.Logf(LogComponentSessionManager, LogLevelError, "[%s] panic dispatching datagrams: %v\n%s", connString(qconn), p, panicStack())
+			qconn.CloseWithError(internalErrorCode, "")
+		}
+	}()
+
+	for {
+		b, err := m.receiveDatagram(ctx, qconn)
+		if err != nil {
+			return
+		}
+		reason, err := m.handleDatagram(qconn, d, b, time.Now())
+		if err != nil {
+			m.mx.Lock()
+			m.droppedDatagrams++
+			m.mx.Unlock()
+			if m.tracer != nil {
+				m.tracer.DatagramDropped(qconn, reason)
+			}
+			stopped := ctx.Err() != nil
+			if (m.strictDatagrams || m.strict) && !stopped && !errors.Is(err, errDatagramClosedSession) {
+				m.violation(qconn, datagramErrorCode, err.Error())
+				return
+			}
+			if m.logger.Enabled(LogComponentSessionManager, LogLevelDebug) {
+				m.logger.Sampledf(LogComponentSessionManager, LogLevelDebug, "dropped datagram", "[%s] dropped datagram: %s", connString(qconn), err)
+			}
+		}
+	}
+}
+
+// handleDatagram dispatches a datagram to its session.
+// If the datagram is dropped, it returns an error, and the reason why it was dropped.
+func (m *sessionManager) handleDatagram(qconn quic.Connection, d *datagramDispatcher, b []byte, rcvTime time.Time) (DatagramDropReason, error) {
+	id, data, err := parseDatagram(b)
+	if err != nil {
+		return DatagramDropMalformed, err
+	}
+	if id == heartbeatSessionID {
+		return m.handleHeartbeatDatagram(qconn, data)
+	}
+	var conn *Conn
+	m.mx.Lock()
+	if sess, ok := m.conns[sessionKey{qconn: qconn, id: id}]; ok {
+		conn = sess.conn
+	}
+	_, closed := d.closed[id]
+	m.mx.Unlock()
+	if conn == nil {
+		if closed {
+			return DatagramDropUnknownSession, fmt.Errorf("%w %d", errDatagramClosedSession, id)
+		}
+		return DatagramDropUnknownSession, fmt.Errorf("datagram for unknown session %d", id)
+	}
+	conn.addDatagram(data, MessageInfo{ReceiveTime: rcvTime})
+	return 0, nil
+}
+
+// DroppedDatagrams returns the number of datagrams that were dropped because they were malformed,
+// or because they belonged to an unknown session.
+func (m *sessionManager) DroppedDatagrams() uint64 {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return m.droppedDatagrams
+}
+
+// AddDatagramStatsStream handles a stream on which the peer reports datagram statistics.
+func (m *sessionManager) AddDatagramStatsStream(qconn quic.Connection, str quic.Stream) {
+	m.refCount.Go(connLabelContext(qconn, nil), func() { m.handleDatagramStatsStream(qconn, str) })
+}
+
+// violation closes the QUIC connection with the error code and message,
+// and reports the protocol violation.
+func (m *sessionManager) violation(qconn quic.Connection, code quic.ApplicationErrorCode, msg string) {
+	qconn.CloseWithError(code, msg)
+	err := &ProtocolViolationError{ErrorCode: code, Message: msg}
+	if m.onViolation == nil {
+		m.logger.Logf(LogComponentSessionManager, LogLevelError, "[%s] %s", connString(qconn), err)
+		return
+	}
+	m.onViolation(qconn, err)
 }
 
 func (m *sessionManager) Close() {
@@ -0,0 +1,483 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPipeConns creates the two ends of an in-memory QUIC connection.
+func newTestPipeConns() (client, server *pipeConn) {
+	return newPipeConns()
+}
+
+func packTestDatagram(id sessionID, payload []byte) []byte {
+	b := &bytes.Buffer{}
+	quicvarint.Write(b, uint64(id)/4)
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func (m *sessionManager) numEntries() (conns, datagramConns int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.conns), len(m.datagramConns)
+}
+
+// numReceiving returns the number of QUIC connections that datagrams are received on.
+func (m *sessionManager) numReceiving() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var n int
+	for _, d := range m.datagramConns {
+		if d.receiving() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSessionManagerNoLeak(t *testing.T) {
+	m := newSessionManager(time.Second)
+	defer m.Close()
+
+	const num = 2000
+	var closeConns []func()
+	defer func() {
+		for _, f := range closeConns {
+			f()
+		}
+	}()
+	for i := 0; i < num; i++ {
+		client, server := newTestPipeConns()
+		conn := newConn(0, server, io.NopCloser(strings.NewReader("")))
+		require.NoError(t, m.AddSession(server, 0, conn))
+		if i%2 == 0 {
+			// the QUIC connection is closed
+			server.CloseWithError(0, "")
+			continue
+		}
+		// The session is closed, but the QUIC connection stays open.
+		conn.Close()
+		closeConns = append(closeConns, func() { client.CloseWithError(0, "") })
+	}
+
+	// Datagrams are not received anymore, but the dispatchers are kept until the QUIC connections are closed.
+	require.Eventually(t, func() bool {
+		conns, datagramConns := m.numEntries()
+		return conns == 0 && datagramConns == num/2 && m.numReceiving() == 0 && m.refCount.Count() == num/2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The calls to ReceiveMessage return once the QUIC connections are closed.
+	for _, f := range closeConns {
+		f()
+	}
+	closeConns = nil
+	require.Eventually(t, func() bool {
+		m.mx.Lock()
+		numReceivers := len(m.datagramReceivers)
+		m.mx.Unlock()
+		_, datagramConns := m.numEntries()
+		return numReceivers == 0 && datagramConns == 0 && m.refCount.Count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSessionManagerDatagramsAfterLastSessionClosed(t *testing.T) {
+	m := newSessionManager(time.Second)
+	defer m.Close()
+
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	conn1 := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	require.NoError(t, m.AddSession(server, 0, conn1))
+	conn1.Close()
+	require.Eventually(t, func() bool {
+		return m.numReceiving() == 0 && m.refCount.Count() == 1
+	}, time.Second, time.Millisecond)
+
+	// The call to ReceiveMessage is still outstanding, and hands the datagram to the new dispatcher.
+	conn2 := newConn(4, server, io.NopCloser(strings.NewReader("")))
+	require.NoError(t, m.AddSession(server, 4, conn2))
+	require.NoError(t, client.SendMessage(packTestDatagram(4, []byte("foobar"))))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := conn2.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+}
+
+func TestSessionManagerClosedSessionDatagrams(t *testing.T) {
+	m := newSessionManager(time.Second)
+	m.strict = true
+	defer m.Close()
+
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	conn1 := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	conn2 := newConn(4, server, io.NopCloser(strings.NewReader("")))
+	require.NoError(t, m.AddSession(server, 0, conn1))
+	require.NoError(t, m.AddSession(server, 4, conn2))
+
+	conn1.Close()
+	require.Eventually(t, func() bool {
+		conns, _ := m.numEntries()
+		return conns == 1
+	}, time.Second, time.Millisecond)
+	// the session ID can't be reused
+	require.Error(t, m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader("")))))
+
+	// Datagrams for the closed session might still be in flight.
+	// They're dropped, but that's not a protocol violation.
+	require.NoError(t, client.SendMessage(packTestDatagram(0, []byte("foo"))))
+	require.NoError(t, client.SendMessage(packTestDatagram(4, []byte("bar"))))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := conn2.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), b)
+	require.NoError(t, server.Context().Err())
+	require.Equal(t, uint64(1), m.DroppedDatagrams())
+
+	// Closing the last session stops receiving datagrams.
+	conn2.Close()
+	require.Eventually(t, func() bool {
+		conns, _ := m.numEntries()
+		return conns == 0 && m.numReceiving() == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestSessionManagerClosedSingleSession(t *testing.T) {
+	m := newSessionManager(50 * time.Millisecond)
+	m.strict = true
+	violations := make(chan *ProtocolViolationError, 1)
+	m.onViolation = func(_ quic.Connection, err *ProtocolViolationError) { violations <- err }
+	defer m.Close()
+
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	conn := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	require.NoError(t, m.AddSession(server, 0, conn))
+	conn.Close()
+	require.Eventually(t, func() bool {
+		conns, _ := m.numEntries()
+		return conns == 0 && m.numReceiving() == 0
+	}, time.Second, time.Millisecond)
+
+	// the session ID can't be reused
+	require.Error(t, m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader("")))))
+	// late streams for the session are reset right away, and are not a protocol violation
+	local, remote := openTestStream(t, client, server)
+	m.AddStream(server, remote, 0)
+	requireStreamReset(t, local, WebTransportSessionGoneErrorCode)
+	require.Zero(t, m.DebugState().BufferedStreams)
+	select {
+	case err := <-violations:
+		t.Fatalf("unexpected protocol violation: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, server.Context().Err())
+
+	// the closed session IDs (and the connection's identifier) are forgotten once the QUIC connection is closed
+	connectionID(server)
+	server.CloseWithError(0, "")
+	require.Eventually(t, func() bool {
+		_, datagramConns := m.numEntries()
+		return datagramConns == 0 && m.refCount.Count() == 0
+	}, time.Second, time.Millisecond)
+	connIDs.mx.Lock()
+	defer connIDs.mx.Unlock()
+	require.NotContains(t, connIDs.m, server)
+}
+
+// openTestStream opens a stream on the client side of a pipe, and returns both ends of the stream.
+func openTestStream(t *testing.T, client, server *pipeConn) (local, remote quic.Stream) {
+	t.Helper()
+	local, err := client.OpenStream()
+	require.NoError(t, err)
+	remote, err = server.AcceptStream(context.Background())
+	require.NoError(t, err)
+	return local, remote
+}
+
+func requireStreamReset(t *testing.T, str quic.Stream, code quic.StreamErrorCode) {
+	t.Helper()
+	require.NoError(t, str.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := str.Read([]byte{0})
+	var streamErr *quic.StreamError
+	require.True(t, errors.As(err, &streamErr), "expected a stream error, got %v", err)
+	require.Equal(t, code, streamErr.ErrorCode)
+}
+
+func TestSessionManagerInvalidSessionID(t *testing.T) {
+	t.Run("non-strict", func(t *testing.T) {
+		m := newSessionManager(time.Hour)
+		defer m.Close()
+		client, server := newTestPipeConns()
+		defer client.CloseWithError(0, "")
+
+		// not a client-initiated bidirectional stream
+		local, remote := openTestStream(t, client, server)
+		m.AddStream(server, remote, 2)
+		requireStreamReset(t, local, WebTransportBufferedStreamRejectedErrorCode)
+		// not a bidirectional stream
+		local, remote = openTestStream(t, client, server)
+		m.AddStream(server, remote, 6)
+		requireStreamReset(t, local, WebTransportBufferedStreamRejectedErrorCode)
+
+		require.Empty(t, m.DebugState().PendingSessions)
+		require.NoError(t, server.Context().Err())
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		m := newSessionManager(time.Hour)
+		m.strict = true
+		violations := make(chan *ProtocolViolationError, 1)
+		m.onViolation = func(_ quic.Connection, err *ProtocolViolationError) { violations <- err }
+		defer m.Close()
+		client, server := newTestPipeConns()
+		defer client.CloseWithError(0, "")
+
+		_, remote := openTestStream(t, client, server)
+		m.AddStream(server, remote, 1)
+		select {
+		case err := <-violations:
+			require.Equal(t, idErrorCode, err.ErrorCode)
+			require.Contains(t, err.Message, "invalid session ID 1")
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		require.Error(t, server.Context().Err())
+	})
+}
+
+func TestSessionManagerDuplicateSession(t *testing.T) {
+	t.Run("non-strict", func(t *testing.T) {
+		m := newSessionManager(time.Hour)
+		defer m.Close()
+		client, server := newTestPipeConns()
+		defer client.CloseWithError(0, "")
+
+		require.NoError(t, m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader("")))))
+		err := m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader(""))))
+		require.ErrorIs(t, err, errSessionEstablished)
+		require.NoError(t, server.Context().Err())
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		m := newSessionManager(time.Hour)
+		m.strict = true
+		violations := make(chan *ProtocolViolationError, 1)
+		m.onViolation = func(_ quic.Connection, err *ProtocolViolationError) { violations <- err }
+		defer m.Close()
+		client, server := newTestPipeConns()
+		defer client.CloseWithError(0, "")
+
+		require.NoError(t, m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader("")))))
+		err := m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader(""))))
+		require.ErrorIs(t, err, errSessionEstablished)
+		select {
+		case err := <-violations:
+			require.Equal(t, idErrorCode, err.ErrorCode)
+			require.Contains(t, err.Message, "session already established: 0")
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		require.Error(t, server.Context().Err())
+	})
+}
+
+func TestSessionManagerRejectSession(t *testing.T) {
+	m := newSessionManager(time.Hour)
+	defer m.Close()
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	// The session is established on the client's first bidirectional stream (see Pipe).
+	local1, remote1 := openTestStream(t, client, server)
+	m.AddStream(server, remote1, 0)
+	local2, remote2 := openTestStream(t, client, server)
+	m.AddStream(server, remote2, 0)
+	require.Equal(t, 2, m.DebugState().BufferedStreams)
+
+	m.RejectSession(server, 0)
+	requireStreamReset(t, local1, WebTransportBufferedStreamRejectedErrorCode)
+	requireStreamReset(t, local2, WebTransportBufferedStreamRejectedErrorCode)
+	require.Eventually(t, func() bool {
+		conns, _ := m.numEntries()
+		return conns == 0 && m.refCount.Count() == 0
+	}, time.Second, time.Millisecond)
+}
+
+type panickingTracer struct{ NoopTracer }
+
+func (panickingTracer) DatagramDropped(quic.Connection, DatagramDropReason) { panic("foobar") }
+
+func TestSessionManagerDatagramDispatchPanic(t *testing.T) {
+	m := newSessionManager(time.Second)
+	m.tracer = panickingTracer{}
+	logged := make(chan string, 1)
+	m.logger = newLogger(&LogConfig{
+		Level:  LogLevelError,
+		Printf: func(format string, args ...interface{}) { logged <- fmt.Sprintf(format, args...) },
+	})
+	defer m.Close()
+
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	require.NoError(t, m.AddSession(server, 0, newConn(0, server, io.NopCloser(strings.NewReader("")))))
+	// The datagram for an unknown session is dropped, and the tracer panics.
+	require.NoError(t, client.SendMessage(packTestDatagram(4, []byte("foo"))))
+	select {
+	case <-server.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("QUIC connection wasn't closed")
+	}
+	select {
+	case msg := <-logged:
+		require.Contains(t, msg, "panic dispatching datagrams: foobar")
+	case <-time.After(time.Second):
+		t.Fatal("panic wasn't logged")
+	}
+	require.Eventually(t, func() bool {
+		_, datagramConns := m.numEntries()
+		return datagramConns == 0
+	}, time.Second, time.Millisecond)
+}
+
+type streamDeliveryTracer struct {
+	NoopTracer
+
+	mx          sync.Mutex
+	identified  []quic.StreamID
+	delivered   map[quic.StreamID]time.Duration
+	onDelivered func()
+}
+
+func (t *streamDeliveryTracer) StreamIdentified(_ quic.Connection, _ uint64, id quic.StreamID) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.identified = append(t.identified, id)
+}
+
+func (t *streamDeliveryTracer) StreamDelivered(_ Session, id quic.StreamID, buffered time.Duration) {
+	t.mx.Lock()
+	t.delivered[id] = buffered
+	onDelivered := t.onDelivered
+	t.mx.Unlock()
+	if onDelivered != nil {
+		onDelivered()
+	}
+}
+
+func TestSessionManagerStreamDeliveryTracing(t *testing.T) {
+	tracer := &streamDeliveryTracer{delivered: make(map[quic.StreamID]time.Duration)}
+	m := newSessionManager(time.Hour)
+	m.tracer = tracer
+	defer m.Close()
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	_, buffered := openTestStream(t, client, server)
+	m.AddStream(server, buffered, 0)
+	require.Equal(t, []quic.StreamID{buffered.StreamID()}, tracer.identified)
+	require.Empty(t, tracer.delivered)
+
+	time.Sleep(10 * time.Millisecond)
+	conn := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	conn.tracer = tracer
+	require.NoError(t, m.AddSession(server, 0, conn))
+	_, direct := openTestStream(t, client, server)
+	m.AddStream(server, direct, 0)
+
+	tracer.mx.Lock()
+	defer tracer.mx.Unlock()
+	require.Equal(t, []quic.StreamID{buffered.StreamID(), direct.StreamID()}, tracer.identified)
+	require.Len(t, tracer.delivered, 2)
+	require.GreaterOrEqual(t, tracer.delivered[buffered.StreamID()], 10*time.Millisecond)
+	require.Zero(t, tracer.delivered[direct.StreamID()])
+}
+
+func TestSessionManagerStreamDeliveryTracingWithoutLocks(t *testing.T) {
+	tracer := &streamDeliveryTracer{delivered: make(map[quic.StreamID]time.Duration)}
+	m := newSessionManager(time.Hour)
+	m.tracer = tracer
+	defer m.Close()
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	// The tracer calls back into the session manager. This deadlocks if the lock is held.
+	tracer.onDelivered = func() {
+		m.DebugState()
+		m.Sessions(server)
+	}
+	_, buffered := openTestStream(t, client, server)
+	m.AddStream(server, buffered, 0)
+	conn := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	conn.tracer = tracer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, m.AddSession(server, 0, conn))
+		_, direct := openTestStream(t, client, server)
+		m.AddStream(server, direct, 0)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tracer was called with the lock held")
+	}
+	tracer.mx.Lock()
+	defer tracer.mx.Unlock()
+	require.Len(t, tracer.delivered, 2)
+}
+
+func TestSessionManagerMaxBufferedStreams(t *testing.T) {
+	m := newSessionManager(time.Hour)
+	m.maxBufferedStreams = 2
+	defer m.Close()
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+
+	// the limit applies across sessions
+	_, remote := openTestStream(t, client, server)
+	m.AddStream(server, remote, 0)
+	_, remote = openTestStream(t, client, server)
+	m.AddStream(server, remote, 4)
+	local, remote := openTestStream(t, client, server)
+	m.AddStream(server, remote, 8) // exceeds the limit
+	requireStreamReset(t, local, WebTransportBufferedStreamRejectedErrorCode)
+	state := m.DebugState()
+	require.Equal(t, 2, state.BufferedStreams)
+	require.Equal(t, uint64(1), state.BufferLimitRejectedStreams)
+
+	// streams for established sessions are not buffered
+	conn := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	require.NoError(t, m.AddSession(server, 0, conn))
+	for i := 0; i < 2; i++ {
+		_, remote = openTestStream(t, client, server)
+		m.AddStream(server, remote, 0)
+	}
+	require.Equal(t, 1, m.DebugState().BufferedStreams)
+	// the streams delivered to the established session freed up space
+	_, remote = openTestStream(t, client, server)
+	m.AddStream(server, remote, 8)
+	require.Equal(t, 2, m.DebugState().BufferedStreams)
+	m.RejectSession(server, 4)
+	m.RejectSession(server, 8)
+	require.Zero(t, m.DebugState().BufferedStreams)
+	require.Equal(t, uint64(1), m.DebugState().BufferLimitRejectedStreams)
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	require.Zero(t, m.numBufferedStreams)
+}
@@ -0,0 +1,62 @@
+package webtransport
+
+import "sync/atomic"
+
+// SessionStats are statistics about the data exchanged on a session.
+// Byte counts only include application data, i.e. they don't include stream and datagram headers.
+type SessionStats struct {
+	// BytesSent is the number of bytes written to streams and sent in datagrams.
+	BytesSent uint64
+	// BytesReceived is the number of bytes read from streams and received in datagrams.
+	BytesReceived uint64
+	// StreamsOpened is the number of (bidirectional and unidirectional) streams opened.
+	StreamsOpened uint64
+	// StreamsAccepted is the number of streams accepted.
+	StreamsAccepted uint64
+	// DatagramsSent is the number of datagrams sent.
+	DatagramsSent uint64
+	// DatagramsReceived is the number of datagrams received.
+	DatagramsReceived uint64
+
+	// BufferedBytes is the memory currently held for data the application didn't consume yet,
+	// i.e. for datagrams that were not received and streams that were not accepted (see SessionMemoryLimit).
+	BufferedBytes uint64
+	// MemoryLimitDroppedDatagrams is the number of datagrams dropped because of the SessionMemoryLimit.
+	MemoryLimitDroppedDatagrams uint64
+	// MemoryLimitRejectedStreams is the number of streams reset because of the SessionMemoryLimit.
+	MemoryLimitRejectedStreams uint64
+}
+
+// sessionCounters counts the data exchanged on a session.
+// All fields are accessed atomically.
+type sessionCounters struct {
+	bytesSent, bytesReceived       uint64
+	streamsOpened, streamsAccepted uint64
+
+	bufferedBytes                                 int64
+	waitingSince                                  int64 // see consumed
+	memoryDroppedDatagrams, memoryRejectedStreams uint64
+}
+
+// Stats returns statistics about the data exchanged on this session.
+func (c *Conn) Stats() SessionStats {
+	return SessionStats{
+		BytesSent:         atomic.LoadUint64(&c.counters.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&c.counters.bytesReceived),
+		StreamsOpened:     atomic.LoadUint64(&c.counters.streamsOpened),
+		StreamsAccepted:   atomic.LoadUint64(&c.counters.streamsAccepted),
+		DatagramsSent:     atomic.LoadUint64(&c.datagramStats.sent),
+		DatagramsReceived: atomic.LoadUint64(&c.datagramStats.received),
+
+		BufferedBytes:               uint64(atomic.LoadInt64(&c.counters.bufferedBytes)),
+		MemoryLimitDroppedDatagrams: atomic.LoadUint64(&c.counters.memoryDroppedDatagrams),
+		MemoryLimitRejectedStreams:  atomic.LoadUint64(&c.counters.memoryRejectedStreams),
+	}
+}
+
+// countBytes adds n to the counter, if it's not nil.
+func countBytes(counter *uint64, n int) {
+	if counter != nil && n > 0 {
+		atomic.AddUint64(counter, uint64(n))
+	}
+}
@@ -0,0 +1,79 @@
+package webtransport
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowConsumerConfig configures the detection of slow consumers: sessions with streams or datagrams
+// waiting to be consumed, while the application hasn't accepted a stream (using AcceptStream or AcceptUniStream) or received
+// a datagram (using ReceiveMessage) for a while, e.g. because the handler is stuck.
+// Without detection, the data of these sessions stays in memory until the session is closed
+// (see also SessionMemoryLimit).
+type SlowConsumerConfig struct {
+	// Timeout is the time that data may wait without the application consuming any of it.
+	Timeout time.Duration
+	// Close closes slow consumers. Otherwise, slow consumers are only reported to OnDetected.
+	Close bool
+	// ErrorCode is the application error code sent to the client in a CLOSE_WEBTRANSPORT_SESSION capsule
+	// when a slow consumer is closed. It is only sent by the Server, and only while the handler
+	// that called Upgrade is still running (quic-go closes the CONNECT stream once the handler returns).
+	ErrorCode SessionErrorCode
+	// OnDetected is called when a slow consumer is detected, before it is closed (if Close is set).
+	// If the session isn't closed, it is called again only after the application consumed data,
+	// and data waited for Timeout once more. It must not block.
+	OnDetected func(Session)
+}
+
+// slowConsumerCloseMessage is the error message sent in the CLOSE_WEBTRANSPORT_SESSION capsule.
+const slowConsumerCloseMessage = "slow consumer"
+
+// watchConsumer periodically checks if the application consumes the streams and datagrams
+// received on the session. It returns when the session or the QUIC connection is closed.
+func (c *Conn) watchConsumer(conf *SlowConsumerConfig) {
+	interval := conf.Timeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reported int64 // the waitingSince value that was last reported
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.qconn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		since := c.waitingSince()
+		if since == 0 || since == reported || time.Since(time.Unix(0, since)) < conf.Timeout {
+			continue
+		}
+		reported = since
+		c.logf(LogLevelInfo, "slow consumer: data waiting for %s", time.Since(time.Unix(0, since)).Round(time.Millisecond))
+		if conf.OnDetected != nil {
+			conf.OnDetected(c)
+		}
+		if conf.Close {
+			c.closeWithReason(&SessionError{ErrorCode: conf.ErrorCode, Message: slowConsumerCloseMessage}, slowConsumerCloseMessage)
+			return
+		}
+	}
+}
+
+// waitingSince returns the time (in Unix nanoseconds) since when data has been waiting for
+// the application to consume it, or 0 if no data is waiting.
+func (c *Conn) waitingSince() int64 {
+	since := atomic.LoadInt64(&c.counters.waitingSince)
+	if since == 0 && atomic.LoadInt64(&c.counters.bufferedBytes) > 0 {
+		// reserveMemory and consumed raced, and the time was reset while data was waiting
+		now := time.Now().UnixNano()
+		if atomic.CompareAndSwapInt64(&c.counters.waitingSince, 0, now) {
+			return now
+		}
+		return atomic.LoadInt64(&c.counters.waitingSince)
+	}
+	return since
+}
@@ -0,0 +1,104 @@
+package webtransport
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowConsumerClose(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	connectStr, remote := openTestStream(t, client, server)
+	c.setConnectStream(remote)
+
+	detected := make(chan Session, 1)
+	go c.watchConsumer(&SlowConsumerConfig{
+		Timeout:    50 * time.Millisecond,
+		Close:      true,
+		ErrorCode:  42,
+		OnDetected: func(sess Session) { detected <- sess },
+	})
+	c.addDatagram([]byte("foobar"), MessageInfo{})
+	select {
+	case sess := <-detected:
+		require.Equal(t, c, sess)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+	require.Equal(t, "slow consumer", c.closeReason)
+
+	// the CLOSE_WEBTRANSPORT_SESSION capsule, in a DATA frame
+	r := quicvarint.NewReader(connectStr)
+	typ, err := quicvarint.Read(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(dataFrameType), typ)
+	_, err = quicvarint.Read(r)
+	require.NoError(t, err)
+	typ, err = quicvarint.Read(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(closeSessionCapsuleType), typ)
+	l, err := quicvarint.Read(r)
+	require.NoError(t, err)
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	require.Equal(t, uint32(42), binary.BigEndian.Uint32(payload))
+	require.Equal(t, "slow consumer", string(payload[4:]))
+}
+
+func TestSlowConsumerDetection(t *testing.T) {
+	client, server := newTestPipeConns()
+	defer client.CloseWithError(0, "")
+	c := newConn(0, server, io.NopCloser(strings.NewReader("")))
+	defer c.Close()
+
+	detected := make(chan struct{}, 10)
+	go c.watchConsumer(&SlowConsumerConfig{
+		Timeout:    50 * time.Millisecond,
+		OnDetected: func(Session) { detected <- struct{}{} },
+	})
+	// no data waiting
+	select {
+	case <-detected:
+		t.Fatal("detected a slow consumer without any data waiting")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.addDatagram([]byte("foo"), MessageInfo{})
+	c.addDatagram([]byte("bar"), MessageInfo{})
+	select {
+	case <-detected:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	// only reported once, as long as no data is consumed
+	select {
+	case <-detected:
+		t.Fatal("slow consumer reported twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, c.Context().Err())
+
+	// Consuming data restarts the clock.
+	_, err := c.ReceiveMessage(context.Background())
+	require.NoError(t, err)
+	select {
+	case <-detected:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,149 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/lucas-clemente/quic-go"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// UDPBufferSizes are the sizes of the receive and send buffers of a UDP socket, in bytes.
+type UDPBufferSizes struct {
+	Receive int
+	Send    int
+}
+
+// socketOptions are applied to the UDP sockets created by the Server and the Dialer.
+type socketOptions struct {
+	dscp          uint8
+	bufferSizes   UDPBufferSizes
+	onBufferSizes func(requested, actual UDPBufferSizes)
+
+	// ctx and refCount are only used by dial: the go routine closing the socket is tracked using refCount,
+	// and closes the QUIC connection once ctx is cancelled (i.e. once the Dialer is closed).
+	ctx      context.Context
+	refCount *refCounter
+}
+
+func (o *socketOptions) isDefault() bool {
+	return o.dscp == 0 && o.bufferSizes == UDPBufferSizes{}
+}
+
+// apply applies the socket options to a packet conn.
+func (o *socketOptions) apply(conn net.PacketConn) error {
+	if o.dscp != 0 {
+		if err := setDSCP(conn, o.dscp); err != nil {
+			return err
+		}
+	}
+	if o.bufferSizes != (UDPBufferSizes{}) {
+		if err := o.setBufferSizes(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type bufferSetter interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+// setBufferSizes sets the socket buffer sizes.
+// The OS might not honor the requested sizes (e.g. on Linux, they are capped by net.core.rmem_max
+// and net.core.wmem_max). We therefore read back the actual buffer sizes, and report them.
+func (o *socketOptions) setBufferSizes(conn net.PacketConn) error {
+	c, ok := conn.(bufferSetter)
+	if !ok {
+		return errors.New("webtransport: can't set buffer sizes on this packet conn")
+	}
+	if o.bufferSizes.Receive > 0 {
+		if err := c.SetReadBuffer(o.bufferSizes.Receive); err != nil {
+			return err
+		}
+	}
+	if o.bufferSizes.Send > 0 {
+		if err := c.SetWriteBuffer(o.bufferSizes.Send); err != nil {
+			return err
+		}
+	}
+	if o.onBufferSizes == nil {
+		return nil
+	}
+	// Not all platforms allow inspecting the buffer sizes.
+	// Failing to inspect them is not a reason to fail setting up the socket.
+	if actual, err := inspectBufferSizes(conn); err == nil {
+		o.onBufferSizes(o.bufferSizes, actual)
+	}
+	return nil
+}
+
+// setDSCP sets the DSCP on all packets sent on conn.
+// The DSCP occupies the upper 6 bits of the IPv4 TOS / IPv6 Traffic Class field.
+// The lower 2 bits (used for ECN) are left unset.
+func setDSCP(conn net.PacketConn, dscp uint8) error {
+	if dscp > 0x3f {
+		return errors.New("webtransport: invalid DSCP value")
+	}
+	tos := int(dscp) << 2
+	// We don't know if this is an IPv4 or an IPv6 socket (or a dual-stack socket),
+	// so we try both. Setting the option only fails if neither of them is applicable.
+	err4 := ipv4.NewPacketConn(conn).SetTOS(tos)
+	err6 := ipv6.NewPacketConn(conn).SetTrafficClass(tos)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// listenUDP creates a new UDP socket and applies the socket options.
+func (o *socketOptions) listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial dials a new QUIC connection on a newly created UDP socket that has the socket options applied.
+// The socket is closed when the QUIC connection is closed. The QUIC connection is closed when ctx is cancelled.
+func (o *socketOptions) dial(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := o.listenUDP(":0")
+	if err != nil {
+		return nil, err
+	}
+	qconn, err := quic.DialEarlyContext(ctx, conn, raddr, host, tlsConf, conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	o.refCount.Go(connLabelContext(qconn, nil), func() {
+		select {
+		case <-qconn.Context().Done():
+		case <-o.ctx.Done():
+			qconn.CloseWithError(0, "")
+		}
+		conn.Close()
+	})
+	return qconn, nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux && !freebsd
+// +build !darwin,!linux,!freebsd
+
+package webtransport
+
+import (
+	"errors"
+	"net"
+)
+
+func inspectBufferSizes(net.PacketConn) (UDPBufferSizes, error) {
+	return UDPBufferSizes{}, errors.New("webtransport: inspecting buffer sizes not supported on this platform")
+}
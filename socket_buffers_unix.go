@@ -0,0 +1,33 @@
+//go:build darwin || linux || freebsd
+// +build darwin linux freebsd
+
+package webtransport
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func inspectBufferSizes(conn net.PacketConn) (UDPBufferSizes, error) {
+	c, ok := conn.(syscall.Conn)
+	if !ok {
+		return UDPBufferSizes{}, errors.New("webtransport: doesn't have a SyscallConn")
+	}
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return UDPBufferSizes{}, err
+	}
+	var sizes UDPBufferSizes
+	var serr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sizes.Receive, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if serr != nil {
+			return
+		}
+		sizes.Send, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil {
+		return UDPBufferSizes{}, err
+	}
+	return sizes, serr
+}
@@ -1,78 +1,764 @@
 package webtransport
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 )
 
-type Stream interface {
-	io.Reader
+type SendStream interface {
+	// StreamID returns the QUIC stream ID of the stream.
+	// Stream IDs are allocated in the order the streams are opened, which allows applications
+	// that rely on the order streams were opened in to verify the order they're accepted in.
+	StreamID() quic.StreamID
+
 	io.Writer
+	// WriteByte writes a single byte.
+	// Unless write coalescing is enabled (see SetWriteBuffer), every byte is written separately.
+	io.ByteWriter
 	io.Closer
 
-	CancelRead(ErrorCode)
 	CancelWrite(ErrorCode)
 
-	SetDeadline(time.Time) error
-	SetReadDeadline(time.Time) error
+	// Done returns a channel that is closed once the send direction of the stream is done:
+	// when it is closed or reset (using Close or CancelWrite), when the peer asks to stop sending
+	// (by sending a STOP_SENDING frame, i.e. by cancelling the receive direction), or when the session is closed.
+	// This allows writers to abort expensive work as soon as the peer is not interested in the data
+	// anymore, instead of discovering it on the next Write.
+	Done() <-chan struct{}
+	// Err returns a *StreamError once Done is closed because the peer asked to stop sending.
+	// It returns nil if Done is not closed yet, and if the stream was closed or reset locally.
+	Err() error
+
+	// Flush writes the stream header, if it hasn't been sent yet, and the data buffered by SetWriteBuffer.
+	// The header is sent along with the first Write (or on Close), so calling Flush is only
+	// necessary if the peer is expected to accept the stream before any data is written.
+	Flush() error
+	// SetWriteBuffer enables coalescing of small writes: data written is buffered until the buffer
+	// (of size bytes) is full, until flushDelay has passed since the buffered data was written,
+	// or until Flush or Close is called. If flushDelay is zero, the data is only sent once the buffer is full,
+	// or when Flush or Close is called. Writes that don't fit into the buffer flush it, and are sent directly.
+	// This avoids sending a separate STREAM frame for every write, e.g. for applications writing
+	// many small messages. Errors sending data after the flush delay are returned by the next call to
+	// Write, Flush or Close.
+	// Calling SetWriteBuffer with a size of 0 flushes the buffer, and disables write coalescing.
+	SetWriteBuffer(size int, flushDelay time.Duration) error
+
+	// SetWriteDeadline sets the deadline for Write calls.
+	// Once the deadline expires, Write returns an error implementing net.Error, with Timeout returning true,
+	// that matches os.ErrDeadlineExceeded using errors.Is. The stream can still be used after extending the deadline.
+	// This distinguishes an expired deadline from a reset of the stream by the peer (a *StreamError),
+	// and from the closure of the session (a *SessionError, matching ErrSessionClosed).
 	SetWriteDeadline(time.Time) error
+
+	// Stats returns statistics about the send direction of the stream, e.g. how often and for how long
+	// writes were blocked because the peer didn't grant enough flow control credit.
+	// Slow transfers are often caused by a receiver that doesn't read fast enough.
+	Stats() StreamStats
 }
 
-type stream struct {
-	str quic.Stream
+type ReceiveStream interface {
+	// StreamID returns the QUIC stream ID of the stream.
+	StreamID() quic.StreamID
+
+	io.Reader
+	// ReadByte reads a single byte.
+	// Data is read from the stream into the read buffer (see Peek), so that reading byte by byte
+	// (e.g. using quicvarint.Read) doesn't require an intermediate buffer.
+	io.ByteReader
+
+	// Peek returns the next n bytes without advancing the stream, blocking until n bytes are available.
+	// The data is returned by subsequent calls to Read, which allows parsing a message header
+	// before handing the stream to another part of the application.
+	// The returned slice is only valid until the next call to Read, Peek or Discard.
+	// If Peek returns fewer than n bytes, it also returns an error explaining why the read is short.
+	// It returns bufio.ErrBufferFull if n is larger than 64 KB.
+	Peek(n int) ([]byte, error)
+	// Discard skips the next n bytes, returning the number of bytes discarded.
+	// If Discard skips fewer than n bytes, it also returns an error.
+	Discard(n int) (int, error)
+
+	// CloseRead closes the receive direction of the stream, like net.TCPConn's CloseRead:
+	// subsequent calls to Read return io.EOF, and data sent by the peer is discarded.
+	// Unlike CancelRead, the peer is not asked to stop sending, so its writes succeed.
+	// Use CancelRead if the peer should stop sending.
+	// It must not be called concurrently with Read, ReadByte, Peek or Discard.
+	CloseRead() error
+
+	CancelRead(ErrorCode)
+
+	// SetReadDeadline sets the deadline for Read, ReadByte, Peek and Discard calls.
+	// Once the deadline expires, they return an error implementing net.Error, with Timeout returning true,
+	// that matches os.ErrDeadlineExceeded using errors.Is. The stream can still be used after extending the deadline.
+	// This distinguishes an expired deadline from a reset of the stream by the peer (a *StreamError),
+	// and from the closure of the session (a *SessionError, matching ErrSessionClosed).
+	SetReadDeadline(time.Time) error
 }
 
-var _ Stream = &stream{}
+// A Stream is a bidirectional stream.
+// Close only closes the send direction of the stream (like CloseWrite): the peer's data can still be read.
+type Stream interface {
+	SendStream
+	ReceiveStream
 
-func (s *stream) maybeConvertStreamError(err error) error {
-	if err == nil {
-		return nil
+	// CloseWrite closes the send direction of the stream, signaling the end of the data to the peer,
+	// e.g. the end of a request, while the response can still be read. It is equivalent to Close.
+	CloseWrite() error
+
+	SetDeadline(time.Time) error
+}
+
+type sendStream struct {
+	str quic.SendStream
+
+	headerMx sync.Mutex
+	// header is the stream header that still needs to be sent.
+	// It is written together with the first payload, to avoid sending it in a separate STREAM frame.
+	header []byte
+
+	// onDone is called once the send direction of the stream is done, i.e. closed or reset.
+	// It may be nil.
+	onDone   func()
+	doneOnce sync.Once
+	// bytesSent counts the bytes written, accessed atomically. It may be nil.
+	bytesSent *uint64
+	// onReset is called once the send direction of the stream is reset,
+	// either using CancelWrite or by the peer. It may be nil.
+	onReset   func(code ErrorCode, remote bool)
+	resetOnce sync.Once
+	// sessionErr returns the session's error once the session was closed. It may be nil.
+	sessionErr func() error
+	// stalls tracks flow control stalls (see Stats). It may be nil.
+	stalls *streamStalls
+	// the error code passed to CancelWrite plus 1, accessed atomically, 0 if not canceled
+	canceledCode uint32
+	// shape delays writes according to the bandwidth limits (see Conn.SetBandwidthLimit). It may be nil.
+	shape func(deadline time.Time, n int) error
+	// the write deadline in Unix nanoseconds, accessed atomically, used when shaping
+	writeDeadline int64
+
+	// protected by the headerMx
+	closed, canceled bool
+	closeErr         error
+
+	// write buffering, see SetWriteBuffer. Protected by the headerMx.
+	buf        []byte
+	bufSize    int
+	flushDelay time.Duration
+	flushTimer *time.Timer
+	flushErr   error // error that occurred when flushing the buffer after the flush delay
+}
+
+var _ SendStream = &sendStream{}
+
+func newSendStream(str quic.SendStream, hdr []byte) *sendStream {
+	return &sendStream{str: str, header: hdr}
+}
+
+func (s *sendStream) StreamID() quic.StreamID {
+	return s.str.StreamID()
+}
+
+func (s *sendStream) Write(b []byte) (int, error) {
+	if s.shape == nil || len(b) == 0 {
+		return s.write(b)
 	}
-	var streamErr *quic.StreamError
-	if errors.As(err, &streamErr) {
-		errorCode, cerr := httpCodeToWebtransportCode(streamErr.ErrorCode)
-		if cerr != nil {
-			return fmt.Errorf("stream reset, but failed to convert stream error %d: %w", streamErr.ErrorCode, cerr)
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shapingQuantum {
+			chunk = chunk[:shapingQuantum]
+		}
+		var deadline time.Time
+		if d := atomic.LoadInt64(&s.writeDeadline); d != 0 {
+			deadline = time.Unix(0, d)
+		}
+		if err := s.shape(deadline, len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := s.write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+func (s *sendStream) write(b []byte) (int, error) {
+	s.headerMx.Lock()
+	if s.bufSize > 0 {
+		defer s.headerMx.Unlock()
+		return s.writeBuffered(b)
+	}
+	if len(s.header) == 0 {
+		s.headerMx.Unlock()
+		n, err := s.str.Write(b)
+		countBytes(s.bytesSent, n)
+		return n, s.handleError(err)
+	}
+	defer s.headerMx.Unlock()
+	return s.writeWithHeader(b)
+}
+
+// writeWithHeader writes the pending stream header, followed by b.
+// It must be called with the headerMx held.
+func (s *sendStream) writeWithHeader(b []byte) (int, error) {
+	if len(s.header) == 0 {
+		n, err := s.str.Write(b)
+		countBytes(s.bytesSent, n)
+		return n, s.handleError(err)
+	}
+	hdrLen := len(s.header)
+	buf := make([]byte, 0, hdrLen+len(b))
+	buf = append(buf, s.header...)
+	buf = append(buf, b...)
+	n, err := s.str.Write(buf)
+	if n < hdrLen {
+		s.header = s.header[n:]
+		return 0, s.handleError(err)
+	}
+	s.header = nil
+	countBytes(s.bytesSent, n-hdrLen)
+	return n - hdrLen, s.handleError(err)
+}
+
+// handleError converts the error, and marks the stream as done if it was reset by the peer.
+func (s *sendStream) handleError(err error) error {
+	err = s.convertError(err)
+	if err != nil && errors.Is(err, &StreamError{}) {
+		if streamErr, ok := err.(*StreamError); ok {
+			s.reset(streamErr.ErrorCode, streamErr.Remote)
 		}
-		return &StreamError{ErrorCode: errorCode}
+		s.done()
+	}
+	return err
+}
+
+func (s *sendStream) done() {
+	if s.onDone != nil {
+		s.doneOnce.Do(s.onDone)
+	}
+}
+
+func (s *sendStream) reset(code ErrorCode, remote bool) {
+	if s.onReset != nil {
+		s.resetOnce.Do(func() { s.onReset(code, remote) })
+	}
+}
+
+// writeBuffered writes b to the write buffer, flushing it if necessary.
+// It must be called with the headerMx held.
+func (s *sendStream) writeBuffered(b []byte) (int, error) {
+	if err := s.takeFlushError(); err != nil {
+		return 0, err
+	}
+	if s.closed || s.canceled {
+		// let quic-go return the respective error
+		return s.writeWithHeader(b)
+	}
+	if len(s.buf)+len(b) > s.bufSize {
+		if len(s.buf) > 0 {
+			if err := s.flushBuffer(); err != nil {
+				return 0, err
+			}
+		}
+		if len(b) >= s.bufSize {
+			return s.writeWithHeader(b)
+		}
+	}
+	s.buf = append(s.buf, b...)
+	if len(s.buf) >= s.bufSize {
+		if err := s.flushBuffer(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if s.flushDelay > 0 && s.flushTimer == nil {
+		var t *time.Timer
+		t = time.AfterFunc(s.flushDelay, func() {
+			s.headerMx.Lock()
+			defer s.headerMx.Unlock()
+
+			if s.flushTimer != t { // the buffer was flushed in the meantime
+				return
+			}
+			if err := s.flushBuffer(); err != nil && s.flushErr == nil {
+				s.flushErr = err
+			}
+		})
+		s.flushTimer = t
+	}
+	return len(b), nil
+}
+
+// flushBuffer writes the pending stream header and the buffered data.
+// It must be called with the headerMx held.
+func (s *sendStream) flushBuffer() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.buf) == 0 {
+		return s.flushHeader()
+	}
+	n, err := s.writeWithHeader(s.buf)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	return err
+}
+
+// takeFlushError returns (and clears) the error that occurred when flushing the buffer after the flush delay.
+// It must be called with the headerMx held.
+func (s *sendStream) takeFlushError() error {
+	err := s.flushErr
+	s.flushErr = nil
+	return err
+}
+
+func (s *sendStream) Done() <-chan struct{} {
+	return s.str.Context().Done()
+}
+
+func (s *sendStream) Err() error {
+	select {
+	case <-s.str.Context().Done():
+	default:
+		return nil
+	}
+	// After the peer asked to stop sending, writes fail with the peer's error code.
+	// Writing no data doesn't send anything.
+	_, err := s.str.Write(nil)
+	if err = maybeConvertStreamError(err, StreamDirectionWrite); errors.Is(err, &StreamError{}) {
+		return s.handleError(err)
 	}
+	return nil
+}
+
+func (s *sendStream) WriteByte(c byte) error {
+	_, err := s.Write([]byte{c})
 	return err
 }
 
-func (s *stream) Read(b []byte) (int, error) {
+func (s *sendStream) Flush() error {
+	s.headerMx.Lock()
+	defer s.headerMx.Unlock()
+	if err := s.takeFlushError(); err != nil {
+		return err
+	}
+	return s.flushBuffer()
+}
+
+func (s *sendStream) SetWriteBuffer(size int, flushDelay time.Duration) error {
+	if size < 0 || flushDelay < 0 {
+		return errors.New("webtransport: invalid write buffer configuration")
+	}
+	s.headerMx.Lock()
+	defer s.headerMx.Unlock()
+
+	s.flushDelay = flushDelay
+	if size == 0 || len(s.buf) >= size {
+		if err := s.flushBuffer(); err != nil {
+			return err
+		}
+	}
+	s.bufSize = size
+	if size == 0 {
+		s.buf = nil
+	} else if cap(s.buf) < size {
+		buf := make([]byte, len(s.buf), size)
+		copy(buf, s.buf)
+		s.buf = buf
+	}
+	return nil
+}
+
+// flushHeader writes the pending stream header.
+// It must be called with the headerMx held.
+func (s *sendStream) flushHeader() error {
+	if len(s.header) == 0 {
+		return nil
+	}
+	n, err := s.str.Write(s.header)
+	s.header = s.header[n:]
+	return s.convertError(err)
+}
+
+// CancelWrite resets the send direction of the stream.
+// It is safe to call it multiple times, and concurrently with Write and Close.
+func (s *sendStream) CancelWrite(e ErrorCode) {
+	// Cancel the QUIC stream first. This unblocks a concurrent Write or Close,
+	// which might be holding the headerMx while writing the stream header.
+	atomic.CompareAndSwapUint32(&s.canceledCode, 0, uint32(e)+1)
+	s.str.CancelWrite(webtransportCodeToHTTPCode(e))
+	s.headerMx.Lock()
+	s.header = nil
+	s.buf = nil
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	s.canceled = true
+	s.headerMx.Unlock()
+	s.reset(e, false)
+	s.done()
+}
+
+// Close closes the send direction of the stream.
+// It is safe to call it multiple times: subsequent calls return the result of the first call.
+// Closing a stream that was canceled is a no-op.
+func (s *sendStream) Close() error {
+	defer s.done()
+
+	s.headerMx.Lock()
+	defer s.headerMx.Unlock()
+
+	if s.closed {
+		return s.closeErr
+	}
+	if s.canceled {
+		return nil
+	}
+	s.closed = true
+	if err := s.takeFlushError(); err != nil {
+		s.closeErr = err
+		return err
+	}
+	if err := s.flushBuffer(); err != nil {
+		s.closeErr = err
+		return err
+	}
+	s.closeErr = s.convertError(s.str.Close())
+	return s.closeErr
+}
+
+func (s *sendStream) SetWriteDeadline(t time.Time) error {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	atomic.StoreInt64(&s.writeDeadline, d)
+	return s.convertError(s.str.SetWriteDeadline(t))
+}
+
+func (s *sendStream) convertError(err error) error {
+	err = convertStreamError(err, s.sessionErr, StreamDirectionWrite)
+	return convertCanceledError(err, &s.canceledCode, StreamDirectionWrite)
+}
+
+type receiveStream struct {
+	str quic.ReceiveStream
+
+	// onDone is called once the receive direction of the stream is done,
+	// i.e. all data was read, or the stream was reset. It may be nil.
+	onDone   func()
+	doneOnce sync.Once
+	// bytesReceived counts the bytes read, accessed atomically. It may be nil.
+	bytesReceived *uint64
+	// onReset is called once the receive direction of the stream is reset,
+	// either using CancelRead or by the peer. It may be nil.
+	onReset   func(code ErrorCode, remote bool)
+	resetOnce sync.Once
+	// sessionErr returns the session's error once the session was closed. It may be nil.
+	sessionErr func() error
+	// the error code passed to CancelRead plus 1, accessed atomically, 0 if not canceled
+	canceledCode uint32
+
+	// The read buffer holds data read by Peek, which is returned by Read before reading from the stream.
+	// It is allocated on the first call to Peek.
+	buf        []byte
+	rpos, wpos int   // buf[rpos:wpos] is the buffered data
+	bufErr     error // error returned by the QUIC stream when filling the buffer, returned once the buffer is drained
+
+	readClosed int32 // set by CloseRead, accessed atomically
+}
+
+var _ ReceiveStream = &receiveStream{}
+
+// maxPeekSize is the maximum number of bytes that can be peeked.
+const maxPeekSize = 64 << 10
+
+func (s *receiveStream) isReadClosed() bool {
+	return atomic.LoadInt32(&s.readClosed) != 0
+}
+
+func (s *receiveStream) Read(b []byte) (int, error) {
+	if s.isReadClosed() {
+		return 0, io.EOF
+	}
+	if s.wpos > s.rpos {
+		n := copy(b, s.buf[s.rpos:s.wpos])
+		s.rpos += n
+		return n, nil
+	}
+	if s.bufErr != nil {
+		return 0, s.handleReadError(s.bufErr)
+	}
 	n, err := s.str.Read(b)
-	return n, s.maybeConvertStreamError(err)
+	countBytes(s.bytesReceived, n)
+	return n, s.handleReadError(err)
+}
+
+// handleReadError converts the error, and marks the stream as done if all data was read,
+// or if the stream was reset.
+func (s *receiveStream) handleReadError(err error) error {
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		s.done()
+	}
+	err = s.convertError(err)
+	if streamErr, ok := err.(*StreamError); ok {
+		s.reset(streamErr.ErrorCode, streamErr.Remote)
+	}
+	return err
+}
+
+// fill reads from the QUIC stream until at least n bytes are buffered, or until an error occurs.
+// Errors are stored in bufErr, except for deadline errors, which are returned.
+func (s *receiveStream) fill(n int) error {
+	if len(s.buf)-s.rpos < n {
+		size := len(s.buf)
+		if size < n {
+			size = n
+		}
+		if size < 4096 {
+			size = 4096
+		}
+		buf := s.buf
+		if len(buf) < size {
+			buf = make([]byte, size)
+		}
+		copy(buf, s.buf[s.rpos:s.wpos])
+		s.buf = buf
+		s.wpos -= s.rpos
+		s.rpos = 0
+	}
+	for s.wpos-s.rpos < n && s.bufErr == nil {
+		m, err := s.str.Read(s.buf[s.wpos:])
+		countBytes(s.bytesReceived, m)
+		s.wpos += m
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return err
+			}
+			s.bufErr = err
+		}
+	}
+	return nil
+}
+
+func (s *receiveStream) ReadByte() (byte, error) {
+	if s.isReadClosed() {
+		return 0, io.EOF
+	}
+	if s.wpos == s.rpos {
+		if s.bufErr == nil {
+			if err := s.fill(1); err != nil {
+				return 0, s.convertError(err)
+			}
+		}
+		if s.wpos == s.rpos {
+			return 0, s.handleReadError(s.bufErr)
+		}
+	}
+	c := s.buf[s.rpos]
+	s.rpos++
+	return c, nil
+}
+
+func (s *receiveStream) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New("webtransport: negative count")
+	}
+	if n > maxPeekSize {
+		return nil, bufio.ErrBufferFull
+	}
+	if s.isReadClosed() {
+		return nil, io.EOF
+	}
+	if err := s.fill(n); err != nil {
+		return s.buf[s.rpos:s.wpos], s.convertError(err)
+	}
+	if s.wpos-s.rpos < n {
+		return s.buf[s.rpos:s.wpos], s.convertError(s.bufErr)
+	}
+	return s.buf[s.rpos : s.rpos+n], nil
 }
 
-func (s *stream) Write(b []byte) (int, error) {
-	n, err := s.str.Write(b)
-	return n, s.maybeConvertStreamError(err)
+func (s *receiveStream) Discard(n int) (int, error) {
+	if n < 0 {
+		return 0, errors.New("webtransport: negative count")
+	}
+	if s.isReadClosed() {
+		return 0, io.EOF
+	}
+	var discarded int
+	for discarded < n {
+		if s.wpos == s.rpos {
+			if s.bufErr != nil {
+				return discarded, s.handleReadError(s.bufErr)
+			}
+			if err := s.fill(1); err != nil {
+				return discarded, s.convertError(err)
+			}
+			continue
+		}
+		k := s.wpos - s.rpos
+		if k > n-discarded {
+			k = n - discarded
+		}
+		s.rpos += k
+		discarded += k
+	}
+	return discarded, nil
+}
+
+func (s *receiveStream) CloseRead() error {
+	if !atomic.CompareAndSwapInt32(&s.readClosed, 0, 1) {
+		return nil
+	}
+	s.buf = nil
+	s.rpos, s.wpos = 0, 0
+	if s.bufErr != nil {
+		s.handleReadError(s.bufErr)
+		return nil
+	}
+	// Discard the peer's data until it closes the stream.
+	// A read deadline would interrupt this, so it is removed.
+	s.str.SetReadDeadline(time.Time{})
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := s.str.Read(b)
+			countBytes(s.bytesReceived, n)
+			if err != nil {
+				s.handleReadError(err)
+				return
+			}
+		}
+	}()
+	return nil
 }
 
-func (s *stream) CancelRead(e ErrorCode) {
+func (s *receiveStream) CancelRead(e ErrorCode) {
+	atomic.CompareAndSwapUint32(&s.canceledCode, 0, uint32(e)+1)
 	s.str.CancelRead(webtransportCodeToHTTPCode(e))
+	s.reset(e, false)
+	s.done()
 }
 
-func (s *stream) CancelWrite(e ErrorCode) {
-	s.str.CancelWrite(webtransportCodeToHTTPCode(e))
+func (s *receiveStream) done() {
+	if s.onDone != nil {
+		s.doneOnce.Do(s.onDone)
+	}
+}
+
+func (s *receiveStream) reset(code ErrorCode, remote bool) {
+	if s.onReset != nil {
+		s.resetOnce.Do(func() { s.onReset(code, remote) })
+	}
+}
+
+func (s *receiveStream) StreamID() quic.StreamID {
+	return s.str.StreamID()
+}
+
+func (s *receiveStream) SetReadDeadline(t time.Time) error {
+	return s.convertError(s.str.SetReadDeadline(t))
+}
+
+func (s *receiveStream) convertError(err error) error {
+	err = convertStreamError(err, s.sessionErr, StreamDirectionRead)
+	return convertCanceledError(err, &s.canceledCode, StreamDirectionRead)
+}
+
+type stream struct {
+	sendStream
+	receiveStream
+}
+
+var _ Stream = &stream{}
+
+func newStream(str quic.Stream, hdr []byte) *stream {
+	return &stream{
+		sendStream:    sendStream{str: str, header: hdr},
+		receiveStream: receiveStream{str: str},
+	}
 }
 
-func (s *stream) Close() error {
-	return s.maybeConvertStreamError(s.str.Close())
+func (s *stream) StreamID() quic.StreamID {
+	return s.sendStream.StreamID()
+}
+
+func (s *stream) CloseWrite() error {
+	return s.sendStream.Close()
 }
 
 func (s *stream) SetDeadline(t time.Time) error {
-	return s.maybeConvertStreamError(s.str.SetDeadline(t))
+	err1 := s.sendStream.SetWriteDeadline(t)
+	err2 := s.receiveStream.SetReadDeadline(t)
+	if err1 != nil {
+		return err1
+	}
+	return err2
 }
 
-func (s *stream) SetReadDeadline(t time.Time) error {
-	return s.maybeConvertStreamError(s.str.SetReadDeadline(t))
+// convertStreamError converts an error returned by a stream operation:
+// Once the session is closed, operations fail with the session's SessionError, regardless of the error returned by
+// the QUIC stream (usually an error due to the stream being canceled, or the QUIC connection being closed).
+// Stream resets by the peer are converted to StreamErrors, for the direction dir of the stream.
+// Expired deadlines are returned as is. These errors implement net.Error, with Timeout returning true,
+// and match os.ErrDeadlineExceeded using errors.Is.
+func convertStreamError(err error, sessionErr func() error, dir StreamDirection) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if sessionErr != nil {
+		if serr := sessionErr(); serr != nil {
+			return serr
+		}
+	}
+	return maybeConvertStreamError(err, dir)
+}
+
+// convertCanceledError converts the error returned by quic-go after the stream was canceled locally
+// into a StreamError. canceledCode holds the error code passed to CancelRead or CancelWrite plus 1.
+func convertCanceledError(err error, canceledCode *uint32, dir StreamDirection) error {
+	if err == nil || err == io.EOF || errors.Is(err, ErrSessionClosed) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, &StreamError{}) {
+		return err
+	}
+	code := atomic.LoadUint32(canceledCode)
+	if code == 0 {
+		return err
+	}
+	return &StreamError{ErrorCode: ErrorCode(code - 1), Direction: dir}
 }
 
-func (s *stream) SetWriteDeadline(t time.Time) error {
-	return s.maybeConvertStreamError(s.str.SetWriteDeadline(t))
+func maybeConvertStreamError(err error, dir StreamDirection) error {
+	if err == nil {
+		return nil
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		if streamErr.ErrorCode == WebTransportSessionGoneErrorCode {
+			// the peer reset the stream because it closed the session
+			return &SessionError{Remote: true}
+		}
+		if streamErr.ErrorCode == requestRejectedErrorCode {
+			// the peer reset the stream because it is draining the session
+			return errSessionDraining
+		}
+		errorCode, cerr := httpCodeToWebtransportCode(streamErr.ErrorCode)
+		if cerr != nil {
+			return fmt.Errorf("stream reset, but failed to convert stream error %d: %w", streamErr.ErrorCode, cerr)
+		}
+		return &StreamError{ErrorCode: errorCode, Remote: true, Direction: dir}
+	}
+	return err
 }
@@ -0,0 +1,100 @@
+package webtransport
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// StreamBudget is the number of streams that can be opened before the peer's stream limits are reached.
+// Stream limits apply to the QUIC connection: they are shared by all sessions on the connection,
+// and by the HTTP/3 streams (e.g. the control stream and the CONNECT request streams).
+type StreamBudget struct {
+	Bidi uint64
+	Uni  uint64
+}
+
+// isLocalStream says if the stream was initiated by this endpoint.
+func isLocalStream(id quic.StreamID, pers logging.Perspective) bool {
+	clientInitiated := id%2 == 0
+	return clientInitiated == (pers == logging.PerspectiveClient)
+}
+
+// openedStream records that a stream was opened.
+// Stream IDs are allocated in order, so the number of streams opened is derived from the highest stream ID.
+func (m *connMetrics) openedStream(id quic.StreamID) {
+	if !isLocalStream(id, m.perspective) {
+		return
+	}
+	num := uint64(id/4) + 1
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if id%4 < 2 {
+		if num > m.openedBidi {
+			m.openedBidi = num
+		}
+	} else if num > m.openedUni {
+		m.openedUni = num
+	}
+}
+
+// setStreamLimits records the peer's stream limits.
+// Stream limits can't decrease, so limits that are lower than the current limits are ignored.
+func (m *connMetrics) setStreamLimits(maxBidi, maxUni uint64) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if maxBidi > m.maxBidi {
+		m.maxBidi = maxBidi
+	}
+	if maxUni > m.maxUni {
+		m.maxUni = maxUni
+	}
+	m.hasStreamLimits = true
+}
+
+func (m *connMetrics) StreamBudget() (StreamBudget, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if !m.hasStreamLimits {
+		return StreamBudget{}, false
+	}
+	var b StreamBudget
+	if m.maxBidi > m.openedBidi {
+		b.Bidi = m.maxBidi - m.openedBidi
+	}
+	if m.maxUni > m.openedUni {
+		b.Uni = m.maxUni - m.openedUni
+	}
+	return b, true
+}
+
+// StreamBudget returns the number of bidirectional and unidirectional streams that can currently be
+// opened before the peer's stream limits are reached, i.e. before OpenStream and OpenUniStream
+// return ErrStreamLimitReached. The peer increases its limits as streams are closed.
+// Applications can use it for admission control, e.g. to shed load before running out of streams.
+// The budget is shared by all sessions on the same QUIC connection.
+// It returns false if the peer's stream limits are not known (yet).
+func (c *Conn) StreamBudget() (StreamBudget, bool) {
+	if c.metrics == nil {
+		return StreamBudget{}, false
+	}
+	m := c.metrics.Get(c.qconn)
+	if m == nil {
+		return StreamBudget{}, false
+	}
+	return m.StreamBudget()
+}
+
+// trackOpenedStream accounts for a stream opened by the application in the stream budget.
+// quic-go only allocates the stream ID once the stream is opened, while the tracer only learns about
+// the stream once data is sent.
+func (c *Conn) trackOpenedStream(id quic.StreamID) {
+	if c.metrics == nil {
+		return
+	}
+	if m := c.metrics.Get(c.qconn); m != nil {
+		m.openedStream(id)
+	}
+}
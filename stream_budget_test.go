@@ -0,0 +1,44 @@
+package webtransport
+
+import (
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamBudget(t *testing.T) {
+	m := &connMetrics{perspective: logging.PerspectiveServer}
+	tr := &connMetricsTracer{metrics: m}
+	_, ok := m.StreamBudget()
+	require.False(t, ok)
+
+	tr.ReceivedTransportParameters(&logging.TransportParameters{MaxBidiStreamNum: 10, MaxUniStreamNum: 3})
+	budget, ok := m.StreamBudget()
+	require.True(t, ok)
+	require.Equal(t, StreamBudget{Bidi: 10, Uni: 3}, budget)
+
+	// streams opened by the client don't count
+	tr.SentPacket(&logging.ExtendedHeader{}, 1000, nil, []logging.Frame{
+		&logging.StreamFrame{StreamID: 0},
+		&logging.StreamFrame{StreamID: 2},
+	})
+	budget, _ = m.StreamBudget()
+	require.Equal(t, StreamBudget{Bidi: 10, Uni: 3}, budget)
+
+	// server-initiated bidirectional stream 3 (stream ID 9), and unidirectional stream 1 (stream ID 3)
+	tr.SentPacket(&logging.ExtendedHeader{}, 1000, nil, []logging.Frame{&logging.StreamFrame{StreamID: 9}})
+	tr.SentPacket(&logging.ExtendedHeader{}, 1000, nil, []logging.Frame{&logging.ResetStreamFrame{StreamID: 3}})
+	budget, _ = m.StreamBudget()
+	require.Equal(t, StreamBudget{Bidi: 7, Uni: 2}, budget)
+	m.openedStream(11) // opened, but no data sent yet
+	m.openedStream(5)
+	budget, _ = m.StreamBudget()
+	require.Equal(t, StreamBudget{Bidi: 7, Uni: 0}, budget)
+
+	tr.ReceivedPacket(&logging.ExtendedHeader{}, 1000, []logging.Frame{&logging.MaxStreamsFrame{Type: logging.StreamTypeUni, MaxStreamNum: 5}})
+	tr.ReceivedPacket(&logging.ExtendedHeader{}, 1000, []logging.Frame{&logging.MaxStreamsFrame{Type: logging.StreamTypeBidi, MaxStreamNum: 4}}) // reordered
+	budget, _ = m.StreamBudget()
+	require.Equal(t, StreamBudget{Bidi: 7, Uni: 2}, budget)
+}
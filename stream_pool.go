@@ -0,0 +1,270 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// defaultMaxPooledMessageSize is the default maximum size of requests and responses exchanged using a StreamPool.
+const defaultMaxPooledMessageSize = 1 << 20
+
+var errStreamPoolClosed = errors.New("webtransport: stream pool closed")
+
+// A StreamPool performs request / response exchanges on a session, reusing bidirectional streams.
+// Opening a new stream for every request costs a stream ID and some bookkeeping on both sides,
+// and high-QPS clients might run into the peer's stream limit.
+// Instead, streams are returned to the pool after a response has been received, and used for the next request.
+// Streams are evicted from the pool as soon as reading or writing fails.
+//
+// Requests and responses are framed by prefixing them with their length (encoded as a QUIC varint).
+// The peer is expected to serve the requests using ServeStreamPool.
+// It is safe to use a StreamPool from multiple go routines concurrently.
+type StreamPool struct {
+	sess    Session
+	maxIdle int
+
+	// MaxMessageSize is the maximum size of a response.
+	// If zero, a default of 1 MB is used.
+	MaxMessageSize int
+
+	ctx       context.Context // cancelled by Close
+	ctxCancel context.CancelFunc
+	// requests counts the requests in flight, including the go routines they started
+	requests sync.WaitGroup
+
+	mx     sync.Mutex
+	idle   []Stream
+	closed bool
+}
+
+// NewStreamPool creates a new StreamPool.
+// At most maxIdle streams are kept open while no request is in flight.
+func NewStreamPool(sess Session, maxIdle int) *StreamPool {
+	p := &StreamPool{sess: sess, maxIdle: maxIdle}
+	p.ctx, p.ctxCancel = context.WithCancel(context.Background())
+	return p
+}
+
+// RoundTrip sends a request, and waits for the response.
+// If ctx is canceled (or the pool is closed) before the response has been received, the stream used is reset.
+// Idle streams might have been closed or reset by the peer in the meantime. If the request can't be sent
+// on an idle stream, or if the peer closed it without responding, the request is retried once on a new stream.
+// Requests are not retried once the peer started processing them, e.g. if the peer reset the stream
+// because it failed to handle the request.
+func (p *StreamPool) RoundTrip(ctx context.Context, req []byte) ([]byte, error) {
+	reqCtx, done, err := p.startRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	str, reused, err := p.get(reqCtx)
+	if err != nil {
+		return nil, p.requestError(ctx, err)
+	}
+	rsp, retry, err := p.roundTrip(reqCtx, str, req)
+	if err != nil && retry && reused && reqCtx.Err() == nil {
+		str.CancelWrite(0)
+		str.CancelRead(0)
+		str, err = p.sess.OpenStreamSync(reqCtx)
+		if err != nil {
+			return nil, p.requestError(ctx, err)
+		}
+		rsp, _, err = p.roundTrip(reqCtx, str, req)
+	}
+	if err != nil {
+		str.CancelWrite(0)
+		str.CancelRead(0)
+		return nil, p.requestError(ctx, err)
+	}
+	p.put(str)
+	return rsp, nil
+}
+
+// startRequest registers a request, such that Close can wait for it.
+// The returned context is cancelled when ctx is cancelled, or when the pool is closed.
+// done must be called once the request has finished.
+func (p *StreamPool) startRequest(ctx context.Context) (context.Context, func(), error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.closed {
+		return nil, nil, errStreamPoolClosed
+	}
+	p.requests.Add(2)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer p.requests.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.ctx.Done():
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		p.requests.Done()
+	}, nil
+}
+
+// requestError returns the error returned by RoundTrip.
+func (p *StreamPool) requestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if p.ctx.Err() != nil {
+		return errStreamPoolClosed
+	}
+	return err
+}
+
+// roundTrip performs a request / response exchange on str.
+// If it fails, retry says if the peer didn't process the request, because the stream was already
+// closed or reset by the peer: either writing the request failed, or the peer closed the stream
+// before sending a response.
+func (p *StreamPool) roundTrip(ctx context.Context, str Stream, req []byte) (rsp []byte, retry bool, err error) {
+	done := make(chan struct{})
+	watcherDone := make(chan bool /* deadline set */)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the Read / Write calls
+			str.SetDeadline(time.Now())
+			<-done
+			watcherDone <- true
+		case <-done:
+			watcherDone <- false
+		}
+	}()
+	defer func() {
+		close(done)
+		// The stream might be reused, so make sure the deadline is reset.
+		if <-watcherDone {
+			str.SetDeadline(time.Time{})
+		}
+	}()
+
+	if err := writePooledMessage(str, req); err != nil {
+		return nil, true, err
+	}
+	maxSize := p.MaxMessageSize
+	if maxSize == 0 {
+		maxSize = defaultMaxPooledMessageSize
+	}
+	rsp, err = readPooledMessage(str, maxSize)
+	return rsp, err == io.EOF, err
+}
+
+// get returns an idle stream, or opens a new one.
+// reused says if the stream was taken from the pool.
+func (p *StreamPool) get(ctx context.Context) (str Stream, reused bool, err error) {
+	p.mx.Lock()
+	if n := len(p.idle); n > 0 {
+		str := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mx.Unlock()
+		return str, true, nil
+	}
+	p.mx.Unlock()
+	str, err = p.sess.OpenStreamSync(ctx)
+	return str, false, err
+}
+
+func (p *StreamPool) put(str Stream) {
+	p.mx.Lock()
+	if !p.closed && len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, str)
+		p.mx.Unlock()
+		return
+	}
+	p.mx.Unlock()
+	str.Close()
+}
+
+// Close closes all idle streams.
+// Requests that are in flight are canceled: their streams are reset, and RoundTrip returns an error.
+// Close waits until they have returned.
+func (p *StreamPool) Close() error {
+	p.mx.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mx.Unlock()
+
+	p.ctxCancel()
+	for _, str := range idle {
+		str.Close()
+	}
+	p.requests.Wait()
+	return nil
+}
+
+// ServeStreamPool serves requests sent using a StreamPool.
+// It accepts streams on the session, and calls handler for every request received.
+// The response returned by the handler is sent back on the same stream.
+// If the handler returns an error, the stream is reset.
+// Like HandleStreams, it blocks until the context is cancelled, or the session is closed.
+func ServeStreamPool(ctx context.Context, sess Session, maxMessageSize int, handler func(req []byte) ([]byte, error)) error {
+	if maxMessageSize == 0 {
+		maxMessageSize = defaultMaxPooledMessageSize
+	}
+	return sess.HandleStreams(ctx, func(str Stream) {
+		for {
+			req, err := readPooledMessage(str, maxMessageSize)
+			if err != nil {
+				if err == io.EOF {
+					str.Close()
+					return
+				}
+				str.CancelRead(0)
+				str.CancelWrite(0)
+				return
+			}
+			rsp, err := handler(req)
+			if err != nil {
+				str.CancelRead(0)
+				str.CancelWrite(0)
+				return
+			}
+			if err := writePooledMessage(str, rsp); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func writePooledMessage(w io.Writer, b []byte) error {
+	buf := bytes.NewBuffer(make([]byte, 0, int(quicvarint.Len(uint64(len(b))))+len(b)))
+	quicvarint.Write(buf, uint64(len(b)))
+	buf.Write(b)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readPooledMessage reads a length-prefixed message.
+// It returns io.EOF if the stream was closed before a new message was started.
+func readPooledMessage(r io.Reader, maxSize int) ([]byte, error) {
+	l, err := quicvarint.Read(quicvarint.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(maxSize) {
+		return nil, fmt.Errorf("webtransport: message too large (%d bytes, max %d)", l, maxSize)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
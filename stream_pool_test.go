@@ -0,0 +1,227 @@
+package webtransport_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamPoolReusesStreams(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	var numStreams int32
+	go func() {
+		for {
+			str, err := server.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&numStreams, 1)
+			go func() {
+				r := quicvarint.NewReader(str)
+				for {
+					l, err := quicvarint.Read(r)
+					if err != nil {
+						return
+					}
+					req := make([]byte, l)
+					if _, err := io.ReadFull(str, req); err != nil {
+						return
+					}
+					rsp := &bytes.Buffer{}
+					quicvarint.Write(rsp, uint64(len(req)))
+					rsp.Write(bytes.ToUpper(req))
+					if _, err := str.Write(rsp.Bytes()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	pool := webtransport.NewStreamPool(client, 2)
+	defer pool.Close()
+	for i := 0; i < 10; i++ {
+		rsp, err := pool.RoundTrip(context.Background(), []byte(fmt.Sprintf("request %d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("REQUEST %d", i)), rsp)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&numStreams))
+}
+
+func TestStreamPoolConcurrentRequests(t *testing.T) {
+	const numWorkers = 8
+	const maxIdle = 3
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	go webtransport.ServeStreamPool(context.Background(), server, 0, func(req []byte) ([]byte, error) {
+		return append([]byte("re: "), req...), nil
+	})
+
+	pool := webtransport.NewStreamPool(client, maxIdle)
+	defer pool.Close()
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				req := []byte(fmt.Sprintf("worker %d, request %d", worker, j))
+				rsp, err := pool.RoundTrip(context.Background(), req)
+				require.NoError(t, err)
+				require.Equal(t, append([]byte("re: "), req...), rsp)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStreamPoolCancelRequest(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	go webtransport.ServeStreamPool(context.Background(), server, 0, func(req []byte) ([]byte, error) {
+		if string(req) == "block" {
+			<-unblock
+		}
+		return req, nil
+	})
+
+	pool := webtransport.NewStreamPool(client, 1)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err := pool.RoundTrip(ctx, []byte("block"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the stream was reset, so the next request uses a new stream
+	rsp, err := pool.RoundTrip(context.Background(), []byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), rsp)
+}
+
+func TestStreamPoolRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close func(webtransport.Stream)
+	}{
+		{name: "stop sending", close: func(str webtransport.Stream) { str.CancelRead(0) }},
+		{name: "closed", close: func(str webtransport.Stream) { str.Close() }},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := webtransport.Pipe()
+			defer client.Close()
+			var numStreams int32
+			go func() {
+				for {
+					str, err := server.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					atomic.AddInt32(&numStreams, 1)
+					// respond to a single request, then close the stream
+					go func() {
+						r := quicvarint.NewReader(str)
+						l, err := quicvarint.Read(r)
+						if err != nil {
+							return
+						}
+						req := make([]byte, l)
+						if _, err := io.ReadFull(str, req); err != nil {
+							return
+						}
+						rsp := &bytes.Buffer{}
+						quicvarint.Write(rsp, uint64(len(req)))
+						rsp.Write(req)
+						str.Write(rsp.Bytes())
+						tc.close(str)
+					}()
+				}
+			}()
+
+			pool := webtransport.NewStreamPool(client, 1)
+			defer pool.Close()
+			for i := 0; i < 3; i++ {
+				req := []byte(fmt.Sprintf("request %d", i))
+				rsp, err := pool.RoundTrip(context.Background(), req)
+				require.NoError(t, err)
+				require.Equal(t, req, rsp)
+				time.Sleep(scaleDuration(5 * time.Millisecond)) // give the server some time to close the stream
+			}
+			require.Equal(t, int32(3), atomic.LoadInt32(&numStreams))
+		})
+	}
+}
+
+func TestStreamPoolNoRetryAfterProcessing(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	var numRequests int32
+	go webtransport.ServeStreamPool(context.Background(), server, 0, func(req []byte) ([]byte, error) {
+		if atomic.AddInt32(&numRequests, 1) > 1 {
+			return nil, errors.New("failed")
+		}
+		return req, nil
+	})
+
+	pool := webtransport.NewStreamPool(client, 1)
+	defer pool.Close()
+	_, err := pool.RoundTrip(context.Background(), []byte("foo"))
+	require.NoError(t, err)
+	// The peer reset the (reused) stream while processing the request. This is not retried.
+	_, err = pool.RoundTrip(context.Background(), []byte("bar"))
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&numRequests))
+}
+
+func TestStreamPoolCloseCancelsRequests(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	received := make(chan struct{}, 1)
+	go webtransport.ServeStreamPool(context.Background(), server, 0, func(req []byte) ([]byte, error) {
+		received <- struct{}{}
+		<-unblock
+		return req, nil
+	})
+
+	pool := webtransport.NewStreamPool(client, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := pool.RoundTrip(context.Background(), []byte("foobar"))
+		errChan <- err
+	}()
+	<-received
+	require.NoError(t, pool.Close())
+	// Close waits for the request
+	select {
+	case err := <-errChan:
+		require.Error(t, err)
+	default:
+		t.Fatal("RoundTrip didn't return")
+	}
+}
+
+func TestStreamPoolClose(t *testing.T) {
+	client, _ := webtransport.Pipe()
+	defer client.Close()
+	pool := webtransport.NewStreamPool(client, 1)
+	require.NoError(t, pool.Close())
+	_, err := pool.RoundTrip(context.Background(), []byte("foobar"))
+	require.Error(t, err)
+}
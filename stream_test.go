@@ -0,0 +1,611 @@
+package webtransport_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamHeaderSentWithFirstWrite(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+
+	// The header hasn't been sent yet, so the peer can't accept the stream.
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err = server.AcceptStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	n, err := str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+}
+
+func TestStreamFlush(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.Flush())
+	require.NoError(t, str.Flush()) // no-op
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+}
+
+func TestStreamHeaderSentOnClose(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Empty(t, data)
+}
+
+func TestStreamWriteBuffer(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.SetWriteBuffer(10, 0))
+	n, err := str.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = str.Write([]byte("bar"))
+	require.NoError(t, err)
+
+	// Nothing was sent yet, not even the header.
+	ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err = server.AcceptStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, str.Flush())
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+
+	// a full buffer is flushed
+	_, err = str.Write([]byte("01234"))
+	require.NoError(t, err)
+	_, err = str.Write([]byte("56789"))
+	require.NoError(t, err)
+	b = make([]byte, 10)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0123456789"), b)
+
+	// writes that don't fit into the buffer are sent directly
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	_, err = str.Write([]byte("0123456789abc"))
+	require.NoError(t, err)
+	b = make([]byte, 16)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo0123456789abc"), b)
+
+	// Close flushes the buffer
+	_, err = str.Write([]byte("end"))
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("end"), data)
+}
+
+func TestStreamWriteBufferFlushDelay(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.SetWriteBuffer(100, scaleDuration(20*time.Millisecond)))
+	start := time.Now()
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	_, err = str.Write([]byte("bar"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b)
+	require.GreaterOrEqual(t, time.Since(start), scaleDuration(20*time.Millisecond))
+
+	// disabling write buffering flushes the buffer
+	require.NoError(t, str.SetWriteBuffer(100, 0))
+	_, err = str.Write([]byte("baz"))
+	require.NoError(t, err)
+	require.NoError(t, str.SetWriteBuffer(0, 0))
+	b = make([]byte, 3)
+	_, err = io.ReadFull(sstr, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), b)
+	require.Error(t, str.SetWriteBuffer(-1, 0))
+}
+
+func TestStreamWriteBufferCancel(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, str.Flush())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, str.SetWriteBuffer(100, scaleDuration(10*time.Millisecond)))
+	_, err = str.Write([]byte("foobar"))
+	require.NoError(t, err)
+	// buffered data is discarded when the stream is reset
+	str.CancelWrite(42)
+	data, err := io.ReadAll(sstr)
+	require.ErrorIs(t, err, &webtransport.StreamError{ErrorCode: 42})
+	require.Empty(t, data)
+}
+
+func TestStreamPeek(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	// Peek blocks until enough data is available
+	go func() {
+		time.Sleep(scaleDuration(10 * time.Millisecond))
+		str.Write([]byte("barbaz"))
+		str.Close()
+	}()
+	b, err := sstr.Peek(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fooba"), b)
+	b, err = sstr.Peek(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fo"), b)
+
+	// Read returns the peeked data first
+	b = make([]byte, 2)
+	n, err := sstr.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fo"), b[:n])
+	discarded, err := sstr.Discard(4)
+	require.NoError(t, err)
+	require.Equal(t, 4, discarded)
+
+	b, err = sstr.Peek(10)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, []byte("baz"), b)
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), data)
+}
+
+func TestStreamDiscard(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = str.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, str.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	b, err := sstr.Peek(2)
+	require.NoError(t, err)
+	require.Equal(t, data[:2], b)
+	n, err := sstr.Discard(9000)
+	require.NoError(t, err)
+	require.Equal(t, 9000, n)
+	b, err = sstr.Peek(1)
+	require.NoError(t, err)
+	require.Equal(t, data[9000:9001], b)
+	n, err = sstr.Discard(2000)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 1000, n)
+
+	_, err = sstr.Peek(1 << 20)
+	require.ErrorIs(t, err, bufio.ErrBufferFull)
+}
+
+func TestStreamByteReaderWriter(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	require.Implements(t, (*quicvarint.Writer)(nil), str)
+	require.NoError(t, str.SetWriteBuffer(100, 0))
+	values := []uint64{0, 42, 1337, 1 << 40}
+	for _, v := range values {
+		quicvarint.Write(str, v)
+	}
+	require.NoError(t, str.WriteByte('x'))
+	require.NoError(t, str.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	for _, v := range values {
+		val, err := quicvarint.Read(sstr)
+		require.NoError(t, err)
+		require.Equal(t, v, val)
+	}
+	c, err := sstr.ReadByte()
+	require.NoError(t, err)
+	require.Equal(t, byte('x'), c)
+	_, err = sstr.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, str.CloseWrite())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(sstr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("request"), data)
+	_, err = sstr.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, sstr.Close())
+
+	data, err = io.ReadAll(str)
+	require.NoError(t, err)
+	require.Equal(t, []byte("response"), data)
+}
+
+func TestStreamCloseRead(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+	_, err = sstr.Peek(1)
+	require.NoError(t, err)
+	require.NoError(t, sstr.CloseRead())
+	require.NoError(t, sstr.CloseRead()) // no-op
+	_, err = sstr.Read(make([]byte, 3))
+	require.ErrorIs(t, err, io.EOF)
+
+	// the peer can continue writing
+	for i := 0; i < 10; i++ {
+		_, err = str.Write(make([]byte, 1000))
+		require.NoError(t, err)
+	}
+	require.NoError(t, str.Close())
+
+	// the stream can still be used to send data
+	_, err = sstr.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, sstr.Close())
+	data, err := io.ReadAll(str)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), data)
+
+	// Once the peer's data was discarded, the stream is done, so CloseGracefully doesn't block.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.CloseGracefully(ctx))
+	require.NoError(t, ctx.Err())
+}
+
+func TestStreamDone(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	select {
+	case <-str.Done():
+		t.Fatal("stream shouldn't be done")
+	default:
+	}
+	require.NoError(t, str.Err())
+
+	// the peer stops reading, which asks the sender to stop sending
+	sstr.CancelRead(42)
+	select {
+	case <-str.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.ErrorIs(t, str.Err(), &webtransport.StreamError{ErrorCode: 42})
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 42, Remote: true, Direction: webtransport.StreamDirectionWrite}, str.Err())
+
+	// The send direction of the server's stream is done once it's closed.
+	select {
+	case <-sstr.Done():
+		t.Fatal("stream shouldn't be done")
+	default:
+	}
+	require.NoError(t, sstr.Close())
+	select {
+	case <-sstr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.NoError(t, sstr.Err())
+}
+
+func TestStreamDoneStopSending(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		str, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		str.Read(make([]byte, 3))
+		str.CancelRead(42)
+	})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	select {
+	case <-str.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 42, Remote: true, Direction: webtransport.StreamDirectionWrite}, str.Err())
+}
+
+func TestStreamDeadlineErrors(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	checkTimeout := func(t *testing.T, err error) {
+		t.Helper()
+		require.Error(t, err)
+		var nerr net.Error
+		require.True(t, errors.As(err, &nerr))
+		require.True(t, nerr.Timeout())
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		require.NotErrorIs(t, err, webtransport.ErrSessionClosed)
+		var serr *webtransport.StreamError
+		require.False(t, errors.As(err, &serr))
+	}
+
+	// read deadline
+	require.NoError(t, str.SetReadDeadline(time.Now().Add(scaleDuration(10*time.Millisecond))))
+	_, err = str.Read(make([]byte, 10))
+	checkTimeout(t, err)
+	_, err = str.Peek(1)
+	checkTimeout(t, err)
+	// the stream can still be used after extending the deadline
+	require.NoError(t, str.SetReadDeadline(time.Time{}))
+	_, err = sstr.Write([]byte("bar"))
+	require.NoError(t, err)
+	b := make([]byte, 3)
+	_, err = io.ReadFull(str, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), b)
+
+	// write deadline
+	require.NoError(t, str.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = str.Write([]byte("foobar"))
+	checkTimeout(t, err)
+	require.NoError(t, str.SetWriteDeadline(time.Time{}))
+	_, err = str.Write([]byte("bar"))
+	require.NoError(t, err)
+}
+
+func TestStreamResetErrors(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	sstr.CancelWrite(42)
+	_, err = str.Read(make([]byte, 10))
+	require.Error(t, err)
+	require.ErrorIs(t, err, &webtransport.StreamError{ErrorCode: 42})
+	var nerr net.Error
+	require.False(t, errors.As(err, &nerr))
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NotErrorIs(t, err, webtransport.ErrSessionClosed)
+}
+
+func TestStreamSessionClosedErrors(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer server.Close()
+
+	str, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = str.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := str.Read(make([]byte, 10))
+		errChan <- err
+	}()
+	require.NoError(t, client.Close())
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+		var nerr net.Error
+		require.False(t, errors.As(err, &nerr))
+		var serr *webtransport.StreamError
+		require.False(t, errors.As(err, &serr))
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	_, err = str.Write([]byte("bar"))
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+	_, err = str.Peek(1)
+	require.ErrorIs(t, err, webtransport.ErrSessionClosed)
+}
+
+func TestStreamID(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		str, err := client.OpenStream()
+		require.NoError(t, err)
+		_, err = str.Write([]byte("foo"))
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		sstr, err := server.AcceptStream(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, str.StreamID(), sstr.StreamID())
+	}
+}
+
+func TestStreamErrorDirection(t *testing.T) {
+	client, server := webtransport.Pipe()
+	defer client.Close()
+
+	cstr, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = cstr.Write([]byte("foo"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sstr, err := server.AcceptStream(ctx)
+	require.NoError(t, err)
+
+	// the server stops reading
+	sstr.CancelRead(1)
+	_, err = sstr.Read([]byte{0})
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 1, Direction: webtransport.StreamDirectionRead}, err)
+	require.EqualError(t, err, "read direction of stream canceled locally with error code 1")
+	_, err = cstr.Write([]byte("bar"))
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 1, Remote: true, Direction: webtransport.StreamDirectionWrite}, err)
+	require.EqualError(t, err, "write direction of stream canceled by the peer with error code 1")
+
+	// the server resets the stream
+	sstr.CancelWrite(2)
+	_, err = sstr.Write([]byte("foo"))
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 2, Direction: webtransport.StreamDirectionWrite}, err)
+	_, err = cstr.Read([]byte{0})
+	require.Equal(t, &webtransport.StreamError{ErrorCode: 2, Remote: true, Direction: webtransport.StreamDirectionRead}, err)
+}
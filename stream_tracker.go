@@ -0,0 +1,101 @@
+package webtransport
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// trackedStream is a stream that was opened or accepted on a session,
+// and that hasn't been closed or reset in both directions yet.
+type trackedStream struct {
+	send quic.SendStream    // nil for unidirectional streams opened by the peer
+	rcv  quic.ReceiveStream // nil for unidirectional streams opened by us
+
+	remaining int // number of directions that are not done yet, protected by the streamTracker's mutex
+}
+
+// streamTracker tracks the streams of a session, such that a session can
+// wait for them to finish before it is closed.
+type streamTracker struct {
+	mx      sync.Mutex
+	streams map[*trackedStream]struct{}
+	// is signaled when a stream is done
+	doneChan chan struct{}
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{
+		streams:  make(map[*trackedStream]struct{}),
+		doneChan: make(chan struct{}, 1),
+	}
+}
+
+// TrackStream starts tracking a bidirectional stream.
+func (t *streamTracker) TrackStream(str *stream, qstr quic.Stream) {
+	ts := &trackedStream{send: qstr, rcv: qstr, remaining: 2}
+	t.add(ts)
+	str.sendStream.onDone = func() { t.directionDone(ts) }
+	str.receiveStream.onDone = func() { t.directionDone(ts) }
+}
+
+// TrackSendStream starts tracking a unidirectional stream.
+func (t *streamTracker) TrackSendStream(str *sendStream, qstr quic.SendStream) {
+	ts := &trackedStream{send: qstr, remaining: 1}
+	t.add(ts)
+	str.onDone = func() { t.directionDone(ts) }
+}
+
+// TrackReceiveStream starts tracking an accepted unidirectional stream.
+func (t *streamTracker) TrackReceiveStream(str *receiveStream, qstr quic.ReceiveStream) {
+	ts := &trackedStream{rcv: qstr, remaining: 1}
+	t.add(ts)
+	str.onDone = func() { t.directionDone(ts) }
+}
+
+func (t *streamTracker) add(ts *trackedStream) {
+	t.mx.Lock()
+	t.streams[ts] = struct{}{}
+	t.mx.Unlock()
+}
+
+func (t *streamTracker) directionDone(ts *trackedStream) {
+	t.mx.Lock()
+	ts.remaining--
+	if ts.remaining > 0 {
+		t.mx.Unlock()
+		return
+	}
+	delete(t.streams, ts)
+	t.mx.Unlock()
+
+	select {
+	case t.doneChan <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of streams that are not done yet.
+func (t *streamTracker) Len() int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return len(t.streams)
+}
+
+// ResetAll resets all streams that are not done yet.
+func (t *streamTracker) ResetAll(code quic.StreamErrorCode) {
+	t.mx.Lock()
+	streams := t.streams
+	t.streams = make(map[*trackedStream]struct{})
+	t.mx.Unlock()
+
+	for ts := range streams {
+		if ts.send != nil {
+			ts.send.CancelWrite(code)
+		}
+		if ts.rcv != nil {
+			ts.rcv.CancelRead(code)
+		}
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 const alpn = "webtransport-go / quic-go"
 
-func getTLSConf(t *testing.T) (*tls.Config, *x509.CertPool) {
+func getTLSConf(t testing.TB) (*tls.Config, *x509.CertPool) {
 	ca, caPrivateKey, err := generateCA()
 	require.NoError(t, err)
 	leafCert, leafPrivateKey, err := generateLeafCert(ca, caPrivateKey)
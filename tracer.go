@@ -0,0 +1,117 @@
+package webtransport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// A DatagramDropReason is the reason why a received datagram was dropped.
+type DatagramDropReason uint8
+
+const (
+	// DatagramDropMalformed is used for datagrams that couldn't be parsed.
+	DatagramDropMalformed DatagramDropReason = iota
+	// DatagramDropUnknownSession is used for datagrams that don't belong to any (established) session.
+	DatagramDropUnknownSession
+	// DatagramDropQueueFull is used for datagrams that were dropped because
+	// the session's receive queue was full, i.e. the application didn't call ReceiveMessage fast enough.
+	DatagramDropQueueFull
+	// DatagramDropMemoryLimit is used for datagrams that were dropped because
+	// the session's memory limit was reached (see Server.SessionMemoryLimit).
+	DatagramDropMemoryLimit
+)
+
+func (r DatagramDropReason) String() string {
+	switch r {
+	case DatagramDropMalformed:
+		return "malformed"
+	case DatagramDropUnknownSession:
+		return "unknown session"
+	case DatagramDropQueueFull:
+		return "queue full"
+	case DatagramDropMemoryLimit:
+		return "memory limit"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint8(r))
+	}
+}
+
+// A Tracer is notified of events on WebTransport sessions.
+// It is the building block for integrating metrics, qlog or distributed tracing.
+// Callbacks are called synchronously, from many go routines, and must not block.
+// Implementations can embed NoopTracer, and only implement the callbacks they're interested in.
+type Tracer interface {
+	// SessionEstablished is called when a session is established.
+	SessionEstablished(sess Session)
+	// SessionClosed is called when a session is closed, or when the underlying QUIC connection is closed.
+	SessionClosed(sess Session)
+
+	// StreamIdentified is called when the header of a stream opened by the peer was parsed,
+	// i.e. when the stream is identified as a WebTransport stream, before it is associated with its session.
+	// The session might not be established yet, in which case the stream is buffered.
+	StreamIdentified(qconn quic.Connection, sessionID uint64, id quic.StreamID)
+	// StreamDelivered is called when a stream opened by the peer is added to the session's accept queue.
+	// buffered is the time the stream waited for the session to be established, zero if the session
+	// was already established when the stream was identified. For buffered streams,
+	// it is called before SessionEstablished.
+	StreamDelivered(sess Session, id quic.StreamID, buffered time.Duration)
+	// StreamOpened is called when a stream is opened.
+	StreamOpened(sess Session, id quic.StreamID, bidirectional bool)
+	// StreamAccepted is called when a stream is accepted using AcceptStream or AcceptUniStream.
+	StreamAccepted(sess Session, id quic.StreamID)
+	// StreamReset is called when a direction of a stream is reset, either locally
+	// (using CancelRead or CancelWrite), or by the peer. For bidirectional streams,
+	// it is called once for every direction that is reset.
+	StreamReset(sess Session, id quic.StreamID, code ErrorCode, remote bool)
+	// StreamFlowControlBlocked is called when sending on a stream is blocked by the flow control limit
+	// granted by the peer (see SendStream.Stats).
+	StreamFlowControlBlocked(sess Session, id quic.StreamID)
+	// StreamFlowControlUnblocked is called when the peer increased the flow control limit of a blocked stream.
+	// stalled is the time the stream was blocked.
+	StreamFlowControlUnblocked(sess Session, id quic.StreamID, stalled time.Duration)
+
+	// DatagramSent is called when a datagram is handed to QUIC. size is the size of the payload.
+	DatagramSent(sess Session, size int)
+	// DatagramReceived is called when a datagram is received. size is the size of the payload.
+	DatagramReceived(sess Session, size int)
+	// DatagramDropped is called when a received datagram is dropped.
+	DatagramDropped(qconn quic.Connection, reason DatagramDropReason)
+
+	// BufferedStreamTimeout is called when a stream is reset (or paused, see BufferedStreamConfig)
+	// because the session it belongs to was not established within the StreamReorderingTimeout.
+	BufferedStreamTimeout(qconn quic.Connection, sessionID uint64, id quic.StreamID)
+}
+
+// NoopTracer is a Tracer that does nothing.
+type NoopTracer struct{}
+
+var _ Tracer = NoopTracer{}
+
+func (NoopTracer) SessionEstablished(Session)                                       {}
+func (NoopTracer) SessionClosed(Session)                                            {}
+func (NoopTracer) StreamIdentified(quic.Connection, uint64, quic.StreamID)          {}
+func (NoopTracer) StreamDelivered(Session, quic.StreamID, time.Duration)            {}
+func (NoopTracer) StreamOpened(Session, quic.StreamID, bool)                        {}
+func (NoopTracer) StreamAccepted(Session, quic.StreamID)                            {}
+func (NoopTracer) StreamReset(Session, quic.StreamID, ErrorCode, bool)              {}
+func (NoopTracer) StreamFlowControlBlocked(Session, quic.StreamID)                  {}
+func (NoopTracer) StreamFlowControlUnblocked(Session, quic.StreamID, time.Duration) {}
+func (NoopTracer) DatagramSent(Session, int)                                        {}
+func (NoopTracer) DatagramReceived(Session, int)                                    {}
+func (NoopTracer) DatagramDropped(quic.Connection, DatagramDropReason)              {}
+func (NoopTracer) BufferedStreamTimeout(quic.Connection, uint64, quic.StreamID)     {}
+
+// startTracing reports the establishment of the session to the session's tracer,
+// and reports the session as closed once it is closed, or once the QUIC connection is closed.
+func (c *Conn) startTracing() {
+	c.tracer.SessionEstablished(c)
+	c.goLabeled(func() {
+		select {
+		case <-c.ctx.Done():
+		case <-c.qconn.Context().Done():
+		}
+		c.tracer.SessionClosed(c)
+	})
+}
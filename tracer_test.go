@@ -0,0 +1,139 @@
+package webtransport_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marten-seemann/webtransport-go"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingTracer struct {
+	webtransport.NoopTracer
+
+	mx     sync.Mutex
+	events []string
+}
+
+var _ webtransport.Tracer = &recordingTracer{}
+
+func (t *recordingTracer) record(format string, args ...interface{}) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.events = append(t.events, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingTracer) Events() []string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return append([]string(nil), t.events...)
+}
+
+func (t *recordingTracer) SessionEstablished(webtransport.Session) { t.record("session established") }
+func (t *recordingTracer) SessionClosed(webtransport.Session)      { t.record("session closed") }
+func (t *recordingTracer) StreamIdentified(_ quic.Connection, sessionID uint64, id quic.StreamID) {
+	t.record("stream %d for session %d identified", id, sessionID)
+}
+func (t *recordingTracer) StreamDelivered(_ webtransport.Session, id quic.StreamID, buffered time.Duration) {
+	t.record("stream %d delivered (buffered: %t)", id, buffered > 0)
+}
+func (t *recordingTracer) StreamOpened(_ webtransport.Session, id quic.StreamID, bidi bool) {
+	t.record("stream %d opened (bidirectional: %t)", id, bidi)
+}
+func (t *recordingTracer) StreamAccepted(_ webtransport.Session, id quic.StreamID) {
+	t.record("stream %d accepted", id)
+}
+func (t *recordingTracer) StreamReset(_ webtransport.Session, id quic.StreamID, code webtransport.ErrorCode, remote bool) {
+	t.record("stream %d reset (code: %d, remote: %t)", id, code, remote)
+}
+func (t *recordingTracer) StreamFlowControlBlocked(_ webtransport.Session, id quic.StreamID) {
+	t.record("stream %d blocked by flow control", id)
+}
+func (t *recordingTracer) StreamFlowControlUnblocked(_ webtransport.Session, id quic.StreamID, _ time.Duration) {
+	t.record("stream %d unblocked", id)
+}
+func (t *recordingTracer) DatagramSent(_ webtransport.Session, size int) {
+	t.record("datagram sent (%d bytes)", size)
+}
+func (t *recordingTracer) DatagramReceived(_ webtransport.Session, size int) {
+	t.record("datagram received (%d bytes)", size)
+}
+func (t *recordingTracer) DatagramDropped(_ quic.Connection, reason webtransport.DatagramDropReason) {
+	t.record("datagram dropped (%s)", reason)
+}
+func (t *recordingTracer) BufferedStreamTimeout(_ quic.Connection, sessionID uint64, id quic.StreamID) {
+	t.record("buffered stream %d for session %d timed out", id, sessionID)
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	s := &webtransport.Server{
+		Tracer:                  tracer,
+		StreamReorderingTimeout: scaleDuration(50 * time.Millisecond),
+	}
+	defer s.Close()
+	qconn, sconn, closeFn := dialRawSession(t, s)
+	defer closeFn()
+	require.Equal(t, []string{"session established"}, tracer.Events())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// streams
+	cstr := createStreamAndWrite(t, qconn, 0, []byte("foobar"))
+	str, err := sconn.AcceptStream(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(str)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+	ustr, err := sconn.OpenUniStream()
+	require.NoError(t, err)
+	ustr.CancelWrite(42)
+	ustr.CancelWrite(42) // only reported once
+	// the session for this stream is never established
+	bufferedStr := createStreamAndWrite(t, qconn, 8, []byte("foobar"))
+
+	// datagrams
+	require.NoError(t, qconn.SendMessage([]byte{0, 'f', 'o', 'o'}))
+	require.NoError(t, qconn.SendMessage([]byte{1, 'f', 'o', 'o'})) // Quarter Stream ID 1 doesn't belong to any session
+	require.NoError(t, qconn.SendMessage([]byte{0x40}))             // truncated varint
+	_, err = sconn.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	require.NoError(t, sconn.SendMessage([]byte("foobar")))
+
+	require.Eventually(t, func() bool { return len(tracer.Events()) >= 12 }, scaleDuration(time.Second), 10*time.Millisecond)
+	require.NoError(t, sconn.Close())
+	require.Eventually(t, func() bool { return len(tracer.Events()) == 13 }, time.Second, 10*time.Millisecond)
+
+	events := tracer.Events()
+	// The stream ID of the unidirectional stream depends on the number of streams opened by HTTP/3.
+	var uniStreamID quic.StreamID
+	for _, e := range events {
+		if _, err := fmt.Sscanf(e, "stream %d opened (bidirectional: false)", &uniStreamID); err == nil {
+			break
+		}
+	}
+	require.NotZero(t, uniStreamID)
+	require.Equal(t, "session established", events[0])
+	require.Equal(t, "session closed", events[12])
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf("stream %d for session 0 identified", cstr.StreamID()),
+		fmt.Sprintf("stream %d delivered (buffered: false)", cstr.StreamID()),
+		fmt.Sprintf("stream %d accepted", cstr.StreamID()),
+		fmt.Sprintf("stream %d opened (bidirectional: false)", uniStreamID),
+		fmt.Sprintf("stream %d reset (code: 42, remote: false)", uniStreamID),
+		fmt.Sprintf("stream %d for session 8 identified", bufferedStr.StreamID()),
+		fmt.Sprintf("buffered stream %d for session 8 timed out", bufferedStr.StreamID()),
+		"datagram received (3 bytes)",
+		"datagram dropped (unknown session)",
+		"datagram dropped (malformed)",
+		"datagram sent (6 bytes)",
+	}, events[1:12])
+}
@@ -0,0 +1,100 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// errUniStreamHijacked is returned to quic-go's HTTP/3 server or client when reading from
+// a WebTransport unidirectional stream, which was passed to the session manager instead.
+var errUniStreamHijacked = errors.New("webtransport: unidirectional stream hijacked")
+
+// uniStreamConn wraps a QUIC connection, to receive the WebTransport unidirectional streams opened by the peer.
+// quic-go's HTTP/3 server and client don't have a hijacker for unidirectional streams:
+// they read the stream type of every unidirectional stream, and reset streams of unknown types.
+type uniStreamConn struct {
+	quic.EarlyConnection
+
+	// onStream is called for every WebTransport unidirectional stream, after the stream header was read.
+	onStream func(str quic.ReceiveStream, id sessionID)
+}
+
+var _ quic.EarlyConnection = &uniStreamConn{}
+
+func (c *uniStreamConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	str, err := c.EarlyConnection.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &uniStreamFilter{ReceiveStream: str, onStream: c.onStream}, nil
+}
+
+// uniStreamFilter reads the stream type of a unidirectional stream.
+// WebTransport streams are passed to onStream, all other streams are passed through to HTTP/3.
+// The stream type is read on the first call to Read, i.e. on the go routine
+// that quic-go's HTTP/3 implementation starts for every unidirectional stream.
+type uniStreamFilter struct {
+	quic.ReceiveStream
+	onStream func(str quic.ReceiveStream, id sessionID)
+
+	started bool
+	prefix  []byte // the stream type, returned by Read before reading from the stream
+	err     error  // set once the stream was hijacked, or if reading the stream header failed
+}
+
+func (f *uniStreamFilter) Read(b []byte) (int, error) {
+	if !f.started {
+		f.started = true
+		f.err = f.readStreamType()
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(f.prefix) > 0 {
+		n := copy(b, f.prefix)
+		f.prefix = f.prefix[n:]
+		return n, nil
+	}
+	return f.ReceiveStream.Read(b)
+}
+
+func (f *uniStreamFilter) readStreamType() error {
+	// quicvarint.NewReader reads byte by byte, so it doesn't read beyond the varint.
+	typ, err := quicvarint.Read(quicvarint.NewReader(f.ReceiveStream))
+	if err != nil {
+		return err
+	}
+	if typ != webTransportUniStreamType {
+		b := &bytes.Buffer{}
+		quicvarint.Write(b, typ)
+		f.prefix = b.Bytes()
+		return nil
+	}
+	id, err := readSessionID(f.ReceiveStream)
+	if err != nil {
+		f.ReceiveStream.CancelRead(WebTransportBufferedStreamRejectedErrorCode)
+		return err
+	}
+	f.onStream(f.ReceiveStream, id)
+	return errUniStreamHijacked
+}
+
+// uniStreamListener wraps the QUIC connections accepted by the server, see uniStreamConn.
+type uniStreamListener struct {
+	quic.EarlyListener
+	onStream func(qconn quic.Connection, str quic.ReceiveStream, id sessionID)
+}
+
+func (l *uniStreamListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	conn, err := l.EarlyListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &uniStreamConn{EarlyConnection: conn}
+	c.onStream = func(str quic.ReceiveStream, id sessionID) { l.onStream(c, str, id) }
+	return c, nil
+}
@@ -1,6 +1,7 @@
 package webtransport_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,17 +10,22 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
 
 	"github.com/marten-seemann/webtransport-go"
+	"github.com/marten-seemann/webtransport-go/webtransporttest"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
 )
 
 // getConn creates a UDP conn for the server to listen on
@@ -103,6 +109,296 @@ func TestSingleClient(t *testing.T) {
 	sendDataAndCheckEcho(t, conn)
 }
 
+func TestConnResponse(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	serverConn := make(chan *webtransport.Conn, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Session-Token", "foobar")
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		serverConn <- conn
+	})
+	s.H3.Handler = mux
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	rsp, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Same(t, rsp, conn.Response())
+	require.Equal(t, 200, conn.Response().StatusCode)
+	require.Equal(t, "foobar", conn.Response().Header.Get("Session-Token"))
+
+	select {
+	case sconn := <-serverConn:
+		require.Nil(t, sconn.Response())
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDialerRoundTripper(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+	s.H3.Handler.(*http.ServeMux).HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: certPool}}
+	defer rt.Close()
+	d := webtransport.Dialer{RoundTripper: rt}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	sendDataAndCheckEcho(t, conn)
+
+	// the QUIC connection is shared with other HTTP/3 requests
+	rsp, err := (&http.Client{Transport: rt}).Get(fmt.Sprintf("https://localhost:%d/hello", port))
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	_, remotePort, err := net.SplitHostPort(string(body))
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port), remotePort)
+}
+
+func TestDialerRoundTripperStreamHijacker(t *testing.T) {
+	d := webtransport.Dialer{
+		RoundTripper: &http3.RoundTripper{
+			StreamHijacker: func(http3.FrameType, quic.Connection, quic.Stream) (bool, error) { return false, nil },
+		},
+	}
+	defer d.Close()
+	_, _, err := d.Dial(context.Background(), "https://localhost:1234/webtransport", nil)
+	require.EqualError(t, err, "StreamHijacker already set")
+}
+
+func TestDialWithOptions(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 2)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		connChan <- conn
+		newEchoHandler(t)(conn)
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	// The Dialer doesn't trust the server's certificate, only the per-dial TLS config does.
+	d := webtransport.Dialer{}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	opts := &webtransport.DialOptions{
+		TLSClientConf:      &tls.Config{RootCAs: certPool},
+		QuicConfig:         &quic.Config{MaxIdleTimeout: 10 * time.Second},
+		AdditionalSettings: map[uint64]uint64{0x1337: 42},
+	}
+	_, conn1, err := d.DialWithOptions(context.Background(), url, nil, opts)
+	require.NoError(t, err)
+	defer conn1.Close()
+	sendDataAndCheckEcho(t, conn1)
+	_, conn2, err := d.DialWithOptions(context.Background(), url, nil, opts)
+	require.NoError(t, err)
+	defer conn2.Close()
+	sendDataAndCheckEcho(t, conn2)
+
+	// every session uses its own QUIC connection
+	require.NotEqual(t, conn1.LocalAddr().String(), conn2.LocalAddr().String())
+	_, _, err = d.Dial(context.Background(), url, nil)
+	require.Error(t, err)
+
+	// closing the session closes the QUIC connection
+	sconn := <-connChan
+	require.NoError(t, conn1.Close())
+	require.Eventually(t, func() bool {
+		_, err := sconn.OpenStream()
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	sendDataAndCheckEcho(t, conn2)
+}
+
+func TestDialWithOptionsHandshakeTimeout(t *testing.T) {
+	udpConn := getConn(t) // doesn't respond to any packets
+	defer udpConn.Close()
+	d := webtransport.Dialer{}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	start := time.Now()
+	_, _, err := d.DialWithOptions(context.Background(), url, nil, &webtransport.DialOptions{HandshakeTimeout: scaleDuration(100 * time.Millisecond)})
+	require.Error(t, err)
+	var nerr net.Error
+	require.ErrorAs(t, err, &nerr)
+	require.True(t, nerr.Timeout())
+	require.Less(t, time.Since(start), scaleDuration(time.Second))
+}
+
+func TestDialWithOptionsRoundTripper(t *testing.T) {
+	d := webtransport.Dialer{RoundTripper: &http3.RoundTripper{}}
+	defer d.Close()
+	_, _, err := d.DialWithOptions(context.Background(), "https://localhost:1234/webtransport", nil, &webtransport.DialOptions{})
+	require.EqualError(t, err, "webtransport: DialOptions can't be used with a custom RoundTripper")
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+	s.H3.Handler.(*http.ServeMux).HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf:    &tls.Config{RootCAs: certPool},
+		HandshakeTimeout: scaleDuration(100 * time.Millisecond),
+	}
+	defer d.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	t.Run("QUIC handshake", func(t *testing.T) {
+		silentConn := getConn(t) // doesn't respond to any packets
+		defer silentConn.Close()
+		_, _, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", silentConn.LocalAddr().(*net.UDPAddr).Port), nil)
+		var dialErr *webtransport.DialError
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, webtransport.DialPhaseQUICHandshake, dialErr.Phase)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("CONNECT", func(t *testing.T) {
+		_, _, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/slow", port), nil)
+		var dialErr *webtransport.DialError
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, webtransport.DialPhaseConnect, dialErr.Phase)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.EqualError(t, err, "webtransport: dial failed during CONNECT: context deadline exceeded")
+	})
+
+	t.Run("session outlives the timeout", func(t *testing.T) {
+		_, conn, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", port), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		time.Sleep(2 * d.HandshakeTimeout)
+		sendDataAndCheckEcho(t, conn)
+	})
+}
+
+func TestDialErrors(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	s.H3.Handler = http.NotFoundHandler()
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	t.Run("rejected", func(t *testing.T) {
+		d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+		defer d.Close()
+		rsp, _, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port), nil)
+		require.Equal(t, 404, rsp.StatusCode)
+		var dialErr *webtransport.DialError
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, webtransport.DialPhaseConnect, dialErr.Phase)
+		require.Equal(t, 404, dialErr.StatusCode)
+		require.EqualError(t, err, "webtransport: CONNECT rejected with status 404")
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		d := webtransport.Dialer{
+			DialFunc: func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+				return nil, &net.OpError{Op: "write", Net: "udp", Err: errors.New("network is unreachable")}
+			},
+		}
+		defer d.Close()
+		_, _, err := d.Dial(context.Background(), "https://localhost:1234/webtransport", nil)
+		var dialErr *webtransport.DialError
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, webtransport.DialPhaseUDP, dialErr.Phase)
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		d := webtransport.Dialer{} // doesn't trust the server's certificate
+		defer d.Close()
+		_, _, err := d.Dial(context.Background(), fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port), nil)
+		var dialErr *webtransport.DialError
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, webtransport.DialPhaseQUICHandshake, dialErr.Phase)
+	})
+}
+
+func TestUnidirectionalStreams(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(c *webtransport.Conn) { connChan <- c })
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	sconn := <-connChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// Streams opened in both directions are delivered to the session, next to the HTTP/3 unidirectional streams.
+	for _, c := range [][2]*webtransport.Conn{{conn, sconn}, {sconn, conn}} {
+		str, err := c[0].OpenUniStream()
+		require.NoError(t, err)
+		_, err = str.Write([]byte("foobar"))
+		require.NoError(t, err)
+		require.NoError(t, str.Close())
+		rstr, err := c[1].AcceptUniStream(ctx)
+		require.NoError(t, err)
+		require.Equal(t, str.StreamID(), rstr.StreamID())
+		b, err := io.ReadAll(rstr)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), b)
+		require.Equal(t, uint64(1), c[1].Stats().StreamsAccepted)
+	}
+}
+
 func TestMultipleClients(t *testing.T) {
 	const numClients = 5
 	tlsConf, certPool := getTLSConf(t)
@@ -181,6 +477,8 @@ func TestStreamResetError(t *testing.T) {
 	var strErr *webtransport.StreamError
 	require.True(t, errors.As(err, &strErr))
 	require.Equal(t, strErr.ErrorCode, errorCode)
+	require.True(t, strErr.Remote)
+	require.Equal(t, webtransport.StreamDirectionRead, strErr.Direction)
 }
 
 func TestCheckOrigin(t *testing.T) {
@@ -253,3 +551,830 @@ func TestCheckOrigin(t *testing.T) {
 		})
 	}
 }
+
+func TestDatagrams(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		for {
+			b, err := conn.ReceiveMessage(context.Background())
+			if err != nil {
+				return
+			}
+			if err := conn.SendMessage(b); err != nil {
+				return
+			}
+		}
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("datagram %d", i))
+		require.NoError(t, conn.SendMessage(data))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reply, err := conn.ReceiveMessage(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, data, reply)
+	}
+}
+
+func TestDatagramsContext(t *testing.T) {
+	const num = 200
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	received := make(chan struct{}, num)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		for {
+			if _, err := conn.ReceiveMessage(context.Background()); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, conn.SendMessageContext(ctx, []byte("foobar")), context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), scaleDuration(5*time.Second))
+	defer cancel()
+	data := make([]byte, 1000)
+	for i := 0; i < num; i++ {
+		require.NoError(t, conn.SendMessageContext(ctx, data))
+	}
+	// Datagrams can still be dropped by the receiver.
+	var count int
+	timeout := time.After(scaleDuration(time.Second))
+loop:
+	for count < num {
+		select {
+		case <-received:
+			count++
+		case <-timeout:
+			break loop
+		}
+	}
+	t.Logf("received %d of %d datagrams", count, num)
+	require.NotZero(t, count)
+}
+
+func TestDatagramDeliveryNotification(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		<-conn.Context().Done()
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	results := make([]<-chan webtransport.DatagramResult, 0, 10)
+	for i := 0; i < 10; i++ {
+		res, err := conn.SendMessageNotify([]byte(fmt.Sprintf("datagram %d", i)))
+		require.NoError(t, err)
+		results = append(results, res)
+	}
+	for _, res := range results {
+		select {
+		case r := <-res:
+			require.Equal(t, webtransport.DatagramAcked, r)
+		case <-time.After(scaleDuration(time.Second)):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestPeerDatagramStats(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                    http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		DatagramStatsInterval: 10 * time.Millisecond,
+	}
+	defer s.Close()
+	connChan := make(chan *webtransport.Conn, 1)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		for i := 0; i < 3; i++ {
+			if _, err := conn.ReceiveMessage(context.Background()); err != nil {
+				return
+			}
+		}
+		require.NoError(t, conn.SendMessage([]byte("foobar")))
+		connChan <- conn
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf:         &tls.Config{RootCAs: certPool},
+		DatagramStatsInterval: 10 * time.Millisecond,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	_, ok := conn.PeerDatagramStats()
+	require.False(t, ok)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, conn.SendMessage([]byte("foobar")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = conn.ReceiveMessage(ctx)
+	require.NoError(t, err)
+	sconn := <-connChan
+
+	require.Eventually(t, func() bool {
+		stats, ok := conn.PeerDatagramStats()
+		return ok && stats.Received == 3 && stats.Sent == 1
+	}, scaleDuration(time.Second), 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		stats, ok := sconn.PeerDatagramStats()
+		return ok && stats.Received == 1 && stats.Sent == 3
+	}, scaleDuration(time.Second), 5*time.Millisecond)
+	// the stats stream is not exposed to the application
+	ctx, cancel = context.WithTimeout(context.Background(), scaleDuration(50*time.Millisecond))
+	defer cancel()
+	_, err = sconn.AcceptStream(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestBandwidthEstimate(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sendDataAndCheckEcho(t, conn)
+
+	bw, ok := conn.BandwidthEstimate()
+	require.True(t, ok)
+	require.NotZero(t, bw.CongestionWindow)
+	require.NotZero(t, bw.SmoothedRTT)
+	require.NotZero(t, bw.Bandwidth)
+}
+
+func TestStreamFlowControlStalls(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server:     &http.Server{TLSConfig: tlsConf},
+			QuicConfig: &quic.Config{InitialStreamReceiveWindow: 10 << 10, MaxStreamReceiveWindow: 10 << 10},
+		},
+	}
+	defer s.Close()
+	unblock := make(chan struct{})
+	received := make(chan []byte, 1)
+	addHandler(t, &s, func(conn *webtransport.Conn) {
+		str, err := conn.AcceptStream(context.Background())
+		require.NoError(t, err)
+		<-unblock
+		data, err := io.ReadAll(str)
+		require.NoError(t, err)
+		received <- data
+	})
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	tracer := &recordingTracer{}
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		Tracer:        tracer,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	str, err := conn.OpenStream()
+	require.NoError(t, err)
+	require.Zero(t, str.Stats())
+	data := make([]byte, 50<<10)
+	rand.Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := str.Write(data)
+		written <- err
+	}()
+	require.Eventually(t, func() bool { return str.Stats().FlowControlStalls == 1 }, time.Second, 10*time.Millisecond)
+	blockedEvent := fmt.Sprintf("stream %d blocked by flow control", str.StreamID())
+	require.Contains(t, tracer.Events(), blockedEvent)
+	// the duration of an ongoing stall increases
+	d1 := str.Stats().FlowControlStallDuration
+	time.Sleep(scaleDuration(10 * time.Millisecond))
+	d2 := str.Stats().FlowControlStallDuration
+	require.Greater(t, d2, d1)
+
+	close(unblock)
+	require.NoError(t, <-written)
+	require.NoError(t, str.Close())
+	require.Equal(t, data, <-received)
+	stats := str.Stats()
+	require.GreaterOrEqual(t, stats.FlowControlStalls, uint64(1))
+	require.GreaterOrEqual(t, stats.FlowControlStallDuration, d2)
+	require.Contains(t, tracer.Events(), fmt.Sprintf("stream %d unblocked", str.StreamID()))
+}
+
+func TestStreamLimit(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server:     &http.Server{TLSConfig: tlsConf},
+			QuicConfig: &quic.Config{MaxIncomingStreams: 5},
+		},
+	}
+	defer s.Close()
+	// The handler doesn't return, since that would close the CONNECT stream,
+	// allowing the client to open another stream.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.Upgrade(w, r)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		for {
+			str, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				io.ReadAll(str)
+				str.Close()
+			}()
+		}
+	})
+	s.H3.Handler = mux
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the CONNECT request uses one of the streams
+	budget, ok := conn.StreamBudget()
+	require.True(t, ok)
+	require.Equal(t, uint64(4), budget.Bidi)
+	require.NotZero(t, budget.Uni)
+
+	var strs []webtransport.Stream
+	for i := 0; i < 4; i++ {
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		strs = append(strs, str)
+	}
+	budget, ok = conn.StreamBudget()
+	require.True(t, ok)
+	require.Zero(t, budget.Bidi)
+	_, err = conn.OpenStream()
+	require.ErrorIs(t, err, webtransport.ErrStreamLimitReached)
+	var nerr net.Error
+	require.True(t, errors.As(err, &nerr))
+	require.True(t, nerr.Temporary())
+
+	// OpenStreamSync waits until the server allows opening a new stream
+	strChan := make(chan webtransport.Stream, 1)
+	go func() {
+		defer close(strChan)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		str, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return
+		}
+		strChan <- str
+	}()
+	select {
+	case <-strChan:
+		t.Fatal("OpenStreamSync should have blocked")
+	case <-time.After(scaleDuration(50 * time.Millisecond)):
+	}
+	_, err = strs[0].Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, strs[0].Close())
+	data, err := io.ReadAll(strs[0])
+	require.NoError(t, err)
+	require.Empty(t, data)
+	select {
+	case str, ok := <-strChan:
+		require.True(t, ok)
+		require.NotNil(t, str)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	const dscp = 46 // Expedited Forwarding
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:   http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		DSCP: dscp,
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		DSCP:          dscp,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sendDataAndCheckEcho(t, conn)
+
+	tos, err := ipv4.NewPacketConn(udpConn).TOS()
+	require.NoError(t, err)
+	require.Equal(t, dscp<<2, tos)
+
+	// closing the Dialer closes the QUIC connections dialed on the sockets it created
+	require.NoError(t, d.Close())
+	require.Eventually(t, func() bool {
+		_, err := conn.OpenStream()
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUDPBufferSizes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("buffer size reporting is only tested on Linux")
+	}
+	const size = 64 << 10
+	tlsConf, certPool := getTLSConf(t)
+	serverSizes := make(chan webtransport.UDPBufferSizes, 1)
+	s := webtransport.Server{
+		H3:             http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		UDPBufferSizes: webtransport.UDPBufferSizes{Receive: size, Send: size},
+		UDPBufferSizesCallback: func(requested, actual webtransport.UDPBufferSizes) {
+			require.Equal(t, webtransport.UDPBufferSizes{Receive: size, Send: size}, requested)
+			serverSizes <- actual
+		},
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	clientSizes := make(chan webtransport.UDPBufferSizes, 1)
+	d := webtransport.Dialer{
+		TLSClientConf:  &tls.Config{RootCAs: certPool},
+		UDPBufferSizes: webtransport.UDPBufferSizes{Receive: size},
+		UDPBufferSizesCallback: func(_, actual webtransport.UDPBufferSizes) {
+			clientSizes <- actual
+		},
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sendDataAndCheckEcho(t, conn)
+
+	// Linux doubles the requested value
+	actual := <-serverSizes
+	require.GreaterOrEqual(t, actual.Receive, size)
+	require.GreaterOrEqual(t, actual.Send, size)
+	require.GreaterOrEqual(t, (<-clientSizes).Receive, size)
+}
+
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	var serverKeyLog, clientKeyLog syncBuffer
+	s := webtransport.Server{
+		H3:           http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		KeyLogWriter: &serverKeyLog,
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		KeyLogWriter:  &clientKeyLog,
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	_, conn, err := d.Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	sendDataAndCheckEcho(t, conn)
+
+	require.Contains(t, serverKeyLog.String(), "CLIENT_TRAFFIC_SECRET_0")
+	require.Contains(t, clientKeyLog.String(), "CLIENT_TRAFFIC_SECRET_0")
+	require.Nil(t, tlsConf.KeyLogWriter, "the original tls.Config must not be modified")
+}
+
+func TestRequireAddressValidation(t *testing.T) {
+	for _, validate := range []bool{true, false} {
+		t.Run(fmt.Sprintf("address validation: %t", validate), func(t *testing.T) {
+			tlsConf, certPool := getTLSConf(t)
+			called := make(chan net.Addr, 10)
+			s := webtransport.Server{
+				H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+				RequireAddressValidation: func(addr net.Addr) bool {
+					called <- addr
+					return validate
+				},
+			}
+			defer s.Close()
+			addHandler(t, &s, newEchoHandler(t))
+
+			udpConn := getConn(t)
+			go s.Serve(udpConn)
+
+			d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+			defer d.Close()
+			url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+			_, conn, err := d.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			sendDataAndCheckEcho(t, conn)
+			if validate {
+				// the first Initial is answered with a Retry, the second one carries the Retry token
+				require.Len(t, called, 2)
+			} else {
+				require.Len(t, called, 1)
+			}
+		})
+	}
+}
+
+func TestConnectionIDLength(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		tlsConf, certPool := getTLSConf(t)
+		s := webtransport.Server{
+			H3:                 http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+			ConnectionIDLength: 16,
+		}
+		defer s.Close()
+		addHandler(t, &s, newEchoHandler(t))
+
+		udpConn := getConn(t)
+		go s.Serve(udpConn)
+
+		d := webtransport.Dialer{
+			TLSClientConf:      &tls.Config{RootCAs: certPool},
+			ConnectionIDLength: 8,
+		}
+		defer d.Close()
+		url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+		_, conn, err := d.Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		sendDataAndCheckEcho(t, conn)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		s := webtransport.Server{
+			H3:                 http3.Server{Server: &http.Server{}},
+			ConnectionIDLength: 3,
+		}
+		defer s.Close()
+		udpConn := getConn(t)
+		defer udpConn.Close()
+		require.EqualError(t, s.Serve(udpConn), "webtransport: invalid connection ID length: 3")
+
+		d := webtransport.Dialer{ConnectionIDLength: 19}
+		defer d.Close()
+		_, _, err := d.Dial(context.Background(), "https://localhost:1234/webtransport", nil)
+		require.EqualError(t, err, "webtransport: invalid connection ID length: 19")
+	})
+}
+
+func TestLossyNetwork(t *testing.T) {
+	conds := webtransporttest.Conditions{
+		Latency:    5 * time.Millisecond,
+		Jitter:     5 * time.Millisecond,
+		Loss:       0.05,
+		Reordering: 0.05,
+	}
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+	}
+	defer s.Close()
+	addHandler(t, &s, newEchoHandler(t))
+
+	udpConn := getConn(t)
+	go s.Serve(webtransporttest.NewPacketConn(udpConn, conds))
+
+	d := webtransport.Dialer{
+		TLSClientConf: &tls.Config{RootCAs: certPool},
+		DialFunc:      webtransporttest.DialFunc(conds),
+	}
+	defer d.Close()
+	url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, conn, err := d.Dial(ctx, url, nil)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 50*1024)
+		rand.Read(data)
+		str, err := conn.OpenStream()
+		require.NoError(t, err)
+		str.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = str.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, str.Close())
+		reply, err := io.ReadAll(str)
+		require.NoError(t, err)
+		require.Equal(t, data, reply)
+	}
+}
+
+// readSettings reads the SETTINGS frame from the peer's HTTP/3 control stream.
+func readSettings(t *testing.T, qconn quic.Connection) map[uint64]uint64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for {
+		str, err := qconn.AcceptUniStream(ctx)
+		require.NoError(t, err)
+		r := quicvarint.NewReader(str)
+		typ, err := quicvarint.Read(r)
+		require.NoError(t, err)
+		if typ != 0 { // not the control stream
+			continue
+		}
+		frameType, err := quicvarint.Read(r)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0x4), frameType)
+		l, err := quicvarint.Read(r)
+		require.NoError(t, err)
+		b := make([]byte, l)
+		_, err = io.ReadFull(str, b)
+		require.NoError(t, err)
+		settings := make(map[uint64]uint64)
+		br := bytes.NewReader(b)
+		for br.Len() > 0 {
+			id, err := quicvarint.Read(br)
+			require.NoError(t, err)
+			val, err := quicvarint.Read(br)
+			require.NoError(t, err)
+			_, ok := settings[id]
+			require.False(t, ok, "duplicate setting %#x", id)
+			settings[id] = val
+		}
+		return settings
+	}
+}
+
+func TestServerAdditionalSettings(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3: http3.Server{
+			Server:             &http.Server{TLSConfig: tlsConf},
+			AdditionalSettings: map[uint64]uint64{0x1337: 1, 0x42: 1},
+		},
+		AdditionalSettings: map[uint64]uint64{0x42: 2},
+	}
+	defer s.Close()
+	addHandler(t, &s, func(*webtransport.Conn) {})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	qconn, err := quic.DialAddr(
+		udpConn.LocalAddr().String(),
+		&tls.Config{RootCAs: certPool, ServerName: "localhost", NextProtos: []string{"h3"}},
+		&quic.Config{Versions: []quic.VersionNumber{quic.Version1}, EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	settings := readSettings(t, qconn)
+	require.Equal(t, uint64(1), settings[0x1337])
+	require.Equal(t, uint64(2), settings[0x42])
+	require.Equal(t, uint64(1), settings[0x2b603742]) // SETTINGS_ENABLE_WEBTRANSPORT
+}
+
+func TestServerReservedSettings(t *testing.T) {
+	tlsConf, _ := getTLSConf(t)
+	s := webtransport.Server{
+		H3:                 http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		AdditionalSettings: map[uint64]uint64{0x2b603742: 0},
+	}
+	defer s.Close()
+	udpConn := getConn(t)
+	defer udpConn.Close()
+	require.EqualError(t, s.Serve(udpConn), "webtransport: setting 0x2b603742 is reserved for WebTransport")
+}
+
+func TestServerDisableDatagramsSettings(t *testing.T) {
+	tlsConf, certPool := getTLSConf(t)
+	s := webtransport.Server{
+		H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+		DisableDatagrams: true,
+	}
+	defer s.Close()
+	addHandler(t, &s, func(*webtransport.Conn) {})
+	udpConn := getConn(t)
+	go s.Serve(udpConn)
+
+	qconn, err := quic.DialAddr(
+		udpConn.LocalAddr().String(),
+		&tls.Config{RootCAs: certPool, ServerName: "localhost", NextProtos: []string{"h3"}},
+		&quic.Config{Versions: []quic.VersionNumber{quic.Version1}, EnableDatagrams: true},
+	)
+	require.NoError(t, err)
+	defer qconn.CloseWithError(0, "")
+	settings := readSettings(t, qconn)
+	require.NotContains(t, settings, uint64(0xffd277)) // H3_DATAGRAM
+	require.Equal(t, uint64(1), settings[0x2b603742])  // SETTINGS_ENABLE_WEBTRANSPORT
+}
+
+func TestDisableDatagrams(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		server, client bool
+	}{
+		{name: "server", server: true},
+		{name: "client", client: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConf, certPool := getTLSConf(t)
+			s := webtransport.Server{
+				H3:               http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+				DisableDatagrams: tc.server,
+			}
+			defer s.Close()
+			connChan := make(chan *webtransport.Conn, 1)
+			addHandler(t, &s, func(c *webtransport.Conn) {
+				connChan <- c
+				<-c.Context().Done()
+			})
+			udpConn := getConn(t)
+			go s.Serve(udpConn)
+
+			d := webtransport.Dialer{
+				TLSClientConf:    &tls.Config{RootCAs: certPool},
+				DisableDatagrams: tc.client,
+			}
+			defer d.Close()
+			url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+			_, cconn, err := d.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer cconn.Close()
+			sconn := <-connChan
+
+			// the session on the endpoint that disabled datagrams
+			c := sconn
+			if tc.client {
+				c = cconn
+			}
+			require.ErrorIs(t, c.SendMessage([]byte("foobar")), webtransport.ErrDatagramsDisabled)
+			require.ErrorIs(t, c.SendMessageContext(context.Background(), []byte("foobar")), webtransport.ErrDatagramsDisabled)
+			require.ErrorIs(t, c.SendMessageWithPriority([]byte("foobar"), webtransport.MessagePriorityHigh), webtransport.ErrDatagramsDisabled)
+			_, err = c.ReceiveMessage(context.Background())
+			require.ErrorIs(t, err, webtransport.ErrDatagramsDisabled)
+
+			// streams can still be used
+			str, err := cconn.OpenStream()
+			require.NoError(t, err)
+			_, err = str.Write([]byte("foobar"))
+			require.NoError(t, err)
+			require.NoError(t, str.Close())
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			sstr, err := sconn.AcceptStream(ctx)
+			require.NoError(t, err)
+			data, err := io.ReadAll(sstr)
+			require.NoError(t, err)
+			require.Equal(t, []byte("foobar"), data)
+		})
+	}
+}
+
+func TestHandshakeInfo(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		retry := retry
+		t.Run(fmt.Sprintf("retry: %t", retry), func(t *testing.T) {
+			tlsConf, certPool := getTLSConf(t)
+			s := webtransport.Server{
+				H3:                       http3.Server{Server: &http.Server{TLSConfig: tlsConf}},
+				RequireAddressValidation: func(net.Addr) bool { return retry },
+			}
+			defer s.Close()
+			connChan := make(chan *webtransport.Conn, 1)
+			addHandler(t, &s, func(conn *webtransport.Conn) {
+				connChan <- conn
+				<-conn.Context().Done()
+			})
+
+			udpConn := getConn(t)
+			go s.Serve(udpConn)
+
+			d := webtransport.Dialer{TLSClientConf: &tls.Config{RootCAs: certPool}}
+			defer d.Close()
+			url := fmt.Sprintf("https://localhost:%d/webtransport", udpConn.LocalAddr().(*net.UDPAddr).Port)
+			_, conn, err := d.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			sconn := <-connChan
+			defer sconn.Close()
+
+			client, ok := conn.HandshakeInfo()
+			require.True(t, ok)
+			server, ok := sconn.HandshakeInfo()
+			require.True(t, ok)
+			require.Equal(t, quic.Version1, client.Version)
+			require.Equal(t, client.Version, server.Version)
+			require.Equal(t, retry, client.Retry)
+			require.Equal(t, retry, server.Retry)
+			require.NotZero(t, client.Duration)
+			require.NotZero(t, server.Duration)
+			require.False(t, client.Resumed)
+			require.False(t, server.Resumed)
+			require.False(t, client.Used0RTT)
+		})
+	}
+
+	t.Run("pipe", func(t *testing.T) {
+		client, server := webtransport.Pipe()
+		defer client.Close()
+		defer server.Close()
+		_, ok := client.HandshakeInfo()
+		require.False(t, ok)
+	})
+}
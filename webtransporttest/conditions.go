@@ -0,0 +1,156 @@
+// Package webtransporttest provides utilities for testing WebTransport applications.
+package webtransporttest
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Conditions describes the network conditions that are simulated.
+// The conditions are applied to every packet sent, so that both streams and datagrams are affected.
+type Conditions struct {
+	// Latency is the one-way delay added to every packet.
+	Latency time.Duration
+	// Jitter is the maximum random delay added on top of Latency.
+	// The additional delay is chosen uniformly from [0, Jitter).
+	// Since the delay varies from packet to packet, jitter also leads to reordering.
+	Jitter time.Duration
+	// Loss is the probability that a packet is dropped, between 0 and 1.
+	Loss float64
+	// Reordering is the probability that a packet is delayed by an additional ReorderingDelay,
+	// such that it arrives after packets sent later.
+	Reordering float64
+	// ReorderingDelay is the delay added to reordered packets.
+	// Defaults to 10 ms.
+	ReorderingDelay time.Duration
+	// Seed is used to seed the random number generator, making packet loss and reordering reproducible.
+	// If zero, a random seed is used.
+	Seed int64
+}
+
+const defaultReorderingDelay = 10 * time.Millisecond
+
+type packetConn struct {
+	net.PacketConn
+
+	conds Conditions
+
+	randMx sync.Mutex
+	rand   *rand.Rand
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewPacketConn wraps a net.PacketConn, such that the packets sent on it are subject to the network conditions.
+// To simulate conditions in both directions, the packet conns of both endpoints need to be wrapped.
+// The returned conn can be passed to webtransport.Server.Serve.
+func NewPacketConn(conn net.PacketConn, conds Conditions) net.PacketConn {
+	seed := conds.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if conds.ReorderingDelay == 0 {
+		conds.ReorderingDelay = defaultReorderingDelay
+	}
+	return &packetConn{
+		PacketConn: conn,
+		conds:      conds,
+		rand:       rand.New(rand.NewSource(seed)),
+		closed:     make(chan struct{}),
+	}
+}
+
+// delay returns the delay for the next packet, and if the packet should be dropped.
+func (c *packetConn) delay() (time.Duration, bool) {
+	c.randMx.Lock()
+	defer c.randMx.Unlock()
+
+	if c.conds.Loss > 0 && c.rand.Float64() < c.conds.Loss {
+		return 0, true
+	}
+	d := c.conds.Latency
+	if c.conds.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(c.conds.Jitter)))
+	}
+	if c.conds.Reordering > 0 && c.rand.Float64() < c.conds.Reordering {
+		d += c.conds.ReorderingDelay
+	}
+	return d, false
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	d, drop := c.delay()
+	if drop {
+		return len(p), nil
+	}
+	if d == 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	b := make([]byte, len(p))
+	copy(b, p)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			c.PacketConn.WriteTo(b, addr)
+		case <-c.closed:
+		}
+	}()
+	return len(p), nil
+}
+
+// Close closes the underlying packet conn.
+// Packets that are still delayed are dropped.
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	err := c.PacketConn.Close()
+	c.wg.Wait()
+	return err
+}
+
+// DialFunc returns a function that can be used as webtransport.Dialer.DialFunc.
+// Every QUIC connection is dialed on a new UDP socket, which is subject to the network conditions.
+// The socket is closed when the QUIC connection is closed.
+func DialFunc(conds Conditions) func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+	return func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		conn := NewPacketConn(udpConn, conds)
+		qconn, err := quic.DialEarlyContext(ctx, conn, raddr, host, tlsConf, conf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		go func() {
+			<-qconn.Context().Done()
+			conn.Close()
+		}()
+		return qconn, nil
+	}
+}
@@ -0,0 +1,83 @@
+package webtransporttest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newConnPair(t *testing.T, conds Conditions) (net.PacketConn, *net.UDPConn) {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", "localhost:0")
+	require.NoError(t, err)
+	sender, err := net.ListenUDP("udp", addr)
+	require.NoError(t, err)
+	receiver, err := net.ListenUDP("udp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { receiver.Close() })
+	conn := NewPacketConn(sender, conds)
+	t.Cleanup(func() { conn.Close() })
+	return conn, receiver
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	conn, receiver := newConnPair(t, Conditions{Latency: latency})
+
+	start := time.Now()
+	_, err := conn.WriteTo([]byte("foobar"), receiver.LocalAddr())
+	require.NoError(t, err)
+	b := make([]byte, 100)
+	n, _, err := receiver.ReadFrom(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), b[:n])
+	require.GreaterOrEqual(t, time.Since(start), latency)
+}
+
+func TestLoss(t *testing.T) {
+	const num = 200
+	conn, receiver := newConnPair(t, Conditions{Loss: 0.5, Seed: 42})
+
+	for i := 0; i < num; i++ {
+		_, err := conn.WriteTo([]byte{byte(i)}, receiver.LocalAddr())
+		require.NoError(t, err)
+	}
+	var received int
+	b := make([]byte, 100)
+	for {
+		receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err := receiver.ReadFrom(b); err != nil {
+			break
+		}
+		received++
+	}
+	require.Greater(t, received, num/4)
+	require.Less(t, received, num*3/4)
+}
+
+func TestReordering(t *testing.T) {
+	const num = 100
+	conn, receiver := newConnPair(t, Conditions{Reordering: 0.2, Seed: 42})
+
+	for i := 0; i < num; i++ {
+		_, err := conn.WriteTo([]byte{byte(i)}, receiver.LocalAddr())
+		require.NoError(t, err)
+	}
+	var received []byte
+	b := make([]byte, 100)
+	for len(received) < num {
+		receiver.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := receiver.ReadFrom(b)
+		require.NoError(t, err)
+		received = append(received, b[:n]...)
+	}
+	var reordered bool
+	for i := 1; i < len(received); i++ {
+		if received[i] < received[i-1] {
+			reordered = true
+		}
+	}
+	require.True(t, reordered)
+}